@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"github.com/tsauter/transmit/structs"
+)
+
+// DefaultBatchSize is the number of chunks collected by a BatchWriter before
+// they are written to the database.
+const DefaultBatchSize = 1024
+
+// BatchWriter collects chunks and writes them with StoreChunks to the
+// database, as soon as the batch is full. Commit must be called after the
+// last chunk, to write the remaining chunks.
+type BatchWriter struct {
+	db     CacheDB
+	size   int
+	chunks []structs.ChunkStream
+}
+
+// NewBatchWriter returns a BatchWriter that writes size chunks at once to db.
+func NewBatchWriter(db CacheDB, size int) *BatchWriter {
+	if size < 1 {
+		size = 1
+	}
+	return &BatchWriter{db: db, size: size, chunks: make([]structs.ChunkStream, 0, size)}
+}
+
+// Store adds the chunk to the batch. The batch is written to the
+// database, if the batch is full.
+func (bw *BatchWriter) Store(chunkId uint64, chunk structs.Chunk) error {
+	bw.chunks = append(bw.chunks, structs.ChunkStream{ChunkId: chunkId, Chunk: chunk})
+	if len(bw.chunks) < bw.size {
+		return nil
+	}
+	return bw.Commit()
+}
+
+// Commit writes all collected chunks to the database.
+func (bw *BatchWriter) Commit() error {
+	if len(bw.chunks) == 0 {
+		return nil
+	}
+
+	err := bw.db.StoreChunks(bw.chunks)
+	bw.chunks = bw.chunks[:0]
+	return err
+}
@@ -9,12 +9,16 @@ import (
 	"github.com/pkg/errors"
 	"github.com/tsauter/transmit/structs"
 	"os"
+	"strconv"
 	"time"
 )
 
 const (
 	BOLT_BUCKETNAME_INFO   = "info"
 	BOLT_BUCKETNAME_CHUNKS = "chunks"
+
+	// the file extension of all bolt databases
+	BOLT_FILE_EXTENSION = ".db"
 )
 
 type BoltCache struct {
@@ -31,7 +35,7 @@ func NewBoltCache() *BoltCache {
 // InitDatabase creates a new BoltDB database and initialize some default buckets
 // The filename of the database is specified in the cachefilename parameter
 func (bc *BoltCache) InitDatabase(cachefilename string) error {
-	cachefilename = cachefilename + ".db" // the .db is required for Bolt databases
+	cachefilename = cachefilename + BOLT_FILE_EXTENSION // the .db is required for Bolt databases
 	bc.DbFilename = cachefilename
 
 	// Open the bold db, use a long timeout, for slow networks
@@ -59,9 +63,56 @@ func (bc *BoltCache) InitDatabase(cachefilename string) error {
 		return errors.Wrap(err, "updating chunk database failed")
 	}
 
+	// upgrade databases of previous versions
+	err = bc.migrate()
+	if err != nil {
+		bc.DB.Close()
+		return err
+	}
+
 	return nil
 }
 
+// migrate upgrades the database to the current schema version. The schema
+// version is stored in the info bucket, new databases get the current version.
+func (bc *BoltCache) migrate() error {
+	return bc.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLT_BUCKETNAME_INFO))
+		fileinfo := b.Get([]byte(BOLT_BUCKETNAME_INFO))
+
+		// databases without version are from version 1, if they contain data
+		version := SCHEMA_VERSION
+		if fileinfo != nil {
+			version = 1
+		}
+		if value := b.Get([]byte(SCHEMA_VERSION_KEY)); value != nil {
+			var err error
+			version, err = strconv.Atoi(string(value))
+			if err != nil {
+				return errors.Wrapf(err, "invalid schema version in cache %s", bc.DbFilename)
+			}
+			if version == SCHEMA_VERSION {
+				return nil
+			}
+		}
+
+		if fileinfo != nil {
+			migrated, err := migrateFileInfo(bc.DbFilename, version, fileinfo)
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(BOLT_BUCKETNAME_INFO), migrated)
+			if err != nil {
+				return errors.Wrap(err, "failed to store migrated file info")
+			}
+		} else if version > SCHEMA_VERSION {
+			return &SchemaError{Filename: bc.DbFilename, Version: version}
+		}
+
+		return b.Put([]byte(SCHEMA_VERSION_KEY), []byte(strconv.Itoa(SCHEMA_VERSION)))
+	})
+}
+
 // CloseDatabase sync and close the bolt database.
 func (bc *BoltCache) CloseDatabase() error {
 	err := bc.DB.Close()
@@ -86,6 +137,11 @@ func (bc *BoltCache) Cleanup() error {
 	return nil
 }
 
+// GetDatabaseFilename returns the filename of the bolt database.
+func (bc *BoltCache) GetDatabaseFilename() string {
+	return bc.DbFilename
+}
+
 // ClearAllChunks remove all previous stored chunks from bolt database.
 // (e.g. delete * from chunks)
 func (bc *BoltCache) ClearAllChunks() error {
@@ -202,6 +258,33 @@ func (bc *BoltCache) StoreChunk(chunkId uint64, chunk structs.Chunk) error {
 	return nil
 }
 
+// StoreChunks store all passed chunks within a single transaction, this is
+// much faster than storing each chunk with StoreChunk.
+// Either all or none of the chunks are stored.
+func (bc *BoltCache) StoreChunks(chunks []structs.ChunkStream) error {
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLT_BUCKETNAME_CHUNKS))
+		for _, chunkStream := range chunks {
+			// marshel the struct to a json string, bolt store values as byte slices
+			marshaled_data, err := json.Marshal(chunkStream.Chunk)
+			if err != nil {
+				return errors.Wrap(err, "failed to convert chunk info to json")
+			}
+
+			err = b.Put(itob(chunkStream.ChunkId), marshaled_data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to store chunks in database")
+	}
+
+	return nil
+}
+
 // GetChunksCount return the number of stored chunks.
 // In case of an error, this error is returned.
 func (bc *BoltCache) GetChunksCount() (int, error) {
@@ -1,11 +1,94 @@
 package cache
 
 import (
+	"fmt"
+	"github.com/pkg/errors"
 	"github.com/tsauter/transmit/structs"
+	"os"
+	"strings"
 )
 
+// Names of all available cache backends.
+const (
+	BACKEND_BOLT     = "bolt"
+	BACKEND_SQLITE   = "sqlite"
+	BACKEND_MANIFEST = "manifest"
+)
+
+// backend describes a cache backend and the file extension of its databases.
+type backend struct {
+	create    func() CacheDB
+	extension string
+}
+
+var (
+	backends = map[string]backend{
+		BACKEND_BOLT:     {func() CacheDB { return NewBoltCache() }, BOLT_FILE_EXTENSION},
+		BACKEND_SQLITE:   {func() CacheDB { return NewSqliteCache() }, SQLITE_FILE_EXTENSION},
+		BACKEND_MANIFEST: {func() CacheDB { return NewManifestCache() }, MANIFEST_FILE_EXTENSION},
+	}
+
+	// DefaultBackend is the backend used for all new caches, it
+	// can be changed with SetDefaultBackend.
+	DefaultBackend = BACKEND_BOLT
+)
+
+// NewCacheDB returns a new and uninitialized cache of the specified backend.
+func NewCacheDB(backendname string) (CacheDB, error) {
+	b, ok := backends[backendname]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cache backend: %s", backendname)
+	}
+	return b.create(), nil
+}
+
+// NewDefaultCacheDB returns a new and uninitialized cache of the default backend.
+func NewDefaultCacheDB() CacheDB {
+	return backends[DefaultBackend].create()
+}
+
+// SetDefaultBackend changes the backend used for all new caches.
+func SetDefaultBackend(backendname string) error {
+	if _, ok := backends[backendname]; !ok {
+		return fmt.Errorf("unsupported cache backend: %s", backendname)
+	}
+	DefaultBackend = backendname
+	return nil
+}
+
+// DatabaseFilename returns the filename of the database, the backend creates
+// for the cache name.
+func DatabaseFilename(backendname string, cachefilename string) (string, error) {
+	b, ok := backends[backendname]
+	if !ok {
+		return "", fmt.Errorf("unsupported cache backend: %s", backendname)
+	}
+	return cachefilename + b.extension, nil
+}
+
+// OpenDatabaseFile opens an existing database file, the backend is selected
+// by the file extension (e.g. file.tcache.db for BoltDB).
+func OpenDatabaseFile(dbfilename string) (CacheDB, error) {
+	for _, b := range backends {
+		if !strings.HasSuffix(dbfilename, b.extension) {
+			continue
+		}
+		if _, err := os.Stat(dbfilename); err != nil {
+			return nil, errors.Wrap(err, "failed to open cache database")
+		}
+
+		db := b.create()
+		err := db.InitDatabase(strings.TrimSuffix(dbfilename, b.extension))
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	}
+	return nil, fmt.Errorf("unknown type of cache database: %s", dbfilename)
+}
+
 // CacheDB is the generic interface for chunk cache backends.
-// Backends could be bolt, mysql, json...
+// Backends could be bolt, sqlite, mysql, json...
 type CacheDB interface {
 	// Open a connecton to the database. This will not fill chunk details.
 	InitDatabase(sourcefile string) error
@@ -13,6 +96,8 @@ type CacheDB interface {
 	CloseDatabase() error
 	// Cleanup database (delete table or file; depending on the implementation)
 	Cleanup() error
+	// Return the filename of the database (empty if the backend is not file based)
+	GetDatabaseFilename() string
 
 	// Remove all existing chunks from database
 	ClearAllChunks() error
@@ -26,9 +111,88 @@ type CacheDB interface {
 	GetChunk(chunkId uint64) (structs.Chunk, error)
 	// Store chunk under the specified chunk id
 	StoreChunk(chunkId uint64, chunk structs.Chunk) error
+	// Store multiple chunks at once, within a single transaction if supported
+	StoreChunks(chunks []structs.ChunkStream) error
 
 	// Get the total number of stored chunks
 	GetChunksCount() (int, error)
 	// Return a channel to iterate over all stored chunks
 	GetAllChunks(chunkChan chan structs.ChunkStream) error
 }
+
+// CopyCache copies the file details and all chunks from src to dst.
+func CopyCache(dst CacheDB, src CacheDB) error {
+	fd, err := src.GetFileInfo()
+	if err != nil {
+		return errors.Wrap(err, "failed to get file info")
+	}
+
+	err = dst.ClearAllChunks()
+	if err != nil {
+		return errors.Wrap(err, "failed to clear chunks")
+	}
+
+	chunkStreamChan := make(chan structs.ChunkStream, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- src.GetAllChunks(chunkStreamChan)
+		close(chunkStreamChan)
+	}()
+
+	// read the channel until the end, otherwise the source stays blocked
+	var storeErr error
+	batch := NewBatchWriter(dst, DefaultBatchSize)
+	for chunkStream := range chunkStreamChan {
+		if storeErr != nil {
+			continue
+		}
+		storeErr = batch.Store(chunkStream.ChunkId, chunkStream.Chunk)
+	}
+	if err := <-errChan; err != nil {
+		return errors.Wrap(err, "failed to get chunks")
+	}
+	if storeErr == nil {
+		storeErr = batch.Commit()
+	}
+	if storeErr != nil {
+		return errors.Wrap(storeErr, "failed to store chunk")
+	}
+
+	err = dst.StoreFileInfo(fd)
+	if err != nil {
+		return errors.Wrap(err, "failed to store file info")
+	}
+
+	return nil
+}
+
+// CompactCache rewrites all data of db into the new and empty database tmp.
+// Afterwards the database file of db is replaced with the file of tmp. Both
+// databases are closed when the function returns.
+func CompactCache(db CacheDB, tmp CacheDB) error {
+	err := CopyCache(tmp, db)
+	if err != nil {
+		db.CloseDatabase()
+		tmp.Cleanup()
+		return err
+	}
+
+	err = db.CloseDatabase()
+	if err != nil {
+		tmp.Cleanup()
+		return err
+	}
+	err = tmp.CloseDatabase()
+	if err != nil {
+		os.Remove(tmp.GetDatabaseFilename())
+		return err
+	}
+
+	err = os.Rename(tmp.GetDatabaseFilename(), db.GetDatabaseFilename())
+	if err != nil {
+		os.Remove(tmp.GetDatabaseFilename())
+		return errors.Wrap(err, "failed to replace database")
+	}
+
+	return nil
+}
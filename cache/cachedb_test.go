@@ -1,6 +1,10 @@
 package cache
 
 import (
+	"fmt"
+	"github.com/tsauter/transmit/structs"
+	"os"
+	"reflect"
 	"testing"
 )
 
@@ -9,7 +13,109 @@ func TestInterface(t *testing.T) {
 	var cache CacheDB
 	// make sure we satisfy the interface
 	cache = NewBoltCache()
+	cache = NewManifestCache()
+	cache = NewSqliteCache()
 	if cache == nil {
 		t.Errorf("Cache is nil.")
 	}
 }
+
+func TestCompactCache(t *testing.T) {
+	fd := structs.FileData{
+		Filename:           "mytestfile.txt",
+		Filesize:           1024,
+		Checksum:           "5ce1a1b956e5336e8a509f4b794f446bbbfec818",
+		ChunkHashAlgorithm: "SHA1",
+		Chunksize:          256,
+	}
+
+	db := NewBoltCache()
+	err := db.InitDatabase("gotest.cache")
+	if err != nil {
+		t.Fatalf("Fail to create database: %s", err.Error())
+	}
+	defer os.Remove(db.GetDatabaseFilename())
+
+	// write the chunks twice, to produce some free pages
+	for i := 0; i < 2; i++ {
+		for pos := 0; pos < 4; pos++ {
+			err = db.StoreChunk(uint64(pos), structs.NewChunk(fmt.Sprintf("hash%d-%d", i, pos), 256))
+			if err != nil {
+				t.Errorf("Fail to store chunk: %s", err.Error())
+			}
+		}
+	}
+	err = db.StoreFileInfo(fd)
+	if err != nil {
+		t.Errorf("Fail to store file info: %s", err.Error())
+	}
+
+	tmp := NewBoltCache()
+	err = tmp.InitDatabase("gotest.cache.compact")
+	if err != nil {
+		t.Fatalf("Fail to create database: %s", err.Error())
+	}
+	err = CompactCache(db, tmp)
+	if err != nil {
+		t.Fatalf("Fail to compact database: %s", err.Error())
+	}
+	if _, err := os.Stat(tmp.GetDatabaseFilename()); !os.IsNotExist(err) {
+		t.Errorf("Temporary database %s still exists", tmp.GetDatabaseFilename())
+	}
+
+	// reopen the compacted database and compare all values
+	db = NewBoltCache()
+	err = db.InitDatabase("gotest.cache")
+	if err != nil {
+		t.Fatalf("Fail to open database: %s", err.Error())
+	}
+	defer db.CloseDatabase()
+
+	fd2, err := db.GetFileInfo()
+	if err != nil {
+		t.Errorf("Fail to get file info: %s", err.Error())
+	}
+	if !reflect.DeepEqual(fd, fd2) {
+		t.Errorf("FileInfo data is not equal after compacting.")
+	}
+	count, err := db.GetChunksCount()
+	if err != nil || count != 4 {
+		t.Errorf("Invalid count returned: %d", count)
+	}
+	for pos := 0; pos < 4; pos++ {
+		chunk, err := db.GetChunk(uint64(pos))
+		if err != nil {
+			t.Errorf("Fail to read chunk: %s", err.Error())
+		}
+		if chunk.Hash != fmt.Sprintf("hash1-%d", pos) {
+			t.Errorf("Invalid chunk returned after compacting: %s", chunk.Hash)
+		}
+	}
+}
+
+func TestOpenDatabaseFile(t *testing.T) {
+	db := NewBoltCache()
+	err := db.InitDatabase("gotest.open")
+	if err != nil {
+		t.Fatalf("Fail to create database: %s", err.Error())
+	}
+	defer os.Remove(db.GetDatabaseFilename())
+	db.StoreFileInfo(structs.FileData{Filename: "mytestfile.txt", Chunksize: 256})
+	db.CloseDatabase()
+
+	opened, err := OpenDatabaseFile(db.GetDatabaseFilename())
+	if err != nil {
+		t.Fatalf("Fail to open database: %s", err.Error())
+	}
+	fd, err := opened.GetFileInfo()
+	if err != nil || fd.Filename != "mytestfile.txt" {
+		t.Errorf("Invalid file info returned: %v", fd)
+	}
+	opened.CloseDatabase()
+
+	for _, filename := range []string{"gotest.missing" + BOLT_FILE_EXTENSION, "gotest.unknown"} {
+		if _, err := OpenDatabaseFile(filename); err == nil {
+			t.Errorf("Opened invalid database: %s", filename)
+		}
+	}
+}
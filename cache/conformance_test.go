@@ -0,0 +1,432 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/tsauter/transmit/structs"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// The tests in this file are run against every cache backend. A new backend
+// must pass all of them.
+
+// testBackends returns the names of all registered backends in a stable order.
+func testBackends() []string {
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// openTestCache creates and initializes a new database of the backend.
+func openTestCache(t *testing.T, backendname string) CacheDB {
+	db, err := NewCacheDB(backendname)
+	if err != nil {
+		t.Fatalf("[%s] Fail to create cache: %s", backendname, err.Error())
+	}
+	err = db.InitDatabase("gotest.cache")
+	if err != nil {
+		t.Fatalf("[%s] Fail to create database: %s", backendname, err.Error())
+	}
+	return db
+}
+
+// closeTestCache closes and deletes the database, in case of deleting is not
+// working, the database was not properly closed
+func closeTestCache(t *testing.T, backendname string, db CacheDB) {
+	err := db.CloseDatabase()
+	if err != nil {
+		t.Errorf("[%s] Fail to close database: %s", backendname, err.Error())
+	}
+	err = os.Remove(db.GetDatabaseFilename())
+	if err != nil {
+		t.Errorf("[%s] Fail to delete database file %s: DB not closed: %s", backendname, db.GetDatabaseFilename(), err.Error())
+	}
+}
+
+func TestNewCacheDB(t *testing.T) {
+	for _, backendname := range testBackends() {
+		db, err := NewCacheDB(backendname)
+		if err != nil || db == nil {
+			t.Errorf("[%s] Fail to create cache", backendname)
+		}
+	}
+
+	if _, err := NewCacheDB("unknown"); err == nil {
+		t.Errorf("Unknown backend accepted.")
+	}
+	if err := SetDefaultBackend("unknown"); err == nil {
+		t.Errorf("Unknown backend accepted as default.")
+	}
+}
+
+func TestGetStoreFileInfo(t *testing.T) {
+	testcases := []struct {
+		Name string
+		Data structs.FileData
+	}{
+		{
+			Name: "case1",
+			Data: structs.FileData{
+				Filename:           "mytestfile.txt",
+				Filesize:           1024,
+				Checksum:           "5ce1a1b956e5336e8a509f4b794f446bbbfec818",
+				ChunkHashAlgorithm: "SHA1",
+				Chunksize:          1024,
+			},
+		},
+		{
+			Name: "case2",
+			Data: structs.FileData{
+				Filename:           "large.iso",
+				Filesize:           202020202,
+				Checksum:           "9940b28d7ec4fcd6cbaa3333a4c3db4c31692d03",
+				ChunkHashAlgorithm: "SHA1",
+				Chunksize:          348728,
+			},
+		},
+	}
+
+	for _, backendname := range testBackends() {
+		for _, tc := range testcases {
+			db := openTestCache(t, backendname)
+
+			// store the FileData variable in the database
+			err := db.StoreFileInfo(tc.Data)
+			if err != nil {
+				t.Errorf("[%s] Fail to store file info: %s", backendname, err.Error())
+			}
+
+			// read the value
+			fd2, err := db.GetFileInfo()
+			if err != nil {
+				t.Errorf("[%s] Fail to get file info: %s", backendname, err.Error())
+			}
+
+			// compare both variables
+			if !reflect.DeepEqual(tc.Data, fd2) {
+				t.Errorf("[%s] FileInfo data is not equal. Missmatch between storing and getting.", backendname)
+			}
+
+			// close the database and reopen again, and read the value again
+			// this makes sure, that the value is really written to disk
+			err = db.CloseDatabase()
+			if err != nil {
+				t.Errorf("[%s] Fail to close database: %s", backendname, err.Error())
+			}
+			err = db.InitDatabase("gotest.cache")
+			if err != nil {
+				t.Errorf("[%s] Fail to create database: %s", backendname, err.Error())
+			}
+			fd2, err = db.GetFileInfo()
+			if err != nil {
+				t.Errorf("[%s] Fail to get file info: %s", backendname, err.Error())
+			}
+			if !reflect.DeepEqual(tc.Data, fd2) {
+				t.Errorf("[%s] FileInfo data is not equal. Missmatch between storing and getting.", backendname)
+			}
+
+			closeTestCache(t, backendname, db)
+		}
+	}
+}
+
+func TestGetStoreChunks(t *testing.T) {
+	testcases := []struct {
+		Name   string
+		Chunks []structs.Chunk
+	}{
+		{
+			Name: "case1",
+			Chunks: []structs.Chunk{
+				{Hash: "0a01c7c5d4d8a0a4d3a3b2f2f55c1ab1", Size: 1024},
+				{Hash: "0a01c7c5d4d8a0a4d3a3b2f2f55c1ab2", Size: 1024},
+				{Hash: "0a01c7c5d4d8a0a4d3a3b2f2f55c1ab3", Size: 1024},
+				{Hash: "0a01c7c5d4d8a0a4d3a3b2f2f55c1ab4", Size: 1024},
+				{Hash: "0a01c7c5d4d8a0a4d3a3b2f2f55c1ab5", Size: 17},
+			},
+		},
+		{
+			Name: "case2",
+			Chunks: []structs.Chunk{
+				{Hash: "0a02c7c5d4d8a0a4d3a3b2f2f55c1ab1"},
+				{Hash: "0a02c7c5d4d8a0a4d3a3b2f2f55c1ab2"},
+				{Hash: "0a02c7c5d4d8a0a4d3a3b2f2f55c1ab3"},
+				{Hash: "0a02c7c5d4d8a0a4d3a3b2f2f55c1ab4"},
+				{Hash: "0a02c7c5d4d8a0a4d3a3b2f2f55c1ab5"},
+			},
+		},
+	}
+
+	for _, backendname := range testBackends() {
+		for _, tc := range testcases {
+			db := openTestCache(t, backendname)
+
+			// store all chunks
+			for pos, chunk := range tc.Chunks {
+				err := db.StoreChunk(uint64(pos), chunk)
+				if err != nil {
+					t.Errorf("[%s] Fail to store chunk: %s", backendname, err.Error())
+				}
+			}
+
+			// read all chunks
+			for pos, chunk := range tc.Chunks {
+				chunk2, err := db.GetChunk(uint64(pos))
+				if err != nil {
+					t.Errorf("[%s] Fail to read chunk: %s", backendname, err.Error())
+				}
+
+				// compare both variables
+				if !reflect.DeepEqual(chunk, chunk2) {
+					t.Errorf("[%s] Retrieved chunk data is not equal. Missmatch between storing and getting.", backendname)
+				}
+			}
+
+			// unknown chunks must return an error
+			_, err := db.GetChunk(uint64(len(tc.Chunks)))
+			if err == nil {
+				t.Errorf("[%s] Missing chunk returned.", backendname)
+			}
+
+			closeTestCache(t, backendname, db)
+		}
+	}
+}
+
+func TestClearAllChunks(t *testing.T) {
+	for _, backendname := range testBackends() {
+		db := openTestCache(t, backendname)
+
+		err := db.StoreChunk(0, structs.Chunk{Hash: "0a01c7c5d4d8a0a4d3a3b2f2f55c1ab1"})
+		if err != nil {
+			t.Errorf("[%s] Fail to store chunk: %s", backendname, err.Error())
+		}
+
+		err = db.ClearAllChunks()
+		if err != nil {
+			t.Errorf("[%s] Fail to clear chunks: %s", backendname, err.Error())
+		}
+
+		count, err := db.GetChunksCount()
+		if err != nil {
+			t.Errorf("[%s] Fail to get count of stored chunks: %s", backendname, err.Error())
+		}
+		if count != 0 {
+			t.Errorf("[%s] Invalid count returned after clearing: %d", backendname, count)
+		}
+
+		closeTestCache(t, backendname, db)
+	}
+}
+
+func TestGetChunksCount(t *testing.T) {
+	testcases := []struct {
+		Name   string
+		Chunks []structs.Chunk
+	}{
+		{
+			Name: "case1",
+			Chunks: []structs.Chunk{
+				{Hash: "0a01c7c5d4d8a0a4d3a3b2f2f55c1ab1"},
+			},
+		},
+		{
+			Name: "case2",
+			Chunks: []structs.Chunk{
+				{Hash: "0a02c7c5d4d8a0a4d3a3b2f2f55c1ab1"},
+				{Hash: "0a02c7c5d4d8a0a4d3a3b2f2f55c1ab2"},
+			},
+		},
+		{
+			Name: "case3",
+			Chunks: []structs.Chunk{
+				{Hash: "0a03c7c5d4d8a0a4d3a3b2f2f55c1ab1"},
+				{Hash: "0a03c7c5d4d8a0a4d3a3b2f2f55c1ab2"},
+				{Hash: "0a03c7c5d4d8a0a4d3a3b2f2f55c1ab3"},
+			},
+		},
+	}
+
+	for _, backendname := range testBackends() {
+		for _, tc := range testcases {
+			db := openTestCache(t, backendname)
+
+			// store all chunks
+			for pos, chunk := range tc.Chunks {
+				err := db.StoreChunk(uint64(pos), chunk)
+				if err != nil {
+					t.Errorf("[%s] Fail to store chunk: %s", backendname, err.Error())
+				}
+			}
+
+			// return the number of chunks and compare them
+			count, err := db.GetChunksCount()
+			if err != nil {
+				t.Errorf("[%s] Fail to get count of stored chunks: %s", backendname, err.Error())
+			}
+			if count != len(tc.Chunks) {
+				t.Errorf("[%s] Invalid count returned: %d", backendname, count)
+			}
+
+			closeTestCache(t, backendname, db)
+		}
+	}
+}
+
+func TestGetAllChunks(t *testing.T) {
+	testcases := []struct {
+		Name   string
+		Chunks []structs.Chunk
+	}{
+		{
+			Name: "case1",
+			Chunks: []structs.Chunk{
+				{Hash: "0a01c7c5d4d8a0a4d3a3b2f2f55c1ab1"},
+			},
+		},
+		{
+			Name: "case2",
+			Chunks: []structs.Chunk{
+				{Hash: "0a02c7c5d4d8a0a4d3a3b2f2f55c1ab1"},
+				{Hash: "0a02c7c5d4d8a0a4d3a3b2f2f55c1ab2"},
+			},
+		},
+		{
+			Name: "case3",
+			Chunks: []structs.Chunk{
+				{Hash: "0a03c7c5d4d8a0a4d3a3b2f2f55c1ab1"},
+				{Hash: "0a03c7c5d4d8a0a4d3a3b2f2f55c1ab2"},
+				{Hash: "0a03c7c5d4d8a0a4d3a3b2f2f55c1ab3"},
+			},
+		},
+	}
+
+	for _, backendname := range testBackends() {
+		for _, tc := range testcases {
+			db := openTestCache(t, backendname)
+
+			// store all chunks, in reverse order to make sure
+			// the chunks are returned ordered by chunk id
+			for pos := len(tc.Chunks) - 1; pos >= 0; pos-- {
+				err := db.StoreChunk(uint64(pos), tc.Chunks[pos])
+				if err != nil {
+					t.Errorf("[%s] Fail to store chunk: %s", backendname, err.Error())
+				}
+			}
+
+			// start a new background go routine that iterates of all available chunks
+			chunkStreamChan := make(chan structs.ChunkStream)
+			errChan := make(chan error, 1)
+			go func() {
+				errChan <- db.GetAllChunks(chunkStreamChan)
+				close(chunkStreamChan)
+			}()
+
+			var tmpchunklist []structs.Chunk
+			for chunkstrm := range chunkStreamChan {
+				if chunkstrm.ChunkId != uint64(len(tmpchunklist)) {
+					t.Errorf("[%s] Invalid chunk id returned: %d", backendname, chunkstrm.ChunkId)
+				}
+				tmpchunklist = append(tmpchunklist, chunkstrm.Chunk)
+			}
+			if err := <-errChan; err != nil {
+				t.Errorf("[%s] Fail to walk over all chunks: %s", backendname, err.Error())
+			}
+
+			if !reflect.DeepEqual(tc.Chunks, tmpchunklist) {
+				t.Errorf("[%s] Returned list of chunks is different.", backendname)
+			}
+
+			closeTestCache(t, backendname, db)
+		}
+	}
+}
+
+func TestStoreChunks(t *testing.T) {
+	var chunks []structs.ChunkStream
+	for pos := 0; pos < 2500; pos++ {
+		chunk := structs.NewChunk(fmt.Sprintf("0a01c7c5d4d8a0a4d3a3b2f2f55c%04x", pos), 1024)
+		chunks = append(chunks, structs.ChunkStream{ChunkId: uint64(pos), Chunk: chunk})
+	}
+
+	for _, backendname := range testBackends() {
+		db := openTestCache(t, backendname)
+
+		// write the chunks through a batch writer, the last batch is incomplete
+		batch := NewBatchWriter(db, DefaultBatchSize)
+		for _, chunkStream := range chunks {
+			err := batch.Store(chunkStream.ChunkId, chunkStream.Chunk)
+			if err != nil {
+				t.Errorf("[%s] Fail to store chunk: %s", backendname, err.Error())
+			}
+		}
+		err := batch.Commit()
+		if err != nil {
+			t.Errorf("[%s] Fail to commit chunks: %s", backendname, err.Error())
+		}
+
+		count, err := db.GetChunksCount()
+		if err != nil {
+			t.Errorf("[%s] Fail to get count of stored chunks: %s", backendname, err.Error())
+		}
+		if count != len(chunks) {
+			t.Errorf("[%s] Invalid count returned: %d", backendname, count)
+		}
+		for _, chunkStream := range chunks {
+			chunk, err := db.GetChunk(chunkStream.ChunkId)
+			if err != nil || !reflect.DeepEqual(chunk, chunkStream.Chunk) {
+				t.Errorf("[%s] Retrieved chunk %d is not equal.", backendname, chunkStream.ChunkId)
+				break
+			}
+		}
+
+		closeTestCache(t, backendname, db)
+	}
+}
+
+// benchmarkStore stores b.N chunks in every backend, either one by one
+// or with a batch writer.
+func benchmarkStore(b *testing.B, batched bool) {
+	for _, backendname := range testBackends() {
+		b.Run(backendname, func(b *testing.B) {
+			db, _ := NewCacheDB(backendname)
+			err := db.InitDatabase("gobench.cache")
+			if err != nil {
+				b.Fatalf("Fail to create database: %s", err.Error())
+			}
+			defer os.Remove(db.GetDatabaseFilename())
+			defer db.CloseDatabase()
+
+			batch := NewBatchWriter(db, DefaultBatchSize)
+			b.ResetTimer()
+			for pos := 0; pos < b.N; pos++ {
+				chunk := structs.NewChunk(fmt.Sprintf("0a01c7c5d4d8a0a4d3a3b2f2f55c1ab1%016x", pos), 1024)
+				if batched {
+					err = batch.Store(uint64(pos), chunk)
+				} else {
+					err = db.StoreChunk(uint64(pos), chunk)
+				}
+				if err != nil {
+					b.Fatalf("Fail to store chunk: %s", err.Error())
+				}
+			}
+			err = batch.Commit()
+			if err != nil {
+				b.Fatalf("Fail to commit chunks: %s", err.Error())
+			}
+		})
+	}
+}
+
+func BenchmarkStoreChunk(b *testing.B) {
+	benchmarkStore(b, false)
+}
+
+func BenchmarkStoreChunks(b *testing.B) {
+	benchmarkStore(b, true)
+}
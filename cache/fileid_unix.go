@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package cache
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileIdentity returns the device and inode number of the file.
+func fileIdentity(fi os.FileInfo) string {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+}
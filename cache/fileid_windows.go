@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package cache
+
+import (
+	"os"
+)
+
+// fileIdentity returns an empty identity, the file index is not available
+// through os.FileInfo on windows. Only the path identifies the file.
+func fileIdentity(fi os.FileInfo) string {
+	return ""
+}
@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// CACHE_DIR_AUTO selects the default cache directory of the user
+	CACHE_DIR_AUTO = "auto"
+
+	// the file extension of the index entries in the cache directory
+	INDEX_FILE_EXTENSION = ".json"
+
+	// the length of the hex encoded keys of the caches
+	cacheKeyLength = 32
+)
+
+// CacheDir is the directory for all chunk caches. If empty, the caches are
+// stored next to the cached file.
+var CacheDir string
+
+// indexEntry describes the file a cache in the cache directory belongs to.
+type indexEntry struct {
+	Path     string `json:"path"`
+	Identity string `json:"identity"`
+}
+
+// DefaultCacheDir returns the default cache directory of the user,
+// e.g. $XDG_CACHE_HOME/transmit.
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get user cache directory")
+	}
+	return filepath.Join(dir, "transmit"), nil
+}
+
+// SetCacheDir changes the directory for all chunk caches. An empty dir stores
+// the caches next to the cached files, CACHE_DIR_AUTO uses DefaultCacheDir.
+func SetCacheDir(dir string) error {
+	if dir == CACHE_DIR_AUTO {
+		var err error
+		dir, err = DefaultCacheDir()
+		if err != nil {
+			return err
+		}
+	}
+	CacheDir = dir
+	return nil
+}
+
+// CacheName returns the name of the cache database for the passed file. The
+// backends append their own file extension.
+// If a cache directory is configured, the name is derived from the canonical
+// path and the identity of the file, and an index entry is written to the
+// cache directory. The index entry is required by GarbageCollect.
+func CacheName(filename string) (string, error) {
+	if CacheDir == "" {
+		return filename + ".tcache", nil
+	}
+
+	entry, err := newIndexEntry(filename)
+	if err != nil {
+		return "", err
+	}
+
+	key := sha256.Sum256([]byte(entry.Path + "\x00" + entry.Identity))
+	name := filepath.Join(CacheDir, hex.EncodeToString(key[:cacheKeyLength/2]))
+
+	err = writeIndexEntry(name+INDEX_FILE_EXTENSION, entry)
+	if err != nil {
+		return "", err
+	}
+
+	return name + ".tcache", nil
+}
+
+// newIndexEntry returns the canonical path and the identity of the file.
+func newIndexEntry(filename string) (indexEntry, error) {
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return indexEntry{}, errors.Wrapf(err, "failed to get absolute path of %s", filename)
+	}
+	path, err = filepath.EvalSymlinks(path)
+	if err != nil {
+		return indexEntry{}, errors.Wrapf(err, "failed to resolve path of %s", filename)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return indexEntry{}, errors.Wrapf(err, "failed to get file info of %s", filename)
+	}
+
+	return indexEntry{Path: path, Identity: fileIdentity(fi)}, nil
+}
+
+// writeIndexEntry writes the index entry, if it does not exist yet.
+func writeIndexEntry(indexfilename string, entry indexEntry) error {
+	if _, err := os.Stat(indexfilename); err == nil {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(indexfilename), 0700)
+	if err != nil {
+		return errors.Wrap(err, "failed to create cache directory")
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "failed to convert index entry to json")
+	}
+
+	err = ioutil.WriteFile(indexfilename, data, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to write index entry")
+	}
+
+	return nil
+}
+
+// GarbageCollect removes all caches from the cache directory whose file does
+// no longer exist or was replaced by another file. The removed files are
+// returned, if dryRun is set nothing is deleted.
+func GarbageCollect(dryRun bool) ([]string, error) {
+	if CacheDir == "" {
+		return nil, fmt.Errorf("no cache directory configured")
+	}
+
+	files, err := ioutil.ReadDir(CacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to read cache directory")
+	}
+
+	// collect all valid cache names first, files without a valid
+	// index entry are removed afterwards
+	valid := map[string]bool{}
+	for _, fi := range files {
+		key, ok := cacheFileKey(fi)
+		if !ok || !strings.HasSuffix(fi.Name(), INDEX_FILE_EXTENSION) {
+			continue
+		}
+		valid[key] = isValidIndexEntry(filepath.Join(CacheDir, fi.Name()))
+	}
+
+	var removed []string
+	for _, fi := range files {
+		// other files in the cache directory are never touched
+		key, ok := cacheFileKey(fi)
+		if !ok || valid[key] {
+			continue
+		}
+
+		filename := filepath.Join(CacheDir, fi.Name())
+		if !dryRun {
+			err = os.Remove(filename)
+			if err != nil {
+				return removed, errors.Wrapf(err, "failed to remove %s", filename)
+			}
+			Logger().Debug("removed stale cache file", "file", filename)
+		}
+		removed = append(removed, filename)
+	}
+
+	return removed, nil
+}
+
+// cacheFileKey returns the key of a file created by CacheName or one of the
+// backends, false for directories and all other files.
+func cacheFileKey(fi os.FileInfo) (string, bool) {
+	name := fi.Name()
+	if !fi.Mode().IsRegular() || len(name) < cacheKeyLength {
+		return "", false
+	}
+	key := name[:cacheKeyLength]
+	if _, err := hex.DecodeString(key); err != nil || strings.ToLower(key) != key {
+		return "", false
+	}
+
+	switch suffix := name[cacheKeyLength:]; suffix {
+	case INDEX_FILE_EXTENSION, ".tcache.sig":
+		return key, true
+	default:
+		for _, b := range backends {
+			if suffix == ".tcache"+b.extension || suffix == ".tcache"+b.extension+".tmp" {
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
+
+// isValidIndexEntry returns true, if the file of the index entry still exists
+// and has the same identity.
+func isValidIndexEntry(indexfilename string) bool {
+	data, err := ioutil.ReadFile(indexfilename)
+	if err != nil {
+		return false
+	}
+
+	var entry indexEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return false
+	}
+
+	current, err := newIndexEntry(entry.Path)
+	if err != nil {
+		return false
+	}
+
+	return current == entry
+}
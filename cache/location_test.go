@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCacheNameSidecar(t *testing.T) {
+	CacheDir = ""
+
+	name, err := CacheName("fixtures/test.txt")
+	if err != nil {
+		t.Fatalf("Fail to get cache name: %s", err.Error())
+	}
+	if name != "fixtures/test.txt.tcache" {
+		t.Errorf("Invalid sidecar cache name: %s", name)
+	}
+}
+
+func TestCacheDirGarbageCollect(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Fail to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	CacheDir = filepath.Join(tmpdir, "cache")
+	defer func() { CacheDir = "" }()
+
+	// create two files with a cache database in the cache directory
+	var filenames, dbfilenames []string
+	for _, name := range []string{"keep.txt", "delete.txt"} {
+		filename := filepath.Join(tmpdir, name)
+		err = ioutil.WriteFile(filename, []byte(name), 0600)
+		if err != nil {
+			t.Fatalf("Fail to create file: %s", err.Error())
+		}
+
+		cachename, err := CacheName(filename)
+		if err != nil {
+			t.Fatalf("Fail to get cache name: %s", err.Error())
+		}
+		if !strings.HasPrefix(cachename, CacheDir) {
+			t.Errorf("Cache %s not in cache directory", cachename)
+		}
+
+		// the name must be stable
+		cachename2, _ := CacheName(filename)
+		if cachename != cachename2 {
+			t.Errorf("Cache name changed: %s != %s", cachename, cachename2)
+		}
+
+		db := NewBoltCache()
+		err = db.InitDatabase(cachename)
+		if err != nil {
+			t.Fatalf("Fail to create database: %s", err.Error())
+		}
+		db.CloseDatabase()
+
+		filenames = append(filenames, filename)
+		dbfilenames = append(dbfilenames, db.GetDatabaseFilename())
+	}
+	if dbfilenames[0] == dbfilenames[1] {
+		t.Errorf("Different files share the same cache: %s", dbfilenames[0])
+	}
+
+	// unrelated files and directories are never removed
+	unrelated := []string{
+		filepath.Join(CacheDir, "other.txt"),
+		filepath.Join(CacheDir, "0123456789abcdef0123456789abcdef.txt"),
+		filepath.Join(CacheDir, "0123456789abcdef0123456789abcdef.tcache.dbx"),
+	}
+	for _, filename := range unrelated {
+		ioutil.WriteFile(filename, []byte("data"), 0600)
+	}
+	unrelatedDir := filepath.Join(CacheDir, "0123456789abcdef0123456789abcdef.tcache.db")
+	os.Mkdir(unrelatedDir, 0700)
+	unrelated = append(unrelated, unrelatedDir)
+
+	os.Remove(filenames[1])
+
+	// a dry run must not delete anything
+	removed, err := GarbageCollect(true)
+	if err != nil {
+		t.Errorf("Fail to collect garbage: %s", err.Error())
+	}
+	if len(removed) != 2 {
+		t.Errorf("Invalid number of files to remove: %v", removed)
+	}
+	if _, err := os.Stat(dbfilenames[1]); err != nil {
+		t.Errorf("Dry run deleted database %s", dbfilenames[1])
+	}
+
+	// the database and index entry of the deleted file are removed
+	removed, err = GarbageCollect(false)
+	if err != nil {
+		t.Errorf("Fail to collect garbage: %s", err.Error())
+	}
+	if len(removed) != 2 {
+		t.Errorf("Invalid number of files removed: %v", removed)
+	}
+	if _, err := os.Stat(dbfilenames[0]); err != nil {
+		t.Errorf("Database of existing file removed: %s", dbfilenames[0])
+	}
+	if _, err := os.Stat(dbfilenames[1]); !os.IsNotExist(err) {
+		t.Errorf("Database of deleted file not removed: %s", dbfilenames[1])
+	}
+	for _, filename := range unrelated {
+		if _, err := os.Stat(filename); err != nil {
+			t.Errorf("Unrelated file removed: %s", filename)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package cache
+
+import (
+	"log/slog"
+)
+
+var logger *slog.Logger
+
+// SetLogger sets the logger of the package, slog.Default() is used if nil.
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// Logger returns the logger of the package.
+func Logger() *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
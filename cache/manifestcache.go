@@ -0,0 +1,209 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/manifest"
+	"github.com/tsauter/transmit/structs"
+	"io"
+	"os"
+)
+
+const (
+	// the file extension of all manifest files
+	MANIFEST_FILE_EXTENSION = ".manifest"
+)
+
+// ManifestCache is a cache backend that keeps all chunks in memory and
+// stores them as a binary manifest file.
+// The file is only written when the database is closed.
+type ManifestCache struct {
+	Filename string
+
+	fd     structs.FileData
+	chunks []structs.Chunk
+	dirty  bool
+}
+
+// NewManifestCache return a initialized manifest cache struct.
+func NewManifestCache() *ManifestCache {
+	mc := &ManifestCache{}
+	return mc
+}
+
+// InitDatabase loads an existing manifest file, if the file does not exist
+// an empty cache is created.
+// The filename of the manifest is specified in the cachefilename parameter.
+func (mc *ManifestCache) InitDatabase(cachefilename string) error {
+	mc.Filename = cachefilename + MANIFEST_FILE_EXTENSION
+	mc.fd = structs.FileData{}
+	mc.chunks = nil
+	mc.dirty = false
+
+	f, err := os.Open(mc.Filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// a new manifest, will be written on close
+			mc.dirty = true
+			return nil
+		}
+		return errors.Wrapf(err, "failed to open cache database (%s)", mc.Filename)
+	}
+	defer f.Close()
+
+	mr, err := manifest.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return errors.Wrapf(err, "failed to read cache database (%s)", mc.Filename)
+	}
+	mc.fd = mr.GetFileInfo()
+
+	for {
+		chunkStream, err := mr.ReadChunk()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.Wrapf(err, "failed to read cache database (%s)", mc.Filename)
+		}
+		mc.chunks = append(mc.chunks, chunkStream.Chunk)
+	}
+
+	return nil
+}
+
+// CloseDatabase writes the manifest file, if the cache was modified.
+// The file is written to a temporary file first and renamed afterwards.
+func (mc *ManifestCache) CloseDatabase() error {
+	if !mc.dirty {
+		return nil
+	}
+
+	tmpfilename := mc.Filename + ".tmp"
+	f, err := os.OpenFile(tmpfilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	err = mc.writeManifest(f)
+	if err != nil {
+		f.Close()
+		os.Remove(tmpfilename)
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmpfilename)
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	err = os.Rename(tmpfilename, mc.Filename)
+	if err != nil {
+		os.Remove(tmpfilename)
+		return errors.Wrap(err, "failed to close database")
+	}
+	mc.dirty = false
+
+	return nil
+}
+
+// writeManifest writes all chunks as binary manifest to w.
+func (mc *ManifestCache) writeManifest(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	mw := manifest.NewWriter(bw, mc.fd, uint64(len(mc.chunks)))
+	for _, chunk := range mc.chunks {
+		err := mw.WriteChunk(chunk)
+		if err != nil {
+			return err
+		}
+	}
+	err := mw.Close()
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// Cleanup delete the manifest file in the filesystem.
+func (mc *ManifestCache) Cleanup() error {
+	// there is nothing to write, the file will be deleted
+	mc.dirty = false
+
+	err := os.Remove(mc.Filename)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "deleting database failed")
+	}
+
+	return nil
+}
+
+// GetDatabaseFilename returns the filename of the manifest file.
+func (mc *ManifestCache) GetDatabaseFilename() string {
+	return mc.Filename
+}
+
+// ClearAllChunks remove all previous stored chunks.
+func (mc *ManifestCache) ClearAllChunks() error {
+	mc.chunks = nil
+	mc.dirty = true
+	return nil
+}
+
+// GetFileInfo returns the stored file information.
+func (mc *ManifestCache) GetFileInfo() (structs.FileData, error) {
+	return mc.fd, nil
+}
+
+// StoreFileInfo takes a FileData struct and store those data in the cache.
+func (mc *ManifestCache) StoreFileInfo(fd structs.FileData) error {
+	mc.fd = fd
+	mc.dirty = true
+	return nil
+}
+
+// GetChunk returns the chunk stored under the paramter chunkid.
+// An error is return when the chunk was not found.
+func (mc *ManifestCache) GetChunk(chunkId uint64) (structs.Chunk, error) {
+	if chunkId >= uint64(len(mc.chunks)) || mc.chunks[chunkId].Hash == "" {
+		return structs.Chunk{}, fmt.Errorf("chunk %d not found", chunkId)
+	}
+	return mc.chunks[chunkId], nil
+}
+
+// StoreChunk store the passed chunk (references by chunk id) in the cache.
+// The manifest format requires that all chunks are stored without gaps.
+func (mc *ManifestCache) StoreChunk(chunkId uint64, chunk structs.Chunk) error {
+	for uint64(len(mc.chunks)) <= chunkId {
+		mc.chunks = append(mc.chunks, structs.Chunk{})
+	}
+	mc.chunks[chunkId] = chunk
+	mc.dirty = true
+	return nil
+}
+
+// StoreChunks store all passed chunks in the cache.
+func (mc *ManifestCache) StoreChunks(chunks []structs.ChunkStream) error {
+	for _, chunkStream := range chunks {
+		err := mc.StoreChunk(chunkStream.ChunkId, chunkStream.Chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetChunksCount return the number of stored chunks.
+func (mc *ManifestCache) GetChunksCount() (int, error) {
+	return len(mc.chunks), nil
+}
+
+// GetAllChunks passes all stored chunks to the chunkStreamChan channel.
+func (mc *ManifestCache) GetAllChunks(chunkStreamChan chan structs.ChunkStream) error {
+	for pos, chunk := range mc.chunks {
+		chunkStreamChan <- structs.ChunkStream{ChunkId: uint64(pos), Chunk: chunk}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"github.com/tsauter/transmit/structs"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestManifestCachePersistence(t *testing.T) {
+	fd := structs.FileData{
+		Filename:           "mytestfile.txt",
+		Filesize:           5,
+		Checksum:           "cfb789a8e782467d5e9af43f9bb19769",
+		ChunkHashAlgorithm: "MD5",
+		Chunksize:          2,
+	}
+	chunks := []structs.Chunk{
+		{Hash: "ef654c40ab4f1747fc699915d4f70902", Size: 2},
+		{Hash: "0e65de7114f9d086a6176fdda0f86e9f", Size: 2},
+		{Hash: "4c7b3fc3288e5f9b49138198cc6a8426", Size: 1},
+	}
+
+	// create and fill the cache
+	mc := NewManifestCache()
+	err := mc.InitDatabase("gotest.cache")
+	if err != nil {
+		t.Fatalf("Fail to create database: %s", err.Error())
+	}
+	err = mc.StoreFileInfo(fd)
+	if err != nil {
+		t.Errorf("Fail to store file info: %s", err.Error())
+	}
+	for pos, chunk := range chunks {
+		err = mc.StoreChunk(uint64(pos), chunk)
+		if err != nil {
+			t.Errorf("Fail to store chunk: %s", err.Error())
+		}
+	}
+
+	// the manifest is written on close
+	err = mc.CloseDatabase()
+	if err != nil {
+		t.Fatalf("Fail to close database: %s", err.Error())
+	}
+	if _, err := os.Stat(mc.Filename); err != nil {
+		t.Fatalf("Manifest file not written: %s", err.Error())
+	}
+
+	// reopen the cache and compare all values
+	mc = NewManifestCache()
+	err = mc.InitDatabase("gotest.cache")
+	if err != nil {
+		t.Fatalf("Fail to open database: %s", err.Error())
+	}
+
+	fd2, err := mc.GetFileInfo()
+	if err != nil {
+		t.Errorf("Fail to get file info: %s", err.Error())
+	}
+	if !reflect.DeepEqual(fd, fd2) {
+		t.Errorf("FileInfo data is not equal. Missmatch between storing and getting.")
+	}
+	for pos, chunk := range chunks {
+		chunk2, err := mc.GetChunk(uint64(pos))
+		if err != nil {
+			t.Errorf("Fail to read chunk: %s", err.Error())
+		}
+		if !reflect.DeepEqual(chunk, chunk2) {
+			t.Errorf("Retrieved chunk data is not equal. Missmatch between storing and getting.")
+		}
+	}
+	if _, err := mc.GetChunk(uint64(len(chunks))); err == nil {
+		t.Errorf("Missing chunk returned.")
+	}
+
+	// cleanup must delete the manifest file
+	err = mc.Cleanup()
+	if err != nil {
+		t.Errorf("Fail to cleanup database: %s", err.Error())
+	}
+	if _, err := os.Stat(mc.Filename); !os.IsNotExist(err) {
+		t.Errorf("Manifest file %s not deleted", mc.Filename)
+	}
+}
@@ -0,0 +1,253 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/structs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// the estimated memory used by a single chunk, without the hash
+	memoryChunkOverhead = 48
+)
+
+// DefaultMemoryLimit is the number of bytes a MemoryCache created by
+// NewDefaultMemoryCache may use before the chunks are spilled to disk.
+var DefaultMemoryLimit int64 = 256 * 1024 * 1024
+
+// MemoryCache is a cache backend that keeps all chunks in memory. It is
+// intended for ephemeral caches like the target caches during a copy, nothing
+// is written next to the cached file.
+// When the chunks would need more than MaxMemory bytes, all chunks are moved
+// to a BoltDB database in a temporary directory and all further calls are
+// passed to this database.
+type MemoryCache struct {
+	MaxMemory int64
+
+	fd     structs.FileData
+	chunks []structs.Chunk
+	count  int
+	used   int64
+
+	// the database used after the memory limit was reached
+	spill    CacheDB
+	spillDir string
+}
+
+// NewMemoryCache return a initialized memory cache struct, with a memory
+// limit of maxMemory bytes. A limit of 0 or less disables spilling.
+func NewMemoryCache(maxMemory int64) *MemoryCache {
+	mc := &MemoryCache{MaxMemory: maxMemory}
+	return mc
+}
+
+// NewDefaultMemoryCache return a memory cache with the DefaultMemoryLimit.
+func NewDefaultMemoryCache() *MemoryCache {
+	return NewMemoryCache(DefaultMemoryLimit)
+}
+
+// InitDatabase resets the cache, the cache name is not used because
+// there is no database file.
+func (mc *MemoryCache) InitDatabase(cachefilename string) error {
+	// make sure the data of a previous use is removed
+	err := mc.Cleanup()
+	if err != nil {
+		return err
+	}
+
+	mc.fd = structs.FileData{}
+	mc.chunks = nil
+	mc.count = 0
+	mc.used = 0
+
+	return nil
+}
+
+// CloseDatabase closes the spill database, if the chunks were spilled to disk.
+func (mc *MemoryCache) CloseDatabase() error {
+	if mc.spill == nil {
+		return nil
+	}
+
+	err := mc.spill.CloseDatabase()
+	mc.spill = nil
+	return err
+}
+
+// Cleanup releases all chunks and deletes the temporary spill database.
+func (mc *MemoryCache) Cleanup() error {
+	mc.chunks = nil
+	mc.count = 0
+	mc.used = 0
+
+	err := mc.CloseDatabase()
+	if err != nil {
+		return err
+	}
+
+	if mc.spillDir != "" {
+		err = os.RemoveAll(mc.spillDir)
+		if err != nil {
+			return errors.Wrap(err, "deleting database failed")
+		}
+		mc.spillDir = ""
+	}
+
+	return nil
+}
+
+// GetDatabaseFilename returns the filename of the spill database, or an
+// empty string if all chunks are kept in memory.
+func (mc *MemoryCache) GetDatabaseFilename() string {
+	if mc.spill == nil {
+		return ""
+	}
+	return mc.spill.GetDatabaseFilename()
+}
+
+// Spilled returns true if the chunks were moved to the spill database.
+func (mc *MemoryCache) Spilled() bool {
+	return mc.spill != nil
+}
+
+// spillToDisk creates the spill database in a new temporary directory and
+// moves all chunks and the file details into it.
+func (mc *MemoryCache) spillToDisk() error {
+	dir, err := ioutil.TempDir("", "transmit-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create spill directory")
+	}
+	mc.spillDir = dir
+
+	db := NewBoltCache()
+	err = db.InitDatabase(filepath.Join(dir, "spill.tcache"))
+	if err != nil {
+		return errors.Wrap(err, "failed to create spill database")
+	}
+
+	err = CopyCache(db, mc)
+	if err != nil {
+		db.CloseDatabase()
+		return errors.Wrap(err, "failed to spill chunks to disk")
+	}
+
+	Logger().Info("chunk cache exceeds memory limit, moved to disk", "limit", mc.MaxMemory, "chunks", mc.count, "database", db.GetDatabaseFilename())
+
+	// from now on, the memory is not longer used
+	mc.spill = db
+	mc.chunks = nil
+	mc.count = 0
+	mc.used = 0
+
+	return nil
+}
+
+// ClearAllChunks remove all previous stored chunks.
+func (mc *MemoryCache) ClearAllChunks() error {
+	if mc.spill != nil {
+		return mc.spill.ClearAllChunks()
+	}
+
+	mc.chunks = nil
+	mc.count = 0
+	mc.used = 0
+	return nil
+}
+
+// GetFileInfo returns the stored file information.
+func (mc *MemoryCache) GetFileInfo() (structs.FileData, error) {
+	if mc.spill != nil {
+		return mc.spill.GetFileInfo()
+	}
+	return mc.fd, nil
+}
+
+// StoreFileInfo takes a FileData struct and store those data in the cache.
+func (mc *MemoryCache) StoreFileInfo(fd structs.FileData) error {
+	mc.fd = fd
+	if mc.spill != nil {
+		return mc.spill.StoreFileInfo(fd)
+	}
+	return nil
+}
+
+// GetChunk returns the chunk stored under the paramter chunkid.
+// An error is return when the chunk was not found.
+func (mc *MemoryCache) GetChunk(chunkId uint64) (structs.Chunk, error) {
+	if mc.spill != nil {
+		return mc.spill.GetChunk(chunkId)
+	}
+
+	if chunkId >= uint64(len(mc.chunks)) || mc.chunks[chunkId].Hash == "" {
+		return structs.Chunk{}, fmt.Errorf("chunk %d not found", chunkId)
+	}
+	return mc.chunks[chunkId], nil
+}
+
+// StoreChunk store the passed chunk (references by chunk id) in the cache.
+// The chunks are moved to disk, if the memory limit is exceeded.
+func (mc *MemoryCache) StoreChunk(chunkId uint64, chunk structs.Chunk) error {
+	if mc.spill != nil {
+		return mc.spill.StoreChunk(chunkId, chunk)
+	}
+
+	for uint64(len(mc.chunks)) <= chunkId {
+		mc.chunks = append(mc.chunks, structs.Chunk{})
+		mc.used += memoryChunkOverhead
+	}
+	if mc.chunks[chunkId].Hash == "" {
+		mc.count++
+	}
+	mc.used += int64(len(chunk.Hash) - len(mc.chunks[chunkId].Hash))
+	mc.chunks[chunkId] = chunk
+
+	if mc.MaxMemory > 0 && mc.used > mc.MaxMemory {
+		return mc.spillToDisk()
+	}
+
+	return nil
+}
+
+// StoreChunks store all passed chunks in the cache. If the chunks are
+// moved to disk in between, the remaining chunks are passed at once to the
+// spill database.
+func (mc *MemoryCache) StoreChunks(chunks []structs.ChunkStream) error {
+	for pos, chunkStream := range chunks {
+		if mc.spill != nil {
+			return mc.spill.StoreChunks(chunks[pos:])
+		}
+
+		err := mc.StoreChunk(chunkStream.ChunkId, chunkStream.Chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetChunksCount return the number of stored chunks.
+func (mc *MemoryCache) GetChunksCount() (int, error) {
+	if mc.spill != nil {
+		return mc.spill.GetChunksCount()
+	}
+	return mc.count, nil
+}
+
+// GetAllChunks passes all stored chunks, ordered by chunk id, to the
+// chunkStreamChan channel.
+func (mc *MemoryCache) GetAllChunks(chunkStreamChan chan structs.ChunkStream) error {
+	if mc.spill != nil {
+		return mc.spill.GetAllChunks(chunkStreamChan)
+	}
+
+	for pos, chunk := range mc.chunks {
+		if chunk.Hash == "" {
+			continue
+		}
+		chunkStreamChan <- structs.ChunkStream{ChunkId: uint64(pos), Chunk: chunk}
+	}
+	return nil
+}
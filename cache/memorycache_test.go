@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/tsauter/transmit/structs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryCacheSpill(t *testing.T) {
+	testcases := []struct {
+		Name      string
+		MaxMemory int64
+		Spilled   bool
+	}{
+		{Name: "unlimited", MaxMemory: 0, Spilled: false},
+		{Name: "large", MaxMemory: 1024 * 1024, Spilled: false},
+		{Name: "small", MaxMemory: 512, Spilled: true},
+	}
+
+	fd := structs.FileData{Filename: "mytestfile.txt", Filesize: 1024, ChunkHashAlgorithm: "SHA1", Chunksize: 64}
+
+	for _, tc := range testcases {
+		db := NewMemoryCache(tc.MaxMemory)
+		err := db.InitDatabase("gotest.cache")
+		if err != nil {
+			t.Fatalf("[%s] Fail to create database: %s", tc.Name, err.Error())
+		}
+
+		var chunks []structs.Chunk
+		for pos := 0; pos < 16; pos++ {
+			chunk := structs.NewChunk(fmt.Sprintf("0a01c7c5d4d8a0a4d3a3b2f2f55c1a%02x", pos), 64)
+			chunks = append(chunks, chunk)
+			err = db.StoreChunk(uint64(pos), chunk)
+			if err != nil {
+				t.Errorf("[%s] Fail to store chunk: %s", tc.Name, err.Error())
+			}
+		}
+		err = db.StoreFileInfo(fd)
+		if err != nil {
+			t.Errorf("[%s] Fail to store file info: %s", tc.Name, err.Error())
+		}
+
+		if db.Spilled() != tc.Spilled {
+			t.Errorf("[%s] Invalid spill state: %t", tc.Name, db.Spilled())
+		}
+
+		// the chunks must be available, independent of the spill state
+		count, err := db.GetChunksCount()
+		if err != nil || count != len(chunks) {
+			t.Errorf("[%s] Invalid count returned: %d", tc.Name, count)
+		}
+		for pos, chunk := range chunks {
+			chunk2, err := db.GetChunk(uint64(pos))
+			if err != nil || !reflect.DeepEqual(chunk, chunk2) {
+				t.Errorf("[%s] Retrieved chunk %d is not equal.", tc.Name, pos)
+			}
+		}
+		fd2, err := db.GetFileInfo()
+		if err != nil || !reflect.DeepEqual(fd, fd2) {
+			t.Errorf("[%s] FileInfo data is not equal.", tc.Name)
+		}
+
+		// nothing must be written next to the cached file
+		matches, _ := filepath.Glob("gotest.cache*")
+		if len(matches) > 0 {
+			t.Errorf("[%s] Database files written: %v", tc.Name, matches)
+		}
+
+		spillfile := db.GetDatabaseFilename()
+		if tc.Spilled && spillfile == "" {
+			t.Errorf("[%s] Spill database has no filename", tc.Name)
+		}
+
+		err = db.CloseDatabase()
+		if err != nil {
+			t.Errorf("[%s] Fail to close database: %s", tc.Name, err.Error())
+		}
+		err = db.Cleanup()
+		if err != nil {
+			t.Errorf("[%s] Fail to cleanup database: %s", tc.Name, err.Error())
+		}
+
+		if spillfile != "" {
+			if _, err := os.Stat(filepath.Dir(spillfile)); !os.IsNotExist(err) {
+				t.Errorf("[%s] Spill directory not removed: %s", tc.Name, filepath.Dir(spillfile))
+			}
+		}
+	}
+}
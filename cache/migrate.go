@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SCHEMA_VERSION is the version of the database schema written by this
+	// version of transmit. Databases without a version have version 1.
+	SCHEMA_VERSION = 2
+
+	// the key of the schema version in the info bucket/table
+	SCHEMA_VERSION_KEY = "version"
+)
+
+// SchemaError is returned when a database was written with a newer
+// schema than supported.
+type SchemaError struct {
+	Filename string
+	Version  int
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("cache %s was created by a newer version of transmit (schema version %d, supported %d), update transmit or rebuild the cache", e.Filename, e.Version, SCHEMA_VERSION)
+}
+
+// Migration upgrades the stored file info from Version-1 to Version.
+// The file info is passed as raw json data, the migrated json data is returned.
+type Migration struct {
+	Version     int
+	Description string
+	Migrate     func(fileinfo []byte) ([]byte, error)
+}
+
+// all migrations, ordered by version
+var migrations = []Migration{
+	{2, "store the chunksize under the json key chunksize", migrateChunksizeKey},
+}
+
+// migrateFileInfo applies all migrations newer than version to the raw
+// file info. An error is returned, if the version is newer than SCHEMA_VERSION.
+func migrateFileInfo(filename string, version int, fileinfo []byte) ([]byte, error) {
+	if version > SCHEMA_VERSION {
+		return nil, &SchemaError{Filename: filename, Version: version}
+	}
+	if version < SCHEMA_VERSION {
+		Logger().Info("migrating cache", "cache", filename, "from", version, "to", SCHEMA_VERSION)
+	}
+
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+
+		var err error
+		fileinfo, err = m.Migrate(fileinfo)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to migrate cache %s to schema version %d (%s)", filename, m.Version, m.Description)
+		}
+	}
+
+	return fileinfo, nil
+}
+
+// migrateChunksizeKey renames the json key Chunksize to chunksize. Previous
+// versions stored the chunksize under the field name because of a typo in
+// the struct tag.
+func migrateChunksizeKey(fileinfo []byte) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	err := json.Unmarshal(fileinfo, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := fields["Chunksize"]
+	if !ok {
+		return fileinfo, nil
+	}
+	delete(fields, "Chunksize")
+	if _, ok := fields["chunksize"]; !ok {
+		fields["chunksize"] = value
+	}
+
+	return json.Marshal(fields)
+}
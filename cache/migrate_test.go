@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"database/sql"
+	"github.com/boltdb/bolt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// the file info as stored by transmit before schema version 2
+var fileinfoV1 = []byte(`{"filename":"test.txt","filesize":5,"checksum":"cfb789a8e782467d5e9af43f9bb19769","hashalgo":"MD5","Chunksize":2}`)
+
+// writeRawInfo writes the raw file info and schema version (if not empty)
+// directly to a new database of the backend, bypassing any migration.
+func writeRawInfo(t *testing.T, backendname string, dbfilename string, fileinfo []byte, version string) {
+	switch backendname {
+	case BACKEND_BOLT:
+		db, err := bolt.Open(dbfilename, 0600, nil)
+		if err != nil {
+			t.Fatalf("Fail to create database: %s", err.Error())
+		}
+		defer db.Close()
+		err = db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte(BOLT_BUCKETNAME_INFO))
+			if err != nil {
+				return err
+			}
+			if version != "" {
+				b.Put([]byte(SCHEMA_VERSION_KEY), []byte(version))
+			}
+			return b.Put([]byte(BOLT_BUCKETNAME_INFO), fileinfo)
+		})
+		if err != nil {
+			t.Fatalf("Fail to write database: %s", err.Error())
+		}
+
+	case BACKEND_SQLITE:
+		db, err := sql.Open("sqlite", dbfilename)
+		if err != nil {
+			t.Fatalf("Fail to create database: %s", err.Error())
+		}
+		defer db.Close()
+		for _, stmt := range sqliteSchema {
+			db.Exec(stmt)
+		}
+		db.Exec(`INSERT INTO info (key, value) VALUES (?, ?)`, SQLITE_INFO_KEY, fileinfo)
+		if version != "" {
+			db.Exec(`INSERT INTO info (key, value) VALUES (?, ?)`, SCHEMA_VERSION_KEY, version)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	for _, backendname := range []string{BACKEND_BOLT, BACKEND_SQLITE} {
+		dbfilename, _ := DatabaseFilename(backendname, "gotest.cache")
+
+		// an old database is upgraded on open
+		writeRawInfo(t, backendname, dbfilename, fileinfoV1, "")
+		db := openTestCache(t, backendname)
+		fd, err := db.GetFileInfo()
+		if err != nil {
+			t.Errorf("[%s] Fail to get file info: %s", backendname, err.Error())
+		}
+		if fd.Chunksize != 2 || fd.Filesize != 5 {
+			t.Errorf("[%s] Invalid file info after migration: %+v", backendname, fd)
+		}
+		closeTestCache(t, backendname, db)
+
+		// a database of a newer version can not be opened
+		writeRawInfo(t, backendname, dbfilename, fileinfoV1, "99")
+		db, _ = NewCacheDB(backendname)
+		err = db.InitDatabase("gotest.cache")
+		if err == nil || !strings.Contains(err.Error(), "newer version") {
+			t.Errorf("[%s] Newer database accepted: %v", backendname, err)
+		}
+		if _, ok := err.(*SchemaError); !ok {
+			t.Errorf("[%s] Invalid error type returned: %T", backendname, err)
+		}
+		// the database must be closed, otherwise deleting fails on some platforms
+		err = os.Remove(dbfilename)
+		if err != nil {
+			t.Errorf("[%s] Fail to delete database: %s", backendname, err.Error())
+		}
+	}
+}
+
+func TestMigrateChunksizeKey(t *testing.T) {
+	migrated, err := migrateFileInfo("test", 1, fileinfoV1)
+	if err != nil {
+		t.Fatalf("Fail to migrate file info: %s", err.Error())
+	}
+	if strings.Contains(string(migrated), "Chunksize") || !strings.Contains(string(migrated), `"chunksize":2`) {
+		t.Errorf("Chunksize not migrated: %s", migrated)
+	}
+
+	// current versions are not changed
+	migrated, err = migrateFileInfo("test", SCHEMA_VERSION, fileinfoV1)
+	if err != nil || string(migrated) != string(fileinfoV1) {
+		t.Errorf("Current file info changed: %s", migrated)
+	}
+}
@@ -0,0 +1,297 @@
+package cache
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/structs"
+	"os"
+	"strconv"
+
+	_ "modernc.org/sqlite" // pure go sqlite driver, no cgo required
+)
+
+const (
+	// the file extension of all sqlite databases
+	SQLITE_FILE_EXTENSION = ".sqlite"
+
+	// the key of the file info in the info table
+	SQLITE_INFO_KEY = "info"
+)
+
+// the statements to create all tables and indexes of a new database
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS info (key TEXT PRIMARY KEY, value BLOB NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS chunks (id INTEGER PRIMARY KEY, hash TEXT NOT NULL, size INTEGER NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS chunks_hash ON chunks (hash)`,
+}
+
+type SqliteCache struct {
+	DbFilename string
+	DB         *sql.DB
+}
+
+// NewSqliteCache return a initialized sqlite cache struct.
+func NewSqliteCache() *SqliteCache {
+	sc := &SqliteCache{}
+	return sc
+}
+
+// InitDatabase creates a new sqlite database and initialize the tables.
+// The filename of the database is specified in the cachefilename parameter.
+func (sc *SqliteCache) InitDatabase(cachefilename string) error {
+	cachefilename = cachefilename + SQLITE_FILE_EXTENSION
+	sc.DbFilename = cachefilename
+
+	db, err := sql.Open("sqlite", cachefilename)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create cache database (%s)", cachefilename)
+	}
+	// sqlite allows only one writer, a single connection avoids locking errors
+	db.SetMaxOpenConns(1)
+	sc.DB = db
+
+	for _, stmt := range sqliteSchema {
+		_, err = sc.DB.Exec(stmt)
+		if err != nil {
+			sc.DB.Close()
+			return errors.Wrapf(err, "failed to create cache database (%s)", cachefilename)
+		}
+	}
+
+	// upgrade databases of previous versions
+	err = sc.migrate()
+	if err != nil {
+		sc.DB.Close()
+		return err
+	}
+
+	return nil
+}
+
+// migrate upgrades the database to the current schema version. The schema
+// version is stored in the info table, new databases get the current version.
+func (sc *SqliteCache) migrate() error {
+	var fileinfo []byte
+	err := sc.DB.QueryRow(`SELECT value FROM info WHERE key = ?`, SQLITE_INFO_KEY).Scan(&fileinfo)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrap(err, "failed to get file info from database")
+	}
+
+	// databases without version are from version 1, if they contain data
+	version := SCHEMA_VERSION
+	if fileinfo != nil {
+		version = 1
+	}
+	var value string
+	err = sc.DB.QueryRow(`SELECT value FROM info WHERE key = ?`, SCHEMA_VERSION_KEY).Scan(&value)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrap(err, "failed to get schema version from database")
+	}
+	if err == nil {
+		version, err = strconv.Atoi(value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid schema version in cache %s", sc.DbFilename)
+		}
+		if version == SCHEMA_VERSION {
+			return nil
+		}
+	}
+
+	tx, err := sc.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+
+	if fileinfo != nil {
+		migrated, err := migrateFileInfo(sc.DbFilename, version, fileinfo)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec(`INSERT OR REPLACE INTO info (key, value) VALUES (?, ?)`, SQLITE_INFO_KEY, migrated)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "failed to store migrated file info")
+		}
+	} else if version > SCHEMA_VERSION {
+		tx.Rollback()
+		return &SchemaError{Filename: sc.DbFilename, Version: version}
+	}
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO info (key, value) VALUES (?, ?)`, SCHEMA_VERSION_KEY, strconv.Itoa(SCHEMA_VERSION))
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "failed to store schema version")
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to migrate database")
+}
+
+// CloseDatabase close the sqlite database.
+func (sc *SqliteCache) CloseDatabase() error {
+	err := sc.DB.Close()
+	return errors.Wrap(err, "failed to close database")
+}
+
+// Cleanup delete the sqlite database file in the filesystem.
+func (sc *SqliteCache) Cleanup() error {
+	// make sure the db is already closed
+	err := sc.CloseDatabase()
+	if err != nil {
+		return err
+	}
+
+	// delete the file
+	err = os.Remove(sc.DbFilename)
+	if err != nil {
+		return errors.Wrap(err, "deleting database failed")
+	}
+
+	return nil
+}
+
+// GetDatabaseFilename returns the filename of the sqlite database.
+func (sc *SqliteCache) GetDatabaseFilename() string {
+	return sc.DbFilename
+}
+
+// ClearAllChunks remove all previous stored chunks from sqlite database.
+func (sc *SqliteCache) ClearAllChunks() error {
+	_, err := sc.DB.Exec(`DELETE FROM chunks`)
+	if err != nil {
+		return errors.Wrap(err, "clear chunks failed")
+	}
+
+	return nil
+}
+
+// GetFileInfo reads the stored file information from the sqlite database.
+// The file information is stored as marshaled json data in the info table.
+func (sc *SqliteCache) GetFileInfo() (structs.FileData, error) {
+	fd := structs.FileData{}
+
+	var jsonbytes []byte
+	err := sc.DB.QueryRow(`SELECT value FROM info WHERE key = ?`, SQLITE_INFO_KEY).Scan(&jsonbytes)
+	if err != nil && err != sql.ErrNoRows {
+		return fd, errors.Wrap(err, "failed to get file info from database")
+	}
+
+	err = json.Unmarshal(jsonbytes, &fd)
+	if err != nil {
+		return fd, errors.Wrap(err, "file info is corrupt in database")
+	}
+
+	return fd, nil
+}
+
+// StoreFileInfo takes a FileData struct and store those data in the sqlite database.
+func (sc *SqliteCache) StoreFileInfo(fd structs.FileData) error {
+	marshaled_data, err := json.Marshal(fd)
+	if err != nil {
+		return errors.Wrap(err, "failed to convert file info to json")
+	}
+
+	_, err = sc.DB.Exec(`INSERT OR REPLACE INTO info (key, value) VALUES (?, ?)`, SQLITE_INFO_KEY, marshaled_data)
+	if err != nil {
+		return errors.Wrap(err, "failed to store file info in database")
+	}
+
+	return nil
+}
+
+// GetChunk returns the chunk stored under the paramter chunkid.
+// An error is return when the chunk was not found.
+func (sc *SqliteCache) GetChunk(chunkId uint64) (structs.Chunk, error) {
+	var chunk structs.Chunk
+
+	err := sc.DB.QueryRow(`SELECT hash, size FROM chunks WHERE id = ?`, int64(chunkId)).Scan(&chunk.Hash, &chunk.Size)
+	if err == sql.ErrNoRows {
+		return chunk, fmt.Errorf("chunk %d not found", chunkId)
+	}
+	if err != nil {
+		return chunk, errors.Wrap(err, "failed to get chunk info from database")
+	}
+
+	return chunk, nil
+}
+
+// StoreChunk store the passed chunk (references by chunk id) in the database.
+func (sc *SqliteCache) StoreChunk(chunkId uint64, chunk structs.Chunk) error {
+	_, err := sc.DB.Exec(`INSERT OR REPLACE INTO chunks (id, hash, size) VALUES (?, ?, ?)`, int64(chunkId), chunk.Hash, chunk.Size)
+	if err != nil {
+		return errors.Wrap(err, "failed to store chunk info in database")
+	}
+
+	return nil
+}
+
+// StoreChunks store all passed chunks within a single transaction.
+// Either all or none of the chunks are stored.
+func (sc *SqliteCache) StoreChunks(chunks []structs.ChunkStream) error {
+	tx, err := sc.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO chunks (id, hash, size) VALUES (?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "failed to store chunks in database")
+	}
+	defer stmt.Close()
+
+	for _, chunkStream := range chunks {
+		_, err = stmt.Exec(int64(chunkStream.ChunkId), chunkStream.Chunk.Hash, chunkStream.Chunk.Size)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "failed to store chunk %d in database", chunkStream.ChunkId)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to store chunks in database")
+	}
+
+	return nil
+}
+
+// GetChunksCount return the number of stored chunks.
+func (sc *SqliteCache) GetChunksCount() (int, error) {
+	var count int
+
+	err := sc.DB.QueryRow(`SELECT COUNT(*) FROM chunks`).Scan(&count)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get number of stored chunk from database")
+	}
+
+	return count, nil
+}
+
+// GetAllChunks passes all stored chunks, ordered by chunk id, to the
+// chunkStreamChan channel.
+func (sc *SqliteCache) GetAllChunks(chunkStreamChan chan structs.ChunkStream) error {
+	rows, err := sc.DB.Query(`SELECT id, hash, size FROM chunks ORDER BY id`)
+	if err != nil {
+		return errors.Wrap(err, "failed to get chunk from database")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var chunk structs.Chunk
+		err = rows.Scan(&id, &chunk.Hash, &chunk.Size)
+		if err != nil {
+			return errors.Wrap(err, "failed to get chunk from database")
+		}
+
+		chunkStreamChan <- structs.ChunkStream{ChunkId: uint64(id), Chunk: chunk}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to get chunk from database")
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright © 2017 Thorsten Sauter <tsauter@gmx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tsauter/transmit/transmitlib"
+)
+
+// applyCmd represents the apply command
+var (
+	applyCmd = &cobra.Command{
+		Use:   "apply",
+		Short: "Apply a patch file to a file",
+		Long: `The apply command updates the target file with a patch created by
+the diff command. The complete patch is verified before the target file is
+modified, and the checksum of the target file is verified afterwards.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if patchfilename == "" || targetfilename == "" {
+				fmt.Printf("Patch or target file is missing.\n")
+				os.Exit(1)
+			}
+
+			fmt.Printf("Applying patch %s to %s\n", patchfilename, targetfilename)
+
+			info, err := transmitlib.ApplyPatch(patchfilename, targetfilename)
+			if err != nil {
+				fmt.Printf("Failed to apply patch: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			fmt.Printf("Target file updated to %s\n", info.New.Checksum)
+		},
+	}
+
+	// flag variables
+	//patchfilename  string
+	//targetfilename string
+)
+
+func init() {
+	RootCmd.AddCommand(applyCmd)
+
+	applyCmd.PersistentFlags().StringVar(&patchfilename, "patch", "", "patch file created by diff")
+	applyCmd.PersistentFlags().StringVar(&targetfilename, "target", "", "file to update")
+}
@@ -0,0 +1,73 @@
+// Copyright © 2017 Thorsten Sauter <tsauter@gmx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/tsauter/transmit/cache"
+)
+
+// cacheCmd represents the cache command, it groups all commands
+// that work on existing chunk caches
+var (
+	cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "Inspect and convert chunk caches",
+		Long: `The cache command groups all sub commands that work on
+existing chunk caches. The caches must be created with gencache first.`,
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(cacheCmd)
+}
+
+// checkCache makes sure that a chunk cache exists for the passed file.
+// The name of the cache is returned.
+func checkCache(filename string) (string, error) {
+	cachename, err := cache.CacheName(filename)
+	if err != nil {
+		return "", err
+	}
+	dbfilename, err := cache.DatabaseFilename(cache.DefaultBackend, cachename)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(dbfilename); os.IsNotExist(err) {
+		return "", fmt.Errorf("no %s cache found for %s, use gencache first", cache.DefaultBackend, filename)
+	}
+	return cachename, nil
+}
+
+// openCache opens the existing chunk cache of the passed file. An error is
+// returned if there is no cache for this file.
+func openCache(filename string) (cache.CacheDB, error) {
+	cachename, err := checkCache(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	db := cache.NewDefaultCacheDB()
+	err = db.InitDatabase(cachename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open cache")
+	}
+
+	return db, nil
+}
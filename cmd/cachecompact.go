@@ -0,0 +1,81 @@
+// Copyright © 2017 Thorsten Sauter <tsauter@gmx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tsauter/transmit/cache"
+)
+
+// cacheCompactCmd represents the cache compact command
+var (
+	cacheCompactCmd = &cobra.Command{
+		Use:   "compact",
+		Short: "Compact the chunk cache of a file",
+		Long: `The compact command rewrites the chunk cache of a file into a
+new database. Space of deleted or overwritten chunks is released.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if sourcefilename == "" {
+				fmt.Printf("Filename is missing.\n")
+				os.Exit(1)
+			}
+
+			db, err := openCache(sourcefilename)
+			if err != nil {
+				fmt.Printf("Failed to open cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+			dbfilename := db.GetDatabaseFilename()
+			before, err := os.Stat(dbfilename)
+			if err != nil {
+				db.CloseDatabase()
+				fmt.Printf("Failed to get size of cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			// the new database is created next to the existing one
+			tmp := cache.NewDefaultCacheDB()
+			err = tmp.InitDatabase(dbfilename + ".compact")
+			if err != nil {
+				db.CloseDatabase()
+				fmt.Printf("Failed to create cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			fmt.Printf("Compacting cache %s...\n", dbfilename)
+			err = cache.CompactCache(db, tmp)
+			if err != nil {
+				fmt.Printf("Failed to compact cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			after, err := os.Stat(dbfilename)
+			if err != nil {
+				fmt.Printf("Failed to get size of cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+			fmt.Printf("Cache compacted: %d Bytes -> %d Bytes\n", before.Size(), after.Size())
+		},
+	}
+)
+
+func init() {
+	cacheCmd.AddCommand(cacheCompactCmd)
+
+	cacheCompactCmd.PersistentFlags().StringVar(&sourcefilename, "filename", "", "file with an existing chunk cache")
+}
@@ -0,0 +1,107 @@
+// Copyright © 2017 Thorsten Sauter <tsauter@gmx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/tsauter/transmit/manifest"
+	"github.com/tsauter/transmit/structs"
+)
+
+// cacheDumpCmd represents the cache dump command
+var (
+	cacheDumpCmd = &cobra.Command{
+		Use:   "dump",
+		Short: "Print all chunks of the chunk cache of a file",
+		Long: `The dump command prints all chunks stored in the chunk cache
+of a file, either as table or as json document.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if sourcefilename == "" {
+				fmt.Printf("Filename is missing.\n")
+				os.Exit(1)
+			}
+			if dumpformat != "table" && dumpformat != "json" {
+				fmt.Printf("Unsupported format: %s\n", dumpformat)
+				os.Exit(1)
+			}
+
+			db, err := openCache(sourcefilename)
+			if err != nil {
+				fmt.Printf("Failed to open cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+			defer db.CloseDatabase()
+
+			fd, err := db.GetFileInfo()
+			if err != nil {
+				fmt.Printf("Failed to get file info from cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+			count, err := db.GetChunksCount()
+			if err != nil {
+				fmt.Printf("Failed to get number of chunks from cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			chunkStreamChan := make(chan structs.ChunkStream, 1)
+			errChan := make(chan error, 1)
+			go func() {
+				errChan <- db.GetAllChunks(chunkStreamChan)
+				close(chunkStreamChan)
+			}()
+
+			w := bufio.NewWriter(os.Stdout)
+			defer w.Flush()
+
+			if dumpformat == "json" {
+				jw := manifest.NewJSONWriter(w, fd, uint64(count))
+				err = manifest.WriteChunks(jw, chunkStreamChan)
+				if err == nil {
+					err = jw.Close()
+				}
+			} else {
+				tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+				fmt.Fprintf(tw, "CHUNK\tSIZE\tHASH\n")
+				for chunkStream := range chunkStreamChan {
+					fmt.Fprintf(tw, "%d\t%d\t%s\n", chunkStream.ChunkId, chunkStream.Chunk.Size, chunkStream.Chunk.Hash)
+				}
+				err = tw.Flush()
+			}
+			if cacheErr := <-errChan; cacheErr != nil {
+				err = cacheErr
+			}
+			if err != nil {
+				w.Flush()
+				fmt.Printf("Failed to dump cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+		},
+	}
+
+	// flag variables
+	dumpformat string
+)
+
+func init() {
+	cacheCmd.AddCommand(cacheDumpCmd)
+
+	cacheDumpCmd.PersistentFlags().StringVar(&sourcefilename, "filename", "", "file with an existing chunk cache")
+	cacheDumpCmd.PersistentFlags().StringVar(&dumpformat, "format", "table", "output format (table, json)")
+}
@@ -0,0 +1,81 @@
+// Copyright © 2017 Thorsten Sauter <tsauter@gmx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tsauter/transmit/transmitlib"
+)
+
+// cacheExportCmd represents the cache export command
+var (
+	cacheExportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "Export the chunk cache of a file as manifest",
+		Long: `The export command writes the chunk cache of a local file
+as manifest file. The binary manifest format is compact and portable,
+the json format should only be used for debugging.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if sourcefilename == "" {
+				fmt.Printf("Filename is missing.\n")
+				os.Exit(1)
+			}
+			if _, err := os.Stat(sourcefilename); os.IsNotExist(err) {
+				fmt.Printf("File does not exist: %s\n", sourcefilename)
+				os.Exit(1)
+			}
+			if manifestfilename == "" {
+				manifestfilename = sourcefilename + ".manifest"
+			}
+
+			fmt.Printf("Exporting cache of %s to %s (format %s)\n", sourcefilename, manifestfilename, manifestformat)
+
+			f, err := os.OpenFile(manifestfilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				fmt.Printf("Failed to create manifest file: %s: %s\n", manifestfilename, err.Error())
+				os.Exit(1)
+			}
+			defer f.Close()
+
+			w := bufio.NewWriter(f)
+			err = transmitlib.ExportManifest(sourcefilename, w, manifestformat)
+			if err == nil {
+				err = w.Flush()
+			}
+			if err != nil {
+				fmt.Printf("Failed to export cache: %s: %s\n", sourcefilename, err.Error())
+				f.Close()
+				os.Remove(manifestfilename)
+				os.Exit(1)
+			}
+		},
+	}
+
+	// flag variables
+	manifestfilename string
+	manifestformat   string
+)
+
+func init() {
+	cacheCmd.AddCommand(cacheExportCmd)
+
+	cacheExportCmd.PersistentFlags().StringVar(&sourcefilename, "filename", "", "file with an existing chunk cache")
+	cacheExportCmd.PersistentFlags().StringVar(&manifestfilename, "manifest", "", "manifest file to write (default is <filename>.manifest)")
+	cacheExportCmd.PersistentFlags().StringVar(&manifestformat, "format", "binary", "manifest format (binary, json)")
+}
@@ -0,0 +1,63 @@
+// Copyright © 2017 Thorsten Sauter <tsauter@gmx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tsauter/transmit/cache"
+)
+
+// cacheGcCmd represents the cache gc command
+var (
+	cacheGcCmd = &cobra.Command{
+		Use:   "gc",
+		Short: "Remove caches of deleted files from the cache directory",
+		Long: `The gc command removes all caches from the cache directory (--cache-dir)
+whose file does no longer exist or was replaced by another file.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if cache.CacheDir == "" {
+				fmt.Printf("No cache directory configured, use --cache-dir.\n")
+				os.Exit(1)
+			}
+
+			action := "Removed"
+			if gcdryrun {
+				action = "Would remove"
+			}
+
+			removed, err := cache.GarbageCollect(gcdryrun)
+			for _, filename := range removed {
+				fmt.Printf("%s: %s\n", action, filename)
+			}
+			if err != nil {
+				fmt.Printf("Failed to clean cache directory: %s\n", err.Error())
+				os.Exit(1)
+			}
+			fmt.Printf("%s %d files in %s\n", action, len(removed), cache.CacheDir)
+		},
+	}
+
+	// flag variables
+	gcdryrun bool
+)
+
+func init() {
+	cacheCmd.AddCommand(cacheGcCmd)
+
+	cacheGcCmd.PersistentFlags().BoolVar(&gcdryrun, "dry-run", false, "only show the files that would be removed")
+}
@@ -0,0 +1,69 @@
+// Copyright © 2017 Thorsten Sauter <tsauter@gmx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tsauter/transmit/transmitlib"
+)
+
+// cacheImportCmd represents the cache import command
+var (
+	cacheImportCmd = &cobra.Command{
+		Use:   "import",
+		Short: "Import a manifest file as chunk cache of a file",
+		Long: `The import command reads a binary manifest file and recreates
+the chunk cache of the local file from it. The checksum of the manifest
+is verified and the manifest must match the size of the local file.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if sourcefilename == "" {
+				fmt.Printf("Filename is missing.\n")
+				os.Exit(1)
+			}
+			if _, err := os.Stat(sourcefilename); os.IsNotExist(err) {
+				fmt.Printf("File does not exist: %s\n", sourcefilename)
+				os.Exit(1)
+			}
+			if manifestfilename == "" {
+				manifestfilename = sourcefilename + ".manifest"
+			}
+
+			fmt.Printf("Importing cache of %s from %s\n", sourcefilename, manifestfilename)
+
+			f, err := os.Open(manifestfilename)
+			if err != nil {
+				fmt.Printf("Failed to open manifest file: %s: %s\n", manifestfilename, err.Error())
+				os.Exit(1)
+			}
+			defer f.Close()
+
+			err = transmitlib.ImportManifest(sourcefilename, f)
+			if err != nil {
+				fmt.Printf("Failed to import cache: %s: %s\n", sourcefilename, err.Error())
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	cacheCmd.AddCommand(cacheImportCmd)
+
+	cacheImportCmd.PersistentFlags().StringVar(&sourcefilename, "filename", "", "file for the imported chunk cache")
+	cacheImportCmd.PersistentFlags().StringVar(&manifestfilename, "manifest", "", "manifest file to import (default is <filename>.manifest)")
+}
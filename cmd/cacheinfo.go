@@ -0,0 +1,105 @@
+// Copyright © 2017 Thorsten Sauter <tsauter@gmx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// cacheInfoCmd represents the cache info command
+var (
+	cacheInfoCmd = &cobra.Command{
+		Use:   "info",
+		Short: "Show details of the chunk cache of a file",
+		Long: `The info command shows the file details stored in the chunk
+cache, the number of chunks and the size of the cache database.
+The cache is stale, if the file was modified after the cache was created.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if sourcefilename == "" {
+				fmt.Printf("Filename is missing.\n")
+				os.Exit(1)
+			}
+			fstat, err := os.Stat(sourcefilename)
+			if err != nil {
+				fmt.Printf("File does not exist: %s\n", sourcefilename)
+				os.Exit(1)
+			}
+
+			db, err := openCache(sourcefilename)
+			if err != nil {
+				fmt.Printf("Failed to open cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+			defer db.CloseDatabase()
+
+			fd, err := db.GetFileInfo()
+			if err != nil {
+				fmt.Printf("Failed to get file info from cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+			count, err := db.GetChunksCount()
+			if err != nil {
+				fmt.Printf("Failed to get number of chunks from cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+			dbstat, err := os.Stat(db.GetDatabaseFilename())
+			if err != nil {
+				fmt.Printf("Failed to get size of cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			fmt.Printf("Filename:       %s\n", fd.Filename)
+			fmt.Printf("Filesize:       %d Bytes\n", fd.Filesize)
+			fmt.Printf("Checksum:       %s\n", fd.Checksum)
+			fmt.Printf("Algorithm:      %s\n", fd.ChunkHashAlgorithm)
+			fmt.Printf("Chunksize:      %d Bytes\n", fd.Chunksize)
+			fmt.Printf("Chunks:         %d\n", count)
+			fmt.Printf("Database:       %s (%d Bytes)\n", db.GetDatabaseFilename(), dbstat.Size())
+
+			// compare the cache with the current state of the file
+			var reasons []string
+			if fd.Filesize != fstat.Size() {
+				reasons = append(reasons, fmt.Sprintf("filesize changed to %d Bytes", fstat.Size()))
+			}
+			if fstat.ModTime().After(dbstat.ModTime()) {
+				reasons = append(reasons, "file modified after cache was created")
+			}
+			if fd.Chunksize > 0 {
+				expected := (fd.Filesize + int64(fd.Chunksize) - 1) / int64(fd.Chunksize)
+				if int64(count) != expected {
+					reasons = append(reasons, fmt.Sprintf("%d chunks expected", expected))
+				}
+			}
+
+			if len(reasons) == 0 {
+				fmt.Printf("State:          up to date\n")
+				return
+			}
+			fmt.Printf("State:          stale\n")
+			for _, reason := range reasons {
+				fmt.Printf("                - %s\n", reason)
+			}
+		},
+	}
+)
+
+func init() {
+	cacheCmd.AddCommand(cacheInfoCmd)
+
+	cacheInfoCmd.PersistentFlags().StringVar(&sourcefilename, "filename", "", "file with an existing chunk cache")
+}
@@ -0,0 +1,84 @@
+// Copyright © 2017 Thorsten Sauter <tsauter@gmx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tsauter/transmit/transmitlib"
+)
+
+// cacheVerifyCmd represents the cache verify command
+var (
+	cacheVerifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Verify the chunk cache of a file against the file",
+		Long: `The verify command rereads the whole file and compares the
+checksum of each chunk with the checksum stored in the chunk cache.
+All mismatching chunks are reported.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if sourcefilename == "" {
+				fmt.Printf("Filename is missing.\n")
+				os.Exit(1)
+			}
+			if _, err := checkCache(sourcefilename); err != nil {
+				fmt.Printf("Failed to open cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			source, err := transmitlib.OpenLocalSource(sourcefilename)
+			if err != nil {
+				fmt.Printf("Failed to open file: %s: %s\n", sourcefilename, err.Error())
+				os.Exit(1)
+			}
+			defer source.Close()
+
+			err = source.LoadCache()
+			if err != nil {
+				fmt.Printf("Failed to load cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			fmt.Printf("Verifying cache of %s...\n", sourcefilename)
+			result, err := source.VerifyCache()
+			if err != nil {
+				fmt.Printf("Failed to verify cache: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			for _, chunkId := range result.Mismatches {
+				fmt.Printf("Chunk %d is different\n", chunkId)
+			}
+			fmt.Printf("%d of %d chunks are different\n", len(result.Mismatches), result.Chunks)
+
+			if !result.ChecksumValid {
+				fmt.Printf("Checksum of the file is different, the cache is invalid!\n")
+				os.Exit(1)
+			}
+			if len(result.Mismatches) > 0 {
+				os.Exit(1)
+			}
+			fmt.Printf("Cache is valid.\n")
+		},
+	}
+)
+
+func init() {
+	cacheCmd.AddCommand(cacheVerifyCmd)
+
+	cacheVerifyCmd.PersistentFlags().StringVar(&sourcefilename, "filename", "", "file with an existing chunk cache")
+}
@@ -16,11 +16,16 @@ package cmd
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/tsauter/transmit/cache"
 	"github.com/tsauter/transmit/hasher"
+	"github.com/tsauter/transmit/manifest"
 	"github.com/tsauter/transmit/transmitlib"
 )
 
@@ -36,16 +41,40 @@ Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 		Run: func(cmd *cobra.Command, args []string) {
+			// several http sources serving the same file can be used as mirrors
+			if len(sourceurls) > 0 {
+				if sourcefilename != "" {
+					fmt.Printf("Use either --sourcefile or --source.\n")
+					os.Exit(1)
+				}
+				for _, sourceurl := range sourceurls {
+					if !transmitlib.IsRemoteSource(sourceurl) {
+						fmt.Printf("Mirror must be a remote source (http/https): %s\n", sourceurl)
+						os.Exit(1)
+					}
+				}
+				sourcefilename = strings.Join(sourceurls, ", ")
+			}
+
 			// make sure the two required parameters source and target are specified
-			if (sourcefilename == "") || (targetfilename == "") {
+			if (sourcefilename == "") || (len(targetfilenames) == 0) {
 				fmt.Printf("Missing source or target file.\n")
 				os.Exit(1)
 			}
 
-			if strings.HasPrefix(targetfilename, "http://") {
-				fmt.Printf("Target file can not be a remote file (http)\n")
-				os.Exit(1)
+			seen := map[string]bool{}
+			for _, targetfile := range targetfilenames {
+				if transmitlib.IsRemoteSource(targetfile) || transmitlib.IsGrpcSource(targetfile) {
+					fmt.Printf("Target file can not be a remote file (http/https/grpc)\n")
+					os.Exit(1)
+				}
+				if seen[filepath.Clean(targetfile)] {
+					fmt.Printf("Target file specified twice: %s\n", targetfile)
+					os.Exit(1)
+				}
+				seen[filepath.Clean(targetfile)] = true
 			}
+			targetfilename = strings.Join(targetfilenames, ", ")
 
 			// load the haser based on the user settings
 			var ghasher hasher.Hasher
@@ -63,10 +92,76 @@ to quickly create a Cobra application.`,
 
 			fmt.Printf("Copy file %s to %s (algorithm %s, chunksize %d Bytes)\n", sourcefilename, targetfilename, ghasher.GetName(), chunksize)
 
+			cache.DefaultMemoryLimit = int64(targetcachememory) * 1024 * 1024
+
 			var err error
+			var results []transmitlib.TargetResult
+
+			if len(sourceurls) > 0 || transmitlib.IsRemoteSource(sourcefilename) || transmitlib.IsGrpcSource(sourcefilename) {
+				var limiter *transmitlib.BandwidthLimiter
+				limiter, err = transmitlib.ParseBandwidthLimiter(bwlimit, bwlimitschedule)
+				if err != nil {
+					fmt.Printf("Invalid bandwidth limit: %s\n", err.Error())
+					os.Exit(1)
+				}
 
-			if strings.HasPrefix(sourcefilename, "http://") {
-				err = transmitlib.CopyHttpToLocal(sourcefilename, targetfilename, &ghasher, chunksize)
+				opts := transmitlib.HttpOptions{
+					ManifestFormat:     manifestformat,
+					CAFile:             cafilename,
+					InsecureSkipVerify: insecureskipverify,
+					ClientCertFile:     clientcertfilename,
+					ClientKeyFile:      clientkeyfilename,
+					Username:           authuser,
+					Password:           os.Getenv("TRANSMIT_PASSWORD"),
+					Timeout:            requesttimeout,
+					Retries:            retries,
+					ErrorBudget:        errorbudget,
+					BandwidthLimit:     limiter,
+					Version:            sourceversion,
+					Checksum:           sourcechecksum,
+					Peer: transmitlib.PeerOptions{
+						Enabled:       enablepeers || peerlisten != "",
+						ListenAddress: peerlisten,
+						Address:       peeraddress,
+						SeedTime:      peerseedtime,
+					},
+				}
+				// zero means DefaultRetries in the options, on the command line it
+				// disables the retries
+				if retries == 0 {
+					opts.Retries = -1
+				}
+				if peerlisten != "" && peeraddress == "" {
+					fmt.Printf("Missing --peer-address for --peer-listen.\n")
+					os.Exit(1)
+				}
+				if authtokenfilename != "" {
+					token, err := ioutil.ReadFile(authtokenfilename)
+					if err != nil {
+						fmt.Printf("Failed to read token: %s\n", err.Error())
+						os.Exit(1)
+					}
+					opts.BearerToken = strings.TrimSpace(string(token))
+				}
+				if insecureskipverify {
+					fmt.Printf("WARNING: the certificate of the source is not verified!\n")
+				}
+				if trustedkeyfilename != "" {
+					opts.TrustedKey, err = manifest.LoadPublicKey(trustedkeyfilename)
+					if err != nil {
+						fmt.Printf("Failed to load trusted key: %s\n", err.Error())
+						os.Exit(1)
+					}
+				}
+				if transmitlib.IsGrpcSource(sourcefilename) {
+					results, err = transmitlib.CopyGrpcToLocal(sourcefilename, targetfilenames, &ghasher, chunksize, opts)
+				} else if len(sourceurls) > 1 {
+					results, err = transmitlib.CopyMirrorsToLocal(sourceurls, targetfilenames, &ghasher, chunksize, opts)
+				} else if len(targetfilenames) > 1 {
+					results, err = transmitlib.CopyHttpToLocalTargets(sourcefilename, targetfilenames, &ghasher, chunksize, opts)
+				} else {
+					err = transmitlib.CopyHttpToLocal(sourcefilename, targetfilename, &ghasher, chunksize, opts)
+				}
 
 			} else {
 				if _, err := os.Stat(sourcefilename); os.IsNotExist(err) {
@@ -74,13 +169,32 @@ to quickly create a Cobra application.`,
 					os.Exit(1)
 				}
 
-				err = transmitlib.CopyLocalToLocal(sourcefilename, targetfilename, &ghasher, chunksize)
+				if len(targetfilenames) > 1 {
+					results, err = transmitlib.CopyLocalToLocalTargets(sourcefilename, targetfilenames, &ghasher, chunksize)
+				} else {
+					err = transmitlib.CopyLocalToLocal(sourcefilename, targetfilename, &ghasher, chunksize)
+				}
 			}
 
 			if err != nil {
 				fmt.Printf("Failed to copy file: %s -> %s: %s", sourcefilename, targetfilename, err.Error())
 				os.Exit(1)
 			}
+
+			// the copy to each target can fail independently
+			failed := 0
+			for _, result := range results {
+				if result.Err != nil {
+					fmt.Printf("Failed to copy file: %s -> %s: %s\n", sourcefilename, result.Filename, result.Err.Error())
+					failed++
+					continue
+				}
+				fmt.Printf("File successfully copied to %s (%d chunks)\n", result.Filename, result.Chunks)
+			}
+			if failed > 0 {
+				fmt.Printf("Failed to copy file to %d of %d targets\n", failed, len(results))
+				os.Exit(1)
+			}
 			fmt.Printf("File successfully copied!\n")
 
 		},
@@ -88,7 +202,28 @@ to quickly create a Cobra application.`,
 
 	// flag variables
 	//sourcefilename string
-	targetfilename string
+	targetfilename     string
+	targetfilenames    []string
+	sourceurls         []string
+	targetcachememory  int
+	trustedkeyfilename string
+	cafilename         string
+	insecureskipverify bool
+	clientcertfilename string
+	clientkeyfilename  string
+	authtokenfilename  string
+	authuser           string
+	requesttimeout     time.Duration
+	retries            int
+	errorbudget        int
+	bwlimit            string
+	bwlimitschedule    string
+	sourceversion      string
+	sourcechecksum     string
+	enablepeers        bool
+	peerlisten         string
+	peeraddress        string
+	peerseedtime       time.Duration
 	//hashalgo       string
 	//chunksize      int
 )
@@ -97,7 +232,28 @@ func init() {
 	RootCmd.AddCommand(copyCmd)
 
 	copyCmd.PersistentFlags().StringVar(&sourcefilename, "sourcefile", "", "source file for copying")
-	copyCmd.PersistentFlags().StringVar(&targetfilename, "targetfile", "", "target file for copying")
+	copyCmd.PersistentFlags().StringArrayVar(&sourceurls, "source", nil, "http source serving the file, can be repeated to download from several mirrors in parallel")
+	copyCmd.PersistentFlags().StringArrayVar(&targetfilenames, "targetfile", nil, "target file for copying, can be repeated to copy the source to several targets in a single pass")
 	copyCmd.PersistentFlags().IntVar(&chunksize, "chunksize", 1024*1024, "size for the individual chunks")
 	copyCmd.PersistentFlags().StringVar(&hashalgo, "hash-algorithm", "sha1", "which algorithm should be used for calculating the chunks")
+	copyCmd.PersistentFlags().StringVar(&manifestformat, "manifest-format", "binary", "format used to transfer the chunk list from http sources (binary, json)")
+	copyCmd.PersistentFlags().IntVar(&targetcachememory, "target-cache-memory", 256, "memory in MB for the target chunk cache, larger caches are moved to a temporary file (0 = unlimited)")
+	copyCmd.PersistentFlags().StringVar(&trustedkeyfilename, "trusted-key", "", "only accept http sources signed with this ed25519 public key (PEM file)")
+	copyCmd.PersistentFlags().StringVar(&cafilename, "ca-file", "", "trust only the certificate authorities in this PEM file for https sources")
+	copyCmd.PersistentFlags().BoolVar(&insecureskipverify, "insecure-skip-verify", false, "do not verify the certificate of https sources (insecure, for testing only)")
+	copyCmd.PersistentFlags().StringVar(&clientcertfilename, "tls-client-cert", "", "client certificate file (PEM) presented to https sources")
+	copyCmd.PersistentFlags().StringVar(&clientkeyfilename, "tls-client-key", "", "private key file (PEM) of the client certificate")
+	copyCmd.PersistentFlags().StringVar(&authtokenfilename, "auth-token-file", "", "send the bearer token from this file to http sources")
+	copyCmd.PersistentFlags().StringVar(&authuser, "auth-user", "", "send basic auth credentials to http sources, the password is read from TRANSMIT_PASSWORD")
+	copyCmd.PersistentFlags().DurationVar(&requesttimeout, "timeout", transmitlib.DefaultRequestTimeout, "timeout of a single request to http sources")
+	copyCmd.PersistentFlags().IntVar(&retries, "retries", transmitlib.DefaultRetries, "number of retries of a failed request to http sources (0 or -1 = no retries)")
+	copyCmd.PersistentFlags().IntVar(&errorbudget, "error-budget", transmitlib.DefaultErrorBudget, "maximum number of retries during the whole copy (-1 = unlimited)")
+	copyCmd.PersistentFlags().StringVar(&bwlimit, "bwlimit", "", "limit the download from http sources in bytes per second (e.g. 500K, 20M)")
+	copyCmd.PersistentFlags().StringVar(&sourceversion, "version", "latest", "version of the file on http sources with snapshots (number of the version, or latest, which is ignored with --checksum)")
+	copyCmd.PersistentFlags().StringVar(&sourcechecksum, "checksum", "", "select the version of the file on http sources by its checksum (or a unique prefix)")
+	copyCmd.PersistentFlags().BoolVar(&enablepeers, "peers", false, "request chunks from other clients announced by the http source before the source")
+	copyCmd.PersistentFlags().StringVar(&peerlisten, "peer-listen", "", "serve the verified chunks of the target to other clients on this address (implies --peers)")
+	copyCmd.PersistentFlags().StringVar(&peeraddress, "peer-address", "", "url of the local peer server announced to other clients (e.g. http://client1:9090)")
+	copyCmd.PersistentFlags().DurationVar(&peerseedtime, "peer-seed-time", 0, "time to serve chunks to other clients after the copy is finished")
+	copyCmd.PersistentFlags().StringVar(&bwlimitschedule, "bwlimit-schedule", "", "bandwidth limits by weekday and time, overrides --bwlimit (e.g. Mon-Fri/08:00-18:00=5M,Sat-Sun=off)")
 }
@@ -0,0 +1,81 @@
+// Copyright © 2017 Thorsten Sauter <tsauter@gmx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tsauter/transmit/transmitlib"
+)
+
+// diffCmd represents the diff command
+var (
+	diffCmd = &cobra.Command{
+		Use:   "diff",
+		Short: "Create a patch file between two versions of a file",
+		Long: `The diff command compares the new file with the chunk cache of the
+old file and writes a patch file. The patch contains the manifest of the new
+file and the data of all different chunks; it can be applied without access
+to the new file (e.g. on offline systems).`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if oldcachefilename == "" || newfilename == "" {
+				fmt.Printf("Old cache or new file is missing.\n")
+				os.Exit(1)
+			}
+			if patchfilename == "" {
+				patchfilename = newfilename + ".tpatch"
+			}
+
+			fmt.Printf("Creating patch %s from %s to %s\n", patchfilename, oldcachefilename, newfilename)
+
+			f, err := os.OpenFile(patchfilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				fmt.Printf("Failed to create patch file: %s: %s\n", patchfilename, err.Error())
+				os.Exit(1)
+			}
+			defer f.Close()
+
+			w := bufio.NewWriter(f)
+			info, err := transmitlib.CreatePatch(oldcachefilename, newfilename, w)
+			if err == nil {
+				err = w.Flush()
+			}
+			if err != nil {
+				fmt.Printf("Failed to create patch: %s\n", err.Error())
+				f.Close()
+				os.Remove(patchfilename)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Patch contains %d chunks\n", info.Chunks)
+		},
+	}
+
+	// flag variables
+	oldcachefilename string
+	newfilename      string
+	patchfilename    string
+)
+
+func init() {
+	RootCmd.AddCommand(diffCmd)
+
+	diffCmd.PersistentFlags().StringVar(&oldcachefilename, "old-cache", "", "chunk cache database of the old file (e.g. file.tcache.db)")
+	diffCmd.PersistentFlags().StringVar(&newfilename, "new", "", "the new file")
+	diffCmd.PersistentFlags().StringVar(&patchfilename, "out", "", "patch file to write (default is <new>.tpatch)")
+}
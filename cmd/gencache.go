@@ -15,12 +15,14 @@
 package cmd
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"os"
 	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/tsauter/transmit/hasher"
+	"github.com/tsauter/transmit/manifest"
 	"github.com/tsauter/transmit/transmitlib"
 )
 
@@ -55,10 +57,20 @@ to avoid recalculating the whole chunk database for this file.`,
 				os.Exit(1)
 			}
 
+			// load the signing key first, a wrong key should not waste a complete cache run
+			var signkey ed25519.PrivateKey
+			if signkeyfilename != "" {
+				var err error
+				signkey, err = manifest.LoadPrivateKey(signkeyfilename)
+				if err != nil {
+					fmt.Printf("Failed to load signing key: %s\n", err.Error())
+					os.Exit(1)
+				}
+			}
+
 			fmt.Printf("Generating cache database for %s (algorithm %s, chunksize %d Bytes)\n", sourcefilename, ghasher.GetName(), chunksize)
 
 			// open the source file
-			var source transmitlib.SourceFile
 			source, err := transmitlib.OpenLocalSource(sourcefilename)
 			if err != nil {
 				fmt.Printf("Failed to open test file: %s: %s", sourcefilename, err.Error())
@@ -74,6 +86,15 @@ to avoid recalculating the whole chunk database for this file.`,
 				os.Exit(1)
 			}
 
+			if signkey != nil {
+				fmt.Printf("Signing cache...\n")
+				err = source.SignCache(signkey)
+				if err != nil {
+					fmt.Printf("Failed to sign cache database: %s", err.Error())
+					os.Exit(1)
+				}
+			}
+
 		},
 	}
 
@@ -82,7 +103,8 @@ to avoid recalculating the whole chunk database for this file.`,
 	hashalgo       string
 	chunksize      int
 
-	force bool
+	force           bool
+	signkeyfilename string
 )
 
 func init() {
@@ -92,4 +114,5 @@ func init() {
 	gencacheCmd.PersistentFlags().IntVar(&chunksize, "chunksize", 1024*1024, "size for the individual chunks")
 	gencacheCmd.PersistentFlags().StringVar(&hashalgo, "hash-algorithm", "sha1", "which algorithm should be used for calculating the chunks")
 	gencacheCmd.PersistentFlags().BoolVar(&force, "force", false, "always overwrite existing cache files")
+	gencacheCmd.PersistentFlags().StringVar(&signkeyfilename, "sign-key", "", "sign the cache with this ed25519 private key (PEM file)")
 }
@@ -0,0 +1,60 @@
+// Copyright © 2017 Thorsten Sauter <tsauter@gmx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tsauter/transmit/manifest"
+)
+
+// genkeyCmd represents the genkey command
+var (
+	genkeyCmd = &cobra.Command{
+		Use:   "genkey",
+		Short: "Generate a key pair for signing chunk caches",
+		Long: `The genkey command creates a new ed25519 key pair. The private key
+is used with gencache --sign-key to sign a cache, the public key is passed
+to copy --trusted-key to verify the signature of a http source.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if keyfilename == "" {
+				fmt.Printf("Key filename is missing.\n")
+				os.Exit(1)
+			}
+			if _, err := os.Stat(keyfilename); err == nil {
+				fmt.Printf("Key file already exists: %s\n", keyfilename)
+				os.Exit(1)
+			}
+
+			err := manifest.GenerateKey(keyfilename, keyfilename+".pub")
+			if err != nil {
+				fmt.Printf("Failed to generate key: %s\n", err.Error())
+				os.Exit(1)
+			}
+			fmt.Printf("Private key written to %s, public key written to %s.pub\n", keyfilename, keyfilename)
+		},
+	}
+
+	// flag variables
+	keyfilename string
+)
+
+func init() {
+	RootCmd.AddCommand(genkeyCmd)
+
+	genkeyCmd.PersistentFlags().StringVar(&keyfilename, "out", "", "filename of the private key, the public key is written to <out>.pub")
+}
@@ -15,8 +15,12 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/tsauter/transmit/transmitlib"
@@ -45,7 +49,73 @@ to quickly create a Cobra application.`,
 			}
 
 			fmt.Printf("Serving file %s via on %s\n", sourcefilename, listenaddress)
-			err := transmitlib.ServeFileOverHttp(listenaddress, sourcefilename)
+			opts := transmitlib.ServerOptions{TLSCertFile: tlscertfilename, TLSKeyFile: tlskeyfilename, ClientCAFile: clientcafilename}
+			if authtokensfilename != "" {
+				auth, err := transmitlib.NewTokenAuthenticator(authtokensfilename)
+				if err != nil {
+					fmt.Printf("Failed to load tokens: %s\n", err.Error())
+					os.Exit(1)
+				}
+				opts.Authenticators = append(opts.Authenticators, auth)
+			}
+			if authhtpasswdfilename != "" {
+				auth, err := transmitlib.NewBasicAuthenticator(authhtpasswdfilename)
+				if err != nil {
+					fmt.Printf("Failed to load users: %s\n", err.Error())
+					os.Exit(1)
+				}
+				opts.Authenticators = append(opts.Authenticators, auth)
+			}
+			if clientcafilename != "" {
+				if len(allowedclients) == 0 {
+					fmt.Printf("Missing allowed clients for client certificates.\n")
+					os.Exit(1)
+				}
+				opts.Authenticators = append(opts.Authenticators, transmitlib.NewCertAuthenticator(allowedclients))
+			}
+
+			limiter, err := transmitlib.ParseBandwidthLimiter(bwlimit, bwlimitschedule)
+			if err != nil {
+				fmt.Printf("Invalid bandwidth limit: %s\n", err.Error())
+				os.Exit(1)
+			}
+			opts.BandwidthLimit = limiter
+			opts.ClientBandwidthLimit, err = transmitlib.ParseBandwidth(bwlimitperclient)
+			if err != nil {
+				fmt.Printf("Invalid bandwidth limit: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			if enablemetrics || adminaddress != "" {
+				opts.Metrics = transmitlib.NewMetrics()
+				opts.AdminAddress = adminaddress
+			}
+
+			opts.ReadTimeout = readtimeout
+			opts.WriteTimeout = writetimeout
+			opts.IdleTimeout = idletimeout
+			opts.ShutdownTimeout = shutdowntimeout
+			opts.ReloadInterval = reloadinterval
+			opts.GrpcAddress = grpcaddress
+			if enabletracker {
+				opts.Tracker = transmitlib.NewTracker(peerttl)
+			}
+
+			if snapshotdir != "" {
+				retention := transmitlib.RetentionPolicy{KeepVersions: keepversions, KeepFor: keepfor}
+				opts.Snapshots, err = transmitlib.OpenSnapshotStore(snapshotdir, retention)
+				if err != nil {
+					fmt.Printf("Failed to open snapshots: %s\n", err.Error())
+					os.Exit(1)
+				}
+				defer opts.Snapshots.Close()
+			}
+
+			// finish all active transfers on SIGTERM or CTRL+C
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			err = transmitlib.ServeFileOverHttp(ctx, listenaddress, sourcefilename, opts)
 			if err != nil {
 				fmt.Printf("Failed to server file: %s: %s", sourcefilename, err.Error())
 				os.Exit(1)
@@ -61,7 +131,29 @@ to quickly create a Cobra application.`,
 	//targetfilename string
 	//hashalgo       string
 	//chunksize      int
-	listenaddress string
+	//bwlimit        string
+	//bwlimitschedule string
+	listenaddress        string
+	tlscertfilename      string
+	tlskeyfilename       string
+	authtokensfilename   string
+	authhtpasswdfilename string
+	clientcafilename     string
+	allowedclients       []string
+	bwlimitperclient     string
+	enablemetrics        bool
+	adminaddress         string
+	readtimeout          time.Duration
+	writetimeout         time.Duration
+	idletimeout          time.Duration
+	shutdowntimeout      time.Duration
+	reloadinterval       time.Duration
+	snapshotdir          string
+	keepversions         int
+	keepfor              time.Duration
+	enabletracker        bool
+	peerttl              time.Duration
+	grpcaddress          string
 )
 
 func init() {
@@ -69,4 +161,26 @@ func init() {
 
 	httpsourceCmd.PersistentFlags().StringVar(&sourcefilename, "sourcefile", "", "source file for copying")
 	httpsourceCmd.PersistentFlags().StringVar(&listenaddress, "listen-address", "127.0.0.1:8080", "address for incoming download request")
+	httpsourceCmd.PersistentFlags().StringVar(&tlscertfilename, "tls-cert", "", "certificate file (PEM) to serve the file over https")
+	httpsourceCmd.PersistentFlags().StringVar(&tlskeyfilename, "tls-key", "", "private key file (PEM) of the https certificate")
+	httpsourceCmd.PersistentFlags().StringVar(&authtokensfilename, "auth-tokens", "", "accept requests with a bearer token from this file (one token and optional client name per line)")
+	httpsourceCmd.PersistentFlags().StringVar(&authhtpasswdfilename, "auth-htpasswd", "", "accept requests with basic auth credentials from this file (user:bcrypt-hash per line)")
+	httpsourceCmd.PersistentFlags().StringVar(&clientcafilename, "client-ca", "", "accept requests with a client certificate signed by the certificate authorities in this PEM file")
+	httpsourceCmd.PersistentFlags().StringSliceVar(&allowedclients, "allowed-clients", nil, "common names or subjects of the accepted client certificates")
+	httpsourceCmd.PersistentFlags().StringVar(&bwlimit, "bwlimit", "", "limit the throughput of all responses in bytes per second (e.g. 500K, 20M)")
+	httpsourceCmd.PersistentFlags().StringVar(&bwlimitschedule, "bwlimit-schedule", "", "bandwidth limits by weekday and time, overrides --bwlimit (e.g. Mon-Fri/08:00-18:00=5M,Sat-Sun=off)")
+	httpsourceCmd.PersistentFlags().StringVar(&bwlimitperclient, "bwlimit-per-client", "", "limit the throughput of each client in bytes per second")
+	httpsourceCmd.PersistentFlags().BoolVar(&enablemetrics, "metrics", false, "serve prometheus metrics on /metrics")
+	httpsourceCmd.PersistentFlags().StringVar(&adminaddress, "admin-address", "", "serve the prometheus metrics on this address instead of the listen address (implies --metrics)")
+	httpsourceCmd.PersistentFlags().DurationVar(&readtimeout, "read-timeout", transmitlib.DefaultReadTimeout, "maximum time to read a request")
+	httpsourceCmd.PersistentFlags().DurationVar(&writetimeout, "write-timeout", 0, "maximum time to write a response, must cover the largest chunk batch on slow links (0 = unlimited)")
+	httpsourceCmd.PersistentFlags().DurationVar(&idletimeout, "idle-timeout", transmitlib.DefaultIdleTimeout, "time to keep idle client connections open")
+	httpsourceCmd.PersistentFlags().DurationVar(&shutdowntimeout, "shutdown-timeout", transmitlib.DefaultShutdownTimeout, "time to wait for active transfers on shutdown (SIGTERM)")
+	httpsourceCmd.PersistentFlags().DurationVar(&reloadinterval, "reload-interval", 0, "interval to check the source file for modifications, the cache is rebuilt and the new file is served (0 = disabled)")
+	httpsourceCmd.PersistentFlags().StringVar(&snapshotdir, "snapshot-dir", "", "store a copy of every served version of the file in this directory, clients can select a version")
+	httpsourceCmd.PersistentFlags().IntVar(&keepversions, "keep-versions", transmitlib.DefaultKeepVersions, "number of stored versions (0 = unlimited)")
+	httpsourceCmd.PersistentFlags().DurationVar(&keepfor, "keep-for", 0, "remove stored versions older than this (e.g. 720h, 0 = unlimited)")
+	httpsourceCmd.PersistentFlags().BoolVar(&enabletracker, "tracker", false, "track the clients sharing chunks with other clients (copy --peers)")
+	httpsourceCmd.PersistentFlags().DurationVar(&peerttl, "peer-ttl", transmitlib.DefaultPeerTTL, "time a client is tracked after its last announcement")
+	httpsourceCmd.PersistentFlags().StringVar(&grpcaddress, "grpc-address", "", "serve the file over grpc on this address, with the same certificate and authentication")
 }
@@ -16,10 +16,14 @@ package cmd
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/tsauter/transmit/cache"
+	"github.com/tsauter/transmit/logging"
+	"github.com/tsauter/transmit/transmitlib"
 )
 
 var cfgFile string
@@ -56,6 +60,14 @@ func init() {
 	// will be global for your application.
 
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.transmit.yaml)")
+	RootCmd.PersistentFlags().String("cache-backend", cache.BACKEND_BOLT, "backend for chunk caches (bolt, sqlite, manifest)")
+	viper.BindPFlag("cache-backend", RootCmd.PersistentFlags().Lookup("cache-backend"))
+	RootCmd.PersistentFlags().String("cache-dir", "", "directory for chunk caches, \"auto\" for $XDG_CACHE_HOME/transmit (default is next to the file)")
+	viper.BindPFlag("cache-dir", RootCmd.PersistentFlags().Lookup("cache-dir"))
+	RootCmd.PersistentFlags().String("log-level", "info", "minimum level of log messages (debug, info, warn, error)")
+	viper.BindPFlag("log-level", RootCmd.PersistentFlags().Lookup("log-level"))
+	RootCmd.PersistentFlags().String("log-format", logging.FormatText, "format of log messages (text, json)")
+	viper.BindPFlag("log-format", RootCmd.PersistentFlags().Lookup("log-format"))
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	RootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
@@ -75,4 +87,26 @@ func initConfig() {
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
+
+	// log messages are written to stderr, the output of the commands to stdout
+	logger, err := logging.New(os.Stderr, viper.GetString("log-level"), viper.GetString("log-format"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+	transmitlib.SetLogger(logger)
+	cache.SetLogger(logger)
+
+	// the cache backend can be set by flag or in the config file
+	if err := cache.SetDefaultBackend(viper.GetString("cache-backend")); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// the cache location can be set by flag or in the config file
+	if err := cache.SetCacheDir(viper.GetString("cache-dir")); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,39 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "warn", FormatJSON)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %s", err.Error())
+	}
+
+	logger.Info("hidden")
+	logger.Warn("visible", "chunk", 5)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Invalid number of records: %v", lines)
+	}
+	record := map[string]interface{}{}
+	err = json.Unmarshal([]byte(lines[0]), &record)
+	if err != nil {
+		t.Fatalf("Invalid json record: %s", lines[0])
+	}
+	if record["msg"] != "visible" || record["level"] != "WARN" || record["chunk"] != float64(5) {
+		t.Errorf("Invalid record: %v", record)
+	}
+
+	if _, err := New(&buf, "verbose", FormatText); err == nil {
+		t.Errorf("Invalid level accepted")
+	}
+	if _, err := New(&buf, "info", "xml"); err == nil {
+		t.Errorf("Invalid format accepted")
+	}
+}
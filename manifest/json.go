@@ -0,0 +1,86 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/structs"
+	"io"
+)
+
+// JSONWriter writes a manifest as a single json document. The json format is
+// much larger than the binary format and should only be used for debugging.
+type JSONWriter struct {
+	w       io.Writer
+	fd      structs.FileData
+	count   uint64
+	written uint64
+	header  bool
+}
+
+// NewJSONWriter returns a JSONWriter for a manifest with count chunks.
+func NewJSONWriter(w io.Writer, fd structs.FileData, count uint64) *JSONWriter {
+	return &JSONWriter{w: w, fd: fd, count: count}
+}
+
+// writeHeader writes the file details and opens the chunk list.
+func (jw *JSONWriter) writeHeader() error {
+	fdjson, err := json.Marshal(jw.fd)
+	if err != nil {
+		return errors.Wrap(err, "failed to convert file info to json")
+	}
+
+	_, err = fmt.Fprintf(jw.w, "{\"fileinfo\":%s,\"count\":%d,\"chunks\":[", fdjson, jw.count)
+	if err != nil {
+		return errors.Wrap(err, "failed to write manifest header")
+	}
+	jw.header = true
+
+	return nil
+}
+
+// WriteChunk appends the next chunk to the manifest.
+func (jw *JSONWriter) WriteChunk(chunk structs.Chunk) error {
+	if !jw.header {
+		if err := jw.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	chunkjson, err := json.Marshal(structs.ChunkStream{ChunkId: jw.written, Chunk: chunk})
+	if err != nil {
+		return errors.Wrap(err, "failed to convert chunk to json")
+	}
+
+	separator := ","
+	if jw.written == 0 {
+		separator = ""
+	}
+	_, err = fmt.Fprintf(jw.w, "%s\n%s", separator, chunkjson)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write chunk %d", jw.written)
+	}
+	jw.written++
+
+	return nil
+}
+
+// Close closes the chunk list and the json document.
+func (jw *JSONWriter) Close() error {
+	if !jw.header {
+		if err := jw.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(jw.w, "\n]}\n")
+	if err != nil {
+		return errors.Wrap(err, "failed to write manifest")
+	}
+
+	if jw.written != jw.count {
+		return fmt.Errorf("incomplete manifest: %d of %d chunks written", jw.written, jw.count)
+	}
+
+	return nil
+}
@@ -0,0 +1,319 @@
+package manifest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/structs"
+	"hash"
+	"io"
+)
+
+const (
+	// The current version of the binary manifest format.
+	// Version 2 added the checksum trailer.
+	Version = 2
+
+	// ContentType is the mime type of a binary manifest.
+	ContentType = "application/x-transmit-manifest"
+
+	// Supported output formats for manifests.
+	FormatBinary = "binary"
+	FormatJSON   = "json"
+)
+
+// every binary manifest starts with these bytes
+var magic = []byte("TMNF")
+
+// ChunkWriter is the common interface for all manifest writers.
+type ChunkWriter interface {
+	// WriteChunk appends the next chunk to the manifest. Chunks must
+	// be written in the order of their chunk ids.
+	WriteChunk(chunk structs.Chunk) error
+	// Close finishes the manifest, the underlying writer is not closed.
+	Close() error
+}
+
+// NewFormatWriter returns a manifest writer for the specified format.
+func NewFormatWriter(format string, w io.Writer, fd structs.FileData, count uint64) (ChunkWriter, error) {
+	switch format {
+	case FormatBinary, "":
+		return NewWriter(w, fd, count), nil
+	case FormatJSON:
+		return NewJSONWriter(w, fd, count), nil
+	default:
+		return nil, fmt.Errorf("unsupported manifest format: %s", format)
+	}
+}
+
+// Writer writes a binary manifest. The manifest contains a header with the
+// file details, followed by one fixed-width entry per chunk.
+// The header layout is (all integers big endian):
+//
+//	magic "TMNF", version (uint16), filename, filesize (int64), checksum,
+//	hash algorithm, chunksize (uint32), hash size (uint16), chunk count (uint64)
+//
+// Strings are prefixed with their length (uint16). Each chunk entry contains
+// the raw hash (hash size bytes) and the chunk size (uint32).
+// The manifest ends with the SHA256 checksum of all previous bytes.
+type Writer struct {
+	w        io.Writer
+	checksum hash.Hash
+	fd       structs.FileData
+	count    uint64
+	written  uint64
+	hashSize int
+	header   bool
+	sum      []byte
+}
+
+// NewWriter returns a Writer for a manifest with count chunks. The header is
+// written together with the first chunk, the hash size is taken from this chunk.
+func NewWriter(w io.Writer, fd structs.FileData, count uint64) *Writer {
+	mw := &Writer{fd: fd, count: count, hashSize: -1}
+	mw.checksum = sha256.New()
+	mw.w = io.MultiWriter(w, mw.checksum)
+	return mw
+}
+
+// writeHeader writes the manifest header to the underlying writer.
+func (mw *Writer) writeHeader() error {
+	var buf bytes.Buffer
+	buf.Write(magic)
+	binary.Write(&buf, binary.BigEndian, uint16(Version))
+	for _, field := range []interface{}{mw.fd.Filename, mw.fd.Filesize, mw.fd.Checksum, mw.fd.ChunkHashAlgorithm, uint32(mw.fd.Chunksize), uint16(mw.hashSize), mw.count} {
+		if s, ok := field.(string); ok {
+			if len(s) > 0xffff {
+				return fmt.Errorf("manifest header field too long: %d bytes", len(s))
+			}
+			binary.Write(&buf, binary.BigEndian, uint16(len(s)))
+			buf.WriteString(s)
+			continue
+		}
+		binary.Write(&buf, binary.BigEndian, field)
+	}
+
+	_, err := mw.w.Write(buf.Bytes())
+	if err != nil {
+		return errors.Wrap(err, "failed to write manifest header")
+	}
+	mw.header = true
+
+	return nil
+}
+
+// WriteChunk appends the next chunk to the manifest.
+func (mw *Writer) WriteChunk(chunk structs.Chunk) error {
+	if mw.written >= mw.count {
+		return fmt.Errorf("too many chunks for manifest, expected %d", mw.count)
+	}
+
+	hash, err := hex.DecodeString(chunk.Hash)
+	if err != nil {
+		return errors.Wrapf(err, "invalid hash for chunk %d", mw.written)
+	}
+
+	if !mw.header {
+		mw.hashSize = len(hash)
+		err = mw.writeHeader()
+		if err != nil {
+			return err
+		}
+	}
+	if len(hash) != mw.hashSize {
+		return fmt.Errorf("invalid hash size for chunk %d: %d != %d", mw.written, len(hash), mw.hashSize)
+	}
+
+	entry := make([]byte, mw.hashSize+4)
+	copy(entry, hash)
+	binary.BigEndian.PutUint32(entry[mw.hashSize:], uint32(chunk.Size))
+	_, err = mw.w.Write(entry)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write chunk %d", mw.written)
+	}
+	mw.written++
+
+	return nil
+}
+
+// Close makes sure all announced chunks were written and writes the
+// checksum trailer.
+func (mw *Writer) Close() error {
+	if !mw.header {
+		mw.hashSize = 0
+		err := mw.writeHeader()
+		if err != nil {
+			return err
+		}
+	}
+
+	if mw.written != mw.count {
+		return fmt.Errorf("incomplete manifest: %d of %d chunks written", mw.written, mw.count)
+	}
+
+	// the checksum itself is not part of the checksum
+	mw.sum = mw.checksum.Sum(nil)
+	_, err := mw.w.Write(mw.sum)
+	if err != nil {
+		return errors.Wrap(err, "failed to write manifest checksum")
+	}
+
+	return nil
+}
+
+// Checksum returns the checksum of the manifest, the result is only
+// available after Close.
+func (mw *Writer) Checksum() []byte {
+	return mw.sum
+}
+
+// Reader reads a binary manifest created by Writer.
+// The checksum of the manifest is verified after the last chunk was read.
+type Reader struct {
+	r        io.Reader
+	src      io.Reader
+	checksum hash.Hash
+	version  uint16
+	fd       structs.FileData
+	count    uint64
+	next     uint64
+	hashSize int
+}
+
+// NewReader reads the manifest header from r and returns a Reader
+// for the chunk entries.
+func NewReader(r io.Reader) (*Reader, error) {
+	mr := &Reader{src: r}
+	mr.checksum = sha256.New()
+	mr.r = io.TeeReader(r, mr.checksum)
+	r = mr.r
+
+	header := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "failed to read manifest header")
+	}
+	if !bytes.Equal(header[:len(magic)], magic) {
+		return nil, fmt.Errorf("not a manifest file")
+	}
+	mr.version = binary.BigEndian.Uint16(header[len(magic):])
+	if mr.version < 1 || mr.version > Version {
+		return nil, fmt.Errorf("unsupported manifest version: %d", mr.version)
+	}
+
+	var err error
+	var chunksize uint32
+	var hashSize uint16
+	if mr.fd.Filename, err = readString(r); err != nil {
+		return nil, err
+	}
+	if err = binary.Read(r, binary.BigEndian, &mr.fd.Filesize); err != nil {
+		return nil, errors.Wrap(err, "failed to read manifest header")
+	}
+	if mr.fd.Checksum, err = readString(r); err != nil {
+		return nil, err
+	}
+	if mr.fd.ChunkHashAlgorithm, err = readString(r); err != nil {
+		return nil, err
+	}
+	for _, field := range []interface{}{&chunksize, &hashSize, &mr.count} {
+		if err = binary.Read(r, binary.BigEndian, field); err != nil {
+			return nil, errors.Wrap(err, "failed to read manifest header")
+		}
+	}
+	mr.fd.Chunksize = int(chunksize)
+	mr.hashSize = int(hashSize)
+
+	return mr, nil
+}
+
+// readString reads a length prefixed string.
+func readString(r io.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", errors.Wrap(err, "failed to read manifest header")
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", errors.Wrap(err, "failed to read manifest header")
+	}
+	return string(buf), nil
+}
+
+// GetFileInfo returns the file details stored in the manifest header.
+func (mr *Reader) GetFileInfo() structs.FileData {
+	return mr.fd
+}
+
+// GetChunksCount returns the number of chunks stored in the manifest.
+func (mr *Reader) GetChunksCount() uint64 {
+	return mr.count
+}
+
+// ReadChunk returns the next chunk from the manifest. io.EOF is returned
+// after the last chunk, if the checksum of the manifest is valid.
+func (mr *Reader) ReadChunk() (structs.ChunkStream, error) {
+	if mr.next == mr.count {
+		err := mr.verifyChecksum()
+		if err != nil {
+			return structs.ChunkStream{}, err
+		}
+		mr.next++
+	}
+	if mr.next > mr.count {
+		return structs.ChunkStream{}, io.EOF
+	}
+
+	entry := make([]byte, mr.hashSize+4)
+	if _, err := io.ReadFull(mr.r, entry); err != nil {
+		return structs.ChunkStream{}, errors.Wrapf(err, "failed to read chunk %d from manifest", mr.next)
+	}
+
+	chunk := structs.NewChunk(hex.EncodeToString(entry[:mr.hashSize]), int(binary.BigEndian.Uint32(entry[mr.hashSize:])))
+	chunkStream := structs.ChunkStream{ChunkId: mr.next, Chunk: chunk}
+	mr.next++
+
+	return chunkStream, nil
+}
+
+// verifyChecksum reads the checksum trailer and compares it with the checksum
+// of all previously read bytes. Manifests of version 1 have no checksum.
+func (mr *Reader) verifyChecksum() error {
+	if mr.version < 2 {
+		return nil
+	}
+
+	expected := mr.checksum.Sum(nil)
+	trailer := make([]byte, len(expected))
+	if _, err := io.ReadFull(mr.src, trailer); err != nil {
+		return errors.Wrap(err, "failed to read manifest checksum")
+	}
+	if !bytes.Equal(expected, trailer) {
+		return fmt.Errorf("manifest checksum is invalid")
+	}
+
+	return nil
+}
+
+// WriteChunks writes all chunks from the channel to the manifest writer. The
+// chunks must be ordered by their chunk id without gaps. The channel is always
+// read until it is closed, even if an error occured.
+func WriteChunks(cw ChunkWriter, chunkStreamChan chan structs.ChunkStream) error {
+	var err error
+	var next uint64
+	for chunkStream := range chunkStreamChan {
+		if err != nil {
+			continue
+		}
+		if chunkStream.ChunkId != next {
+			err = fmt.Errorf("chunk %d is missing", next)
+			continue
+		}
+		err = cw.WriteChunk(chunkStream.Chunk)
+		next++
+	}
+
+	return err
+}
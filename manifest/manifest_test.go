@@ -0,0 +1,246 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/tsauter/transmit/structs"
+	"io"
+	"reflect"
+	"testing"
+)
+
+var (
+	testcases = []struct {
+		Name     string
+		FileData structs.FileData
+		Chunks   []structs.Chunk
+	}{
+		{
+			Name: "md5",
+			FileData: structs.FileData{
+				Filename:           "test2.txt",
+				Filesize:           5,
+				Checksum:           "cfb789a8e782467d5e9af43f9bb19769",
+				ChunkHashAlgorithm: "MD5",
+				Chunksize:          2,
+			},
+			Chunks: []structs.Chunk{
+				{Hash: "ef654c40ab4f1747fc699915d4f70902", Size: 2},
+				{Hash: "0e65de7114f9d086a6176fdda0f86e9f", Size: 2},
+				{Hash: "4c7b3fc3288e5f9b49138198cc6a8426", Size: 1},
+			},
+		},
+		{
+			Name: "sha1",
+			FileData: structs.FileData{
+				Filename:           "large.iso",
+				Filesize:           202020202,
+				Checksum:           "9940b28d7ec4fcd6cbaa3333a4c3db4c31692d03",
+				ChunkHashAlgorithm: "SHA1",
+				Chunksize:          348728,
+			},
+			Chunks: []structs.Chunk{
+				{Hash: "5ce1a1b956e5336e8a509f4b794f446bbbfec818", Size: 348728},
+			},
+		},
+		{
+			Name: "empty",
+			FileData: structs.FileData{
+				Filename:           "empty.txt",
+				ChunkHashAlgorithm: "SHA256",
+				Chunksize:          1024,
+			},
+		},
+	}
+)
+
+func TestWriteReadManifest(t *testing.T) {
+	for _, tc := range testcases {
+		var buf bytes.Buffer
+
+		mw := NewWriter(&buf, tc.FileData, uint64(len(tc.Chunks)))
+		for _, chunk := range tc.Chunks {
+			err := mw.WriteChunk(chunk)
+			if err != nil {
+				t.Fatalf("[%s] Failed to write chunk: %s", tc.Name, err.Error())
+			}
+		}
+		err := mw.Close()
+		if err != nil {
+			t.Fatalf("[%s] Failed to close manifest: %s", tc.Name, err.Error())
+		}
+
+		mr, err := NewReader(&buf)
+		if err != nil {
+			t.Fatalf("[%s] Failed to read manifest: %s", tc.Name, err.Error())
+		}
+		if !reflect.DeepEqual(mr.GetFileInfo(), tc.FileData) {
+			t.Errorf("[%s] FileInfo data is not equal: %#v", tc.Name, mr.GetFileInfo())
+		}
+		if mr.GetChunksCount() != uint64(len(tc.Chunks)) {
+			t.Errorf("[%s] Invalid count returned: %d", tc.Name, mr.GetChunksCount())
+		}
+
+		var chunks []structs.Chunk
+		for {
+			chunkStream, err := mr.ReadChunk()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("[%s] Failed to read chunk: %s", tc.Name, err.Error())
+			}
+			if chunkStream.ChunkId != uint64(len(chunks)) {
+				t.Errorf("[%s] Invalid chunk id returned: %d", tc.Name, chunkStream.ChunkId)
+			}
+			chunks = append(chunks, chunkStream.Chunk)
+		}
+		if !reflect.DeepEqual(chunks, tc.Chunks) {
+			t.Errorf("[%s] Returned list of chunks is different.", tc.Name)
+		}
+	}
+}
+
+func TestWriteInvalidChunks(t *testing.T) {
+	fd := testcases[0].FileData
+
+	// the hash must be hex encoded
+	mw := NewWriter(&bytes.Buffer{}, fd, 1)
+	if err := mw.WriteChunk(structs.Chunk{Hash: "case1hash1"}); err == nil {
+		t.Errorf("Invalid hash accepted.")
+	}
+
+	// all hashes must have the same size
+	mw = NewWriter(&bytes.Buffer{}, fd, 2)
+	mw.WriteChunk(structs.Chunk{Hash: "ef654c40ab4f1747fc699915d4f70902"})
+	if err := mw.WriteChunk(structs.Chunk{Hash: "5ce1a1b956e5336e8a509f4b794f446bbbfec818"}); err == nil {
+		t.Errorf("Different hash size accepted.")
+	}
+
+	// the number of chunks must match
+	mw = NewWriter(&bytes.Buffer{}, fd, 2)
+	mw.WriteChunk(structs.Chunk{Hash: "ef654c40ab4f1747fc699915d4f70902"})
+	if err := mw.Close(); err == nil {
+		t.Errorf("Incomplete manifest accepted.")
+	}
+}
+
+func TestReadInvalidManifest(t *testing.T) {
+	var buf bytes.Buffer
+	mw := NewWriter(&buf, testcases[0].FileData, uint64(len(testcases[0].Chunks)))
+	for _, chunk := range testcases[0].Chunks {
+		mw.WriteChunk(chunk)
+	}
+	mw.Close()
+	data := buf.Bytes()
+
+	// no manifest at all
+	if _, err := NewReader(bytes.NewReader([]byte("{\"filename\":\"test.txt\"}"))); err == nil {
+		t.Errorf("Invalid manifest accepted.")
+	}
+
+	// truncated chunk entries
+	mr, err := NewReader(bytes.NewReader(data[:len(data)-3]))
+	if err != nil {
+		t.Fatalf("Failed to read manifest header: %s", err.Error())
+	}
+	for {
+		_, err = mr.ReadChunk()
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		t.Errorf("Truncated manifest accepted.")
+	}
+}
+
+func TestJSONWriter(t *testing.T) {
+	for _, tc := range testcases {
+		var buf bytes.Buffer
+
+		jw, err := NewFormatWriter(FormatJSON, &buf, tc.FileData, uint64(len(tc.Chunks)))
+		if err != nil {
+			t.Fatalf("[%s] Failed to create json writer: %s", tc.Name, err.Error())
+		}
+		for _, chunk := range tc.Chunks {
+			err = jw.WriteChunk(chunk)
+			if err != nil {
+				t.Fatalf("[%s] Failed to write chunk: %s", tc.Name, err.Error())
+			}
+		}
+		err = jw.Close()
+		if err != nil {
+			t.Fatalf("[%s] Failed to close manifest: %s", tc.Name, err.Error())
+		}
+
+		var doc struct {
+			FileInfo structs.FileData      `json:"fileinfo"`
+			Count    int                   `json:"count"`
+			Chunks   []structs.ChunkStream `json:"chunks"`
+		}
+		err = json.Unmarshal(buf.Bytes(), &doc)
+		if err != nil {
+			t.Fatalf("[%s] Invalid json written: %s", tc.Name, err.Error())
+		}
+		if !reflect.DeepEqual(doc.FileInfo, tc.FileData) {
+			t.Errorf("[%s] FileInfo data is not equal: %#v", tc.Name, doc.FileInfo)
+		}
+		if doc.Count != len(tc.Chunks) || len(doc.Chunks) != len(tc.Chunks) {
+			t.Errorf("[%s] Invalid number of chunks: %d", tc.Name, doc.Count)
+		}
+	}
+}
+
+// readAllChunks reads all chunks from the manifest and returns the
+// first error
+func readAllChunks(data []byte) error {
+	mr, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for {
+		_, err = mr.ReadChunk()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestManifestChecksum(t *testing.T) {
+	tc := testcases[0]
+
+	var buf bytes.Buffer
+	mw := NewWriter(&buf, tc.FileData, uint64(len(tc.Chunks)))
+	for _, chunk := range tc.Chunks {
+		mw.WriteChunk(chunk)
+	}
+	mw.Close()
+	data := buf.Bytes()
+
+	if err := readAllChunks(data); err != nil {
+		t.Fatalf("Failed to read valid manifest: %s", err.Error())
+	}
+
+	// modify one byte of the last chunk hash
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)-32-5] ^= 0xff
+	if err := readAllChunks(corrupt); err == nil {
+		t.Errorf("Corrupt manifest accepted.")
+	}
+
+	// missing checksum
+	if err := readAllChunks(data[:len(data)-32]); err == nil {
+		t.Errorf("Manifest without checksum accepted.")
+	}
+
+	// version 1 manifests have no checksum trailer
+	v1 := append([]byte{}, data[:len(data)-32]...)
+	v1[len(magic)+1] = 1
+	if err := readAllChunks(v1); err != nil {
+		t.Errorf("Failed to read version 1 manifest: %s", err.Error())
+	}
+}
@@ -0,0 +1,162 @@
+package manifest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/structs"
+	"io/ioutil"
+)
+
+const (
+	// SignatureAlgorithm is the only supported signature algorithm.
+	SignatureAlgorithm = "ed25519"
+)
+
+// all signatures are calculated over this prefix and the manifest checksum,
+// this makes sure a signature can not be reused in another context
+var signaturePrefix = []byte("transmit manifest signature\x00")
+
+// Signature is a signature over the file details and the chunk list. The
+// signed data is the checksum of the binary manifest of the file.
+type Signature struct {
+	Algorithm string `json:"algorithm"`
+	PublicKey []byte `json:"publickey"`
+	Signature []byte `json:"signature"`
+}
+
+// Digest returns the manifest checksum of the file details and the chunks.
+// The chunks must be ordered by their chunk id without gaps.
+func Digest(fd structs.FileData, chunks []structs.Chunk) ([]byte, error) {
+	mw := NewWriter(ioutil.Discard, fd, uint64(len(chunks)))
+	for _, chunk := range chunks {
+		err := mw.WriteChunk(chunk)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := mw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return mw.Checksum(), nil
+}
+
+// Sign signs the manifest checksum with the private key.
+func Sign(key ed25519.PrivateKey, checksum []byte) Signature {
+	msg := append(append([]byte{}, signaturePrefix...), checksum...)
+	return Signature{
+		Algorithm: SignatureAlgorithm,
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(key, msg),
+	}
+}
+
+// Verify makes sure the signature was created with the trusted key over
+// the manifest checksum.
+func (s Signature) Verify(trusted ed25519.PublicKey, checksum []byte) error {
+	if s.Algorithm != SignatureAlgorithm {
+		return fmt.Errorf("unsupported signature algorithm: %s", s.Algorithm)
+	}
+	if !bytes.Equal(s.PublicKey, trusted) {
+		return fmt.Errorf("manifest is signed by an untrusted key")
+	}
+
+	msg := append(append([]byte{}, signaturePrefix...), checksum...)
+	if !ed25519.Verify(trusted, msg, s.Signature) {
+		return fmt.Errorf("manifest signature is invalid")
+	}
+
+	return nil
+}
+
+// GenerateKey creates a new key pair and writes the private key and the
+// public key as PEM files.
+func GenerateKey(privfilename string, pubfilename string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate key")
+	}
+
+	privbytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode private key")
+	}
+	pubbytes, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode public key")
+	}
+
+	err = ioutil.WriteFile(privfilename, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privbytes}), 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to write private key")
+	}
+	err = ioutil.WriteFile(pubfilename, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubbytes}), 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to write public key")
+	}
+
+	return nil
+}
+
+// LoadPrivateKey reads an Ed25519 private key from a PEM file (PKCS #8),
+// as written by GenerateKey or "openssl genpkey -algorithm ed25519".
+func LoadPrivateKey(filename string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(filename, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid private key: %s", filename)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ed25519 private key: %s", filename)
+	}
+
+	return priv, nil
+}
+
+// LoadPublicKey reads an Ed25519 public key from a PEM file (PKIX).
+func LoadPublicKey(filename string) (ed25519.PublicKey, error) {
+	der, err := readPEM(filename, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid public key: %s", filename)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ed25519 public key: %s", filename)
+	}
+
+	return pub, nil
+}
+
+// readPEM returns the content of the first PEM block with the type blocktype.
+func readPEM(filename string, blocktype string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read key")
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no %s found in %s", blocktype, filename)
+		}
+		if block.Type == blocktype {
+			return block.Bytes, nil
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package manifest
+
+import (
+	"github.com/tsauter/transmit/structs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignVerify(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	keyfilename := filepath.Join(tmpdir, "sign.key")
+	err = GenerateKey(keyfilename, keyfilename+".pub")
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err.Error())
+	}
+	priv, err := LoadPrivateKey(keyfilename)
+	if err != nil {
+		t.Fatalf("Failed to load private key: %s", err.Error())
+	}
+	pub, err := LoadPublicKey(keyfilename + ".pub")
+	if err != nil {
+		t.Fatalf("Failed to load public key: %s", err.Error())
+	}
+	if _, err := LoadPublicKey(keyfilename); err == nil {
+		t.Errorf("Private key accepted as public key.")
+	}
+
+	fd := structs.FileData{Filename: "test.txt", Filesize: 5, Checksum: "cfb789a8e782467d5e9af43f9bb19769", ChunkHashAlgorithm: "MD5", Chunksize: 2}
+	chunks := []structs.Chunk{
+		{Hash: "ef654c40ab4f1747fc699915d4f70902", Size: 2},
+		{Hash: "0e65de7114f9d086a6176fdda0f86e9f", Size: 2},
+		{Hash: "4c7b3fc3288e5f9b49138198cc6a8426", Size: 1},
+	}
+	digest, err := Digest(fd, chunks)
+	if err != nil {
+		t.Fatalf("Failed to calculate digest: %s", err.Error())
+	}
+	signature := Sign(priv, digest)
+
+	err = signature.Verify(pub, digest)
+	if err != nil {
+		t.Errorf("Valid signature rejected: %s", err.Error())
+	}
+
+	// every modification must invalidate the signature
+	fd.Filesize = 6
+	modified, _ := Digest(fd, chunks)
+	if err := signature.Verify(pub, modified); err == nil {
+		t.Errorf("Signature of modified file info accepted.")
+	}
+	fd.Filesize = 5
+	chunks[1].Hash = "00000000000000000000000000000000"
+	modified, _ = Digest(fd, chunks)
+	if err := signature.Verify(pub, modified); err == nil {
+		t.Errorf("Signature of modified chunks accepted.")
+	}
+}
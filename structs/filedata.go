@@ -13,5 +13,5 @@ type FileData struct {
 	// The used hash algorithm as string, depends on the used hasher
 	ChunkHashAlgorithm string `json:"hashalgo"`
 	// The default size of all chunks, this can be overwritten by each individual chunk
-	Chunksize int `jons:"chunksize"`
+	Chunksize int `json:"chunksize"`
 }
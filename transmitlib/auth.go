@@ -0,0 +1,230 @@
+package transmitlib
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Authenticator checks the credentials of incoming requests.
+type Authenticator interface {
+	// Authenticate returns the name of the authenticated client, an error
+	// is returned if the request does not contain valid credentials.
+	Authenticate(r *http.Request) (string, error)
+	// Challenge returns the value of the WWW-Authenticate header, if the
+	// authentication method uses this header.
+	Challenge() string
+}
+
+// AuthMiddleware returns a mux middleware that only passes requests, that
+// are accepted by at least one of the authenticators. Without authenticators
+// all requests are passed.
+func AuthMiddleware(authenticators []Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(authenticators) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var reasons []string
+			for _, auth := range authenticators {
+				_, err := auth.Authenticate(r)
+				if err == nil {
+					next.ServeHTTP(w, r)
+					return
+				}
+				reasons = append(reasons, err.Error())
+			}
+
+			for _, auth := range authenticators {
+				if challenge := auth.Challenge(); challenge != "" {
+					w.Header().Add("WWW-Authenticate", challenge)
+				}
+			}
+			requestLogger(r).Warn("unauthorized request", "reasons", strings.Join(reasons, ", "))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		})
+	}
+}
+
+// readCredentialLines returns all lines of the file without empty lines
+// and comments (starting with #).
+func readCredentialLines(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open credentials file")
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read credentials file")
+	}
+
+	return lines, nil
+}
+
+// TokenAuthenticator accepts requests with a known bearer token.
+type TokenAuthenticator struct {
+	// the client name of each token
+	tokens map[string]string
+}
+
+// NewTokenAuthenticator loads the tokens from the file. Each line contains
+// a token, optionally followed by the name of the client.
+func NewTokenAuthenticator(filename string) (*TokenAuthenticator, error) {
+	lines, err := readCredentialLines(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	ta := &TokenAuthenticator{tokens: map[string]string{}}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		name := "token"
+		if len(fields) > 1 {
+			name = fields[1]
+		}
+		ta.tokens[fields[0]] = name
+	}
+	if len(ta.tokens) == 0 {
+		return nil, fmt.Errorf("no tokens found in %s", filename)
+	}
+
+	return ta, nil
+}
+
+// Authenticate compares the bearer token of the request with all known tokens.
+func (ta *TokenAuthenticator) Authenticate(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", fmt.Errorf("no bearer token")
+	}
+	token := []byte(strings.TrimPrefix(header, "Bearer "))
+
+	// compare all tokens in constant time, to not leak valid prefixes
+	name := ""
+	for known, client := range ta.tokens {
+		if subtle.ConstantTimeCompare([]byte(known), token) == 1 {
+			name = client
+		}
+	}
+	if name == "" {
+		return "", fmt.Errorf("invalid bearer token")
+	}
+
+	return name, nil
+}
+
+// Challenge returns the WWW-Authenticate header for bearer tokens.
+func (ta *TokenAuthenticator) Challenge() string {
+	return `Bearer realm="transmit"`
+}
+
+// BasicAuthenticator accepts requests with http basic auth credentials. The
+// passwords are stored as bcrypt hashes.
+type BasicAuthenticator struct {
+	users map[string][]byte
+}
+
+// NewBasicAuthenticator loads the users from a htpasswd like file. Each line
+// contains the username and the bcrypt hash of the password, separated by a colon.
+func NewBasicAuthenticator(filename string) (*BasicAuthenticator, error) {
+	lines, err := readCredentialLines(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	ba := &BasicAuthenticator{users: map[string][]byte{}}
+	for _, line := range lines {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid line in %s: missing colon", filename)
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, errors.Wrapf(err, "invalid bcrypt hash for user %s", parts[0])
+		}
+		ba.users[parts[0]] = []byte(parts[1])
+	}
+	if len(ba.users) == 0 {
+		return nil, fmt.Errorf("no users found in %s", filename)
+	}
+
+	return ba, nil
+}
+
+// Authenticate compares the basic auth password with the stored hash.
+func (ba *BasicAuthenticator) Authenticate(r *http.Request) (string, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return "", fmt.Errorf("no basic auth credentials")
+	}
+
+	hash, ok := ba.users[username]
+	if !ok {
+		return "", fmt.Errorf("unknown user %s", username)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", fmt.Errorf("invalid password for user %s", username)
+	}
+
+	return username, nil
+}
+
+// Challenge returns the WWW-Authenticate header for basic auth.
+func (ba *BasicAuthenticator) Challenge() string {
+	return `Basic realm="transmit"`
+}
+
+// CertAuthenticator accepts requests with a verified client certificate, if
+// the subject of the certificate is in the allowlist. The certificate itself
+// is verified by the tls server.
+type CertAuthenticator struct {
+	subjects map[string]bool
+}
+
+// NewCertAuthenticator returns a CertAuthenticator for the allowed subjects.
+// A subject is either the common name or the complete subject of the
+// certificate (e.g. "CN=client,O=example").
+func NewCertAuthenticator(subjects []string) *CertAuthenticator {
+	ca := &CertAuthenticator{subjects: map[string]bool{}}
+	for _, subject := range subjects {
+		ca.subjects[subject] = true
+	}
+	return ca
+}
+
+// Authenticate checks the subject of the verified client certificate.
+func (ca *CertAuthenticator) Authenticate(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", fmt.Errorf("no verified client certificate")
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	for _, subject := range []string{cert.Subject.CommonName, cert.Subject.String()} {
+		if ca.subjects[subject] {
+			return subject, nil
+		}
+	}
+
+	return "", fmt.Errorf("client certificate %s not allowed", cert.Subject.String())
+}
+
+// Challenge returns nothing, client certificates are requested during
+// the tls handshake.
+func (ca *CertAuthenticator) Challenge() string {
+	return ""
+}
@@ -0,0 +1,208 @@
+package transmitlib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/tsauter/transmit/hasher"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCopyHttpAuthenticated(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	defer source.Close()
+
+	tokensfile := filepath.Join(tmpdir, "tokens")
+	err = ioutil.WriteFile(tokensfile, []byte("# test tokens\nsecret-token client1\n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write tokens: %s", err.Error())
+	}
+	tokens, err := NewTokenAuthenticator(tokensfile)
+	if err != nil {
+		t.Fatalf("Failed to load tokens: %s", err.Error())
+	}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret-password"), bcrypt.MinCost)
+	htpasswdfile := filepath.Join(tmpdir, "htpasswd")
+	err = ioutil.WriteFile(htpasswdfile, []byte("user1:"+string(hash)+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write users: %s", err.Error())
+	}
+	users, err := NewBasicAuthenticator(htpasswdfile)
+	if err != nil {
+		t.Fatalf("Failed to load users: %s", err.Error())
+	}
+
+	handler, err := NewSourceHandler(source, ServerOptions{Authenticators: []Authenticator{tokens, users}})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	testcases := []struct {
+		Name  string
+		Opts  HttpOptions
+		Valid bool
+	}{
+		{Name: "no credentials", Opts: HttpOptions{}, Valid: false},
+		{Name: "token", Opts: HttpOptions{BearerToken: "secret-token"}, Valid: true},
+		{Name: "invalid token", Opts: HttpOptions{BearerToken: "secret"}, Valid: false},
+		{Name: "basic auth", Opts: HttpOptions{Username: "user1", Password: "secret-password"}, Valid: true},
+		{Name: "invalid password", Opts: HttpOptions{Username: "user1", Password: "secret"}, Valid: false},
+		{Name: "unknown user", Opts: HttpOptions{Username: "user2", Password: "secret-password"}, Valid: false},
+	}
+
+	for _, tc := range testcases {
+		targetfile := filepath.Join(tmpdir, "target.txt")
+		var h hasher.Hasher = hasher.NewSHA1Hasher()
+		err := CopyHttpToLocal(server.URL, targetfile, &h, 64, tc.Opts)
+		if tc.Valid && err != nil {
+			t.Errorf("[%s] Failed to copy file: %s", tc.Name, err.Error())
+		}
+		if !tc.Valid && err == nil {
+			t.Errorf("[%s] Invalid credentials accepted", tc.Name)
+		}
+		os.Remove(targetfile)
+	}
+
+	// the htpasswd file must contain bcrypt hashes
+	err = ioutil.WriteFile(htpasswdfile, []byte("user1:secret-password\n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write users: %s", err.Error())
+	}
+	_, err = NewBasicAuthenticator(htpasswdfile)
+	if err == nil {
+		t.Errorf("Plain text password accepted")
+	}
+}
+
+// writeTestCertificate creates a certificate for the common name, signed by
+// the parent (self signed if nil). The certificate and key are written as PEM
+// files to the directory.
+func writeTestCertificate(t *testing.T, dir string, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err.Error())
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"transmit"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyder, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	certfile := filepath.Join(dir, cn+".pem")
+	keyfile := filepath.Join(dir, cn+".key")
+	ioutil.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyder}), 0600)
+
+	return cert, key, certfile, keyfile
+}
+
+func TestCopyHttpsClientCertificate(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	defer source.Close()
+
+	ca, cakey, cafile, _ := writeTestCertificate(t, tmpdir, "ca", nil, nil)
+	_, _, allowedcert, allowedkey := writeTestCertificate(t, tmpdir, "allowed", ca, cakey)
+	_, _, deniedcert, deniedkey := writeTestCertificate(t, tmpdir, "denied", ca, cakey)
+	// a self signed certificate with an allowed name
+	foreigndir := filepath.Join(tmpdir, "foreign")
+	os.Mkdir(foreigndir, 0755)
+	_, _, foreigncert, foreignkey := writeTestCertificate(t, foreigndir, "allowed", nil, nil)
+
+	opts := ServerOptions{
+		ClientCAFile:   cafile,
+		Authenticators: []Authenticator{NewCertAuthenticator([]string{"allowed"})},
+	}
+	handler, err := NewSourceHandler(source, opts)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	tlsconfig, err := newServerTLSConfig(opts)
+	if err != nil {
+		t.Fatalf("Failed to create tls config: %s", err.Error())
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = tlsconfig
+	server.StartTLS()
+	defer server.Close()
+
+	servercafile := filepath.Join(tmpdir, "server-ca.pem")
+	capem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	err = ioutil.WriteFile(servercafile, capem, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write ca file: %s", err.Error())
+	}
+
+	testcases := []struct {
+		Name     string
+		CertFile string
+		KeyFile  string
+		Valid    bool
+	}{
+		{Name: "no certificate", Valid: false},
+		{Name: "allowed", CertFile: allowedcert, KeyFile: allowedkey, Valid: true},
+		{Name: "denied", CertFile: deniedcert, KeyFile: deniedkey, Valid: false},
+		{Name: "foreign ca", CertFile: foreigncert, KeyFile: foreignkey, Valid: false},
+	}
+
+	for _, tc := range testcases {
+		targetfile := filepath.Join(tmpdir, "target.txt")
+		var h hasher.Hasher = hasher.NewSHA1Hasher()
+		httpopts := HttpOptions{CAFile: servercafile, ClientCertFile: tc.CertFile, ClientKeyFile: tc.KeyFile}
+		err := CopyHttpToLocal(server.URL, targetfile, &h, 64, httpopts)
+		if tc.Valid && err != nil {
+			t.Errorf("[%s] Failed to copy file: %s", tc.Name, err.Error())
+		}
+		if !tc.Valid && err == nil {
+			t.Errorf("[%s] Invalid client certificate accepted", tc.Name)
+		}
+		os.Remove(targetfile)
+	}
+
+	// the key must be specified with the certificate
+	_, err = OpenHttpSource(nil, HttpOptions{ClientCertFile: allowedcert})
+	if err == nil {
+		t.Errorf("Client certificate without key accepted")
+	}
+}
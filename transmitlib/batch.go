@@ -0,0 +1,195 @@
+package transmitlib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/hasher"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxBatchChunks is the maximum number of chunks that can be requested
+	// with a single batch request.
+	MaxBatchChunks = 1024
+	// DefaultBatchChunks is the number of differing chunks a client collects
+	// before the chunk data is requested from the server.
+	DefaultBatchChunks = 64
+
+	// the content type of a framed multi-chunk response
+	batchContentType = "application/x-transmit-chunkframes"
+	// the maximum length of the hash of a chunk frame
+	maxFrameHash = 256
+	// the maximum size of a chunk frame without the data
+	frameOverhead = 8 + 2 + maxFrameHash + 4
+)
+
+// ChunkRange describes a range of consecutive chunk ids. First and Last
+// are both included in the range.
+type ChunkRange struct {
+	First uint64
+	Last  uint64
+}
+
+// ChunkFrame is a single chunk transmitted within a framed multi-chunk response.
+type ChunkFrame struct {
+	// the id of the chunk
+	ChunkId uint64
+	// the checksum of the chunk, as stored in the source cache
+	Hash string
+	// the raw data of the chunk
+	Data []byte
+}
+
+// GroupChunkRanges groups the passed chunk ids into ranges of consecutive ids.
+// The chunk ids must be sorted in ascending order.
+func GroupChunkRanges(chunkIds []uint64) []ChunkRange {
+	var ranges []ChunkRange
+	for _, id := range chunkIds {
+		last := len(ranges) - 1
+		if last >= 0 && ranges[last].Last+1 == id {
+			ranges[last].Last = id
+			continue
+		}
+		ranges = append(ranges, ChunkRange{First: id, Last: id})
+	}
+	return ranges
+}
+
+// FormatChunkRanges converts the list of ranges into its string representation,
+// e.g. "0-4,7,9-12".
+func FormatChunkRanges(ranges []ChunkRange) string {
+	parts := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		if r.First == r.Last {
+			parts = append(parts, strconv.FormatUint(r.First, 10))
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%d-%d", r.First, r.Last))
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseChunkRanges parses a string created by FormatChunkRanges and returns
+// the list of all included chunk ids. An error is returned if the string is
+// malformed or contains more than maxChunks chunk ids.
+func ParseChunkRanges(s string, maxChunks int) ([]uint64, error) {
+	var chunkIds []uint64
+
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+
+		first, err := strconv.ParseUint(bounds[0], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid chunk range: %s", part)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.ParseUint(bounds[1], 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid chunk range: %s", part)
+			}
+		}
+		if last < first {
+			return nil, fmt.Errorf("invalid chunk range: %s", part)
+		}
+
+		// check the limit before expanding the range, the range could be huge
+		// and must not overflow
+		if len(chunkIds) >= maxChunks || last-first >= uint64(maxChunks-len(chunkIds)) {
+			return nil, fmt.Errorf("too many chunks requested, maximum is %d", maxChunks)
+		}
+		for n := uint64(0); n <= last-first; n++ {
+			chunkIds = append(chunkIds, first+n)
+		}
+	}
+
+	return chunkIds, nil
+}
+
+// verifyChunkFrame checks that the frame is one of the expected chunks and
+// that its data matches the expected hash. The hash sent with the frame is not
+// trusted, the data is hashed with h.
+func verifyChunkFrame(h hasher.Hasher, expected map[uint64]string, frame ChunkFrame) error {
+	hash, ok := expected[frame.ChunkId]
+	if !ok {
+		return fmt.Errorf("received unexpected chunk from source: %d", frame.ChunkId)
+	}
+	if frame.Hash != hash {
+		return fmt.Errorf("received chunk %d with different hash: %s != %s", frame.ChunkId, frame.Hash, hash)
+	}
+	if h.HashChunk(frame.Data) != hash {
+		return fmt.Errorf("received chunk %d with different data", frame.ChunkId)
+	}
+	return nil
+}
+
+// WriteChunkFrame writes a single length-prefixed chunk frame to w.
+// The frame layout is (all integers big endian):
+//
+//	chunk id (uint64), hash length (uint16), hash, data length (uint32), data
+func WriteChunkFrame(w io.Writer, frame ChunkFrame) error {
+	header := make([]byte, 8+2)
+	binary.BigEndian.PutUint64(header[0:8], frame.ChunkId)
+	binary.BigEndian.PutUint16(header[8:10], uint16(len(frame.Hash)))
+	if _, err := w.Write(header); err != nil {
+		return errors.Wrap(err, "failed to write frame header")
+	}
+	if _, err := io.WriteString(w, frame.Hash); err != nil {
+		return errors.Wrap(err, "failed to write frame hash")
+	}
+
+	datalen := make([]byte, 4)
+	binary.BigEndian.PutUint32(datalen, uint32(len(frame.Data)))
+	if _, err := w.Write(datalen); err != nil {
+		return errors.Wrap(err, "failed to write frame header")
+	}
+	if _, err := w.Write(frame.Data); err != nil {
+		return errors.Wrap(err, "failed to write frame data")
+	}
+
+	return nil
+}
+
+// ReadChunkFrame reads the next chunk frame from r. io.EOF is returned
+// if there are no more frames available. Frames with more than maxData
+// bytes of data are rejected before the data is read.
+func ReadChunkFrame(r io.Reader, maxData int) (ChunkFrame, error) {
+	var frame ChunkFrame
+
+	header := make([]byte, 8+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return frame, io.EOF
+		}
+		return frame, errors.Wrap(err, "failed to read frame header")
+	}
+	frame.ChunkId = binary.BigEndian.Uint64(header[0:8])
+
+	hashlen := binary.BigEndian.Uint16(header[8:10])
+	if hashlen > maxFrameHash {
+		return frame, fmt.Errorf("frame hash of chunk %d too long: %d bytes", frame.ChunkId, hashlen)
+	}
+	hash := make([]byte, hashlen)
+	if _, err := io.ReadFull(r, hash); err != nil {
+		return frame, errors.Wrap(err, "failed to read frame hash")
+	}
+	frame.Hash = string(hash)
+
+	datalen := make([]byte, 4)
+	if _, err := io.ReadFull(r, datalen); err != nil {
+		return frame, errors.Wrap(err, "failed to read frame header")
+	}
+	size := binary.BigEndian.Uint32(datalen)
+	if maxData < 0 || uint64(size) > uint64(maxData) {
+		return frame, fmt.Errorf("frame data of chunk %d too large: %d bytes", frame.ChunkId, size)
+	}
+	frame.Data = make([]byte, size)
+	if _, err := io.ReadFull(r, frame.Data); err != nil {
+		return frame, errors.Wrap(err, "failed to read frame data")
+	}
+
+	return frame, nil
+}
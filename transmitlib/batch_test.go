@@ -0,0 +1,209 @@
+package transmitlib
+
+import (
+	"bytes"
+	"github.com/tsauter/transmit/hasher"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestChunkRanges(t *testing.T) {
+	testcases := []struct {
+		ChunkIds []uint64
+		Ranges   string
+	}{
+		{[]uint64{0}, "0"},
+		{[]uint64{0, 1, 2, 3, 4}, "0-4"},
+		{[]uint64{0, 1, 2, 3, 4, 7, 9, 10, 11, 12}, "0-4,7,9-12"},
+		{[]uint64{3, 5, 7}, "3,5,7"},
+	}
+
+	for _, tc := range testcases {
+		ranges := FormatChunkRanges(GroupChunkRanges(tc.ChunkIds))
+		if ranges != tc.Ranges {
+			t.Errorf("invalid ranges returned: %s != %s", ranges, tc.Ranges)
+		}
+
+		chunkIds, err := ParseChunkRanges(ranges, MaxBatchChunks)
+		if err != nil {
+			t.Errorf("failed to parse ranges: %s: %s", ranges, err.Error())
+		}
+		if !reflect.DeepEqual(chunkIds, tc.ChunkIds) {
+			t.Errorf("parsed chunk ids are different: %v != %v", chunkIds, tc.ChunkIds)
+		}
+	}
+}
+
+func TestParseChunkRangesInvalid(t *testing.T) {
+	testcases := []string{"", "a", "1-", "5-2", "1,,2", "0-18446744073709551615", "0-1024",
+		"5,0-18446744073709551615", "1-18446744073709551615", "18446744073709551615-18446744073709551615,0-1023"}
+
+	for _, tc := range testcases {
+		_, err := ParseChunkRanges(tc, MaxBatchChunks)
+		if err == nil {
+			t.Errorf("invalid range accepted: %s", tc)
+		}
+	}
+}
+
+func TestChunkFrames(t *testing.T) {
+	frames := []ChunkFrame{
+		{ChunkId: 0, Hash: "ef654c40ab4f1747fc699915d4f70902", Data: []byte("testdata")},
+		{ChunkId: 7, Hash: "0e65de7114f9d086a6176fdda0f86e9f", Data: []byte("testdata2")},
+		{ChunkId: 8, Hash: "", Data: []byte{}},
+	}
+
+	var buf bytes.Buffer
+	for _, frame := range frames {
+		err := WriteChunkFrame(&buf, frame)
+		if err != nil {
+			t.Fatalf("failed to write frame: %s", err.Error())
+		}
+	}
+
+	for _, frame := range frames {
+		frame2, err := ReadChunkFrame(&buf, 9)
+		if err != nil {
+			t.Fatalf("failed to read frame: %s", err.Error())
+		}
+		if !reflect.DeepEqual(frame, frame2) {
+			t.Errorf("frame is different: %#v != %#v", frame, frame2)
+		}
+	}
+
+	_, err := ReadChunkFrame(&buf, 9)
+	if err != io.EOF {
+		t.Errorf("expected EOF after last frame: %v", err)
+	}
+}
+
+func TestChunkFrameTooLarge(t *testing.T) {
+	// the header announces 4 GiB of data, only a few bytes follow
+	header := []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0xff, 0xff, 0xff, 0xff}
+	_, err := ReadChunkFrame(bytes.NewReader(append(header, "testdata"...)), 1024)
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("oversized frame accepted: %v", err)
+	}
+
+	var buf bytes.Buffer
+	WriteChunkFrame(&buf, ChunkFrame{ChunkId: 2, Hash: "abc", Data: []byte("testdata")})
+	_, err = ReadChunkFrame(&buf, 7)
+	if err == nil {
+		t.Errorf("frame larger than chunk size accepted")
+	}
+
+	buf.Reset()
+	WriteChunkFrame(&buf, ChunkFrame{ChunkId: 3, Hash: strings.Repeat("a", maxFrameHash+1), Data: []byte("testdata")})
+	_, err = ReadChunkFrame(&buf, 1024)
+	if err == nil {
+		t.Errorf("frame with too long hash accepted")
+	}
+}
+
+// newCorruptServer serves the handler, the data of all chunks sent by
+// ReadChunksData is corrupted while the hashes are kept.
+func newCorruptServer(handler http.Handler) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/ReadChunksData") {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		for key, values := range rec.Header() {
+			w.Header()[key] = values
+		}
+		for {
+			frame, err := ReadChunkFrame(rec.Body, 1<<20)
+			if err != nil {
+				return
+			}
+			frame.Data[0] ^= 0xff
+			WriteChunkFrame(w, frame)
+		}
+	}))
+}
+
+func TestCopyChunkBatchCorruptData(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	handler, err := NewSourceHandler(source, ServerOptions{})
+	if err != nil {
+		source.Close()
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	defer handler.Close()
+	server := newCorruptServer(handler)
+	defer server.Close()
+
+	targetfile := filepath.Join(tmpdir, "target.txt")
+	var h hasher.Hasher = hasher.NewSHA1Hasher()
+	err = CopyHttpToLocal(server.URL, targetfile, &h, 64, HttpOptions{Retries: -1})
+	if err == nil || !strings.Contains(err.Error(), "different data") {
+		t.Errorf("Expected error for corrupt chunk data, got %v", err)
+	}
+}
+
+func TestReadChunksDataConcurrent(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	handler, err := NewSourceHandler(source, ServerOptions{})
+	if err != nil {
+		source.Close()
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	defer handler.Close()
+
+	// all requests read from the same file, each chunk must contain its own data
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h := hasher.NewSHA1Hasher()
+			path := []string{"/ReadChunksData?chunks=0-2", "/ReadChunksData?chunks=2,0", "/ReadChunkData/1"}[i%3]
+			for n := 0; n < 200; n++ {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+				if strings.HasPrefix(path, "/ReadChunkData/") {
+					chunk, _ := source.GetChunk(1)
+					if h.HashChunk(rec.Body.Bytes()) != chunk.Hash {
+						t.Errorf("Chunk 1 contains different data")
+						return
+					}
+					continue
+				}
+				for {
+					frame, err := ReadChunkFrame(rec.Body, 64)
+					if err != nil {
+						break
+					}
+					if h.HashChunk(frame.Data) != frame.Hash {
+						t.Errorf("Chunk %d contains different data", frame.ChunkId)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
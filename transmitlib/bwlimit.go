@@ -0,0 +1,412 @@
+package transmitlib
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the minimum burst of a limiter, smaller bursts would split every
+	// read or write into many small pieces
+	minBandwidthBurst = 32 * 1024
+	// per client limiters are removed after this idle time
+	clientLimiterIdle = 10 * time.Minute
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseBandwidth parses a bandwidth in bytes per second. The suffixes K, M
+// and G multiply the value by 1024, 1024^2 and 1024^3. Zero means unlimited.
+func ParseBandwidth(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" || value == "OFF" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	switch value[len(value)-1] {
+	case 'K':
+		multiplier = 1024
+	case 'M':
+		multiplier = 1024 * 1024
+	case 'G':
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid bandwidth: %s", value)
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
+
+// ScheduleRule is the bandwidth limit during a time window.
+type ScheduleRule struct {
+	// the weekdays of the rule, all days if empty
+	Days map[time.Weekday]bool
+	// the time window in minutes since midnight, the window wraps at midnight
+	// if To is smaller than From; the whole day if both are equal
+	From int
+	To   int
+	// the limit in bytes per second, 0 is unlimited
+	Limit int64
+}
+
+// Matches returns true if the time is within the time window of the rule.
+func (sr ScheduleRule) Matches(t time.Time) bool {
+	if len(sr.Days) > 0 && !sr.Days[t.Weekday()] {
+		return false
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	switch {
+	case sr.From == sr.To:
+		return true
+	case sr.From < sr.To:
+		return minute >= sr.From && minute < sr.To
+	default:
+		return minute >= sr.From || minute < sr.To
+	}
+}
+
+// Schedule is a list of rules, the first matching rule defines the limit.
+type Schedule []ScheduleRule
+
+// ParseSchedule parses a comma separated list of rules. Each rule has the
+// format [DAYS/][HH:MM-HH:MM]=LIMIT, e.g. "Mon-Fri/08:00-18:00=5M,Sat-Sun=off".
+func ParseSchedule(value string) (Schedule, error) {
+	var schedule Schedule
+	if strings.TrimSpace(value) == "" {
+		return schedule, nil
+	}
+
+	for _, text := range strings.Split(value, ",") {
+		text = strings.TrimSpace(text)
+		parts := strings.SplitN(text, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid schedule rule, missing limit: %s", text)
+		}
+
+		var rule ScheduleRule
+		var err error
+		rule.Limit, err = ParseBandwidth(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid schedule rule: %s", text)
+		}
+
+		// split the optional weekdays and time window
+		days, window := "", parts[0]
+		if pos := strings.Index(window, "/"); pos >= 0 {
+			days, window = window[:pos], window[pos+1:]
+		} else if !strings.Contains(window, ":") {
+			days, window = window, ""
+		}
+		if days != "" {
+			rule.Days, err = parseDays(days)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid schedule rule: %s", text)
+			}
+		}
+		if window != "" {
+			rule.From, rule.To, err = parseTimeWindow(window)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid schedule rule: %s", text)
+			}
+		}
+
+		schedule = append(schedule, rule)
+	}
+
+	return schedule, nil
+}
+
+// parseDays parses a single weekday (Mon) or a range of weekdays (Mon-Fri).
+func parseDays(value string) (map[time.Weekday]bool, error) {
+	parts := strings.SplitN(strings.ToLower(value), "-", 2)
+	first, ok := weekdays[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("invalid weekday: %s", parts[0])
+	}
+	last := first
+	if len(parts) == 2 {
+		last, ok = weekdays[parts[1]]
+		if !ok {
+			return nil, fmt.Errorf("invalid weekday: %s", parts[1])
+		}
+	}
+
+	days := map[time.Weekday]bool{}
+	for day := first; ; day = (day + 1) % 7 {
+		days[day] = true
+		if day == last {
+			break
+		}
+	}
+	return days, nil
+}
+
+// parseTimeWindow parses a time window (HH:MM-HH:MM) in minutes since midnight.
+func parseTimeWindow(value string) (int, int, error) {
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid time window: %s", value)
+	}
+
+	var minutes [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", part)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid time: %s", part)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	return minutes[0], minutes[1], nil
+}
+
+// BandwidthLimiter limits the throughput with a token bucket. The limit
+// can change over time with a schedule.
+type BandwidthLimiter struct {
+	limit    int64
+	schedule Schedule
+	now      func() time.Time
+
+	mu      sync.Mutex
+	current int64
+	limiter *rate.Limiter
+}
+
+// NewBandwidthLimiter returns a limiter with the limit in bytes per second,
+// the rules of the schedule take precedence over the limit.
+func NewBandwidthLimiter(limit int64, schedule Schedule) *BandwidthLimiter {
+	bl := &BandwidthLimiter{limit: limit, schedule: schedule, now: time.Now}
+	bl.current = -1
+	return bl
+}
+
+// ParseBandwidthLimiter returns a limiter for the limit and schedule as
+// passed on the command line, nil is returned if both are empty.
+func ParseBandwidthLimiter(limit string, schedule string) (*BandwidthLimiter, error) {
+	if limit == "" && schedule == "" {
+		return nil, nil
+	}
+
+	bwlimit, err := ParseBandwidth(limit)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := ParseSchedule(schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBandwidthLimiter(bwlimit, rules), nil
+}
+
+// Limit returns the limit in bytes per second at the current time, 0 is unlimited.
+func (bl *BandwidthLimiter) Limit() int64 {
+	now := bl.now()
+	for _, rule := range bl.schedule {
+		if rule.Matches(now) {
+			return rule.Limit
+		}
+	}
+	return bl.limit
+}
+
+// bucket returns the token bucket of the current limit, nil if unlimited.
+func (bl *BandwidthLimiter) bucket() *rate.Limiter {
+	limit := bl.Limit()
+
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	if limit != bl.current {
+		bl.current = limit
+		if limit == 0 {
+			bl.limiter = nil
+		} else {
+			burst := int(limit)
+			if burst < minBandwidthBurst {
+				burst = minBandwidthBurst
+			}
+			bl.limiter = rate.NewLimiter(rate.Limit(limit), burst)
+		}
+	}
+
+	return bl.limiter
+}
+
+// WaitN blocks until n bytes can be transferred.
+func (bl *BandwidthLimiter) WaitN(ctx context.Context, n int) error {
+	for n > 0 {
+		limiter := bl.bucket()
+		if limiter == nil {
+			return nil
+		}
+
+		size := n
+		if size > limiter.Burst() {
+			size = limiter.Burst()
+		}
+		err := limiter.WaitN(ctx, size)
+		if err != nil {
+			return err
+		}
+		n -= size
+	}
+
+	return nil
+}
+
+// limitedReadCloser limits the throughput of the underlying reader.
+type limitedReadCloser struct {
+	io.ReadCloser
+	limiters []*BandwidthLimiter
+}
+
+// NewLimitedReadCloser returns a reader limited by all passed limiters,
+// nil limiters are ignored.
+func NewLimitedReadCloser(r io.ReadCloser, limiters ...*BandwidthLimiter) io.ReadCloser {
+	lr := &limitedReadCloser{ReadCloser: r}
+	for _, limiter := range limiters {
+		if limiter != nil {
+			lr.limiters = append(lr.limiters, limiter)
+		}
+	}
+	if len(lr.limiters) == 0 {
+		return r
+	}
+	return lr
+}
+
+func (lr *limitedReadCloser) Read(p []byte) (int, error) {
+	n, err := lr.ReadCloser.Read(p)
+	for _, limiter := range lr.limiters {
+		if werr := limiter.WaitN(context.Background(), n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// limitedResponseWriter limits the throughput of a http response.
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*BandwidthLimiter
+}
+
+func (lw *limitedResponseWriter) Write(p []byte) (int, error) {
+	for _, limiter := range lw.limiters {
+		err := limiter.WaitN(lw.ctx, len(p))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return lw.ResponseWriter.Write(p)
+}
+
+// bandwidthLimits contains the global limiter and the limiters of each client
+// (by ip address) of a server.
+type bandwidthLimits struct {
+	global    *BandwidthLimiter
+	perClient int64
+	mu        sync.Mutex
+	clients   map[string]*BandwidthLimiter
+	lastUsed  map[string]time.Time
+}
+
+// newBandwidthLimits returns the limits of a server, the throughput of each
+// client is limited to perClient bytes per second. Both limits are optional.
+func newBandwidthLimits(global *BandwidthLimiter, perClient int64) *bandwidthLimits {
+	return &bandwidthLimits{
+		global:    global,
+		perClient: perClient,
+		clients:   map[string]*BandwidthLimiter{},
+		lastUsed:  map[string]time.Time{},
+	}
+}
+
+// enabled returns true if any limit is set.
+func (bl *bandwidthLimits) enabled() bool {
+	return bl.global != nil || bl.perClient != 0
+}
+
+// limiters returns all limiters of the client with the remote address.
+func (bl *bandwidthLimits) limiters(remoteAddr string) []*BandwidthLimiter {
+	var limiters []*BandwidthLimiter
+	if client := bl.clientLimiter(remoteAddr); client != nil {
+		limiters = append(limiters, client)
+	}
+	if bl.global != nil {
+		limiters = append(limiters, bl.global)
+	}
+	return limiters
+}
+
+func (bl *bandwidthLimits) clientLimiter(remoteAddr string) *BandwidthLimiter {
+	if bl.perClient == 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	now := time.Now()
+	limiter, ok := bl.clients[host]
+	if !ok {
+		// forget idle clients, otherwise the map grows forever
+		for client, used := range bl.lastUsed {
+			if now.Sub(used) > clientLimiterIdle {
+				delete(bl.clients, client)
+				delete(bl.lastUsed, client)
+			}
+		}
+		limiter = NewBandwidthLimiter(bl.perClient, nil)
+		bl.clients[host] = limiter
+	}
+	bl.lastUsed[host] = now
+	return limiter
+}
+
+// middleware returns a mux middleware that limits the throughput of all
+// responses.
+func (bl *bandwidthLimits) middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !bl.enabled() {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lw := &limitedResponseWriter{ResponseWriter: w, ctx: r.Context(), limiters: bl.limiters(r.RemoteAddr)}
+			next.ServeHTTP(lw, r)
+		})
+	}
+}
+
+// BandwidthMiddleware returns a mux middleware that limits the throughput of
+// all responses to the global limit, and the throughput of each client (by
+// ip address) to perClient bytes per second.
+func BandwidthMiddleware(global *BandwidthLimiter, perClient int64) func(http.Handler) http.Handler {
+	return newBandwidthLimits(global, perClient).middleware()
+}
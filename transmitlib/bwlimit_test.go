@@ -0,0 +1,114 @@
+package transmitlib
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	testcases := map[string]int64{
+		"":     0,
+		"off":  0,
+		"0":    0,
+		"100":  100,
+		"500K": 500 * 1024,
+		"20M":  20 * 1024 * 1024,
+		"1.5m": 1536 * 1024,
+		"1G":   1024 * 1024 * 1024,
+	}
+	for value, expected := range testcases {
+		limit, err := ParseBandwidth(value)
+		if err != nil || limit != expected {
+			t.Errorf("Invalid bandwidth for %s: %d (%v)", value, limit, err)
+		}
+	}
+
+	for _, value := range []string{"M", "abc", "-5M", "10X"} {
+		if _, err := ParseBandwidth(value); err == nil {
+			t.Errorf("Invalid bandwidth accepted: %s", value)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	schedule, err := ParseSchedule("Mon-Fri/08:00-18:00=5M, Sat-Sun=off, 22:00-06:00=1M")
+	if err != nil {
+		t.Fatalf("Failed to parse schedule: %s", err.Error())
+	}
+
+	limiter := NewBandwidthLimiter(20*1024*1024, schedule)
+	testcases := []struct {
+		Time  string
+		Limit int64
+	}{
+		{Time: "2024-01-08 09:30", Limit: 5 * 1024 * 1024},  // monday
+		{Time: "2024-01-12 17:59", Limit: 5 * 1024 * 1024},  // friday
+		{Time: "2024-01-12 18:00", Limit: 20 * 1024 * 1024}, // friday evening
+		{Time: "2024-01-13 09:30", Limit: 0},                // saturday
+		{Time: "2024-01-09 23:00", Limit: 1024 * 1024},      // tuesday night
+		{Time: "2024-01-10 05:59", Limit: 1024 * 1024},      // wednesday morning
+	}
+	for _, tc := range testcases {
+		now, _ := time.Parse("2006-01-02 15:04", tc.Time)
+		limiter.now = func() time.Time { return now }
+		if limit := limiter.Limit(); limit != tc.Limit {
+			t.Errorf("Invalid limit at %s: %d != %d", tc.Time, limit, tc.Limit)
+		}
+	}
+
+	for _, value := range []string{"Mon-Fri/08:00-18:00", "Foo=5M", "08:00=5M", "Mon/25:00-26:00=1M"} {
+		if _, err := ParseSchedule(value); err == nil {
+			t.Errorf("Invalid schedule accepted: %s", value)
+		}
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	// the burst allows the first 64K immediately, the next 32K need half a second
+	limiter := NewBandwidthLimiter(64*1024, nil)
+	start := time.Now()
+	err := limiter.WaitN(context.Background(), 96*1024)
+	if err != nil {
+		t.Fatalf("Failed to wait: %s", err.Error())
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Bandwidth not limited: %s", elapsed)
+	}
+
+	// unlimited
+	limiter = NewBandwidthLimiter(0, nil)
+	start = time.Now()
+	limiter.WaitN(context.Background(), 1024*1024*1024)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Unlimited bandwidth limited: %s", elapsed)
+	}
+}
+
+func TestBandwidthMiddleware(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 96*1024)
+	handler := BandwidthMiddleware(nil, 64*1024)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to get data: %s", err.Error())
+	}
+	received, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if !bytes.Equal(received, data) {
+		t.Errorf("Invalid data received: %d bytes", len(received))
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Bandwidth not limited: %s", elapsed)
+	}
+}
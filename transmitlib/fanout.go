@@ -0,0 +1,336 @@
+package transmitlib
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/hasher"
+	"github.com/tsauter/transmit/structs"
+	"gopkg.in/cheggaaa/pb.v1"
+	"net/url"
+	"sync"
+)
+
+// TargetResult is the result of the copy to a single target file.
+type TargetResult struct {
+	Filename string
+	// the number of chunks written to the target
+	Chunks int
+	// the error of the copy, nil if the target was copied and verified
+	Err error
+}
+
+// fanoutTarget is a target file of a fan-out copy.
+type fanoutTarget struct {
+	*TargetResult
+	target *LocalFile
+}
+
+// fail marks the target as failed, the target is not used any more.
+func (ft *fanoutTarget) fail(err error) {
+	if ft.Err == nil {
+		ft.Err = err
+	}
+}
+
+// chunkReader reads the data of all passed chunks from the source and calls
+// fn for each chunk. The data passed to fn must match the hash of the chunk.
+type chunkReader func(chunks []structs.ChunkStream, fn func(frame ChunkFrame) error) error
+
+// CopyLocalToLocalTargets copy the sourcefile to all targetfiles, the source
+// is read only once. An error is returned if the source can not be read, the
+// results of the targets are returned otherwise.
+func CopyLocalToLocalTargets(sourcefile string, targetfiles []string, h *hasher.Hasher, chunksize int) ([]TargetResult, error) {
+	source, err := OpenLocalSource(sourcefile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open local source file")
+	}
+	defer source.Close()
+
+	Logger().Info("loading source cache", "file", sourcefile)
+	err = source.LoadCache()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to local cache for local source file")
+	}
+
+	read := func(chunks []structs.ChunkStream, fn func(frame ChunkFrame) error) error {
+		for _, chunkStream := range chunks {
+			filepos := int64(chunkStream.ChunkId * uint64(chunksize))
+			data, datalen, err := source.ReadChunkData(filepos)
+			if err != nil {
+				return errors.Wrap(err, "failed to read from source")
+			}
+			err = fn(ChunkFrame{ChunkId: chunkStream.ChunkId, Hash: chunkStream.Chunk.Hash, Data: data[:datalen]})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return copyToTargets(source, read, targetfiles, h, chunksize)
+}
+
+// CopyHttpToLocalTargets copy the file served by a remote http source to all
+// targetfiles, each chunk is requested only once. Like CopyHttpToLocal, the
+// copy is started again if the file is changed on the server.
+func CopyHttpToLocalTargets(baseurl string, targetfiles []string, h *hasher.Hasher, chunksize int, opts HttpOptions) ([]TargetResult, error) {
+	for attempt := 1; ; attempt++ {
+		results, err := copyHttpToLocalTargets(baseurl, targetfiles, h, chunksize, opts)
+		if err == nil || !errors.Is(err, ErrSourceChanged) || attempt > MaxSourceChanges {
+			return results, err
+		}
+		Logger().Warn("source file changed on the server, starting again", "attempt", attempt)
+	}
+}
+
+// copyHttpToLocalTargets copy a single version of the file served by a
+// remote http source to all targetfiles.
+func copyHttpToLocalTargets(baseurl string, targetfiles []string, h *hasher.Hasher, chunksize int, opts HttpOptions) ([]TargetResult, error) {
+	url, err := url.Parse(baseurl)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid url")
+	}
+
+	source, err := OpenHttpSource(url, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open local source file")
+	}
+	defer source.Close()
+
+	sourceinfo, err := source.GetFileInfo()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get file info for source file")
+	}
+	read := batchReader(source.ReadChunkDataBatch, sourceinfo.ChunkHashAlgorithm)
+
+	if opts.Peer.Enabled {
+		var stopPeers func()
+		read, stopPeers, err = startPeers(source, read, targetfiles[0], opts)
+		if err != nil {
+			return nil, err
+		}
+		defer stopPeers()
+	}
+
+	return copyToTargets(source, read, targetfiles, h, chunksize)
+}
+
+// batchReader returns a chunkReader requesting the chunks in batches with
+// readBatch. The data of each received chunk must match the expected hash,
+// hashed with the algorithm of the source.
+func batchReader(readBatch func(chunkIds []uint64, fn func(frame ChunkFrame) error) error, algorithm string) chunkReader {
+	return func(chunks []structs.ChunkStream, fn func(frame ChunkFrame) error) error {
+		h, err := newHasher(algorithm)
+		if err != nil {
+			return err
+		}
+
+		expected := make(map[uint64]string, len(chunks))
+		chunkIds := make([]uint64, 0, len(chunks))
+		for _, chunkStream := range chunks {
+			expected[chunkStream.ChunkId] = chunkStream.Chunk.Hash
+			chunkIds = append(chunkIds, chunkStream.ChunkId)
+		}
+
+		err = readBatch(chunkIds, func(frame ChunkFrame) error {
+			err := verifyChunkFrame(h, expected, frame)
+			if err != nil {
+				return err
+			}
+			return fn(frame)
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to read from source")
+		}
+		return nil
+	}
+}
+
+// copyToTargets copy the source to all targetfiles. The caches of all targets
+// are built concurrently, each chunk that is different in at least one target
+// is read once and written to all targets with a different chunk. A failed
+// target does not stop the copy to the other targets.
+func copyToTargets(source SourceFile, read chunkReader, targetfiles []string, h *hasher.Hasher, chunksize int) ([]TargetResult, error) {
+	sourceinfo, err := source.GetFileInfo()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get file info for source file")
+	}
+
+	results := make([]TargetResult, len(targetfiles))
+	targets := make([]*fanoutTarget, len(targetfiles))
+	for i, targetfile := range targetfiles {
+		results[i].Filename = targetfile
+		targets[i] = &fanoutTarget{TargetResult: &results[i]}
+	}
+
+	// the hasher builds the checksum of the whole file, every target
+	// requires its own hasher
+	algorithm := (*h).GetName()
+	Logger().Info("building target caches", "targets", len(targets))
+	var wg sync.WaitGroup
+	for _, ft := range targets {
+		wg.Add(1)
+		go func(ft *fanoutTarget) {
+			defer wg.Done()
+			ft.fail(openFanoutTarget(ft, algorithm, chunksize, sourceinfo.Filesize))
+		}(ft)
+	}
+	wg.Wait()
+	defer func() {
+		for _, ft := range targets {
+			if ft.target != nil {
+				ft.target.CloseAndRemove()
+			}
+		}
+	}()
+
+	// walk over the list of stored source chunks,
+	// compaire the chunk checksum with the checksum of each target
+	// collect all chunks with missmatching hashes in any target
+	Logger().Info("copying chunks", "source", sourceinfo.Filename, "size", sourceinfo.Filesize, "targets", len(targets))
+	var pending []structs.ChunkStream
+	writers := map[uint64][]*fanoutTarget{}
+	flush := func() error {
+		err := copyChunksToTargets(read, pending, writers, chunksize)
+		pending = pending[:0]
+		writers = map[uint64][]*fanoutTarget{}
+		return err
+	}
+
+	maxchunkno, chunkStreamChan, errChan := source.GetAllChunks()
+	percentBar := pb.StartNew(int(maxchunkno) + 1)
+	for chunkStream := range chunkStreamChan {
+		percentBar.Increment()
+
+		for _, ft := range targets {
+			if ft.Err != nil {
+				continue
+			}
+			dstchunk, err := ft.target.GetChunk(chunkStream.ChunkId)
+			if err != nil {
+				ft.fail(errors.Wrapf(err, "failed to get chunk from target: %d", chunkStream.ChunkId))
+				continue
+			}
+
+			// comparing both chunks, do nothing if both are equal
+			if chunkStream.Chunk.Hash == dstchunk.Hash {
+				continue
+			}
+			writers[chunkStream.ChunkId] = append(writers[chunkStream.ChunkId], ft)
+		}
+		if len(writers[chunkStream.ChunkId]) == 0 {
+			continue
+		}
+
+		pending = append(pending, chunkStream)
+		if len(pending) < DefaultBatchChunks {
+			continue
+		}
+		err = flush()
+		if err != nil {
+			// drain the channel, otherwise the cache stays blocked
+			for range chunkStreamChan {
+			}
+			return results, err
+		}
+	}
+	if err := <-errChan; err != nil {
+		return results, errors.Wrap(err, "failed to get chunks from source")
+	}
+	err = flush()
+	if err != nil {
+		return results, err
+	}
+	percentBar.FinishPrint("Finish.")
+
+	Logger().Info("validating checksums", "targets", len(targets))
+	for _, ft := range targets {
+		if ft.Err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(ft *fanoutTarget) {
+			defer wg.Done()
+			ft.fail(verifyTarget(ft.Filename, algorithm, sourceinfo.Checksum))
+		}(ft)
+	}
+	wg.Wait()
+
+	for _, ft := range targets {
+		if ft.Err != nil {
+			Logger().Error("failed to copy file", "target", ft.Filename, "error", ft.Err.Error())
+			continue
+		}
+		Logger().Info("file copied", "target", ft.Filename, "chunks", ft.Chunks)
+	}
+
+	return results, nil
+}
+
+// openFanoutTarget opens the target file, resizes it to the filesize and
+// builds the cache with a new hasher.
+func openFanoutTarget(ft *fanoutTarget, algorithm string, chunksize int, filesize int64) error {
+	h, err := newHasher(algorithm)
+	if err != nil {
+		return err
+	}
+
+	target, err := OpenOrCreateLocalTarget(ft.Filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to open target file")
+	}
+	target.quiet = true
+	ft.target = target
+
+	err = target.SetFilesize(filesize)
+	if err != nil {
+		return errors.Wrap(err, "unable to resize target file to new filesize")
+	}
+
+	err = target.BuildCache(&h, chunksize)
+	if err != nil {
+		return errors.Wrap(err, "failed to build cache for local target file")
+	}
+	return nil
+}
+
+// copyChunksToTargets reads the data of all chunks and writes each chunk to
+// the targets that require it. Only errors of the source are returned.
+func copyChunksToTargets(read chunkReader, chunks []structs.ChunkStream, writers map[uint64][]*fanoutTarget, chunksize int) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	return read(chunks, func(frame ChunkFrame) error {
+		filepos := int64(frame.ChunkId * uint64(chunksize))
+		for _, ft := range writers[frame.ChunkId] {
+			if ft.Err != nil {
+				continue
+			}
+			err := ft.target.WriteChunkData(filepos, frame.Data, len(frame.Data))
+			if err != nil {
+				ft.fail(errors.Wrap(err, "failed to write to target"))
+				continue
+			}
+			ft.Chunks++
+		}
+		return nil
+	})
+}
+
+// verifyTarget compares the checksum of the target file with the checksum
+// of the source.
+func verifyTarget(targetfile string, algorithm string, checksum string) error {
+	h, err := newHasher(algorithm)
+	if err != nil {
+		return err
+	}
+	tchecksum, err := h.HashFile(targetfile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to calculate checksum: %s", targetfile)
+	}
+	if checksum != tchecksum {
+		return fmt.Errorf("checksum is different: %s != %s", tchecksum, checksum)
+	}
+	return nil
+}
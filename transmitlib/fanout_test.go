@@ -0,0 +1,153 @@
+package transmitlib
+
+import (
+	"bytes"
+	"github.com/tsauter/transmit/hasher"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCopyLocalToLocalTargets(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	source.Close()
+	sourcefile := filepath.Join(tmpdir, "test2.txt")
+	original, _ := ioutil.ReadFile(sourcefile)
+
+	// a new target, a target with a single different chunk and a target
+	// that can not be created
+	modified := append([]byte{}, original...)
+	modified[0] = 'X'
+	ioutil.WriteFile(filepath.Join(tmpdir, "modified.txt"), modified, 0644)
+	targetfiles := []string{
+		filepath.Join(tmpdir, "new.txt"),
+		filepath.Join(tmpdir, "modified.txt"),
+		filepath.Join(tmpdir, "missing", "target.txt"),
+	}
+
+	var h hasher.Hasher = hasher.NewSHA1Hasher()
+	results, err := CopyLocalToLocalTargets(sourcefile, targetfiles, &h, 64)
+	if err != nil {
+		t.Fatalf("Failed to copy file: %s", err.Error())
+	}
+	if len(results) != 3 {
+		t.Fatalf("Invalid number of results: %d", len(results))
+	}
+
+	expected := []int{3, 1}
+	for i, result := range results[:2] {
+		if result.Err != nil {
+			t.Errorf("Failed to copy file to %s: %s", result.Filename, result.Err.Error())
+			continue
+		}
+		if result.Chunks != expected[i] {
+			t.Errorf("Invalid number of chunks written to %s: %d", result.Filename, result.Chunks)
+		}
+		data, _ := ioutil.ReadFile(result.Filename)
+		if !bytes.Equal(data, original) {
+			t.Errorf("Target file %s is different", result.Filename)
+		}
+	}
+	if results[2].Err == nil {
+		t.Errorf("Copy to an invalid target succeeded")
+	}
+}
+
+func TestCopyHttpToLocalTargets(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	original, _ := ioutil.ReadFile(filepath.Join(tmpdir, "test2.txt"))
+	handler, err := NewSourceHandler(source, ServerOptions{})
+	if err != nil {
+		source.Close()
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	defer handler.Close()
+
+	// every chunk must be requested only once
+	var mu sync.Mutex
+	requested := map[uint64]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/ReadChunksData") {
+			chunkIds, err := ParseChunkRanges(r.URL.Query().Get("chunks"), MaxBatchChunks)
+			if err != nil {
+				t.Errorf("Invalid chunks requested: %s", err.Error())
+			}
+			mu.Lock()
+			for _, id := range chunkIds {
+				requested[id]++
+			}
+			mu.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	targetfiles := []string{filepath.Join(tmpdir, "target1.txt"), filepath.Join(tmpdir, "target2.txt")}
+	var h hasher.Hasher = hasher.NewSHA1Hasher()
+	results, err := CopyHttpToLocalTargets(server.URL, targetfiles, &h, 64, HttpOptions{})
+	if err != nil {
+		t.Fatalf("Failed to copy file: %s", err.Error())
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			t.Errorf("Failed to copy file to %s: %s", result.Filename, result.Err.Error())
+		}
+		data, _ := ioutil.ReadFile(result.Filename)
+		if !bytes.Equal(data, original) {
+			t.Errorf("Target file %s is different", result.Filename)
+		}
+	}
+	if len(requested) != 3 {
+		t.Errorf("Invalid chunks requested: %v", requested)
+	}
+	for id, count := range requested {
+		if count != 1 {
+			t.Errorf("Chunk %d requested %d times", id, count)
+		}
+	}
+}
+
+func TestCopyHttpToLocalTargetsCorruptData(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	handler, err := NewSourceHandler(source, ServerOptions{})
+	if err != nil {
+		source.Close()
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	defer handler.Close()
+	server := newCorruptServer(handler)
+	defer server.Close()
+
+	targetfiles := []string{filepath.Join(tmpdir, "target1.txt")}
+	var h hasher.Hasher = hasher.NewSHA1Hasher()
+	results, err := CopyHttpToLocalTargets(server.URL, targetfiles, &h, 64, HttpOptions{Retries: -1})
+	if err == nil && results[0].Err != nil {
+		err = results[0].Err
+	}
+	if err == nil || !strings.Contains(err.Error(), "different data") {
+		t.Errorf("Expected error for corrupt chunk data, got %v", err)
+	}
+}
@@ -18,8 +18,9 @@ type SourceFile interface {
 	// This is not the real raw data from source file.
 	GetChunk(chunkNo uint64) (structs.Chunk, error)
 	// GetAllChunks return all available chunks form source database, the chunks are passed
-	// back through the pipe.
-	GetAllChunks() (int, chan structs.ChunkStream)
+	// back through the pipe. Errors are passed back through the error channel, this channel
+	// must be checked after the chunk channel was closed.
+	GetAllChunks() (int, chan structs.ChunkStream, chan error)
 	// ReadChunkData reads the raw data from source file (not the chunk) and return the data.
 	ReadChunkData(filepos int64) ([]byte, int, error)
 	// Close closes the source file and source cache database.
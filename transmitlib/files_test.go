@@ -105,7 +105,7 @@ func RegenerateFixtures() error {
 				return fmt.Errorf("Failed to write test file: %s", err.Error())
 			}
 
-			numOfChunks, chunkStreamChan := source.GetAllChunks()
+			numOfChunks, chunkStreamChan, errChan := source.GetAllChunks()
 			_, err = f.WriteString(fmt.Sprintf("Chunks: %d\n", numOfChunks))
 			if err != nil {
 				return fmt.Errorf("Failed to write test file: %s", err.Error())
@@ -116,6 +116,9 @@ func RegenerateFixtures() error {
 					return fmt.Errorf("Failed to write test file: %s", err.Error())
 				}
 			}
+			if err := <-errChan; err != nil {
+				return fmt.Errorf("Failed to get chunks from cache: %s", err.Error())
+			}
 
 			err = f.Sync()
 			if err != nil {
@@ -174,7 +177,7 @@ func TestLocalFileCacheGeneration(t *testing.T) {
 				return
 			}
 
-			numOfChunks, chunkStreamChan := source.GetAllChunks()
+			numOfChunks, chunkStreamChan, errChan := source.GetAllChunks()
 			_, err = f.WriteString(fmt.Sprintf("Chunks: %d\n", numOfChunks))
 			if err != nil {
 				t.Fatalf("[%s] Failed to write test file: %s", tc.filename, err.Error())
@@ -186,6 +189,9 @@ func TestLocalFileCacheGeneration(t *testing.T) {
 					return
 				}
 			}
+			if err := <-errChan; err != nil {
+				t.Fatalf("[%s] Failed to get chunks from cache: %s", tc.filename, err.Error())
+			}
 
 			err = f.Sync()
 			if err != nil {
@@ -0,0 +1,302 @@
+package transmitlib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/hasher"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGrpcMessages(t *testing.T) {
+	testcases := []struct {
+		Name    string
+		Message grpcMessage
+		Empty   grpcMessage
+	}{
+		{Name: "file info request", Message: &fileInfoRequest{Checksum: "253fe693"}, Empty: &fileInfoRequest{}},
+		{Name: "file info", Message: &fileInfoResponse{Filename: "test.bin", Filesize: 1 << 40, Checksum: "abc", HashAlgorithm: "SHA1", Chunksize: 1024}, Empty: &fileInfoResponse{}},
+		{Name: "chunk list request", Message: &chunkListRequest{Checksum: "abc", First: 7, Count: 1}, Empty: &chunkListRequest{}},
+		{Name: "chunk info", Message: &chunkInfo{ChunkId: 300, Hash: "def", Size: 64}, Empty: &chunkInfo{}},
+		{Name: "chunk data request", Message: &chunkDataRequest{Checksum: "abc", ChunkIds: []uint64{0, 1, 1 << 33}}, Empty: &chunkDataRequest{}},
+		{Name: "chunk data", Message: &chunkData{ChunkId: 2, Hash: "def", Data: []byte{0, 1, 2}}, Empty: &chunkData{}},
+	}
+
+	for _, tc := range testcases {
+		// unknown fields of newer versions are skipped
+		b := tc.Message.marshal()
+		b = protowire.AppendTag(b, 99, protowire.BytesType)
+		b = protowire.AppendString(b, "unknown")
+		b = protowire.AppendTag(b, 98, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+
+		err := tc.Empty.unmarshal(b)
+		if err != nil {
+			t.Errorf("[%s] Failed to decode message: %s", tc.Name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(tc.Message, tc.Empty) {
+			t.Errorf("[%s] Message is different: %+v != %+v", tc.Name, tc.Empty, tc.Message)
+		}
+	}
+
+	// repeated fields may be sent unpacked
+	var b []byte
+	for _, id := range []uint64{3, 5} {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, id)
+	}
+	var req chunkDataRequest
+	if err := req.unmarshal(b); err != nil || !reflect.DeepEqual(req.ChunkIds, []uint64{3, 5}) {
+		t.Errorf("Failed to decode unpacked chunk ids: %v, %v", req.ChunkIds, err)
+	}
+
+	if err := req.unmarshal([]byte{0x12, 0x05, 0x01}); err == nil {
+		t.Errorf("Expected error for truncated message, got none")
+	}
+}
+
+// startGrpcServer serves the source over grpc on a free port and returns the
+// url of the server and a function to stop it.
+func startGrpcServer(t *testing.T, source *LocalFile, opts ServerOptions) (string, func()) {
+	handler, err := NewSourceHandler(source, opts)
+	if err != nil {
+		source.Close()
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	server, err := NewGrpcServer(handler, opts)
+	if err != nil {
+		handler.Close()
+		t.Fatalf("Failed to create grpc server: %s", err.Error())
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		handler.Close()
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	go server.Serve(listener)
+
+	return "grpc://" + listener.Addr().String(), func() {
+		server.Stop()
+		handler.Close()
+	}
+}
+
+func TestCopyGrpcToLocal(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	original, _ := ioutil.ReadFile(filepath.Join(tmpdir, "test2.txt"))
+	fileinfo, _ := source.GetFileInfo()
+	baseurl, stop := startGrpcServer(t, source, ServerOptions{})
+	defer stop()
+
+	targetfiles := []string{filepath.Join(tmpdir, "target1.txt"), filepath.Join(tmpdir, "target2.txt")}
+	var h hasher.Hasher = hasher.NewSHA1Hasher()
+	results, err := CopyGrpcToLocal(baseurl, targetfiles, &h, 64, HttpOptions{Retries: -1})
+	if err != nil {
+		t.Fatalf("Failed to copy file: %s", err.Error())
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			t.Errorf("Failed to copy file to %s: %s", result.Filename, result.Err.Error())
+		}
+		data, _ := ioutil.ReadFile(result.Filename)
+		if !bytes.Equal(data, original) {
+			t.Errorf("Target file %s is different", result.Filename)
+		}
+	}
+
+	u, _ := url.Parse(baseurl)
+	gf, err := OpenGrpcSource(u, HttpOptions{Retries: -1, Checksum: fileinfo.Checksum[:8]})
+	if err != nil {
+		t.Fatalf("Failed to open grpc source: %s", err.Error())
+	}
+	defer gf.Close()
+
+	chunk, err := gf.GetChunk(1)
+	expected, _ := source.GetChunk(1)
+	if err != nil || chunk.Hash != expected.Hash {
+		t.Errorf("Invalid chunk: %v, %v", chunk, err)
+	}
+	if _, err := gf.GetChunk(100); err == nil {
+		t.Errorf("Expected error for missing chunk, got none")
+	}
+	data, datalen, err := gf.ReadChunkData(128)
+	if err != nil || !bytes.Equal(data[:datalen], original[128:]) {
+		t.Errorf("Invalid chunk data: %v", err)
+	}
+
+	// requests of a previous version are rejected
+	gf.fileinfo.Checksum = "previous"
+	err = gf.ReadChunkDataBatch([]uint64{0}, func(frame ChunkFrame) error {
+		return nil
+	})
+	if !errors.Is(err, ErrSourceChanged) {
+		t.Errorf("Expected changed source, got %v", err)
+	}
+
+	// unknown versions are not found
+	gf, err = OpenGrpcSource(u, HttpOptions{Retries: -1, Checksum: "ffff"})
+	if err != nil {
+		t.Fatalf("Failed to open grpc source: %s", err.Error())
+	}
+	defer gf.Close()
+	if _, err := gf.GetFileInfo(); err == nil || errors.Is(err, ErrSourceChanged) {
+		t.Errorf("Expected version not found, got %v", err)
+	}
+}
+
+func TestCopyGrpcAuthenticated(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	tokensfile := filepath.Join(tmpdir, "tokens")
+	err = ioutil.WriteFile(tokensfile, []byte("secret-token client1\n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write tokens: %s", err.Error())
+	}
+	tokens, err := NewTokenAuthenticator(tokensfile)
+	if err != nil {
+		t.Fatalf("Failed to load tokens: %s", err.Error())
+	}
+	baseurl, stop := startGrpcServer(t, source, ServerOptions{Authenticators: []Authenticator{tokens}})
+	defer stop()
+
+	testcases := []struct {
+		Name  string
+		Opts  HttpOptions
+		Valid bool
+	}{
+		{Name: "no credentials", Opts: HttpOptions{Retries: -1}, Valid: false},
+		{Name: "token", Opts: HttpOptions{Retries: -1, BearerToken: "secret-token"}, Valid: true},
+		{Name: "invalid token", Opts: HttpOptions{Retries: -1, BearerToken: "secret"}, Valid: false},
+	}
+
+	for _, tc := range testcases {
+		targetfile := filepath.Join(tmpdir, "target.txt")
+		var h hasher.Hasher = hasher.NewSHA1Hasher()
+		results, err := CopyGrpcToLocal(baseurl, []string{targetfile}, &h, 64, tc.Opts)
+		if err == nil && results[0].Err != nil {
+			err = results[0].Err
+		}
+		if tc.Valid && err != nil {
+			t.Errorf("[%s] Failed to copy file: %s", tc.Name, err.Error())
+		}
+		if !tc.Valid && err == nil {
+			t.Errorf("[%s] Expected error, got none", tc.Name)
+		}
+		os.Remove(targetfile)
+	}
+}
+
+func TestCopyGrpcLimitedWithMetrics(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// the burst of the limiter is used up, the responses are sent
+	// with 1000 bytes per second
+	limiter := NewBandwidthLimiter(1000, nil)
+	limiter.WaitN(context.Background(), minBandwidthBurst)
+	metrics := NewMetrics()
+	source := openTestSource(t, tmpdir, "test2.txt")
+	baseurl, stop := startGrpcServer(t, source, ServerOptions{BandwidthLimit: limiter, Metrics: metrics})
+	defer stop()
+
+	start := time.Now()
+	targetfile := filepath.Join(tmpdir, "target.txt")
+	var h hasher.Hasher = hasher.NewSHA1Hasher()
+	results, err := CopyGrpcToLocal(baseurl, []string{targetfile}, &h, 64, HttpOptions{Retries: -1})
+	if err == nil && results[0].Err != nil {
+		err = results[0].Err
+	}
+	if err != nil {
+		t.Fatalf("Failed to copy file: %s", err.Error())
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Bandwidth not limited: %s", elapsed)
+	}
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	expected := []string{
+		`transmit_http_requests_total{code="OK",route="/transmit.v1.Transmit/GetFileInfo"} 1`,
+		`transmit_http_requests_total{code="OK",route="/transmit.v1.Transmit/ReadChunks"} 1`,
+		`transmit_http_request_duration_seconds_count{route="/transmit.v1.Transmit/GetChunks"} 1`,
+		`transmit_http_response_bytes_total{route="/transmit.v1.Transmit/ReadChunks"}`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("Metric not found: %s", line)
+		}
+	}
+}
+
+func TestGrpcReadChunksConcurrent(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	baseurl, stop := startGrpcServer(t, source, ServerOptions{})
+	defer stop()
+
+	u, _ := url.Parse(baseurl)
+	gf, err := OpenGrpcSource(u, HttpOptions{Retries: -1})
+	if err != nil {
+		t.Fatalf("Failed to open grpc source: %s", err.Error())
+	}
+	defer gf.Close()
+	if _, err := gf.GetFileInfo(); err != nil {
+		t.Fatalf("Failed to get file info: %s", err.Error())
+	}
+
+	// all streams read from the same file, each chunk must contain its own data
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h := hasher.NewSHA1Hasher()
+			chunkIds := [][]uint64{{0, 1, 2}, {2, 0}, {1}}[i%3]
+			for n := 0; n < 100; n++ {
+				err := gf.ReadChunkDataBatch(chunkIds, func(frame ChunkFrame) error {
+					if h.HashChunk(frame.Data) != frame.Hash {
+						return fmt.Errorf("chunk %d contains different data", frame.ChunkId)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Errorf("Failed to read chunks: %s", err.Error())
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,303 @@
+package transmitlib
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of the gRPC service (transmit.proto), encoded with the
+// protobuf wire format. Unknown fields are skipped.
+
+// grpcMessage is a message of the gRPC service.
+type grpcMessage interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+// grpcCodec encodes the messages of the gRPC service, the encoding is
+// compatible with generated protobuf code.
+type grpcCodec struct{}
+
+// grpcEncodedMessage is a message that was already encoded.
+type grpcEncodedMessage []byte
+
+func (grpcCodec) Marshal(v interface{}) ([]byte, error) {
+	if b, ok := v.(grpcEncodedMessage); ok {
+		return b, nil
+	}
+	m, ok := v.(grpcMessage)
+	if !ok {
+		return nil, fmt.Errorf("unsupported grpc message: %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (grpcCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(grpcMessage)
+	if !ok {
+		return fmt.Errorf("unsupported grpc message: %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+func (grpcCodec) Name() string {
+	return "proto"
+}
+
+// fileInfoRequest is the request of GetFileInfo.
+type fileInfoRequest struct {
+	Checksum string
+}
+
+// fileInfoResponse is the file details returned by GetFileInfo.
+type fileInfoResponse struct {
+	Filename      string
+	Filesize      int64
+	Checksum      string
+	HashAlgorithm string
+	Chunksize     int64
+}
+
+// chunkListRequest is the request of GetChunks.
+type chunkListRequest struct {
+	Checksum string
+	First    uint64
+	Count    uint64
+}
+
+// chunkInfo is a chunk of the list streamed by GetChunks.
+type chunkInfo struct {
+	ChunkId uint64
+	Hash    string
+	Size    int64
+}
+
+// chunkDataRequest is a request sent to the ReadChunks stream.
+type chunkDataRequest struct {
+	Checksum string
+	ChunkIds []uint64
+}
+
+// chunkData is a chunk sent by the ReadChunks stream.
+type chunkData struct {
+	ChunkId uint64
+	Hash    string
+	Data    []byte
+}
+
+func (m *fileInfoRequest) marshal() []byte {
+	return appendString(nil, 1, m.Checksum)
+}
+
+func (m *fileInfoRequest) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool) {
+		if num == 1 {
+			return consumeString(typ, b, &m.Checksum)
+		}
+		return 0, false
+	})
+}
+
+func (m *fileInfoResponse) marshal() []byte {
+	b := appendString(nil, 1, m.Filename)
+	b = appendVarint(b, 2, uint64(m.Filesize))
+	b = appendString(b, 3, m.Checksum)
+	b = appendString(b, 4, m.HashAlgorithm)
+	return appendVarint(b, 5, uint64(m.Chunksize))
+}
+
+func (m *fileInfoResponse) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.Filename)
+		case 2:
+			return consumeInt64(typ, b, &m.Filesize)
+		case 3:
+			return consumeString(typ, b, &m.Checksum)
+		case 4:
+			return consumeString(typ, b, &m.HashAlgorithm)
+		case 5:
+			return consumeInt64(typ, b, &m.Chunksize)
+		}
+		return 0, false
+	})
+}
+
+func (m *chunkListRequest) marshal() []byte {
+	b := appendString(nil, 1, m.Checksum)
+	b = appendVarint(b, 2, m.First)
+	return appendVarint(b, 3, m.Count)
+}
+
+func (m *chunkListRequest) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.Checksum)
+		case 2:
+			return consumeVarint(typ, b, &m.First)
+		case 3:
+			return consumeVarint(typ, b, &m.Count)
+		}
+		return 0, false
+	})
+}
+
+func (m *chunkInfo) marshal() []byte {
+	b := appendVarint(nil, 1, m.ChunkId)
+	b = appendString(b, 2, m.Hash)
+	return appendVarint(b, 3, uint64(m.Size))
+}
+
+func (m *chunkInfo) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool) {
+		switch num {
+		case 1:
+			return consumeVarint(typ, b, &m.ChunkId)
+		case 2:
+			return consumeString(typ, b, &m.Hash)
+		case 3:
+			return consumeInt64(typ, b, &m.Size)
+		}
+		return 0, false
+	})
+}
+
+func (m *chunkDataRequest) marshal() []byte {
+	b := appendString(nil, 1, m.Checksum)
+	if len(m.ChunkIds) == 0 {
+		return b
+	}
+	// repeated scalars are packed in proto3
+	var packed []byte
+	for _, id := range m.ChunkIds {
+		packed = protowire.AppendVarint(packed, id)
+	}
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, packed)
+}
+
+func (m *chunkDataRequest) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool) {
+		switch {
+		case num == 1:
+			return consumeString(typ, b, &m.Checksum)
+		case num == 2 && typ == protowire.VarintType:
+			var id uint64
+			n, ok := consumeVarint(typ, b, &id)
+			m.ChunkIds = append(m.ChunkIds, id)
+			return n, ok
+		case num == 2 && typ == protowire.BytesType:
+			packed, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, true
+			}
+			for len(packed) > 0 {
+				id, l := protowire.ConsumeVarint(packed)
+				if l < 0 {
+					return l, true
+				}
+				m.ChunkIds = append(m.ChunkIds, id)
+				packed = packed[l:]
+			}
+			return n, true
+		}
+		return 0, false
+	})
+}
+
+func (m *chunkData) marshal() []byte {
+	b := appendVarint(nil, 1, m.ChunkId)
+	b = appendString(b, 2, m.Hash)
+	if len(m.Data) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	return protowire.AppendBytes(b, m.Data)
+}
+
+func (m *chunkData) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool) {
+		switch {
+		case num == 1:
+			return consumeVarint(typ, b, &m.ChunkId)
+		case num == 2:
+			return consumeString(typ, b, &m.Hash)
+		case num == 3 && typ == protowire.BytesType:
+			data, n := protowire.ConsumeBytes(b)
+			// the buffer of the message may be reused
+			m.Data = append([]byte{}, data...)
+			return n, true
+		}
+		return 0, false
+	})
+}
+
+// appendString appends the field, empty strings are left out.
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendVarint appends the field, zero values are left out.
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// consumeFields calls fn with the value of each field of the message. fn
+// returns the length of the consumed value (negative on errors) and false for
+// unknown fields, which are skipped.
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) (int, bool)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n, ok := fn(num, typ, b)
+		if !ok {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeString(typ protowire.Type, b []byte, v *string) (int, bool) {
+	if typ != protowire.BytesType {
+		return 0, false
+	}
+	s, n := protowire.ConsumeString(b)
+	*v = s
+	return n, true
+}
+
+func consumeVarint(typ protowire.Type, b []byte, v *uint64) (int, bool) {
+	if typ != protowire.VarintType {
+		return 0, false
+	}
+	x, n := protowire.ConsumeVarint(b)
+	*v = x
+	return n, true
+}
+
+func consumeInt64(typ protowire.Type, b []byte, v *int64) (int, bool) {
+	var x uint64
+	n, ok := consumeVarint(typ, b, &x)
+	if ok {
+		*v = int64(x)
+	}
+	return n, ok
+}
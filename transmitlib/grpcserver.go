@@ -0,0 +1,438 @@
+package transmitlib
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// GrpcServiceName is the name of the gRPC service, see transmit.proto.
+const GrpcServiceName = "transmit.v1.Transmit"
+
+// grpcChunkCountHeader is the header of GetChunks with the number of chunks.
+const grpcChunkCountHeader = "chunk-count"
+
+// grpcTransmitServer is implemented by the gRPC service.
+type grpcTransmitServer interface {
+	GetFileInfo(ctx context.Context, req *fileInfoRequest) (*fileInfoResponse, error)
+	GetChunks(req *chunkListRequest, stream grpc.ServerStream) error
+	ReadChunks(stream grpc.ServerStream) error
+}
+
+// grpcServiceDesc describes the gRPC service, like the code generated from
+// transmit.proto.
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: GrpcServiceName,
+	HandlerType: (*grpcTransmitServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetFileInfo",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(fileInfoRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return srv.(grpcTransmitServer).GetFileInfo(ctx, req)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + GrpcServiceName + "/GetFileInfo"}
+				return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(grpcTransmitServer).GetFileInfo(ctx, req.(*fileInfoRequest))
+				})
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GetChunks",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := new(chunkListRequest)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(grpcTransmitServer).GetChunks(req, stream)
+			},
+		},
+		{
+			StreamName:    "ReadChunks",
+			ServerStreams: true,
+			ClientStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(grpcTransmitServer).ReadChunks(stream)
+			},
+		},
+	},
+	Metadata: "transmit.proto",
+}
+
+// grpcService serves the versions of the source handler over gRPC.
+type grpcService struct {
+	sh             *SourceHandler
+	authenticators []Authenticator
+	metrics        *Metrics
+}
+
+// NewGrpcServer returns a gRPC server serving the file of the handler, the
+// same versions are served as over http. Requests are checked by the
+// authenticators of the options, the server uses tls if a certificate is set.
+// The responses share the bandwidth limits of the handler, the requests are
+// recorded in the metrics of the options.
+func NewGrpcServer(handler *SourceHandler, opts ServerOptions) (*grpc.Server, error) {
+	gs := &grpcService{sh: handler, authenticators: opts.Authenticators, metrics: opts.Metrics}
+
+	serverOpts := []grpc.ServerOption{
+		grpc.ForceServerCodec(grpcCodec{}),
+		grpc.UnaryInterceptor(gs.unaryInterceptor),
+		grpc.StreamInterceptor(gs.streamInterceptor),
+	}
+	if opts.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load tls certificate")
+		}
+		tlsconfig, err := newServerTLSConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		if tlsconfig == nil {
+			tlsconfig = &tls.Config{}
+		}
+		tlsconfig.Certificates = []tls.Certificate{cert}
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(tlsconfig)))
+	}
+
+	server := grpc.NewServer(serverOpts...)
+	server.RegisterService(&grpcServiceDesc, gs)
+	return server, nil
+}
+
+// grpcServerStream replaces the context of a stream, limits the throughput
+// of the sent messages and counts their size.
+type grpcServerStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	limiters []*BandwidthLimiter
+	bytes    int
+}
+
+func (s *grpcServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *grpcServerStream) SendMsg(m interface{}) error {
+	// the message is encoded only once, the size is required before sending
+	b, err := grpcCodec{}.Marshal(m)
+	if err != nil {
+		return err
+	}
+	for _, limiter := range s.limiters {
+		if err := limiter.WaitN(s.ctx, len(b)); err != nil {
+			return status.FromContextError(err).Err()
+		}
+	}
+
+	err = s.ServerStream.SendMsg(grpcEncodedMessage(b))
+	if err == nil {
+		s.bytes += len(b)
+	}
+	return err
+}
+
+func (gs *grpcService) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	ctx, err := gs.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		gs.record(info.FullMethod, err, start, 0)
+		return nil, err
+	}
+
+	resp, err := handler(ctx, req)
+	size := 0
+	if m, ok := resp.(grpcMessage); ok && err == nil {
+		// the file info is small, it is not limited and encoded twice
+		size = len(m.marshal())
+	}
+	gs.record(info.FullMethod, err, start, size)
+	return resp, err
+}
+
+func (gs *grpcService) streamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, err := gs.authenticate(stream.Context(), info.FullMethod)
+	if err != nil {
+		gs.record(info.FullMethod, err, start, 0)
+		return err
+	}
+
+	s := &grpcServerStream{ServerStream: stream, ctx: ctx, limiters: gs.sh.bandwidth.limiters(grpcRemoteAddr(ctx))}
+	err = handler(srv, s)
+	gs.record(info.FullMethod, err, start, s.bytes)
+	return err
+}
+
+// record adds the finished request to the metrics, the route label is the
+// full method name.
+func (gs *grpcService) record(method string, err error, start time.Time, bytes int) {
+	code := status.Code(err)
+	gs.metrics.Request(method, code.String(), time.Since(start), bytes)
+	switch code {
+	case codes.Internal, codes.Unknown, codes.DataLoss:
+		gs.metrics.Error(method)
+	}
+}
+
+// grpcRemoteAddr returns the address of the client of the request.
+func grpcRemoteAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// authenticate checks the credentials of the request with the authenticators
+// and adds the request logger to the context.
+func (gs *grpcService) authenticate(ctx context.Context, method string) (context.Context, error) {
+	r := grpcHttpRequest(ctx)
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = newRequestID()
+	}
+	l := Logger().With("request_id", id, "remote", r.RemoteAddr, "path", method)
+	ctx = context.WithValue(ctx, requestLoggerKey{}, l)
+
+	if len(gs.authenticators) == 0 {
+		return ctx, nil
+	}
+	var reasons []string
+	for _, auth := range gs.authenticators {
+		_, err := auth.Authenticate(r)
+		if err == nil {
+			return ctx, nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+	l.Warn("unauthorized request", "reasons", strings.Join(reasons, ", "))
+	return nil, status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+// grpcHttpRequest returns a http request with the metadata of the gRPC
+// request as headers and the tls state of the connection, the authenticators
+// of the http server check this request.
+func grpcHttpRequest(ctx context.Context) *http.Request {
+	r := &http.Request{Header: http.Header{}, URL: &url.URL{}, RemoteAddr: grpcRemoteAddr(ctx)}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state := info.State
+			r.TLS = &state
+		}
+	}
+	return r.WithContext(ctx)
+}
+
+// grpcLogger returns the logger of the request, including the request id.
+func grpcLogger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(requestLoggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return Logger()
+}
+
+// acquire returns the version with the checksum, the current version if the
+// checksum is empty. The caller must call active.Done when it is finished.
+func (gs *grpcService) acquire(checksum string) (*sourceVersion, error) {
+	v, ok := gs.sh.acquireVersion(checksum)
+	if !ok {
+		return nil, status.Error(codes.FailedPrecondition, ErrSourceChanged.Error())
+	}
+
+	// the data of the file does not match the cache until the new cache
+	// is complete, clients retry the request
+	if atomic.LoadInt32(&v.stale) == 1 {
+		v.active.Done()
+		return nil, status.Error(codes.Unavailable, "source file is being reloaded")
+	}
+	return v, nil
+}
+
+// resolve returns the checksum of the current or stored version starting
+// with the prefix.
+func (gs *grpcService) resolve(prefix string) (string, error) {
+	v := gs.sh.acquire()
+	checksums := []string{v.id}
+	v.active.Done()
+	if gs.sh.snapshots != nil {
+		for _, snapshot := range gs.sh.snapshots.List() {
+			if snapshot.Checksum != checksums[0] {
+				checksums = append(checksums, snapshot.Checksum)
+			}
+		}
+	}
+
+	var matches []string
+	for _, checksum := range checksums {
+		if strings.HasPrefix(checksum, strings.ToLower(prefix)) {
+			matches = append(matches, checksum)
+		}
+	}
+	if len(matches) == 0 {
+		return "", status.Errorf(codes.NotFound, "version not found: %s", prefix)
+	}
+	if len(matches) > 1 {
+		return "", status.Errorf(codes.InvalidArgument, "checksum matches %d versions: %s", len(matches), prefix)
+	}
+	return matches[0], nil
+}
+
+// GetFileInfo returns the file info of the current version, or of the
+// selected version.
+func (gs *grpcService) GetFileInfo(ctx context.Context, req *fileInfoRequest) (*fileInfoResponse, error) {
+	checksum := req.Checksum
+	if checksum != "" {
+		var err error
+		checksum, err = gs.resolve(checksum)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	v, err := gs.acquire(checksum)
+	if err != nil {
+		return nil, err
+	}
+	defer v.active.Done()
+
+	grpcLogger(ctx).Debug("sending file info", "fileinfo", v.fileinfo)
+	return &fileInfoResponse{
+		Filename:      v.fileinfo.Filename,
+		Filesize:      v.fileinfo.Filesize,
+		Checksum:      v.fileinfo.Checksum,
+		HashAlgorithm: v.fileinfo.ChunkHashAlgorithm,
+		Chunksize:     int64(v.fileinfo.Chunksize),
+	}, nil
+}
+
+// GetChunks streams the chunks of the requested range.
+func (gs *grpcService) GetChunks(req *chunkListRequest, stream grpc.ServerStream) error {
+	v, err := gs.acquire(req.Checksum)
+	if err != nil {
+		return err
+	}
+	defer v.active.Done()
+	l := grpcLogger(stream.Context())
+
+	// a range is read from the cache chunk by chunk
+	if req.Count > 0 {
+		l.Debug("sending chunks", "first", req.First, "count", req.Count)
+		for chunkno := req.First; chunkno < req.First+req.Count; chunkno++ {
+			chunk, err := v.source.GetChunk(chunkno)
+			gs.metrics.CacheLookup(err == nil)
+			if err != nil {
+				return status.Errorf(codes.NotFound, "chunk not found: %d", chunkno)
+			}
+			err = stream.SendMsg(&chunkInfo{ChunkId: chunkno, Hash: chunk.Hash, Size: int64(chunk.Size)})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	numberOfChunks, chunkStreamChan, errChan := v.source.GetAllChunks()
+	l.Debug("sending all chunks", "chunks", numberOfChunks)
+	stream.SetHeader(metadata.Pairs(grpcChunkCountHeader, strconv.Itoa(numberOfChunks)))
+	var sendErr error
+	for chunkStream := range chunkStreamChan {
+		// continue reading the channel after an error, otherwise
+		// the cache would be blocked
+		if sendErr != nil || chunkStream.ChunkId < req.First {
+			continue
+		}
+		sendErr = stream.SendMsg(&chunkInfo{ChunkId: chunkStream.ChunkId, Hash: chunkStream.Chunk.Hash, Size: int64(chunkStream.Chunk.Size)})
+	}
+	if err := <-errChan; err != nil {
+		l.Error("failed to read chunks", "error", err.Error())
+		return status.Error(codes.Internal, "failed to read chunks")
+	}
+	if sendErr != nil {
+		l.Error("failed to send chunks", "error", sendErr.Error())
+		return sendErr
+	}
+	return nil
+}
+
+// ReadChunks sends the data of the chunks of all requests received on the
+// stream, until the client closes the stream.
+func (gs *grpcService) ReadChunks(stream grpc.ServerStream) error {
+	for {
+		req := new(chunkDataRequest)
+		err := stream.RecvMsg(req)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(req.ChunkIds) > MaxBatchChunks {
+			return status.Errorf(codes.InvalidArgument, "too many chunks requested: %d > %d", len(req.ChunkIds), MaxBatchChunks)
+		}
+
+		err = gs.sendChunkData(stream, req)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sendChunkData sends the data of the requested chunks in the order of
+// the request.
+func (gs *grpcService) sendChunkData(stream grpc.ServerStream, req *chunkDataRequest) error {
+	v, err := gs.acquire(req.Checksum)
+	if err != nil {
+		return err
+	}
+	defer v.active.Done()
+	l := grpcLogger(stream.Context())
+
+	l.Debug("sending chunk data", "chunks", len(req.ChunkIds))
+	for _, chunkno := range req.ChunkIds {
+		chunk, err := v.source.GetChunk(chunkno)
+		gs.metrics.CacheLookup(err == nil)
+		if err != nil {
+			return status.Errorf(codes.NotFound, "chunk not found: %d", chunkno)
+		}
+
+		filepos := int64(chunkno * uint64(v.fileinfo.Chunksize))
+		data, datalen, err := v.source.ReadChunkData(filepos)
+		if err != nil {
+			l.Error("failed to read chunk data", "chunk", chunkno, "error", err.Error())
+			return status.Error(codes.Internal, "failed to read chunk data")
+		}
+
+		err = stream.SendMsg(&chunkData{ChunkId: chunkno, Hash: chunk.Hash, Data: data[:datalen]})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,397 @@
+package transmitlib
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/hasher"
+	"github.com/tsauter/transmit/structs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MaxGrpcMessageSize is the maximum size of a message received from a gRPC
+// server, a message contains the data of a single chunk.
+const MaxGrpcMessageSize = 64 << 20
+
+// GrpcFile is a source file served by the gRPC service of a http source.
+// All requests are served by the version of the first file info.
+type GrpcFile struct {
+	conn *grpc.ClientConn
+	opts HttpOptions
+	// the file info of the selected version
+	mu       sync.Mutex
+	fileinfo *structs.FileData
+}
+
+// OpenGrpcSource opens the source file served by a remote gRPC server, with
+// tls for grpcs urls. The http options are used for the tls configuration,
+// the credentials, the retries and the version; signed caches, bandwidth
+// limits and peers are not supported.
+func OpenGrpcSource(u *url.URL, opts HttpOptions) (*GrpcFile, error) {
+	if opts.TrustedKey != nil {
+		return nil, fmt.Errorf("signed caches are not supported by grpc sources")
+	}
+	if opts.BandwidthLimit != nil {
+		return nil, fmt.Errorf("bandwidth limits are not supported by grpc sources")
+	}
+	if opts.Peer.Enabled {
+		return nil, fmt.Errorf("peers are not supported by grpc sources")
+	}
+	if opts.Version != "" && opts.Version != "latest" {
+		return nil, fmt.Errorf("grpc sources select the version by checksum only")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultRequestTimeout
+	}
+
+	var creds credentials.TransportCredentials
+	switch u.Scheme {
+	case "grpcs":
+		tlsconfig, err := newClientTLSConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(tlsconfig)
+	case "grpc":
+		creds = insecure.NewCredentials()
+	default:
+		return nil, fmt.Errorf("unsupported grpc url: %s", u.String())
+	}
+
+	dialOpts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(grpcCodec{}), grpc.MaxCallRecvMsgSize(MaxGrpcMessageSize)),
+	}
+	if config := grpcServiceConfig(opts); config != "" {
+		dialOpts = append(dialOpts, grpc.WithDefaultServiceConfig(config))
+	}
+	conn, err := grpc.NewClient(u.Host, dialOpts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to grpc server")
+	}
+
+	return &GrpcFile{conn: conn, opts: opts}, nil
+}
+
+// grpcServiceConfig returns the service config retrying unavailable requests
+// with an exponential backoff, empty if retries are disabled. gRPC limits
+// the attempts to 5.
+func grpcServiceConfig(opts HttpOptions) string {
+	retries := opts.Retries
+	if retries == 0 {
+		retries = DefaultRetries
+	}
+	if retries < 0 {
+		return ""
+	}
+	backoff := opts.RetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+
+	return fmt.Sprintf(`{"methodConfig":[{"name":[{"service":%q}],"retryPolicy":{"maxAttempts":%d,"initialBackoff":"%.3fs","maxBackoff":"30s","backoffMultiplier":2,"retryableStatusCodes":["UNAVAILABLE"]}}]}`,
+		GrpcServiceName, retries+1, backoff.Seconds())
+}
+
+// IsGrpcSource returns true if the source is served by a remote gRPC server
+// (grpc:// or grpcs:// with tls).
+func IsGrpcSource(source string) bool {
+	return strings.HasPrefix(source, "grpc://") || strings.HasPrefix(source, "grpcs://")
+}
+
+// grpcError returns ErrSourceChanged if the version is not served any more,
+// all other errors are wrapped with the message.
+func grpcError(err error, message string) error {
+	if status.Code(err) == codes.FailedPrecondition {
+		return errors.Wrap(ErrSourceChanged, message)
+	}
+	return errors.Wrap(err, message)
+}
+
+// context returns the context of a request with the credentials of the options.
+func (gf *GrpcFile) context(ctx context.Context) context.Context {
+	if gf.opts.BearerToken != "" {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+gf.opts.BearerToken)
+	}
+	if gf.opts.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(gf.opts.Username + ":" + gf.opts.Password))
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Basic "+credentials)
+	}
+	return ctx
+}
+
+// LoadCache loads the chunk cache database for the local file.
+func (gf *GrpcFile) LoadCache() error {
+	// loading a remote cache is not necessary
+	return nil
+}
+
+// BuildCache regnerates the complete chunk database by rereading the whole file.
+func (gf *GrpcFile) BuildCache(h *hasher.Hasher, chunksize int) error {
+	return fmt.Errorf("remote building of cache is not possible")
+}
+
+// GetFileInfo returns the file info of the selected version, the version is
+// selected by the first request.
+func (gf *GrpcFile) GetFileInfo() (structs.FileData, error) {
+	gf.mu.Lock()
+	defer gf.mu.Unlock()
+	if gf.fileinfo != nil {
+		return *gf.fileinfo, nil
+	}
+
+	ctx, cancel := context.WithTimeout(gf.context(context.Background()), gf.opts.Timeout)
+	defer cancel()
+	resp := new(fileInfoResponse)
+	err := gf.conn.Invoke(ctx, "/"+GrpcServiceName+"/GetFileInfo", &fileInfoRequest{Checksum: gf.opts.Checksum}, resp)
+	if err != nil {
+		return structs.FileData{}, grpcError(err, "failed to get file info from remote server")
+	}
+
+	gf.fileinfo = &structs.FileData{
+		Filename:           resp.Filename,
+		Filesize:           resp.Filesize,
+		Checksum:           resp.Checksum,
+		ChunkHashAlgorithm: resp.HashAlgorithm,
+		Chunksize:          int(resp.Chunksize),
+	}
+	if gf.opts.Checksum != "" {
+		Logger().Info("selected version", "checksum", resp.Checksum)
+	}
+	return *gf.fileinfo, nil
+}
+
+// openChunkList requests the chunks of the range from the server, all chunks
+// if count is zero.
+func (gf *GrpcFile) openChunkList(ctx context.Context, first uint64, count uint64) (grpc.ClientStream, error) {
+	fileinfo, err := gf.GetFileInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := gf.conn.NewStream(gf.context(ctx), &grpcServiceDesc.Streams[0], "/"+GrpcServiceName+"/GetChunks")
+	if err != nil {
+		return nil, grpcError(err, "failed to read chunks from remote server")
+	}
+	err = stream.SendMsg(&chunkListRequest{Checksum: fileinfo.Checksum, First: first, Count: count})
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	if err != nil {
+		return nil, grpcError(err, "failed to read chunks from remote server")
+	}
+	return stream, nil
+}
+
+// GetChunk returns the specified chunk details from the remote server.
+func (gf *GrpcFile) GetChunk(chunkNo uint64) (structs.Chunk, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gf.opts.Timeout)
+	defer cancel()
+	stream, err := gf.openChunkList(ctx, chunkNo, 1)
+	if err != nil {
+		return structs.Chunk{}, err
+	}
+
+	chunk := new(chunkInfo)
+	err = stream.RecvMsg(chunk)
+	if err != nil {
+		return structs.Chunk{}, grpcError(err, "failed to get chunk from remote server")
+	}
+	return structs.NewChunk(chunk.Hash, int(chunk.Size)), nil
+}
+
+// GetAllChunks returns all chunks of the remote server, the chunks are passed
+// back through the pipe. Errors are passed back through the error channel,
+// this channel must be checked after the chunk channel was closed.
+func (gf *GrpcFile) GetAllChunks() (int, chan structs.ChunkStream, chan error) {
+	chunkStreamChan := make(chan structs.ChunkStream, 1)
+	errChan := make(chan error, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := gf.openChunkList(ctx, 0, 0)
+	var header metadata.MD
+	if err == nil {
+		header, err = stream.Header()
+		if err != nil {
+			err = grpcError(err, "failed to read chunks from remote server")
+		}
+	}
+	if err != nil {
+		cancel()
+		errChan <- err
+		close(chunkStreamChan)
+		close(errChan)
+		return 0, chunkStreamChan, errChan
+	}
+
+	numberOfChunks := -1
+	if values := header.Get(grpcChunkCountHeader); len(values) > 0 {
+		numberOfChunks, err = strconv.Atoi(values[0])
+		if err != nil {
+			numberOfChunks = -1
+		}
+	}
+
+	go func() {
+		defer cancel()
+		defer close(errChan)
+		defer close(chunkStreamChan)
+
+		received := 0
+		for {
+			chunk := new(chunkInfo)
+			err := stream.RecvMsg(chunk)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				errChan <- grpcError(err, "failed to read chunks from remote server")
+				return
+			}
+
+			chunkStreamChan <- structs.ChunkStream{ChunkId: chunk.ChunkId, Chunk: structs.NewChunk(chunk.Hash, int(chunk.Size))}
+			received++
+		}
+
+		if numberOfChunks >= 0 && received != numberOfChunks {
+			errChan <- fmt.Errorf("incomplete chunk list: received %d of %d chunks", received, numberOfChunks)
+		}
+	}()
+
+	if numberOfChunks < 0 {
+		numberOfChunks = 0
+	}
+	return numberOfChunks, chunkStreamChan, errChan
+}
+
+// ReadChunkData reads the raw data of the chunk at the file position.
+func (gf *GrpcFile) ReadChunkData(filepos int64) ([]byte, int, error) {
+	fileinfo, err := gf.GetFileInfo()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var data []byte
+	chunkno := uint64(filepos) / uint64(fileinfo.Chunksize)
+	err = gf.ReadChunkDataBatch([]uint64{chunkno}, func(frame ChunkFrame) error {
+		data = frame.Data
+		return nil
+	})
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to read remote chunk data")
+	}
+	return data, len(data), nil
+}
+
+// ReadChunkDataBatch requests the data of all chunks on a single stream and
+// calls fn for each chunk, in the order of the chunk ids. The requests are
+// sent while the chunks are received, errors returned by fn abort the stream.
+func (gf *GrpcFile) ReadChunkDataBatch(chunkIds []uint64, fn func(frame ChunkFrame) error) error {
+	if len(chunkIds) == 0 {
+		return nil
+	}
+	fileinfo, err := gf.GetFileInfo()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(gf.context(context.Background()))
+	defer cancel()
+	stream, err := gf.conn.NewStream(ctx, &grpcServiceDesc.Streams[1], "/"+GrpcServiceName+"/ReadChunks")
+	if err != nil {
+		return grpcError(err, "failed to read chunk data from remote server")
+	}
+
+	// send errors are reported by RecvMsg
+	go func() {
+		for start := 0; start < len(chunkIds); start += MaxBatchChunks {
+			end := start + MaxBatchChunks
+			if end > len(chunkIds) {
+				end = len(chunkIds)
+			}
+			err := stream.SendMsg(&chunkDataRequest{Checksum: fileinfo.Checksum, ChunkIds: chunkIds[start:end]})
+			if err != nil {
+				return
+			}
+		}
+		stream.CloseSend()
+	}()
+
+	for i, chunkno := range chunkIds {
+		chunk := new(chunkData)
+		err := stream.RecvMsg(chunk)
+		if err == io.EOF {
+			return errors.Wrapf(ErrIncompleteBatch, "received %d of %d chunks", i, len(chunkIds))
+		}
+		if err != nil {
+			return grpcError(err, "failed to read chunk data from remote server")
+		}
+		if chunk.ChunkId != chunkno {
+			return fmt.Errorf("received unexpected chunk from source: %d", chunk.ChunkId)
+		}
+
+		err = fn(ChunkFrame{ChunkId: chunk.ChunkId, Hash: chunk.Hash, Data: chunk.Data})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = stream.RecvMsg(new(chunkData))
+	if err == nil {
+		return fmt.Errorf("received more chunks than requested")
+	}
+	if err != io.EOF {
+		return grpcError(err, "failed to read chunk data from remote server")
+	}
+	return nil
+}
+
+// Close closes the connection to the remote server.
+func (gf *GrpcFile) Close() error {
+	return gf.conn.Close()
+}
+
+// CopyGrpcToLocal copy the file served by a remote gRPC source to all
+// targetfiles. Like CopyHttpToLocal, the copy is started again if the file is
+// changed on the server.
+func CopyGrpcToLocal(baseurl string, targetfiles []string, h *hasher.Hasher, chunksize int, opts HttpOptions) ([]TargetResult, error) {
+	for attempt := 1; ; attempt++ {
+		results, err := copyGrpcToLocal(baseurl, targetfiles, h, chunksize, opts)
+		if err == nil || !errors.Is(err, ErrSourceChanged) || attempt > MaxSourceChanges {
+			return results, err
+		}
+		Logger().Warn("source file changed on the server, starting again", "attempt", attempt)
+	}
+}
+
+// copyGrpcToLocal copy a single version of the file served by a remote
+// gRPC source to all targetfiles.
+func copyGrpcToLocal(baseurl string, targetfiles []string, h *hasher.Hasher, chunksize int, opts HttpOptions) ([]TargetResult, error) {
+	url, err := url.Parse(baseurl)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid url")
+	}
+
+	source, err := OpenGrpcSource(url, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open grpc source")
+	}
+	defer source.Close()
+
+	sourceinfo, err := source.GetFileInfo()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get file info for source file")
+	}
+	return copyToTargets(source, batchReader(source.ReadChunkDataBatch, sourceinfo.ChunkHashAlgorithm), targetfiles, h, chunksize)
+}
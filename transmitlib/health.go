@@ -0,0 +1,52 @@
+package transmitlib
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// SetShuttingDown marks the server as shutting down, the readiness check
+// fails from now on.
+func (sh *SourceHandler) SetShuttingDown() {
+	atomic.StoreInt32(&sh.shuttingDown, 1)
+}
+
+// Ready returns an error if the server should not receive new requests:
+// the server is shutting down, a signed file was modified, or the cache
+// is not loaded or not valid.
+// If the file is watched, a cache of a replaced file is valid until the
+// new cache is complete.
+func (sh *SourceHandler) Ready() error {
+	if atomic.LoadInt32(&sh.shuttingDown) == 1 {
+		return fmt.Errorf("server is shutting down")
+	}
+	if atomic.LoadInt32(&sh.unsignedReload) == 1 {
+		return fmt.Errorf("signed source file was modified, the new file is not signed")
+	}
+
+	v := sh.acquire()
+	defer v.active.Done()
+	if atomic.LoadInt32(&v.stale) == 1 {
+		return fmt.Errorf("source file is being reloaded")
+	}
+	if atomic.LoadInt32(&sh.watching) == 1 {
+		return nil
+	}
+	return v.source.CheckCache()
+}
+
+// healthz reports that the server is running.
+func (sh *SourceHandler) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "ok\n")
+}
+
+// readyz reports whether the server is ready to serve the file.
+func (sh *SourceHandler) readyz(w http.ResponseWriter, r *http.Request) {
+	err := sh.Ready()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "ok\n")
+}
@@ -0,0 +1,155 @@
+package transmitlib
+
+import (
+	"bytes"
+	"context"
+	"github.com/tsauter/transmit/hasher"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	defer source.Close()
+
+	// the health endpoints do not require authentication
+	tokensfile := filepath.Join(tmpdir, "tokens")
+	ioutil.WriteFile(tokensfile, []byte("secret-token\n"), 0600)
+	tokens, err := NewTokenAuthenticator(tokensfile)
+	if err != nil {
+		t.Fatalf("Failed to load tokens: %s", err.Error())
+	}
+
+	handler, err := NewSourceHandler(source, ServerOptions{Authenticators: []Authenticator{tokens}})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+
+	status := func(path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	if code := status("/healthz"); code != http.StatusOK {
+		t.Errorf("Invalid status of healthz: %d", code)
+	}
+	if code := status("/readyz"); code != http.StatusOK {
+		t.Errorf("Invalid status of readyz: %d", code)
+	}
+	if code := status("/GetFileInfo"); code != http.StatusUnauthorized {
+		t.Errorf("Unauthenticated request accepted: %d", code)
+	}
+
+	// the cache does not match the modified file
+	err = ioutil.WriteFile(filepath.Join(tmpdir, "test2.txt"), []byte("modified"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to modify file: %s", err.Error())
+	}
+	if code := status("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Stale cache reported as ready: %d", code)
+	}
+	if code := status("/healthz"); code != http.StatusOK {
+		t.Errorf("Invalid status of healthz: %d", code)
+	}
+
+	handler.SetShuttingDown()
+	if err := handler.Ready(); err == nil {
+		t.Errorf("Server reported as ready during shutdown")
+	}
+}
+
+func TestServeFileOverHttpShutdown(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	sourcefile := filepath.Join(tmpdir, "source.bin")
+	err = ioutil.WriteFile(sourcefile, bytes.Repeat([]byte("0123456789abcdef"), 8*1024), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write test file: %s", err.Error())
+	}
+	var h hasher.Hasher = hasher.NewSHA1Hasher()
+	source, err := OpenLocalSource(sourcefile)
+	if err != nil {
+		t.Fatalf("Failed to open test file: %s", err.Error())
+	}
+	err = source.BuildCache(&h, 1024)
+	source.Close()
+	if err != nil {
+		t.Fatalf("Failed to build cache: %s", err.Error())
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find free port: %s", err.Error())
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	// the limit delays the response, the transfer is still active on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := ServerOptions{BandwidthLimit: NewBandwidthLimiter(64*1024, nil)}
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeFileOverHttp(ctx, address, sourcefile, opts)
+	}()
+
+	// wait until the server is ready
+	ready := false
+	for i := 0; i < 50 && !ready; i++ {
+		resp, err := http.Get("http://" + address + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+			ready = resp.StatusCode == http.StatusOK
+		}
+		if !ready {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	if !ready {
+		cancel()
+		t.Fatalf("Server not ready")
+	}
+
+	transferred := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + address + "/ReadChunksData?chunks=0-127")
+		if err != nil {
+			transferred <- -1
+			return
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		transferred <- len(data)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+
+	if n := <-transferred; n < 128*1024 {
+		t.Errorf("Active transfer aborted on shutdown: %d bytes received", n)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Failed to shut down: %s", err.Error())
+	}
+
+	// no new requests are accepted
+	if _, err := http.Get("http://" + address + "/healthz"); err == nil {
+		t.Errorf("Request accepted after shutdown")
+	}
+}
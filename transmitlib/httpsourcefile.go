@@ -1,41 +1,218 @@
 package transmitlib
 
 import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/tsauter/transmit/hasher"
+	"github.com/tsauter/transmit/manifest"
 	"github.com/tsauter/transmit/structs"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// HttpOptions contains the client side options for remote http sources.
+type HttpOptions struct {
+	// The format used to transfer the chunk list, manifest.FormatBinary (default)
+	// or manifest.FormatJSON (for debugging).
+	ManifestFormat string
+	// If set, the file info and chunk list must be signed with this key.
+	// The signature is verified before any chunk is returned.
+	TrustedKey ed25519.PublicKey
+	// A PEM file with the certificates of all trusted certificate authorities
+	// for https sources. The system certificates are used if empty.
+	CAFile string
+	// Accept any certificate of https sources, for testing only.
+	InsecureSkipVerify bool
+	// The client certificate and key files (PEM) presented to https sources.
+	ClientCertFile string
+	ClientKeyFile  string
+	// The bearer token sent with every request.
+	BearerToken string
+	// The http basic auth credentials sent with every request.
+	Username string
+	Password string
+	// The time to wait for the response of a single request,
+	// DefaultRequestTimeout if zero.
+	Timeout time.Duration
+	// The number of retries of a failed request, DefaultRetries if zero.
+	// Negative values disable retries.
+	Retries int
+	// The delay before the first retry, DefaultRetryBackoff if zero.
+	RetryBackoff time.Duration
+	// The number of retries of all requests, DefaultErrorBudget if zero.
+	// Negative values disable the limit.
+	ErrorBudget int
+	// Limits the throughput of all responses, unlimited if nil.
+	BandwidthLimit *BandwidthLimiter
+	// The version (number of a snapshot) of the file on the server,
+	// the current version if empty or "latest". "latest" is ignored if a
+	// checksum is set.
+	Version string
+	// The checksum (or a unique prefix) of the selected version of the file.
+	Checksum string
+	// The exchange of chunks with other clients, the source must track
+	// the peers.
+	Peer PeerOptions
+}
+
 // HttpFile is the internal representation of the HttpFile
 type HttpFile struct {
 	// the filename of the file
 	baseUrl    *url.URL
 	httpclient *http.Client
+	// the client options
+	opts HttpOptions
+	// the verified file info and chunk list, only used with a trusted key
+	verified bool
+	fileinfo structs.FileData
+	chunks   []structs.ChunkStream
+	// the number of retries during this transfer
+	mu       sync.Mutex
+	failures int
+	// the version of the file on the server (ETag), all requests must
+	// be served by the same version
+	version string
+	// the path of the selected version, empty for the current version
+	prefix string
+	// the chunk size of the file, the data of received chunk frames
+	// must not be larger
+	chunksize int
 }
 
-// OpenLocalHttpSource opens the soure file in the local filesystem.
+// OpenHttpSource opens the source file served by a remote http or https server.
 // A HttpFile struct is returned.
-func OpenHttpSource(url *url.URL) (*HttpFile, error) {
-	hf := HttpFile{baseUrl: url}
+func OpenHttpSource(url *url.URL, opts HttpOptions) (*HttpFile, error) {
+	hf := HttpFile{baseUrl: url, opts: opts}
+
+	switch opts.ManifestFormat {
+	case "", manifest.FormatBinary, manifest.FormatJSON:
+	default:
+		return nil, fmt.Errorf("unsupported manifest format: %s", opts.ManifestFormat)
+	}
+
+	tlsconfig, err := newClientTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if hf.opts.Timeout <= 0 {
+		hf.opts.Timeout = DefaultRequestTimeout
+	}
 
 	tr := &http.Transport{
-		MaxIdleConns:       10,
-		IdleConnTimeout:    30 * time.Second,
-		DisableCompression: false, //TODO:???
+		DialContext:           (&net.Dialer{Timeout: hf.opts.Timeout}).DialContext,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+		TLSHandshakeTimeout:   hf.opts.Timeout,
+		ResponseHeaderTimeout: hf.opts.Timeout,
+		DisableCompression:    false, //TODO:???
+		TLSClientConfig:       tlsconfig,
 	}
 
 	hf.httpclient = &http.Client{Transport: tr}
 
+	if (opts.Version != "" && opts.Version != "latest") || opts.Checksum != "" {
+		err := hf.selectVersion()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &hf, nil
 }
 
+// GetVersions returns all versions of the file stored on the remote server.
+func (hf *HttpFile) GetVersions() ([]Snapshot, error) {
+	content, err := hf.FetchRemoteBytes("GetVersions")
+	if err != nil {
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("remote server does not serve versions")
+		}
+		return nil, errors.Wrap(err, "failed to get versions from remote server")
+	}
+
+	var versions []Snapshot
+	err = json.Unmarshal(content, &versions)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read versions from remote server")
+	}
+
+	return versions, nil
+}
+
+// AnnouncePeer registers the address of the local peer server with the
+// tracker of the remote server, the address is optional. The addresses of
+// other peers serving the same version of the file are returned.
+func (hf *HttpFile) AnnouncePeer(address string) ([]string, error) {
+	content, err := hf.FetchRemoteBytes("AnnouncePeer?address=" + url.QueryEscape(address))
+	if err != nil {
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("remote server does not track peers")
+		}
+		return nil, errors.Wrap(err, "failed to announce peer to remote server")
+	}
+
+	var peers []string
+	err = json.Unmarshal(content, &peers)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read peers from remote server")
+	}
+
+	return peers, nil
+}
+
+// selectVersion selects the version of the options, all further requests
+// are served by this version.
+func (hf *HttpFile) selectVersion() error {
+	versions, err := hf.GetVersions()
+	if err != nil {
+		return err
+	}
+
+	// latest is the default version, a checksum selects older versions too
+	latest := hf.opts.Version == "latest" && hf.opts.Checksum == ""
+
+	var matches []Snapshot
+	for _, v := range versions {
+		if hf.opts.Version != "" && hf.opts.Version != "latest" && hf.opts.Version != strconv.Itoa(v.Version) {
+			continue
+		}
+		if latest && !v.Current {
+			continue
+		}
+		if !strings.HasPrefix(v.Checksum, strings.ToLower(hf.opts.Checksum)) {
+			continue
+		}
+		matches = append(matches, v)
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("version not found on remote server: version %q, checksum %q", hf.opts.Version, hf.opts.Checksum)
+	}
+	if len(matches) > 1 {
+		return fmt.Errorf("checksum matches %d versions: %s", len(matches), hf.opts.Checksum)
+	}
+
+	Logger().Info("selected version", "version", matches[0].Version, "checksum", matches[0].Checksum, "created", matches[0].Created)
+	hf.prefix = "versions/" + matches[0].Checksum + "/"
+	hf.version = strconv.Quote(matches[0].Checksum)
+	return nil
+}
+
 // LoadCache loads the chunk cache database for the local file.
 func (hf *HttpFile) LoadCache() error {
 	// loading a remote cache is not necessary
@@ -49,8 +226,26 @@ func (hf *HttpFile) BuildCache(h *hasher.Hasher, chunksize int) error {
 }
 
 // GetFileInfo return the previously stored filedata from the cache database.
+// With a trusted key, the file info is only returned after the signature
+// was verified.
 func (hf *HttpFile) GetFileInfo() (structs.FileData, error) {
+	if hf.opts.TrustedKey != nil {
+		err := hf.verify()
+		if err != nil {
+			return structs.FileData{}, err
+		}
+		return hf.fileinfo, nil
+	}
+
+	return hf.fetchFileInfo()
+}
+
+// fetchFileInfo reads the file info from the remote server.
+func (hf *HttpFile) fetchFileInfo() (structs.FileData, error) {
 	content, err := hf.FetchRemoteBytes("GetFileInfo")
+	if err != nil {
+		return structs.FileData{}, errors.Wrap(err, "failed to get file info from remote server")
+	}
 
 	var data structs.FileData
 	err = json.Unmarshal(content, &data)
@@ -58,40 +253,242 @@ func (hf *HttpFile) GetFileInfo() (structs.FileData, error) {
 		return structs.FileData{}, errors.Wrap(err, "failed to read file info from remote server")
 	}
 
+	hf.mu.Lock()
+	hf.chunksize = data.Chunksize
+	hf.mu.Unlock()
+
 	return data, nil
 }
 
-// Close closes the cache database and the open file handle.
+// getChunksize returns the chunk size of the file, the file info is only
+// requested if it was not received before.
+func (hf *HttpFile) getChunksize() (int, error) {
+	hf.mu.Lock()
+	chunksize := hf.chunksize
+	hf.mu.Unlock()
+	if chunksize > 0 {
+		return chunksize, nil
+	}
+
+	fileinfo, err := hf.GetFileInfo()
+	if err != nil {
+		return 0, err
+	}
+	return fileinfo.Chunksize, nil
+}
+
+// Close closes the idle connections to the remote server.
 func (hf *HttpFile) Close() error {
-	// nothing to close for remote connections
+	hf.httpclient.CloseIdleConnections()
+	return nil
+}
+
+// GetSignature reads the signature of the file info and chunk list from
+// the remote server. ErrNotSigned is returned if the source is not signed.
+func (hf *HttpFile) GetSignature() (manifest.Signature, error) {
+	var signature manifest.Signature
+
+	content, err := hf.FetchRemoteBytes("GetSignature")
+	if err != nil {
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return signature, ErrNotSigned
+		}
+		return signature, errors.Wrap(err, "failed to get signature from remote server")
+	}
+
+	err = json.Unmarshal(content, &signature)
+	if err != nil {
+		return signature, errors.Wrap(err, "failed to read signature from remote server")
+	}
+
+	return signature, nil
+}
+
+// verify downloads the file info, the chunk list and the signature and
+// verifies the signature with the trusted key. The verified data is kept
+// in memory, the download is done only once.
+func (hf *HttpFile) verify() error {
+	if hf.verified {
+		return nil
+	}
+
+	signature, err := hf.GetSignature()
+	if err != nil {
+		return err
+	}
+
+	fileinfo, err := hf.fetchFileInfo()
+	if err != nil {
+		return err
+	}
+
+	var chunks []structs.ChunkStream
+	var plain []structs.Chunk
+	var orderErr error
+	_, chunkStreamChan, errChan := hf.fetchAllChunks()
+	for chunkStream := range chunkStreamChan {
+		if chunkStream.ChunkId != uint64(len(chunks)) && orderErr == nil {
+			orderErr = fmt.Errorf("chunk %d is missing", len(chunks))
+		}
+		chunks = append(chunks, chunkStream)
+		plain = append(plain, chunkStream.Chunk)
+	}
+	if err := <-errChan; err != nil {
+		return err
+	}
+	if orderErr != nil {
+		return orderErr
+	}
+
+	digest, err := manifest.Digest(fileinfo, plain)
+	if err != nil {
+		return errors.Wrap(err, "failed to calculate manifest digest")
+	}
+	err = signature.Verify(hf.opts.TrustedKey, digest)
+	if err != nil {
+		return err
+	}
+
+	hf.fileinfo = fileinfo
+	hf.chunks = chunks
+	hf.verified = true
+
 	return nil
 }
 
 // GetAllChunks return all available chunks form database, the chunks are passed
-// back through the pipe.
-func (hf *HttpFile) GetAllChunks() (int, chan structs.ChunkStream) {
+// back through the pipe. Errors are passed back through the error channel, this
+// channel must be checked after the chunk channel was closed.
+// With a trusted key, the chunks are only returned after the signature
+// was verified.
+func (hf *HttpFile) GetAllChunks() (int, chan structs.ChunkStream, chan error) {
+	if hf.opts.TrustedKey == nil {
+		return hf.fetchAllChunks()
+	}
+
 	chunkStreamChan := make(chan structs.ChunkStream, 1)
+	errChan := make(chan error, 1)
 
-	content, err := hf.FetchRemoteBytes("GetAllChunks")
+	err := hf.verify()
+	if err != nil {
+		errChan <- err
+		close(chunkStreamChan)
+		close(errChan)
+		return 0, chunkStreamChan, errChan
+	}
 
-	var data []structs.ChunkStream
-	err = json.Unmarshal(content, &data)
+	go func() {
+		defer close(errChan)
+		defer close(chunkStreamChan)
+
+		for _, chunkStream := range hf.chunks {
+			chunkStreamChan <- chunkStream
+		}
+	}()
+
+	return len(hf.chunks), chunkStreamChan, errChan
+}
+
+// fetchAllChunks streams the chunk list from the remote server, either in the
+// binary manifest format or as newline delimited json. The chunks are decoded
+// incrementally and passed back through the pipe.
+func (hf *HttpFile) fetchAllChunks() (int, chan structs.ChunkStream, chan error) {
+	chunkStreamChan := make(chan structs.ChunkStream, 1)
+	errChan := make(chan error, 1)
+
+	accept := manifest.ContentType
+	if hf.opts.ManifestFormat == manifest.FormatJSON {
+		accept = "application/x-ndjson"
+	}
+
+	resp, err := hf.FetchRemoteStream("GetAllChunks", accept)
 	if err != nil {
+		errChan <- errors.Wrap(err, "failed to read chunks from remote server")
 		close(chunkStreamChan)
-		panic(err)
-		return 0, chunkStreamChan // TODO: how can we transmit errors here?
+		close(errChan)
+		return 0, chunkStreamChan, errChan
+	}
+
+	if resp.Header.Get("Content-Type") == manifest.ContentType {
+		return hf.readManifestChunks(resp, chunkStreamChan, errChan)
+	}
+
+	// the number of chunks is optional, without the header the
+	// completeness of the list can not be verified
+	numberOfChunks := -1
+	if resp.Header.Get("X-ChunkCount") != "" {
+		numberOfChunks, err = strconv.Atoi(resp.Header.Get("X-ChunkCount"))
+		if err != nil {
+			numberOfChunks = -1
+		}
 	}
-	numberOfChunks := len(data)
 
 	go func() {
-		for _, stream := range data {
-			chunkStreamChan <- stream
+		defer resp.Body.Close()
+		defer close(errChan)
+		defer close(chunkStreamChan)
+
+		received := 0
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var chunkStream structs.ChunkStream
+			err := decoder.Decode(&chunkStream)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				errChan <- errors.Wrap(err, "failed to decode chunk from remote server")
+				return
+			}
+
+			chunkStreamChan <- chunkStream
+			received++
+		}
+
+		if numberOfChunks >= 0 && received != numberOfChunks {
+			errChan <- fmt.Errorf("incomplete chunk list: received %d of %d chunks", received, numberOfChunks)
 		}
+	}()
 
+	if numberOfChunks < 0 {
+		numberOfChunks = 0
+	}
+	return numberOfChunks, chunkStreamChan, errChan
+}
+
+// readManifestChunks decodes a chunk list in the binary manifest format and
+// passes the chunks back through the pipe.
+func (hf *HttpFile) readManifestChunks(resp *http.Response, chunkStreamChan chan structs.ChunkStream, errChan chan error) (int, chan structs.ChunkStream, chan error) {
+	mr, err := manifest.NewReader(bufio.NewReader(resp.Body))
+	if err != nil {
+		resp.Body.Close()
+		errChan <- errors.Wrap(err, "failed to decode chunks from remote server")
 		close(chunkStreamChan)
+		close(errChan)
+		return 0, chunkStreamChan, errChan
+	}
+
+	go func() {
+		defer resp.Body.Close()
+		defer close(errChan)
+		defer close(chunkStreamChan)
+
+		for {
+			chunkStream, err := mr.ReadChunk()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				errChan <- errors.Wrap(err, "failed to decode chunk from remote server")
+				return
+			}
+
+			chunkStreamChan <- chunkStream
+		}
 	}()
 
-	return numberOfChunks, chunkStreamChan
+	return int(mr.GetChunksCount()), chunkStreamChan, errChan
 }
 
 // ReadChunkData reads the raw data from file (not the chunk) and return the data.
@@ -107,7 +504,21 @@ func (hf *HttpFile) ReadChunkData(filepos int64) ([]byte, int, error) {
 // GetChunk return the specified chunk details from database.
 // This is not the real raw data from file.
 func (hf *HttpFile) GetChunk(chunkNo uint64) (structs.Chunk, error) {
+	if hf.opts.TrustedKey != nil {
+		err := hf.verify()
+		if err != nil {
+			return structs.Chunk{}, err
+		}
+		if chunkNo >= uint64(len(hf.chunks)) {
+			return structs.Chunk{}, fmt.Errorf("chunk %d not found", chunkNo)
+		}
+		return hf.chunks[chunkNo].Chunk, nil
+	}
+
 	content, err := hf.FetchRemoteBytes(fmt.Sprintf("GetChunk/%d", chunkNo))
+	if err != nil {
+		return structs.Chunk{}, errors.Wrap(err, "failed to get chunk from remote server")
+	}
 
 	var data structs.Chunk
 	err = json.Unmarshal(content, &data)
@@ -118,32 +529,254 @@ func (hf *HttpFile) GetChunk(chunkNo uint64) (structs.Chunk, error) {
 	return data, nil
 }
 
+// ErrIncompleteBatch is returned by ReadChunkDataBatch if the response does
+// not contain all requested chunks.
+var ErrIncompleteBatch = errors.New("incomplete batch response")
+
+// ReadChunkDataBatch requests the raw data of all passed chunks with a single
+// request. Consecutive chunk ids are grouped into ranges. The server streams back
+// one frame per chunk, each frame is passed to fn as soon as it is received.
+func (hf *HttpFile) ReadChunkDataBatch(chunkIds []uint64, fn func(frame ChunkFrame) error) error {
+	if len(chunkIds) == 0 {
+		return nil
+	}
+
+	chunksize, err := hf.getChunksize()
+	if err != nil {
+		return err
+	}
+
+	// an interrupted response is resumed by requesting only the
+	// chunks that were not received yet
+	pending := chunkIds
+	received := map[uint64]bool{}
+	var fnErr error
+	err = hf.retry("ReadChunksData", func() error {
+		ranges := FormatChunkRanges(GroupChunkRanges(pending))
+		resp, err := hf.doRequest(context.Background(), "ReadChunksData?chunks="+url.QueryEscape(ranges), "")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		// the response can not be larger than the frames of all chunks
+		body := io.LimitReader(resp.Body, int64(len(pending))*int64(chunksize+frameOverhead))
+		for {
+			frame, err := ReadChunkFrame(body, chunksize)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				pending = missingChunks(pending, received)
+				return errors.Wrap(err, "failed to read remote chunk data")
+			}
+			if received[frame.ChunkId] {
+				continue
+			}
+
+			// errors of fn are never retried
+			fnErr = fn(frame)
+			if fnErr != nil {
+				return nil
+			}
+			received[frame.ChunkId] = true
+		}
+
+		pending = missingChunks(pending, received)
+		if len(pending) > 0 {
+			return errors.Wrapf(ErrIncompleteBatch, "received %d of %d chunks", len(received), len(chunkIds))
+		}
+		return nil
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+
+	return err
+}
+
+// missingChunks returns all chunk ids that were not received.
+func missingChunks(chunkIds []uint64, received map[uint64]bool) []uint64 {
+	var missing []uint64
+	for _, chunkId := range chunkIds {
+		if !received[chunkId] {
+			missing = append(missing, chunkId)
+		}
+	}
+	return missing
+}
+
 func (hf *HttpFile) BuildRequestUrl(method string) string {
-	return hf.baseUrl.String() + "/" + method
+	return hf.baseUrl.String() + "/" + hf.prefix + method
 }
 
-func (hf *HttpFile) FetchRemoteBytes(method string) ([]byte, error) {
-	resp, err := hf.httpclient.Get(hf.BuildRequestUrl(method))
+// newRequest returns a new GET request for the method, including the
+// credentials of the client options.
+func (hf *HttpFile) newRequest(method string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", hf.BuildRequestUrl(method), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+
+	if hf.opts.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+hf.opts.BearerToken)
+	} else if hf.opts.Username != "" {
+		req.SetBasicAuth(hf.opts.Username, hf.opts.Password)
+	}
+
+	hf.mu.Lock()
+	if hf.version != "" {
+		req.Header.Set("If-Match", hf.version)
+	}
+	hf.mu.Unlock()
+
+	return req, nil
+}
+
+// FetchRemoteStream sends the request to the remote server and returns the
+// response without reading the body. The caller must close the response body.
+// The accept parameter is optional and specifies the requested content type.
+// Failed requests are retried until the response headers are received.
+func (hf *HttpFile) FetchRemoteStream(method string, accept string) (*http.Response, error) {
+	var resp *http.Response
+	err := hf.retry(method, func() error {
+		var err error
+		resp, err = hf.doRequest(context.Background(), method, accept)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// doRequest sends a single request to the remote server, a StatusError is
+// returned for all responses except 200. ErrSourceChanged is returned if the
+// response is from a different version of the file than the previous responses.
+// The request is aborted if no data of the body is received within the timeout.
+func (hf *HttpFile) doRequest(ctx context.Context, method string, accept string) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	resp, err := hf.sendRequest(ctx, method, accept)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = NewLimitedReadCloser(newIdleTimeoutBody(resp.Body, hf.opts.Timeout, cancel), hf.opts.BandwidthLimit)
+	return resp, nil
+}
+
+// sendRequest sends the request of doRequest and checks the response.
+func (hf *HttpFile) sendRequest(ctx context.Context, method string, accept string) (*http.Response, error) {
+	req, err := hf.newRequest(method)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := hf.httpclient.Do(req)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get data from remote server")
 	}
-	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		resp.Body.Close()
+		return nil, ErrSourceChanged
+	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("failed to query remote size: %d: %s", resp.StatusCode, resp.Request.URL.String())
+		resp.Body.Close()
+		return nil, &StatusError{StatusCode: resp.StatusCode, URL: resp.Request.URL.String()}
 	}
 
-	content, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to read data from remote server")
+	// the first response selects the version of the file
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		hf.mu.Lock()
+		if hf.version == "" {
+			hf.version = etag
+		}
+		changed := hf.version != etag
+		hf.mu.Unlock()
+		if changed {
+			resp.Body.Close()
+			return nil, ErrSourceChanged
+		}
 	}
 
-	if resp.Header.Get("X-Chunklength") != "" {
-		length, err := strconv.Atoi(resp.Header.Get("X-Chunklength"))
-		if err == nil {
-			content = content[:length]
+	return resp, nil
+}
+
+// FetchRemoteBytes sends the request to the remote server and returns the
+// complete response body. Failed requests are retried, including failures
+// while reading the body.
+func (hf *HttpFile) FetchRemoteBytes(method string) ([]byte, error) {
+	var content []byte
+	err := hf.retry(method, func() error {
+		// the body must be read within the request timeout
+		ctx, cancel := context.WithTimeout(context.Background(), hf.opts.Timeout)
+		defer cancel()
+
+		resp, err := hf.doRequest(ctx, method, "")
+		if err != nil {
+			return err
 		}
+		defer resp.Body.Close()
+
+		content, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return errors.Wrap(err, "failed to read data from remote server")
+		}
+
+		if resp.Header.Get("X-Chunklength") != "" {
+			length, err := strconv.Atoi(resp.Header.Get("X-Chunklength"))
+			if err == nil && length <= len(content) {
+				content = content[:length]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return content, nil
 }
+
+// newClientTLSConfig returns the tls configuration for https sources.
+func newClientTLSConfig(opts HttpOptions) (*tls.Config, error) {
+	tlsconfig := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read ca bundle")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca bundle: %s", opts.CAFile)
+		}
+		tlsconfig.RootCAs = pool
+	}
+
+	if (opts.ClientCertFile == "") != (opts.ClientKeyFile == "") {
+		return nil, fmt.Errorf("client certificate and key must be specified together")
+	}
+	if opts.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		tlsconfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsconfig, nil
+}
+
+// IsRemoteSource returns true if the source is served by a remote http
+// or https server.
+func IsRemoteSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
@@ -0,0 +1,257 @@
+package transmitlib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/tsauter/transmit/manifest"
+	"github.com/tsauter/transmit/structs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	httpTestChunks = []structs.ChunkStream{
+		{ChunkId: 0, Chunk: structs.Chunk{Hash: "ef654c40ab4f1747fc699915d4f70902", Size: 2}},
+		{ChunkId: 1, Chunk: structs.Chunk{Hash: "0e65de7114f9d086a6176fdda0f86e9f", Size: 2}},
+		{ChunkId: 2, Chunk: structs.Chunk{Hash: "4c7b3fc3288e5f9b49138198cc6a8426", Size: 1}},
+	}
+)
+
+// openTestHttpSource starts a test server with the passed handler and returns
+// a HttpFile connected to this server.
+func openTestHttpSource(t *testing.T, opts HttpOptions, handler http.HandlerFunc) (*HttpFile, *httptest.Server) {
+	server := httptest.NewServer(handler)
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		server.Close()
+		t.Fatalf("Failed to parse test server url: %s", err.Error())
+	}
+
+	source, err := OpenHttpSource(u, opts)
+	if err != nil {
+		server.Close()
+		t.Fatalf("Failed to open http source: %s", err.Error())
+	}
+
+	return source, server
+}
+
+func TestHttpGetAllChunks(t *testing.T) {
+	source, server := openTestHttpSource(t, HttpOptions{ManifestFormat: manifest.FormatJSON}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-ChunkCount", fmt.Sprintf("%d", len(httpTestChunks)))
+		encoder := json.NewEncoder(w)
+		for _, chunkStream := range httpTestChunks {
+			encoder.Encode(chunkStream)
+		}
+	})
+	defer server.Close()
+
+	numOfChunks, chunkStreamChan, errChan := source.GetAllChunks()
+	if numOfChunks != len(httpTestChunks) {
+		t.Errorf("Invalid count returned: %d", numOfChunks)
+	}
+
+	var chunks []structs.ChunkStream
+	for chunkStream := range chunkStreamChan {
+		chunks = append(chunks, chunkStream)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("Failed to get chunks: %s", err.Error())
+	}
+
+	if !reflect.DeepEqual(chunks, httpTestChunks) {
+		t.Errorf("Returned list of chunks is different.")
+	}
+}
+
+func TestHttpGetAllChunksManifest(t *testing.T) {
+	fileinfo := structs.FileData{Filename: "test.txt", Filesize: 5, Checksum: "cfb789a8e782467d5e9af43f9bb19769", ChunkHashAlgorithm: "MD5", Chunksize: 2}
+	source, server := openTestHttpSource(t, HttpOptions{}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != manifest.ContentType {
+			t.Errorf("Invalid content type requested: %s", r.Header.Get("Accept"))
+		}
+		w.Header().Set("Content-Type", manifest.ContentType)
+		mw := manifest.NewWriter(w, fileinfo, uint64(len(httpTestChunks)))
+		for _, chunkStream := range httpTestChunks {
+			mw.WriteChunk(chunkStream.Chunk)
+		}
+		mw.Close()
+	})
+	defer server.Close()
+
+	numOfChunks, chunkStreamChan, errChan := source.GetAllChunks()
+	if numOfChunks != len(httpTestChunks) {
+		t.Errorf("Invalid count returned: %d", numOfChunks)
+	}
+
+	var chunks []structs.ChunkStream
+	for chunkStream := range chunkStreamChan {
+		chunks = append(chunks, chunkStream)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("Failed to get chunks: %s", err.Error())
+	}
+
+	if !reflect.DeepEqual(chunks, httpTestChunks) {
+		t.Errorf("Returned list of chunks is different.")
+	}
+}
+
+func TestHttpGetAllChunksErrors(t *testing.T) {
+	testcases := []struct {
+		Name    string
+		Handler http.HandlerFunc
+	}{
+		{
+			Name: "corrupt",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(httpTestChunks[0])
+				fmt.Fprintf(w, "{\"ChunkId\": 1, \"Chunk\": {\n")
+			},
+		},
+		{
+			Name: "incomplete",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-ChunkCount", fmt.Sprintf("%d", len(httpTestChunks)))
+				json.NewEncoder(w).Encode(httpTestChunks[0])
+			},
+		},
+		{
+			Name: "status",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "failed", http.StatusInternalServerError)
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		func() {
+			source, server := openTestHttpSource(t, HttpOptions{ManifestFormat: manifest.FormatJSON, RetryBackoff: time.Millisecond}, tc.Handler)
+			defer server.Close()
+
+			_, chunkStreamChan, errChan := source.GetAllChunks()
+			for range chunkStreamChan {
+			}
+			if err := <-errChan; err == nil {
+				t.Errorf("[%s] Expected error, got none", tc.Name)
+			}
+		}()
+	}
+}
+
+func TestHttpReadChunkDataBatch(t *testing.T) {
+	source, server := openTestHttpSource(t, HttpOptions{ManifestFormat: manifest.FormatJSON}, func(w http.ResponseWriter, r *http.Request) {
+		chunkIds, err := ParseChunkRanges(r.URL.Query().Get("chunks"), MaxBatchChunks)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, chunkno := range chunkIds {
+			WriteChunkFrame(w, ChunkFrame{ChunkId: chunkno, Hash: fmt.Sprintf("hash%d", chunkno), Data: []byte(fmt.Sprintf("data%d", chunkno))})
+		}
+	})
+	defer server.Close()
+	source.chunksize = 8
+
+	chunkIds := []uint64{0, 1, 2, 5, 7, 8}
+	var received []uint64
+	err := source.ReadChunkDataBatch(chunkIds, func(frame ChunkFrame) error {
+		if string(frame.Data) != fmt.Sprintf("data%d", frame.ChunkId) {
+			t.Errorf("Invalid data for chunk %d: %s", frame.ChunkId, frame.Data)
+		}
+		received = append(received, frame.ChunkId)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read chunk batch: %s", err.Error())
+	}
+
+	if !reflect.DeepEqual(chunkIds, received) {
+		t.Errorf("Received chunks are different: %v != %v", received, chunkIds)
+	}
+}
+
+func TestHttpSignedSource(t *testing.T) {
+	fileinfo := structs.FileData{Filename: "test.txt", Filesize: 5, Checksum: "cfb789a8e782467d5e9af43f9bb19769", ChunkHashAlgorithm: "MD5", Chunksize: 2}
+	var chunks []structs.Chunk
+	for _, chunkStream := range httpTestChunks {
+		chunks = append(chunks, chunkStream.Chunk)
+	}
+	digest, err := manifest.Digest(fileinfo, chunks)
+	if err != nil {
+		t.Fatalf("Failed to calculate digest: %s", err.Error())
+	}
+
+	trusted, key, _ := ed25519.GenerateKey(rand.Reader)
+	untrusted, _, _ := ed25519.GenerateKey(rand.Reader)
+	signature := manifest.Sign(key, digest)
+
+	testcases := []struct {
+		Name       string
+		TrustedKey ed25519.PublicKey
+		Signature  *manifest.Signature
+		Tamper     bool
+		Valid      bool
+	}{
+		{Name: "valid", TrustedKey: trusted, Signature: &signature, Valid: true},
+		{Name: "unsigned", TrustedKey: trusted, Signature: nil, Valid: false},
+		{Name: "untrusted key", TrustedKey: untrusted, Signature: &signature, Valid: false},
+		{Name: "tampered chunks", TrustedKey: trusted, Signature: &signature, Tamper: true, Valid: false},
+		{Name: "no trusted key", TrustedKey: nil, Signature: nil, Valid: true},
+	}
+
+	for _, tc := range testcases {
+		source, server := openTestHttpSource(t, HttpOptions{TrustedKey: tc.TrustedKey}, func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/GetSignature":
+				if tc.Signature == nil {
+					http.NotFound(w, r)
+					return
+				}
+				json.NewEncoder(w).Encode(tc.Signature)
+			case "/GetFileInfo":
+				json.NewEncoder(w).Encode(fileinfo)
+			case "/GetAllChunks":
+				w.Header().Set("Content-Type", manifest.ContentType)
+				mw := manifest.NewWriter(w, fileinfo, uint64(len(chunks)))
+				for pos, chunk := range chunks {
+					if tc.Tamper && pos == 1 {
+						chunk.Hash = "00000000000000000000000000000000"
+					}
+					mw.WriteChunk(chunk)
+				}
+				mw.Close()
+			}
+		})
+
+		fd, err := source.GetFileInfo()
+		if tc.Valid && (err != nil || !reflect.DeepEqual(fd, fileinfo)) {
+			t.Errorf("[%s] Failed to get file info: %v", tc.Name, err)
+		}
+		if !tc.Valid && err == nil {
+			t.Errorf("[%s] File info of invalid source returned", tc.Name)
+		}
+
+		_, chunkStreamChan, errChan := source.GetAllChunks()
+		var received []structs.ChunkStream
+		for chunkStream := range chunkStreamChan {
+			received = append(received, chunkStream)
+		}
+		err = <-errChan
+		if tc.Valid && (err != nil || !reflect.DeepEqual(received, httpTestChunks)) {
+			t.Errorf("[%s] Failed to get chunks: %v", tc.Name, err)
+		}
+		if !tc.Valid && (err == nil || len(received) > 0) {
+			t.Errorf("[%s] Chunks of invalid source returned", tc.Name)
+		}
+
+		server.Close()
+	}
+}
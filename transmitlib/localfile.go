@@ -1,13 +1,17 @@
 package transmitlib
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/tsauter/transmit/cache"
 	"github.com/tsauter/transmit/hasher"
+	"github.com/tsauter/transmit/manifest"
 	"github.com/tsauter/transmit/structs"
 	"gopkg.in/cheggaaa/pb.v1"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -25,8 +29,17 @@ type LocalFile struct {
 	chunksize int
 	// how and where should we cache the chunks
 	cache cache.CacheDB
+	// the cache is only used temporarily and never stored
+	ephemeral bool
+	// the name of the cache, without backend specific extension
+	cachename string
+	// no progress bar is shown while the cache is built
+	quiet bool
 }
 
+// ErrNotSigned is returned by GetSignature if the cache is not signed.
+var ErrNotSigned = errors.New("source is not signed")
+
 // OpenLocalSource opens the soure file in the local filesystem.
 // A LocalFile struct is returned.
 func OpenLocalSource(filename string) (*LocalFile, error) {
@@ -38,14 +51,15 @@ func OpenLocalSource(filename string) (*LocalFile, error) {
 	}
 	lf.f = f
 
-	// we use BoltDB for caching
-	lf.cache = cache.NewBoltCache()
+	// the cache backend is selected by the user, default is BoltDB
+	lf.cache = cache.NewDefaultCacheDB()
 
 	return &lf, nil
 }
 
 // OpenOrCreateLocalTarget opens the target file in the filesystem. If the file
-// does not exists, it will be created.
+// does not exists, it will be created. The chunk cache of the target is kept
+// in memory and never written next to the file.
 // A LocalFile struct is returned.
 func OpenOrCreateLocalTarget(filename string) (*LocalFile, error) {
 	lf := LocalFile{filename: filename}
@@ -56,18 +70,72 @@ func OpenOrCreateLocalTarget(filename string) (*LocalFile, error) {
 	}
 	lf.f = f
 
-	// we use BoltDB for caching
-	lf.cache = cache.NewBoltCache()
+	// the target cache is only used during the copy, keep it in memory
+	lf.cache = cache.NewDefaultMemoryCache()
+	lf.ephemeral = true
+
+	return &lf, nil
+}
+
+// OpenLocalTarget opens an existing target file in the filesystem, the file is
+// never created. The chunk cache of the target is kept in memory.
+// A LocalFile struct is returned.
+func OpenLocalTarget(filename string) (*LocalFile, error) {
+	lf := LocalFile{filename: filename}
+
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open file")
+	}
+	lf.f = f
+
+	lf.cache = cache.NewDefaultMemoryCache()
+	lf.ephemeral = true
 
 	return &lf, nil
 }
 
+// initCache opens the chunk cache database for the local file.
+func (lf *LocalFile) initCache() error {
+	// ephemeral caches are not stored, the name is not relevant
+	cachename := lf.filename
+	if !lf.ephemeral {
+		var err error
+		cachename, err = cache.CacheName(lf.filename)
+		if err != nil {
+			return errors.Wrap(err, "failed to get cache name")
+		}
+	}
+
+	err := lf.cache.InitDatabase(cachename)
+	if err != nil {
+		return errors.Wrap(err, "failed to open or create file")
+	}
+	lf.cachename = cachename
+
+	return nil
+}
+
+// removeSignature deletes the signature of the cache, the signature
+// becomes invalid when the cache is modified.
+func (lf *LocalFile) removeSignature() error {
+	if lf.ephemeral {
+		return nil
+	}
+
+	err := os.Remove(lf.signatureFilename())
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove signature")
+	}
+	return nil
+}
+
 // LoadCache loads the chunk cache database for the local file.
 func (lf *LocalFile) LoadCache() error {
 	// read the file
-	err := lf.cache.InitDatabase(lf.filename + ".tcache")
+	err := lf.initCache()
 	if err != nil {
-		return errors.Wrap(err, "failed to open or create file")
+		return err
 	}
 
 	info, err := lf.cache.GetFileInfo()
@@ -77,20 +145,27 @@ func (lf *LocalFile) LoadCache() error {
 
 	lf.chunksize = info.Chunksize
 
-	var h hasher.Hasher
-	switch strings.ToLower(info.ChunkHashAlgorithm) {
+	h, err := newHasher(info.ChunkHashAlgorithm)
+	if err != nil {
+		return err
+	}
+	lf.h = h
+
+	return nil
+}
+
+// newHasher returns a new hasher for the hash algorithm stored in a cache.
+func newHasher(algorithm string) (hasher.Hasher, error) {
+	switch strings.ToLower(algorithm) {
 	case "sha256":
-		h = hasher.NewSHA256Hasher()
+		return hasher.NewSHA256Hasher(), nil
 	case "sha1":
-		h = hasher.NewSHA1Hasher()
+		return hasher.NewSHA1Hasher(), nil
 	case "md5":
-		h = hasher.NewMD5Hasher()
+		return hasher.NewMD5Hasher(), nil
 	default:
-		return fmt.Errorf("unsupported hash algorithm: %s\n", info.ChunkHashAlgorithm)
+		return nil, fmt.Errorf("unsupported hash algorithm: %s\n", algorithm)
 	}
-	lf.h = h
-
-	return nil
 }
 
 // BuildCache regnerates the complete chunk database by rereading the whole file.
@@ -105,9 +180,14 @@ func (lf *LocalFile) BuildCache(h *hasher.Hasher, chunksize int) error {
 	}
 
 	// read the file
-	err := lf.cache.InitDatabase(lf.filename + ".tcache")
+	err := lf.initCache()
 	if err != nil {
-		return errors.Wrap(err, "failed to open or create file")
+		return err
+	}
+
+	err = lf.removeSignature()
+	if err != nil {
+		return err
 	}
 
 	// remove all pre existing chunks in database
@@ -129,7 +209,14 @@ func (lf *LocalFile) BuildCache(h *hasher.Hasher, chunksize int) error {
 	fd.Chunksize = lf.chunksize
 
 	maxchunkno := fd.Filesize / int64(lf.chunksize)
-	percentBar := pb.StartNew(int(maxchunkno) + 1)
+	percentBar := pb.New(int(maxchunkno) + 1)
+	if lf.quiet {
+		percentBar.Output = ioutil.Discard
+	}
+	percentBar.Start()
+
+	// the chunks are written in batches, a transaction per chunk is too slow
+	batch := cache.NewBatchWriter(lf.cache, cache.DefaultBatchSize)
 
 	var chunkno uint64 = 0
 	buf := make([]byte, lf.chunksize)
@@ -143,12 +230,19 @@ func (lf *LocalFile) BuildCache(h *hasher.Hasher, chunksize int) error {
 		}
 
 		chunk := structs.NewChunk(lf.h.HashChunk(buf[:n]), len(buf[:n]))
-		lf.cache.StoreChunk(chunkno, chunk)
+		err = batch.Store(chunkno, chunk)
+		if err != nil {
+			return errors.Wrapf(err, "failed to store chunk %d", chunkno)
+		}
 
 		percentBar.Increment()
 
 		chunkno++
 	}
+	err = batch.Commit()
+	if err != nil {
+		return errors.Wrapf(err, "failed to store chunks for file %s", lf.filename)
+	}
 	percentBar.FinishPrint("Finish.")
 
 	// return the checksum of the complete file
@@ -166,6 +260,176 @@ func (lf *LocalFile) BuildCache(h *hasher.Hasher, chunksize int) error {
 	return nil
 }
 
+// ImportCache replaces the complete chunk database with the chunks read from
+// the manifest. The manifest must match the size of the local file.
+// The file info is stored after all chunks, an incomplete import leaves
+// an invalid cache that can not be loaded.
+func (lf *LocalFile) ImportCache(mr *manifest.Reader) error {
+	fd := mr.GetFileInfo()
+
+	// make sure the manifest belongs to this file
+	fstat, err := lf.f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get file info")
+	}
+	if fstat.Size() != fd.Filesize {
+		return fmt.Errorf("manifest does not match file: filesize %d != %d", fd.Filesize, fstat.Size())
+	}
+	if fd.Chunksize < 1 {
+		return fmt.Errorf("chunksize %d to small", fd.Chunksize)
+	}
+	expectedChunks := uint64((fd.Filesize + int64(fd.Chunksize) - 1) / int64(fd.Chunksize))
+	if mr.GetChunksCount() != expectedChunks {
+		return fmt.Errorf("manifest does not match file: %d chunks != %d", mr.GetChunksCount(), expectedChunks)
+	}
+
+	err = lf.initCache()
+	if err != nil {
+		return err
+	}
+
+	err = lf.removeSignature()
+	if err != nil {
+		return err
+	}
+
+	// invalidate the existing cache, until the import is complete
+	err = lf.cache.StoreFileInfo(structs.FileData{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to store file info for file %s", lf.filename)
+	}
+
+	// remove all pre existing chunks in database
+	err = lf.cache.ClearAllChunks()
+	if err != nil {
+		return errors.Wrap(err, "failed to clear existing chunks")
+	}
+
+	batch := cache.NewBatchWriter(lf.cache, cache.DefaultBatchSize)
+	for {
+		chunkStream, err := mr.ReadChunk()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.Wrap(err, "failed to read chunk from manifest")
+		}
+
+		err = batch.Store(chunkStream.ChunkId, chunkStream.Chunk)
+		if err != nil {
+			return errors.Wrapf(err, "failed to store chunk %d", chunkStream.ChunkId)
+		}
+	}
+	err = batch.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to store chunks")
+	}
+
+	err = lf.cache.StoreFileInfo(fd)
+	if err != nil {
+		return errors.Wrapf(err, "failed to store file info for file %s", lf.filename)
+	}
+	lf.chunksize = fd.Chunksize
+
+	return nil
+}
+
+// VerifyResult contains the result of a cache verification.
+type VerifyResult struct {
+	// the number of verified chunks
+	Chunks int
+	// the ids of all chunks with a different checksum
+	Mismatches []uint64
+	// true if the checksum of the complete file matches the cache
+	ChecksumValid bool
+}
+
+// VerifyCache rereads the whole file and compares the checksum of each chunk
+// with the checksum stored in the cache database. The cache must be loaded first.
+func (lf *LocalFile) VerifyCache() (VerifyResult, error) {
+	result := VerifyResult{}
+
+	fd, err := lf.cache.GetFileInfo()
+	if err != nil {
+		return result, errors.Wrap(err, "failed to load file info from cache")
+	}
+
+	// the chunks are returned in order, this builds the checksum
+	// of the complete file
+	_, chunkStreamChan, errChan := lf.GetAllChunks()
+	var readErr error
+	for chunkStream := range chunkStreamChan {
+		if readErr != nil {
+			continue
+		}
+		result.Chunks++
+
+		filepos := int64(chunkStream.ChunkId * uint64(lf.chunksize))
+		data, datalen, err := lf.ReadChunkData(filepos)
+		if err != nil {
+			// the file is smaller than the cache
+			if errors.Cause(err) == io.EOF {
+				result.Mismatches = append(result.Mismatches, chunkStream.ChunkId)
+				continue
+			}
+			readErr = err
+			continue
+		}
+
+		if lf.h.HashChunk(data[:datalen]) != chunkStream.Chunk.Hash {
+			result.Mismatches = append(result.Mismatches, chunkStream.ChunkId)
+		}
+	}
+	if err := <-errChan; err != nil {
+		return result, errors.Wrap(err, "failed to get chunks from cache")
+	}
+	if readErr != nil {
+		return result, errors.Wrapf(readErr, "failed to read file %s", lf.filename)
+	}
+
+	fstat, err := lf.f.Stat()
+	if err != nil {
+		return result, errors.Wrapf(err, "failed to get file info")
+	}
+	checksum, err := lf.h.GetFilehash()
+	if err != nil {
+		return result, errors.Wrapf(err, "failed to create checksum for file %s", lf.filename)
+	}
+	result.ChecksumValid = (checksum == fd.Checksum) && (fstat.Size() == fd.Filesize)
+
+	return result, nil
+}
+
+// CheckCache returns an error if the cache is not loaded or does not match
+// the file anymore, e.g. the file was modified after the cache was created.
+// Only the file details are compared, the file is not read.
+func (lf *LocalFile) CheckCache() error {
+	if lf.h == nil {
+		return fmt.Errorf("cache is not loaded")
+	}
+
+	fd, err := lf.cache.GetFileInfo()
+	if err != nil {
+		return errors.Wrap(err, "failed to load file info from cache")
+	}
+
+	// the file is checked by name, a replaced file must be detected too
+	fstat, err := os.Stat(lf.filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to get file details")
+	}
+	if fstat.Size() != fd.Filesize {
+		return fmt.Errorf("filesize changed to %d bytes", fstat.Size())
+	}
+
+	dbstat, err := os.Stat(lf.cache.GetDatabaseFilename())
+	if err == nil && fstat.ModTime().After(dbstat.ModTime()) {
+		return fmt.Errorf("file modified after cache was created")
+	}
+
+	return nil
+}
+
 // GetFileInfo return the previously stored filedata from the cache database.
 func (lf *LocalFile) GetFileInfo() (structs.FileData, error) {
 	return lf.cache.GetFileInfo()
@@ -236,30 +500,39 @@ func (lf *LocalFile) CloseAndRemove() error {
 }
 
 // GetAllChunks return all available chunks form database, the chunks are passed
-// back through the pipe.
-func (lf *LocalFile) GetAllChunks() (int, chan structs.ChunkStream) {
+// back through the pipe. Errors are passed back through the error channel, this
+// channel must be checked after the chunk channel was closed.
+func (lf *LocalFile) GetAllChunks() (int, chan structs.ChunkStream, chan error) {
 	chunkStreamChan := make(chan structs.ChunkStream, 1)
+	errChan := make(chan error, 1)
 
-	numberOfChunks, _ := lf.cache.GetChunksCount()
+	numberOfChunks, err := lf.cache.GetChunksCount()
+	if err != nil {
+		errChan <- errors.Wrap(err, "failed to get number of chunks")
+		close(chunkStreamChan)
+		close(errChan)
+		return 0, chunkStreamChan, errChan
+	}
 
 	go func() {
-		lf.cache.GetAllChunks(chunkStreamChan)
-		close(chunkStreamChan)
+		defer close(errChan)
+		defer close(chunkStreamChan)
+
+		err := lf.cache.GetAllChunks(chunkStreamChan)
+		if err != nil {
+			errChan <- err
+		}
 	}()
 
-	return numberOfChunks, chunkStreamChan
+	return numberOfChunks, chunkStreamChan, errChan
 }
 
 // ReadChunkData reads the raw data from file (not the chunk) and return the data.
+// The offset of the file is not used, concurrent reads are possible.
 func (lf *LocalFile) ReadChunkData(filepos int64) ([]byte, int, error) {
-	_, err := lf.f.Seek(filepos, 0)
-	if err != nil {
-		return nil, 0, errors.Wrap(err, "failed to seek file")
-	}
-
 	buf := make([]byte, lf.chunksize)
-	buflen, err := lf.f.Read(buf)
-	if err != nil {
+	buflen, err := lf.f.ReadAt(buf, filepos)
+	if err != nil && !(err == io.EOF && buflen > 0) {
 		return nil, 0, errors.Wrap(err, "failed to read file")
 	}
 	return buf, buflen, nil
@@ -288,3 +561,97 @@ func (lf *LocalFile) WriteChunkData(filepos int64, data []byte, datalen int) err
 func (lf *LocalFile) GetChunk(chunkNo uint64) (structs.Chunk, error) {
 	return lf.cache.GetChunk(chunkNo)
 }
+
+// signatureFilename returns the filename of the signature of the cache.
+func (lf *LocalFile) signatureFilename() string {
+	return lf.cachename + ".sig"
+}
+
+// cacheDigest returns the manifest checksum of the file details and all
+// chunks of the loaded cache.
+func (lf *LocalFile) cacheDigest() ([]byte, error) {
+	fd, err := lf.cache.GetFileInfo()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get file info")
+	}
+
+	var chunks []structs.Chunk
+	var orderErr error
+	_, chunkStreamChan, errChan := lf.GetAllChunks()
+	for chunkStream := range chunkStreamChan {
+		if chunkStream.ChunkId != uint64(len(chunks)) && orderErr == nil {
+			orderErr = fmt.Errorf("chunk %d is missing", len(chunks))
+		}
+		chunks = append(chunks, chunkStream.Chunk)
+	}
+	if err := <-errChan; err != nil {
+		return nil, errors.Wrap(err, "failed to get chunks")
+	}
+	if orderErr != nil {
+		return nil, orderErr
+	}
+
+	return manifest.Digest(fd, chunks)
+}
+
+// SignCache signs the file details and all chunks of the loaded cache with
+// the private key. The signature is stored next to the cache database.
+func (lf *LocalFile) SignCache(key ed25519.PrivateKey) error {
+	digest, err := lf.cacheDigest()
+	if err != nil {
+		return errors.Wrap(err, "failed to calculate cache digest")
+	}
+
+	data, err := json.Marshal(manifest.Sign(key, digest))
+	if err != nil {
+		return errors.Wrap(err, "failed to convert signature to json")
+	}
+
+	err = ioutil.WriteFile(lf.signatureFilename(), data, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to write signature")
+	}
+
+	return nil
+}
+
+// GetSignature returns the signature of the loaded cache. ErrNotSigned is
+// returned if the cache was not signed.
+func (lf *LocalFile) GetSignature() (manifest.Signature, error) {
+	var signature manifest.Signature
+
+	// ephemeral caches are never signed
+	if lf.ephemeral {
+		return signature, ErrNotSigned
+	}
+
+	data, err := ioutil.ReadFile(lf.signatureFilename())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return signature, ErrNotSigned
+		}
+		return signature, errors.Wrap(err, "failed to read signature")
+	}
+
+	err = json.Unmarshal(data, &signature)
+	if err != nil {
+		return signature, errors.Wrap(err, "signature is corrupt")
+	}
+
+	return signature, nil
+}
+
+// VerifySignature makes sure the loaded cache is signed by the key.
+func (lf *LocalFile) VerifySignature(key ed25519.PublicKey) error {
+	signature, err := lf.GetSignature()
+	if err != nil {
+		return err
+	}
+
+	digest, err := lf.cacheDigest()
+	if err != nil {
+		return errors.Wrap(err, "failed to calculate cache digest")
+	}
+
+	return signature.Verify(key, digest)
+}
@@ -0,0 +1,142 @@
+package transmitlib
+
+import (
+	"github.com/tsauter/transmit/hasher"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyCache(t *testing.T) {
+	testfile := filepath.Join("fixtures", "target_verify.txt")
+	data, err := ioutil.ReadFile(filepath.Join("fixtures", "test2.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read test file: %s", err.Error())
+	}
+	err = ioutil.WriteFile(testfile, data, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write test file: %s", err.Error())
+	}
+	defer os.Remove(testfile)
+	defer os.Remove(testfile + ".tcache.db")
+
+	var h hasher.Hasher = hasher.NewSHA1Hasher()
+	source, err := OpenLocalSource(testfile)
+	if err != nil {
+		t.Fatalf("Failed to open test file: %s: %s", testfile, err.Error())
+	}
+	err = source.BuildCache(&h, 64)
+	source.Close()
+	if err != nil {
+		t.Fatalf("Failed to build cache: %s", err.Error())
+	}
+
+	testcases := []struct {
+		Name       string
+		Modify     func() error
+		Mismatches []uint64
+		Valid      bool
+	}{
+		{
+			Name:   "unmodified",
+			Modify: func() error { return nil },
+			Valid:  true,
+		},
+		{
+			Name: "chunk 1 modified",
+			Modify: func() error {
+				modified := append([]byte{}, data...)
+				modified[70] ^= 0xff
+				return ioutil.WriteFile(testfile, modified, 0644)
+			},
+			Mismatches: []uint64{1},
+		},
+		{
+			Name: "truncated",
+			Modify: func() error {
+				return os.Truncate(testfile, 64)
+			},
+			Mismatches: []uint64{1, 2},
+		},
+	}
+
+	for _, tc := range testcases {
+		err := tc.Modify()
+		if err != nil {
+			t.Fatalf("[%s] Failed to modify test file: %s", tc.Name, err.Error())
+		}
+
+		func() {
+			source, err := OpenLocalSource(testfile)
+			if err != nil {
+				t.Fatalf("[%s] Failed to open test file: %s", tc.Name, err.Error())
+			}
+			defer source.Close()
+
+			err = source.LoadCache()
+			if err != nil {
+				t.Fatalf("[%s] Failed to load cache: %s", tc.Name, err.Error())
+			}
+
+			result, err := source.VerifyCache()
+			if err != nil {
+				t.Fatalf("[%s] Failed to verify cache: %s", tc.Name, err.Error())
+			}
+			if result.Chunks != 3 {
+				t.Errorf("[%s] Invalid number of verified chunks: %d", tc.Name, result.Chunks)
+			}
+			if !reflect.DeepEqual(result.Mismatches, tc.Mismatches) {
+				t.Errorf("[%s] Invalid mismatches returned: %v", tc.Name, result.Mismatches)
+			}
+			if result.ChecksumValid != tc.Valid {
+				t.Errorf("[%s] Invalid checksum state returned: %v", tc.Name, result.ChecksumValid)
+			}
+		}()
+	}
+}
+
+func TestCopyLocalToLocalTargetError(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// the source cache has more chunks than the target cache, the copy
+	// fails in the middle of the chunk stream
+	sourcefile := filepath.Join(tmpdir, "test2.txt")
+	data, _ := ioutil.ReadFile(filepath.Join("fixtures", "test2.txt"))
+	ioutil.WriteFile(sourcefile, data, 0644)
+	source, err := OpenLocalSource(sourcefile)
+	if err != nil {
+		t.Fatalf("Failed to open test file: %s", err.Error())
+	}
+	var h hasher.Hasher = hasher.NewSHA1Hasher()
+	err = source.BuildCache(&h, 16)
+	source.Close()
+	if err != nil {
+		t.Fatalf("Failed to build cache: %s", err.Error())
+	}
+
+	err = CopyLocalToLocal(sourcefile, filepath.Join(tmpdir, "target.txt"), &h, 64)
+	if err == nil {
+		t.Errorf("Expected error for missing target chunk, got none")
+	}
+
+	// the chunks of the source are not read any more
+	buf := make([]byte, 1<<20)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		if !strings.Contains(stacks, "GetAllChunks") {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Source chunks still read after the copy failed")
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package transmitlib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+)
+
+// RequestIDHeader is the http header with the id of a request. The id of
+// the client is used if valid, otherwise the server creates a new id.
+const RequestIDHeader = "X-Request-Id"
+
+var (
+	logger *slog.Logger
+
+	validRequestID = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+)
+
+type requestLoggerKey struct{}
+
+// SetLogger sets the logger of the package, slog.Default() is used if nil.
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// Logger returns the logger of the package.
+func Logger() *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+// newRequestID returns a new random request id.
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// RequestIDMiddleware returns a mux middleware that assigns an id to every
+// request. The id is returned in the response header and added to all
+// log records of the request.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		l := Logger().With("request_id", id, "remote", r.RemoteAddr, "path", r.URL.Path)
+		ctx := context.WithValue(r.Context(), requestLoggerKey{}, l)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestLogger returns the logger of the request, including the request id.
+func requestLogger(r *http.Request) *slog.Logger {
+	if l, ok := r.Context().Value(requestLoggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return Logger()
+}
@@ -0,0 +1,49 @@
+package transmitlib
+
+import (
+	"bytes"
+	"github.com/tsauter/transmit/logging"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := logging.New(&buf, "debug", logging.FormatJSON)
+	SetLogger(l)
+	defer SetLogger(nil)
+
+	handler := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestLogger(r).Debug("handled")
+	}))
+
+	testcases := []struct {
+		Name   string
+		Header string
+		Keep   bool
+	}{
+		{Name: "client id", Header: "client-id-1", Keep: true},
+		{Name: "no id", Header: "", Keep: false},
+		{Name: "invalid id", Header: "invalid id\nwith newline", Keep: false},
+	}
+
+	for _, tc := range testcases {
+		buf.Reset()
+		req := httptest.NewRequest("GET", "/GetFileInfo", nil)
+		if tc.Header != "" {
+			req.Header.Set(RequestIDHeader, tc.Header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		id := w.Header().Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) || (tc.Keep && id != tc.Header) || (!tc.Keep && id == tc.Header) {
+			t.Errorf("[%s] Invalid request id: %s", tc.Name, id)
+		}
+		if !strings.Contains(buf.String(), `"request_id":"`+id+`"`) {
+			t.Errorf("[%s] Request id not logged: %s", tc.Name, buf.String())
+		}
+	}
+}
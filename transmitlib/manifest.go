@@ -0,0 +1,75 @@
+package transmitlib
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/manifest"
+	"io"
+)
+
+// ExportManifest writes the chunk cache of the local file as manifest to w.
+// The format is either manifest.FormatBinary or manifest.FormatJSON.
+func ExportManifest(filename string, w io.Writer, format string) error {
+	var source SourceFile
+	source, err := OpenLocalSource(filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to open local source file")
+	}
+	defer source.Close()
+
+	err = source.LoadCache()
+	if err != nil {
+		return errors.Wrap(err, "failed to load cache for local source file")
+	}
+
+	fileinfo, err := source.GetFileInfo()
+	if err != nil {
+		return errors.Wrap(err, "failed to get file info for source file")
+	}
+
+	numberOfChunks, chunkStreamChan, errChan := source.GetAllChunks()
+	mw, err := manifest.NewFormatWriter(format, w, fileinfo, uint64(numberOfChunks))
+	if err != nil {
+		// drain the channel, otherwise the cache stays blocked
+		for range chunkStreamChan {
+		}
+		return err
+	}
+
+	err = manifest.WriteChunks(mw, chunkStreamChan)
+	if cacheErr := <-errChan; cacheErr != nil {
+		return errors.Wrap(cacheErr, "failed to get chunks from cache")
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write manifest")
+	}
+
+	err = mw.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to write manifest")
+	}
+
+	return nil
+}
+
+// ImportManifest reads the manifest from r and replaces the chunk cache of
+// the local file with the content of the manifest.
+func ImportManifest(filename string, r io.Reader) error {
+	source, err := OpenLocalSource(filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to open local source file")
+	}
+	defer source.Close()
+
+	mr, err := manifest.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return errors.Wrap(err, "failed to read manifest")
+	}
+
+	err = source.ImportCache(mr)
+	if err != nil {
+		return errors.Wrap(err, "failed to import manifest")
+	}
+
+	return nil
+}
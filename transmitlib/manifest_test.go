@@ -0,0 +1,60 @@
+package transmitlib
+
+import (
+	"bytes"
+	"github.com/tsauter/transmit/hasher"
+	"github.com/tsauter/transmit/manifest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportImportManifest(t *testing.T) {
+	testfile := filepath.Join("fixtures", "test2.txt")
+
+	// build a fresh cache for the test file
+	var h hasher.Hasher = hasher.NewMD5Hasher()
+	source, err := OpenLocalSource(testfile)
+	if err != nil {
+		t.Fatalf("Failed to open test file: %s: %s", testfile, err.Error())
+	}
+	err = source.BuildCache(&h, 2)
+	source.Close()
+	if err != nil {
+		t.Fatalf("Failed to build cache: %s", err.Error())
+	}
+	defer os.Remove(testfile + ".tcache.db")
+
+	var exported bytes.Buffer
+	err = ExportManifest(testfile, &exported, manifest.FormatBinary)
+	if err != nil {
+		t.Fatalf("Failed to export manifest: %s", err.Error())
+	}
+
+	// remove the cache and recreate it from the manifest
+	err = os.Remove(testfile + ".tcache.db")
+	if err != nil {
+		t.Fatalf("Failed to remove cache: %s", err.Error())
+	}
+	err = ImportManifest(testfile, bytes.NewReader(exported.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to import manifest: %s", err.Error())
+	}
+
+	var reexported bytes.Buffer
+	err = ExportManifest(testfile, &reexported, manifest.FormatBinary)
+	if err != nil {
+		t.Fatalf("Failed to export manifest: %s", err.Error())
+	}
+	if !bytes.Equal(exported.Bytes(), reexported.Bytes()) {
+		t.Errorf("Imported cache is different from the exported cache.")
+	}
+
+	// the manifest does not match a different file
+	otherfile := filepath.Join("fixtures", "test1.txt")
+	defer os.Remove(otherfile + ".tcache.db")
+	err = ImportManifest(otherfile, bytes.NewReader(exported.Bytes()))
+	if err == nil {
+		t.Errorf("Manifest imported for a different file.")
+	}
+}
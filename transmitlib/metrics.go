@@ -0,0 +1,160 @@
+package transmitlib
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Metrics contains the prometheus metrics of the http source server.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests    *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+	bytesServed *prometheus.CounterVec
+	connections prometheus.Gauge
+	cacheLookup *prometheus.CounterVec
+	errors      *prometheus.CounterVec
+}
+
+// NewMetrics returns the metrics of the http source server, registered in
+// a new registry together with the go runtime and process metrics.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "transmit_http_requests_total",
+			Help: "Number of http requests by route and status code, and of grpc requests by method and status code.",
+		}, []string{"route", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "transmit_http_request_duration_seconds",
+			Help:    "Duration of http requests by route, and of grpc requests by method.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"route"}),
+		bytesServed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "transmit_http_response_bytes_total",
+			Help: "Number of bytes sent in http responses by route, and in grpc responses by method.",
+		}, []string{"route"}),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "transmit_http_active_connections",
+			Help: "Number of open client connections.",
+		}),
+		cacheLookup: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "transmit_chunk_cache_lookups_total",
+			Help: "Number of chunk lookups in the source cache by result (hit, miss).",
+		}, []string{"result"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "transmit_http_errors_total",
+			Help: "Number of failed requests by route, including failures after the response was started.",
+		}, []string{"route"}),
+	}
+
+	m.registry.MustRegister(m.requests, m.duration, m.bytesServed, m.connections, m.cacheLookup, m.errors)
+	m.registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	return m
+}
+
+// Handler returns the http handler serving the metrics.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ConnState tracks the number of open connections, it must be set as
+// ConnState of the http server.
+func (m *Metrics) ConnState(conn net.Conn, state http.ConnState) {
+	if m == nil {
+		return
+	}
+
+	switch state {
+	case http.StateNew:
+		m.connections.Inc()
+	case http.StateClosed, http.StateHijacked:
+		m.connections.Dec()
+	}
+}
+
+// CacheLookup counts a chunk lookup in the source cache.
+func (m *Metrics) CacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+
+	if hit {
+		m.cacheLookup.WithLabelValues("hit").Inc()
+	} else {
+		m.cacheLookup.WithLabelValues("miss").Inc()
+	}
+}
+
+// Error counts a failed request of the route.
+func (m *Metrics) Error(route string) {
+	if m == nil {
+		return
+	}
+
+	m.errors.WithLabelValues(route).Inc()
+}
+
+// Request records the status code, the duration and the size of the response
+// of a finished request.
+func (m *Metrics) Request(route string, code string, duration time.Duration, bytes int) {
+	if m == nil {
+		return
+	}
+
+	m.requests.WithLabelValues(route, code).Inc()
+	m.duration.WithLabelValues(route).Observe(duration.Seconds())
+	m.bytesServed.WithLabelValues(route).Add(float64(bytes))
+}
+
+// metricsResponseWriter records the status code and the size of a response.
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (mw *metricsResponseWriter) WriteHeader(code int) {
+	mw.code = code
+	mw.ResponseWriter.WriteHeader(code)
+}
+
+func (mw *metricsResponseWriter) Write(p []byte) (int, error) {
+	n, err := mw.ResponseWriter.Write(p)
+	mw.bytes += n
+	return n, err
+}
+
+// Middleware returns a mux middleware that records the number, duration and
+// size of all requests. The route label is the name of the mux route.
+func (m *Metrics) Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if m == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := "unknown"
+			if current := mux.CurrentRoute(r); current != nil && current.GetName() != "" {
+				route = current.GetName()
+			}
+
+			start := time.Now()
+			mw := &metricsResponseWriter{ResponseWriter: w, code: http.StatusOK}
+			next.ServeHTTP(mw, r)
+
+			m.Request(route, strconv.Itoa(mw.code), time.Since(start), mw.bytes)
+			if mw.code >= 500 {
+				m.Error(route)
+			}
+		})
+	}
+}
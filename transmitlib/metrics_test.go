@@ -0,0 +1,64 @@
+package transmitlib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	defer source.Close()
+
+	metrics := NewMetrics()
+	handler, err := NewSourceHandler(source, ServerOptions{Metrics: metrics})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.ConnState = metrics.ConnState
+	server.Start()
+	defer server.Close()
+
+	for _, path := range []string{"/GetFileInfo", "/GetChunk/0", "/GetChunk/1", "/GetChunk/999", "/ReadChunksData?chunks=0-1"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Failed to request %s: %s", path, err.Error())
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to get metrics: %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	expected := []string{
+		`transmit_http_requests_total{code="200",route="GetFileInfo"} 1`,
+		`transmit_http_requests_total{code="200",route="GetChunk"} 2`,
+		`transmit_http_requests_total{code="500",route="GetChunk"} 1`,
+		`transmit_http_errors_total{route="GetChunk"} 1`,
+		`transmit_chunk_cache_lookups_total{result="hit"} 4`,
+		`transmit_chunk_cache_lookups_total{result="miss"} 1`,
+		`transmit_http_request_duration_seconds_count{route="ReadChunksData"} 1`,
+		`transmit_http_response_bytes_total{route="ReadChunksData"}`,
+		`transmit_http_active_connections 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("Metric not found: %s", line)
+		}
+	}
+}
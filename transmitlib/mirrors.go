@@ -0,0 +1,331 @@
+package transmitlib
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/hasher"
+	"github.com/tsauter/transmit/structs"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// mirror is a http source serving the same file as the other mirrors.
+type mirror struct {
+	url    string
+	source *HttpFile
+	// the received bytes and the time spent for them
+	bytes   int64
+	elapsed time.Duration
+	// the mirror is not used any more after an error
+	err error
+}
+
+// throughput returns the measured throughput in bytes per second, zero if
+// nothing was received yet.
+func (m *mirror) throughput() float64 {
+	if m.elapsed <= 0 {
+		return 0
+	}
+	return float64(m.bytes) / m.elapsed.Seconds()
+}
+
+// MirrorPool distributes the chunk requests over several http sources
+// serving the same file. Each mirror receives a share of the chunks
+// according to its measured throughput, the chunks of a failed mirror are
+// requested from the remaining mirrors.
+type MirrorPool struct {
+	mu       sync.Mutex
+	mirrors  []*mirror
+	fileinfo structs.FileData
+	// the error of the mirror that failed last
+	lastErr error
+	// serializes the calls of the chunk callback
+	fnMu sync.Mutex
+}
+
+// OpenMirrors opens all http sources and verifies that all sources serve the
+// same file (checksum, hash algorithm and chunk size). Unreachable sources
+// are skipped, at least one source must be available.
+func OpenMirrors(baseurls []string, opts HttpOptions) (*MirrorPool, error) {
+	mp := &MirrorPool{}
+
+	for _, baseurl := range baseurls {
+		url, err := url.Parse(baseurl)
+		if err != nil {
+			mp.Close()
+			return nil, errors.Wrapf(err, "invalid url: %s", baseurl)
+		}
+
+		source, err := OpenHttpSource(url, opts)
+		var fileinfo structs.FileData
+		if err == nil {
+			fileinfo, err = source.GetFileInfo()
+			if err != nil {
+				source.Close()
+			}
+		}
+		if err != nil {
+			Logger().Warn("mirror is not available", "source", baseurl, "error", err.Error())
+			continue
+		}
+
+		if len(mp.mirrors) == 0 {
+			mp.fileinfo = fileinfo
+		} else if fileinfo.Checksum != mp.fileinfo.Checksum ||
+			fileinfo.ChunkHashAlgorithm != mp.fileinfo.ChunkHashAlgorithm ||
+			fileinfo.Chunksize != mp.fileinfo.Chunksize {
+			source.Close()
+			mp.Close()
+			return nil, fmt.Errorf("mirror %s serves a different file: checksum %s != %s", baseurl, fileinfo.Checksum, mp.fileinfo.Checksum)
+		}
+		mp.mirrors = append(mp.mirrors, &mirror{url: baseurl, source: source})
+	}
+
+	if len(mp.mirrors) == 0 {
+		return nil, fmt.Errorf("none of %d mirrors is available", len(baseurls))
+	}
+	Logger().Info("mirrors available", "mirrors", len(mp.mirrors), "checksum", mp.fileinfo.Checksum)
+
+	return mp, nil
+}
+
+// Close closes the sources of all mirrors.
+func (mp *MirrorPool) Close() error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	for _, m := range mp.mirrors {
+		m.source.Close()
+	}
+	return nil
+}
+
+// Source returns the first available mirror, it is used for the file info
+// and the chunk list.
+func (mp *MirrorPool) Source() (*HttpFile, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	for _, m := range mp.mirrors {
+		if m.err == nil {
+			return m.source, nil
+		}
+	}
+	return nil, fmt.Errorf("no mirror available")
+}
+
+// assign splits the chunks into contiguous parts for all available mirrors,
+// according to their throughput. Mirrors without measurement get the share
+// of the fastest mirror, so they are measured as well.
+func (mp *MirrorPool) assign(chunks []structs.ChunkStream) map[*mirror][]structs.ChunkStream {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	var available []*mirror
+	var fastest float64
+	for _, m := range mp.mirrors {
+		if m.err != nil {
+			continue
+		}
+		available = append(available, m)
+		if m.throughput() > fastest {
+			fastest = m.throughput()
+		}
+	}
+	if fastest == 0 {
+		fastest = 1
+	}
+
+	weights := make([]float64, len(available))
+	var total float64
+	for i, m := range available {
+		weights[i] = m.throughput()
+		if weights[i] == 0 {
+			weights[i] = fastest
+		}
+		total += weights[i]
+	}
+
+	parts := map[*mirror][]structs.ChunkStream{}
+	start := 0
+	var assigned float64
+	for i, m := range available {
+		assigned += weights[i]
+		end := int(float64(len(chunks))*assigned/total + 0.5)
+		if i == len(available)-1 {
+			end = len(chunks)
+		}
+		if end > start {
+			parts[m] = chunks[start:end]
+			start = end
+		}
+	}
+	return parts
+}
+
+// ReadChunks requests the data of all chunks from the available mirrors in
+// parallel and calls fn for each chunk, the calls of fn are serialized. The
+// data of each received chunk must match the expected hash. Chunks not
+// received from a failed mirror are requested from the other mirrors, an
+// error is returned if no mirror is left.
+func (mp *MirrorPool) ReadChunks(chunks []structs.ChunkStream, fn func(frame ChunkFrame) error) error {
+	for len(chunks) > 0 {
+		parts := mp.assign(chunks)
+		if len(parts) == 0 {
+			mp.mu.Lock()
+			defer mp.mu.Unlock()
+			return errors.Wrap(mp.lastErr, "no mirror available")
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var missing []structs.ChunkStream
+		var fnErr error
+		for m, part := range parts {
+			wg.Add(1)
+			go func(m *mirror, part []structs.ChunkStream) {
+				defer wg.Done()
+				received, err := mp.readFromMirror(m, part, fn)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err == nil {
+					return
+				}
+				if _, ok := errors.Cause(err).(callbackError); ok {
+					fnErr = err
+					return
+				}
+				for _, chunkStream := range part {
+					if !received[chunkStream.ChunkId] {
+						missing = append(missing, chunkStream)
+					}
+				}
+			}(m, part)
+		}
+		wg.Wait()
+
+		if fnErr != nil {
+			return errors.Cause(fnErr).(callbackError).err
+		}
+		sort.Slice(missing, func(i, j int) bool {
+			return missing[i].ChunkId < missing[j].ChunkId
+		})
+		chunks = missing
+	}
+
+	return nil
+}
+
+// callbackError wraps an error returned by the chunk callback, it is not an
+// error of the mirror.
+type callbackError struct {
+	err error
+}
+
+func (ce callbackError) Error() string {
+	return ce.err.Error()
+}
+
+// readFromMirror requests the chunks from a single mirror and measures the
+// throughput. The mirror is disabled if the request fails, the ids of all
+// received chunks are returned.
+func (mp *MirrorPool) readFromMirror(m *mirror, chunks []structs.ChunkStream, fn func(frame ChunkFrame) error) (map[uint64]bool, error) {
+	h, err := newHasher(mp.fileinfo.ChunkHashAlgorithm)
+	if err != nil {
+		return nil, callbackError{err}
+	}
+
+	expected := make(map[uint64]string, len(chunks))
+	chunkIds := make([]uint64, 0, len(chunks))
+	for _, chunkStream := range chunks {
+		expected[chunkStream.ChunkId] = chunkStream.Chunk.Hash
+		chunkIds = append(chunkIds, chunkStream.ChunkId)
+	}
+
+	received := map[uint64]bool{}
+	var size int64
+	started := time.Now()
+	err = m.source.ReadChunkDataBatch(chunkIds, func(frame ChunkFrame) error {
+		err := verifyChunkFrame(h, expected, frame)
+		if err != nil {
+			return err
+		}
+
+		mp.fnMu.Lock()
+		err = fn(frame)
+		mp.fnMu.Unlock()
+		if err != nil {
+			return callbackError{err}
+		}
+		received[frame.ChunkId] = true
+		size += int64(len(frame.Data))
+		return nil
+	})
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	m.bytes += size
+	m.elapsed += time.Since(started)
+	if err != nil {
+		if _, ok := errors.Cause(err).(callbackError); ok {
+			return received, err
+		}
+		m.err = err
+		mp.lastErr = err
+		Logger().Warn("mirror failed, using the remaining mirrors", "source", m.url, "error", err.Error())
+		return received, err
+	}
+
+	return received, nil
+}
+
+// CopyMirrorsToLocal copy the file served by several http sources (mirrors)
+// to all targetfiles. The chunk list is read from the first available
+// mirror, the chunk data is requested from all mirrors. Like CopyHttpToLocal,
+// the copy is started again if the file is changed on the server.
+func CopyMirrorsToLocal(baseurls []string, targetfiles []string, h *hasher.Hasher, chunksize int, opts HttpOptions) ([]TargetResult, error) {
+	for attempt := 1; ; attempt++ {
+		results, err := copyMirrorsToLocal(baseurls, targetfiles, h, chunksize, opts)
+		if err == nil || !errors.Is(err, ErrSourceChanged) || attempt > MaxSourceChanges {
+			return results, err
+		}
+		Logger().Warn("source file changed on the server, starting again", "attempt", attempt)
+	}
+}
+
+// copyMirrorsToLocal copy a single version of the file served by several
+// http sources to all targetfiles.
+func copyMirrorsToLocal(baseurls []string, targetfiles []string, h *hasher.Hasher, chunksize int, opts HttpOptions) ([]TargetResult, error) {
+	pool, err := OpenMirrors(baseurls, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Close()
+
+	source, err := pool.Source()
+	if err != nil {
+		return nil, err
+	}
+
+	read := func(chunks []structs.ChunkStream, fn func(frame ChunkFrame) error) error {
+		err := pool.ReadChunks(chunks, fn)
+		if err != nil {
+			return errors.Wrap(err, "failed to read from source")
+		}
+		return nil
+	}
+
+	if opts.Peer.Enabled {
+		var stopPeers func()
+		read, stopPeers, err = startPeers(source, read, targetfiles[0], opts)
+		if err != nil {
+			return nil, err
+		}
+		defer stopPeers()
+	}
+
+	return copyToTargets(source, read, targetfiles, h, chunksize)
+}
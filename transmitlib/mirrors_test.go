@@ -0,0 +1,149 @@
+package transmitlib
+
+import (
+	"bytes"
+	"github.com/tsauter/transmit/hasher"
+	"github.com/tsauter/transmit/structs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startMirror serves the fixture from its own directory, the number of
+// chunk data requests is counted. With fail set, all chunk data requests fail.
+// The returned function stops the mirror.
+func startMirror(t *testing.T, fixture string, fail bool, requests *int32) (*httptest.Server, func()) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+
+	source := openTestSource(t, tmpdir, fixture)
+	handler, err := NewSourceHandler(source, ServerOptions{})
+	if err != nil {
+		source.Close()
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/ReadChunksData") {
+			atomic.AddInt32(requests, 1)
+			if fail {
+				http.Error(w, "mirror failed", http.StatusInternalServerError)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	return server, func() {
+		server.Close()
+		handler.Close()
+		os.RemoveAll(tmpdir)
+	}
+}
+
+func TestMirrorAssign(t *testing.T) {
+	fast := &mirror{url: "fast", bytes: 300, elapsed: time.Second}
+	slow := &mirror{url: "slow", bytes: 100, elapsed: time.Second}
+	failed := &mirror{url: "failed", err: ErrSourceChanged}
+	mp := &MirrorPool{mirrors: []*mirror{fast, slow, failed}}
+
+	chunks := make([]structs.ChunkStream, 8)
+	for i := range chunks {
+		chunks[i].ChunkId = uint64(i)
+	}
+	parts := mp.assign(chunks)
+	if len(parts[fast]) != 6 || len(parts[slow]) != 2 || len(parts[failed]) != 0 {
+		t.Errorf("Invalid distribution: fast %d, slow %d, failed %d", len(parts[fast]), len(parts[slow]), len(parts[failed]))
+	}
+	if parts[slow][0].ChunkId != 6 {
+		t.Errorf("Chunks not assigned in order: %d", parts[slow][0].ChunkId)
+	}
+
+	// mirrors without measurement get the share of the fastest mirror
+	unmeasured := &mirror{url: "new"}
+	mp.mirrors = append(mp.mirrors, unmeasured)
+	parts = mp.assign(chunks)
+	if len(parts[unmeasured]) == 0 {
+		t.Errorf("Mirror without measurement not used")
+	}
+}
+
+func TestCopyMirrorsToLocal(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+	original, _ := ioutil.ReadFile(filepath.Join("fixtures", "test2.txt"))
+
+	var requests1, requests2, requests3 int32
+	mirror1, stop := startMirror(t, "test2.txt", false, &requests1)
+	defer stop()
+	mirror2, stop := startMirror(t, "test2.txt", false, &requests2)
+	defer stop()
+	broken, stop := startMirror(t, "test2.txt", true, &requests3)
+	defer stop()
+	other, stop := startMirror(t, "test1.txt", false, new(int32))
+	defer stop()
+	corruptsource := openTestSource(t, tmpdir, "test2.txt")
+	corrupthandler, err := NewSourceHandler(corruptsource, ServerOptions{})
+	if err != nil {
+		corruptsource.Close()
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	defer corrupthandler.Close()
+	corrupt := newCorruptServer(corrupthandler)
+	defer corrupt.Close()
+	opts := HttpOptions{Retries: -1}
+
+	testcases := []struct {
+		Name    string
+		Mirrors []string
+		Valid   bool
+	}{
+		{Name: "parallel", Mirrors: []string{mirror1.URL, mirror2.URL}, Valid: true},
+		{Name: "failover", Mirrors: []string{broken.URL, mirror1.URL}, Valid: true},
+		{Name: "corrupt data", Mirrors: []string{corrupt.URL, mirror1.URL}, Valid: true},
+		{Name: "unreachable", Mirrors: []string{"http://127.0.0.1:1", mirror2.URL}, Valid: true},
+		{Name: "different file", Mirrors: []string{mirror1.URL, other.URL}, Valid: false},
+		{Name: "all broken", Mirrors: []string{broken.URL}, Valid: false},
+	}
+
+	for _, tc := range testcases {
+		targetfile := filepath.Join(tmpdir, "target.txt")
+		var h hasher.Hasher = hasher.NewSHA1Hasher()
+		results, err := CopyMirrorsToLocal(tc.Mirrors, []string{targetfile}, &h, 64, opts)
+		if err == nil && results[0].Err != nil {
+			err = results[0].Err
+		}
+		if !tc.Valid {
+			if err == nil {
+				t.Errorf("[%s] Expected error, got none", tc.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%s] Failed to copy file: %s", tc.Name, err.Error())
+			continue
+		}
+		data, _ := ioutil.ReadFile(targetfile)
+		if !bytes.Equal(data, original) {
+			t.Errorf("[%s] Target file is different", tc.Name)
+		}
+		os.Remove(targetfile)
+
+		if tc.Name == "parallel" && (atomic.LoadInt32(&requests1) == 0 || atomic.LoadInt32(&requests2) == 0) {
+			t.Errorf("[%s] Chunks not requested from all mirrors", tc.Name)
+		}
+		if tc.Name == "failover" && atomic.LoadInt32(&requests3) == 0 {
+			t.Errorf("[%s] Broken mirror not used", tc.Name)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package transmitlib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/cache"
+	"github.com/tsauter/transmit/manifest"
+	"github.com/tsauter/transmit/structs"
+	"io"
+	"os"
+)
+
+const (
+	// PatchVersion is the current version of the patch format.
+	PatchVersion uint16 = 1
+)
+
+// patchMagic identifies a patch file.
+var patchMagic = []byte("TPCH")
+
+// PatchInfo describes a patch, the patch updates a file with the checksum
+// OldChecksum to the file described by New.
+type PatchInfo struct {
+	OldChecksum string
+	New         structs.FileData
+	// the number of chunks contained in the patch
+	Chunks uint64
+}
+
+// chunkGetter returns the details of a single chunk, implemented by all
+// caches and local files.
+type chunkGetter interface {
+	GetChunk(chunkNo uint64) (structs.Chunk, error)
+}
+
+// changedChunks returns all chunks from the channel that are different from
+// the chunk at the same position of other. Chunks missing in other are
+// also different.
+func changedChunks(chunkStreamChan chan structs.ChunkStream, errChan chan error, other chunkGetter) ([]structs.ChunkStream, error) {
+	var changed []structs.ChunkStream
+	for chunkStream := range chunkStreamChan {
+		chunk, err := other.GetChunk(chunkStream.ChunkId)
+		if err == nil && chunkStream.Chunk.Hash == chunk.Hash {
+			continue
+		}
+		changed = append(changed, chunkStream)
+	}
+	if err := <-errChan; err != nil {
+		return nil, errors.Wrap(err, "failed to get chunks")
+	}
+	return changed, nil
+}
+
+// CreatePatch writes a patch to w that updates the file described by the
+// cache database oldcachefile to newfile. The patch contains the manifest of
+// newfile and the data of all chunks that are different. The hash algorithm
+// and chunk size of the old cache are used.
+func CreatePatch(oldcachefile string, newfile string, w io.Writer) (PatchInfo, error) {
+	var info PatchInfo
+
+	old, err := cache.OpenDatabaseFile(oldcachefile)
+	if err != nil {
+		return info, errors.Wrap(err, "failed to open old cache")
+	}
+	defer old.CloseDatabase()
+
+	oldinfo, err := old.GetFileInfo()
+	if err != nil {
+		return info, errors.Wrap(err, "failed to load file info from old cache")
+	}
+	info.OldChecksum = oldinfo.Checksum
+
+	h, err := newHasher(oldinfo.ChunkHashAlgorithm)
+	if err != nil {
+		return info, err
+	}
+	source, err := OpenLocalSource(newfile)
+	if err != nil {
+		return info, errors.Wrap(err, "failed to open new file")
+	}
+	source.cache = cache.NewDefaultMemoryCache()
+	source.ephemeral = true
+	defer source.CloseAndRemove()
+
+	Logger().Info("building cache", "file", newfile)
+	err = source.BuildCache(&h, oldinfo.Chunksize)
+	if err != nil {
+		return info, errors.Wrap(err, "failed to build cache for new file")
+	}
+	info.New, err = source.GetFileInfo()
+	if err != nil {
+		return info, errors.Wrap(err, "failed to get file info for new file")
+	}
+
+	_, chunkStreamChan, errChan := source.GetAllChunks()
+	changed, err := changedChunks(chunkStreamChan, errChan, old)
+	if err != nil {
+		return info, err
+	}
+	info.Chunks = uint64(len(changed))
+
+	err = writePatchHeader(w, info)
+	if err != nil {
+		return info, err
+	}
+
+	numberOfChunks, chunkStreamChan, errChan := source.GetAllChunks()
+	mw := manifest.NewWriter(w, info.New, uint64(numberOfChunks))
+	err = manifest.WriteChunks(mw, chunkStreamChan)
+	if cacheErr := <-errChan; cacheErr != nil {
+		return info, errors.Wrap(cacheErr, "failed to get chunks from cache")
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	if err != nil {
+		return info, errors.Wrap(err, "failed to write manifest")
+	}
+
+	Logger().Info("writing changed chunks", "chunks", len(changed), "total", numberOfChunks)
+	for _, chunkStream := range changed {
+		filepos := int64(chunkStream.ChunkId * uint64(info.New.Chunksize))
+		data, datalen, err := source.ReadChunkData(filepos)
+		if err != nil {
+			return info, errors.Wrapf(err, "failed to read chunk %d", chunkStream.ChunkId)
+		}
+		frame := ChunkFrame{ChunkId: chunkStream.ChunkId, Hash: chunkStream.Chunk.Hash, Data: data[:datalen]}
+		err = WriteChunkFrame(w, frame)
+		if err != nil {
+			return info, errors.Wrap(err, "failed to write patch")
+		}
+	}
+
+	return info, nil
+}
+
+// writePatchHeader writes the magic, the version, the checksum of the old
+// file and the number of chunks.
+func writePatchHeader(w io.Writer, info PatchInfo) error {
+	var buf bytes.Buffer
+	buf.Write(patchMagic)
+	binary.Write(&buf, binary.BigEndian, PatchVersion)
+	binary.Write(&buf, binary.BigEndian, uint16(len(info.OldChecksum)))
+	buf.WriteString(info.OldChecksum)
+	binary.Write(&buf, binary.BigEndian, info.Chunks)
+
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		return errors.Wrap(err, "failed to write patch header")
+	}
+	return nil
+}
+
+// readPatchHeader reads the patch header and the manifest from r, the
+// chunks of the manifest are returned ordered by chunk id.
+func readPatchHeader(r io.Reader) (PatchInfo, []structs.Chunk, error) {
+	var info PatchInfo
+
+	header := make([]byte, len(patchMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return info, nil, errors.Wrap(err, "failed to read patch header")
+	}
+	if !bytes.Equal(header[:len(patchMagic)], patchMagic) {
+		return info, nil, fmt.Errorf("not a patch file")
+	}
+	if version := binary.BigEndian.Uint16(header[len(patchMagic):]); version != PatchVersion {
+		return info, nil, fmt.Errorf("unsupported patch version: %d", version)
+	}
+
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return info, nil, errors.Wrap(err, "failed to read patch header")
+	}
+	checksum := make([]byte, length)
+	if _, err := io.ReadFull(r, checksum); err != nil {
+		return info, nil, errors.Wrap(err, "failed to read patch header")
+	}
+	info.OldChecksum = string(checksum)
+	if err := binary.Read(r, binary.BigEndian, &info.Chunks); err != nil {
+		return info, nil, errors.Wrap(err, "failed to read patch header")
+	}
+
+	mr, err := manifest.NewReader(r)
+	if err != nil {
+		return info, nil, err
+	}
+	info.New = mr.GetFileInfo()
+
+	// the count is not trusted, it must match the size of the file
+	if info.New.Chunksize <= 0 || info.New.Filesize < 0 ||
+		mr.GetChunksCount() > uint64(info.New.Filesize/int64(info.New.Chunksize))+1 {
+		return info, nil, fmt.Errorf("invalid patch header: %d chunks", mr.GetChunksCount())
+	}
+	chunks := make([]structs.Chunk, 0, mr.GetChunksCount())
+	for {
+		chunkStream, err := mr.ReadChunk()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return info, nil, err
+		}
+		chunks = append(chunks, chunkStream.Chunk)
+	}
+
+	return info, chunks, nil
+}
+
+// patchManifest provides the chunks of a patch manifest.
+type patchManifest []structs.Chunk
+
+// GetChunk returns the chunk of the manifest.
+func (pm patchManifest) GetChunk(chunkNo uint64) (structs.Chunk, error) {
+	if chunkNo >= uint64(len(pm)) {
+		return structs.Chunk{}, fmt.Errorf("chunk %d not found", chunkNo)
+	}
+	return pm[chunkNo], nil
+}
+
+// readPatchChunks reads all chunk frames of the patch and verifies the data
+// of each chunk against the manifest. fn is called for each verified chunk.
+func readPatchChunks(r io.Reader, info PatchInfo, chunks patchManifest, fn func(frame ChunkFrame) error) error {
+	h, err := newHasher(info.New.ChunkHashAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < info.Chunks; i++ {
+		frame, err := ReadChunkFrame(r, info.New.Chunksize)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read chunk %d of %d from patch", i+1, info.Chunks)
+		}
+		expected, err := chunks.GetChunk(frame.ChunkId)
+		if err != nil {
+			return errors.Wrap(err, "patch contains invalid chunk")
+		}
+		if frame.Hash != expected.Hash || h.HashChunk(frame.Data) != expected.Hash {
+			return fmt.Errorf("patch contains chunk %d with different hash", frame.ChunkId)
+		}
+
+		err = fn(frame)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ApplyPatch updates the targetfile with the patch read from patchfile. The
+// target must be the old file of the patch, or already be updated. The
+// complete patch is verified before the target is modified. After all chunks
+// are written, the checksum of the target is verified.
+func ApplyPatch(patchfile string, targetfile string) (PatchInfo, error) {
+	f, err := os.Open(patchfile)
+	if err != nil {
+		return PatchInfo{}, errors.Wrap(err, "failed to open patch")
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	info, chunks, err := readPatchHeader(r)
+	if err != nil {
+		return info, err
+	}
+
+	h, err := newHasher(info.New.ChunkHashAlgorithm)
+	if err != nil {
+		return info, err
+	}
+	// a patch updates an existing file, a missing target is never created
+	target, err := OpenLocalTarget(targetfile)
+	if err != nil {
+		return info, errors.Wrap(err, "failed to open target file")
+	}
+	defer target.CloseAndRemove()
+
+	Logger().Info("building target cache", "file", targetfile)
+	err = target.BuildCache(&h, info.New.Chunksize)
+	if err != nil {
+		return info, errors.Wrap(err, "failed to build cache for target file")
+	}
+	targetinfo, err := target.GetFileInfo()
+	if err != nil {
+		return info, errors.Wrap(err, "failed to get file info for target file")
+	}
+	if targetinfo.Checksum == info.New.Checksum {
+		Logger().Info("target file is already up to date", "file", targetfile)
+		return info, nil
+	}
+	if targetinfo.Checksum != info.OldChecksum {
+		return info, fmt.Errorf("target file does not match the patch: checksum %s != %s", targetinfo.Checksum, info.OldChecksum)
+	}
+
+	// the same comparison as for the creation of the patch
+	chunkStreamChan := make(chan structs.ChunkStream, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(errChan)
+		defer close(chunkStreamChan)
+		for pos, chunk := range chunks {
+			chunkStreamChan <- structs.ChunkStream{ChunkId: uint64(pos), Chunk: chunk}
+		}
+	}()
+	changed, err := changedChunks(chunkStreamChan, errChan, target)
+	if err != nil {
+		return info, err
+	}
+	pending := make(map[uint64]bool, len(changed))
+	for _, chunkStream := range changed {
+		pending[chunkStream.ChunkId] = true
+	}
+
+	// verify all chunks of the patch before the target is modified
+	err = readPatchChunks(r, info, chunks, func(frame ChunkFrame) error {
+		delete(pending, frame.ChunkId)
+		return nil
+	})
+	if err == nil && len(pending) > 0 {
+		err = fmt.Errorf("patch does not contain %d different chunks", len(pending))
+	}
+	if err != nil {
+		return info, errors.Wrap(err, "patch is invalid")
+	}
+
+	err = target.SetFilesize(info.New.Filesize)
+	if err != nil {
+		return info, errors.Wrap(err, "unable to resize target file to new filesize")
+	}
+
+	Logger().Info("applying patch", "file", targetfile, "chunks", len(changed))
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return info, errors.Wrap(err, "failed to read patch")
+	}
+	r.Reset(f)
+	_, _, err = readPatchHeader(r)
+	if err == nil {
+		err = readPatchChunks(r, info, chunks, func(frame ChunkFrame) error {
+			filepos := int64(frame.ChunkId * uint64(info.New.Chunksize))
+			return target.WriteChunkData(filepos, frame.Data, len(frame.Data))
+		})
+	}
+	if err != nil {
+		return info, errors.Wrap(err, "failed to write to target")
+	}
+
+	Logger().Info("validating checksum", "file", targetfile)
+	tchecksum, err := h.HashFile(targetfile)
+	if err != nil {
+		return info, errors.Wrapf(err, "failed to calculate checksum: %s", targetfile)
+	}
+	if tchecksum != info.New.Checksum {
+		return info, fmt.Errorf("checksum is different after applying the patch: %s != %s", tchecksum, info.New.Checksum)
+	}
+
+	return info, nil
+}
@@ -0,0 +1,118 @@
+package transmitlib
+
+import (
+	"bytes"
+	"github.com/tsauter/transmit/hasher"
+	"github.com/tsauter/transmit/manifest"
+	"github.com/tsauter/transmit/structs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateApplyPatch(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	olddata := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	newdata := append([]byte{}, olddata...)
+	copy(newdata[200:], []byte("changed"))
+	newdata = append(newdata, []byte("appended data")...)
+
+	oldfile := filepath.Join(tmpdir, "old.bin")
+	newfile := filepath.Join(tmpdir, "new.bin")
+	ioutil.WriteFile(oldfile, olddata, 0644)
+	ioutil.WriteFile(newfile, newdata, 0644)
+
+	var h hasher.Hasher = hasher.NewSHA1Hasher()
+	old, err := OpenLocalSource(oldfile)
+	if err != nil {
+		t.Fatalf("Failed to open test file: %s", err.Error())
+	}
+	err = old.BuildCache(&h, 64)
+	if err != nil {
+		t.Fatalf("Failed to build cache: %s", err.Error())
+	}
+	oldcachefile := old.cache.GetDatabaseFilename()
+	old.Close()
+
+	patchfile := filepath.Join(tmpdir, "update.tpatch")
+	var patch bytes.Buffer
+	info, err := CreatePatch(oldcachefile, newfile, &patch)
+	if err != nil {
+		t.Fatalf("Failed to create patch: %s", err.Error())
+	}
+	// the changed chunk and the last chunk
+	if info.Chunks != 2 || info.New.Filesize != int64(len(newdata)) {
+		t.Errorf("Invalid patch: %v", info)
+	}
+	ioutil.WriteFile(patchfile, patch.Bytes(), 0644)
+
+	// the target is updated, a second apply does not modify it
+	targetfile := filepath.Join(tmpdir, "target.bin")
+	ioutil.WriteFile(targetfile, olddata, 0644)
+	for i := 0; i < 2; i++ {
+		_, err = ApplyPatch(patchfile, targetfile)
+		if err != nil {
+			t.Fatalf("Failed to apply patch: %s", err.Error())
+		}
+		data, _ := ioutil.ReadFile(targetfile)
+		if !bytes.Equal(data, newdata) {
+			t.Errorf("Target file is different after applying the patch")
+		}
+	}
+
+	// a different target is not modified
+	otherdata := bytes.Repeat([]byte("x"), 500)
+	ioutil.WriteFile(targetfile, otherdata, 0644)
+	_, err = ApplyPatch(patchfile, targetfile)
+	if err == nil {
+		t.Errorf("Patch applied to a different file")
+	}
+	if data, _ := ioutil.ReadFile(targetfile); !bytes.Equal(data, otherdata) {
+		t.Errorf("Different target file was modified")
+	}
+
+	// a corrupted patch is rejected before the target is modified
+	corrupted := patch.Bytes()
+	corrupted[len(corrupted)-1] ^= 0xff
+	ioutil.WriteFile(patchfile, corrupted, 0644)
+	ioutil.WriteFile(targetfile, olddata, 0644)
+	_, err = ApplyPatch(patchfile, targetfile)
+	if err == nil {
+		t.Errorf("Corrupted patch applied")
+	}
+	if data, _ := ioutil.ReadFile(targetfile); !bytes.Equal(data, olddata) {
+		t.Errorf("Target file was modified by a corrupted patch")
+	}
+
+	// a missing target is not created
+	missingfile := filepath.Join(tmpdir, "missing.bin")
+	_, err = ApplyPatch(patchfile, missingfile)
+	if err == nil {
+		t.Errorf("Patch applied to a missing file")
+	}
+	if _, err := os.Stat(missingfile); !os.IsNotExist(err) {
+		t.Errorf("Missing target file was created")
+	}
+}
+
+func TestReadPatchHeaderInvalidCount(t *testing.T) {
+	fd := structs.FileData{Filename: "new.bin", Filesize: 1024, Checksum: "abc", ChunkHashAlgorithm: "SHA1", Chunksize: 64}
+
+	for _, count := range []uint64{18, 1 << 62} {
+		var patch bytes.Buffer
+		writePatchHeader(&patch, PatchInfo{OldChecksum: "def", Chunks: 1})
+		// only the header of the manifest is required
+		manifest.NewWriter(&patch, fd, count).Close()
+
+		_, _, err := readPatchHeader(&patch)
+		if err == nil {
+			t.Errorf("Patch with %d chunks accepted", count)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package transmitlib
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/structs"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// PeerAnnounceInterval is the interval a client announces itself to the
+	// tracker and receives new peers.
+	PeerAnnounceInterval = 30 * time.Second
+	// MaxPeerAttempts is the number of peers asked for the chunks of a batch,
+	// before the remaining chunks are requested from the source.
+	MaxPeerAttempts = 3
+	// PeerRequestTimeout is the maximum timeout of the requests to peers,
+	// unreachable peers must not delay the copy.
+	PeerRequestTimeout = 5 * time.Second
+)
+
+// PeerOptions contains the options for the exchange of chunks with other
+// clients (peers). The source must track the peers.
+type PeerOptions struct {
+	// Request chunks from other clients before the source.
+	Enabled bool
+	// The address of the local peer server, the verified chunks of the
+	// target are served to other clients. No chunks are served if empty.
+	ListenAddress string
+	// The url of the local peer server announced to other clients,
+	// e.g. http://client1:9090.
+	Address string
+	// The time the chunks are served after the copy is finished.
+	SeedTime time.Duration
+}
+
+// PeerServer serves the chunks of a target file to other clients. Only chunks
+// matching the chunk list of the source are served, the chunks are read and
+// verified for every request.
+type PeerServer struct {
+	filename string
+	fileinfo structs.FileData
+	hashes   []string
+	router   *mux.Router
+	server   *http.Server
+}
+
+// NewPeerServer returns a peer server for the target file, hashes are the
+// chunk hashes of the source.
+func NewPeerServer(filename string, fileinfo structs.FileData, hashes []string) *PeerServer {
+	ps := &PeerServer{filename: filename, fileinfo: fileinfo, hashes: hashes, router: mux.NewRouter()}
+	ps.router.Use(RequestIDMiddleware)
+	ps.router.HandleFunc("/ReadChunksData", ps.readChunksData).Methods("GET").Name("ReadChunksData")
+	return ps
+}
+
+// ServeHTTP passes the request to the router.
+func (ps *PeerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ps.router.ServeHTTP(w, r)
+}
+
+// Start serves the chunks on listenAddress in the background.
+func (ps *PeerServer) Start(listenAddress string) error {
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen on peer address")
+	}
+
+	ps.server = &http.Server{Handler: ps, ReadTimeout: DefaultReadTimeout, IdleTimeout: DefaultIdleTimeout}
+	go func() {
+		err := ps.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			Logger().Error("peer server failed", "error", err.Error())
+		}
+	}()
+	Logger().Info("serving chunks to peers", "address", listenAddress)
+	return nil
+}
+
+// Close stops the peer server.
+func (ps *PeerServer) Close() error {
+	if ps.server == nil {
+		return nil
+	}
+	return ps.server.Close()
+}
+
+// readChunksData sends all requested chunks of the target file that match the
+// chunk list of the source, all other chunks are left out.
+func (ps *PeerServer) readChunksData(w http.ResponseWriter, r *http.Request) {
+	id := strconv.Quote(ps.fileinfo.Checksum)
+	w.Header().Set("ETag", id)
+	if header := r.Header.Get("If-Match"); header != "" && !matchesVersion(header, ps.fileinfo.Checksum) {
+		http.Error(w, "version not served", http.StatusPreconditionFailed)
+		return
+	}
+
+	chunkIds, err := ParseChunkRanges(r.URL.Query().Get("chunks"), MaxBatchChunks)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		requestLogger(r).Warn("invalid chunk ranges", "chunks", r.URL.Query().Get("chunks"), "error", err.Error())
+		return
+	}
+
+	h, err := newHasher(ps.fileinfo.ChunkHashAlgorithm)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Open(ps.filename)
+	if err != nil {
+		http.Error(w, "file not available", http.StatusNotFound)
+		requestLogger(r).Warn("failed to open target file", "error", err.Error())
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", batchContentType)
+	sent := 0
+	buf := make([]byte, ps.fileinfo.Chunksize)
+	for _, chunkno := range chunkIds {
+		if chunkno >= uint64(len(ps.hashes)) {
+			continue
+		}
+		n, err := f.ReadAt(buf, int64(chunkno*uint64(ps.fileinfo.Chunksize)))
+		if err != nil && err != io.EOF {
+			requestLogger(r).Warn("failed to read chunk data", "chunk", chunkno, "error", err.Error())
+			continue
+		}
+		if h.HashChunk(buf[:n]) != ps.hashes[chunkno] {
+			continue
+		}
+
+		err = WriteChunkFrame(w, ChunkFrame{ChunkId: chunkno, Hash: ps.hashes[chunkno], Data: buf[:n]})
+		if err != nil {
+			requestLogger(r).Warn("failed to send chunk data", "chunk", chunkno, "error", err.Error())
+			return
+		}
+		sent++
+	}
+	requestLogger(r).Debug("sent chunk data to peer", "requested", len(chunkIds), "sent", sent)
+}
+
+// peerSwarm requests chunks from the peers announced by the tracker of the
+// source. Peers sending invalid data or failing are not used any more.
+type peerSwarm struct {
+	origin  *HttpFile
+	opts    HttpOptions
+	address string
+	// the hash algorithm used to verify the chunks of the peers
+	algorithm string
+	// the chunk size of the origin, peers can not send larger chunks
+	chunksize int
+	mu        sync.Mutex
+	peers     []*HttpFile
+	known     map[string]bool
+	announced time.Time
+}
+
+// newPeerSwarm returns a swarm for the peers of the origin. The credentials
+// of the origin are never sent to peers.
+func newPeerSwarm(origin *HttpFile, fileinfo structs.FileData, opts HttpOptions) *peerSwarm {
+	timeout := opts.Timeout
+	if timeout <= 0 || timeout > PeerRequestTimeout {
+		timeout = PeerRequestTimeout
+	}
+	peeropts := HttpOptions{
+		CAFile:             opts.CAFile,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+		Timeout:            timeout,
+		Retries:            -1,
+		ErrorBudget:        -1,
+		BandwidthLimit:     opts.BandwidthLimit,
+	}
+	return &peerSwarm{
+		origin:    origin,
+		opts:      peeropts,
+		address:   opts.Peer.Address,
+		algorithm: fileinfo.ChunkHashAlgorithm,
+		chunksize: fileinfo.Chunksize,
+		known:     map[string]bool{opts.Peer.Address: true},
+	}
+}
+
+// announce registers the local peer server with the tracker and adds all new
+// peers, at most once per PeerAnnounceInterval.
+func (ps *peerSwarm) announce() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if time.Since(ps.announced) < PeerAnnounceInterval {
+		return
+	}
+	ps.announced = time.Now()
+
+	addresses, err := ps.origin.AnnouncePeer(ps.address)
+	if err != nil {
+		Logger().Warn("failed to announce peer", "error", err.Error())
+		return
+	}
+
+	ps.origin.mu.Lock()
+	version := ps.origin.version
+	ps.origin.mu.Unlock()
+	for _, address := range addresses {
+		if ps.known[address] {
+			continue
+		}
+		ps.known[address] = true
+
+		u, err := url.Parse(address)
+		if err != nil {
+			continue
+		}
+		peer, err := OpenHttpSource(u, ps.opts)
+		if err != nil {
+			Logger().Warn("failed to open peer", "peer", address, "error", err.Error())
+			continue
+		}
+		// the peer must serve the same version as the origin, the
+		// file info of the peer is never requested
+		peer.version = version
+		peer.chunksize = ps.chunksize
+		ps.peers = append(ps.peers, peer)
+	}
+}
+
+// candidates returns up to max peers.
+func (ps *peerSwarm) candidates(max int) []*HttpFile {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if len(ps.peers) < max {
+		max = len(ps.peers)
+	}
+	return append([]*HttpFile{}, ps.peers[:max]...)
+}
+
+// remove stops using the peer.
+func (ps *peerSwarm) remove(peer *HttpFile, err error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for i, p := range ps.peers {
+		if p == peer {
+			ps.peers = append(ps.peers[:i], ps.peers[i+1:]...)
+			break
+		}
+	}
+	Logger().Warn("peer removed", "peer", peer.baseUrl.String(), "error", err.Error())
+}
+
+// wrap returns a chunkReader that requests the chunks from the peers first,
+// the remaining chunks are requested with read from the source.
+func (ps *peerSwarm) wrap(read chunkReader) chunkReader {
+	return func(chunks []structs.ChunkStream, fn func(frame ChunkFrame) error) error {
+		ps.announce()
+
+		remaining := chunks
+		for _, peer := range ps.candidates(MaxPeerAttempts) {
+			if len(remaining) == 0 {
+				break
+			}
+			var err error
+			remaining, err = ps.readFromPeer(peer, remaining, fn)
+			if err != nil {
+				return err
+			}
+		}
+
+		return read(remaining, fn)
+	}
+}
+
+// readFromPeer requests the chunks from the peer and verifies the data of each
+// chunk with the hash of the source. The chunks not received are returned.
+// Only errors of fn are returned, the peer is removed after other errors.
+func (ps *peerSwarm) readFromPeer(peer *HttpFile, chunks []structs.ChunkStream, fn func(frame ChunkFrame) error) ([]structs.ChunkStream, error) {
+	h, err := newHasher(ps.algorithm)
+	if err != nil {
+		return chunks, err
+	}
+
+	expected := make(map[uint64]string, len(chunks))
+	chunkIds := make([]uint64, 0, len(chunks))
+	for _, chunkStream := range chunks {
+		expected[chunkStream.ChunkId] = chunkStream.Chunk.Hash
+		chunkIds = append(chunkIds, chunkStream.ChunkId)
+	}
+
+	received := map[uint64]bool{}
+	err = peer.ReadChunkDataBatch(chunkIds, func(frame ChunkFrame) error {
+		hash, ok := expected[frame.ChunkId]
+		if !ok {
+			return fmt.Errorf("received unexpected chunk from peer: %d", frame.ChunkId)
+		}
+		if h.HashChunk(frame.Data) != hash {
+			return fmt.Errorf("received chunk %d with different data from peer", frame.ChunkId)
+		}
+
+		err := fn(frame)
+		if err != nil {
+			return callbackError{err}
+		}
+		received[frame.ChunkId] = true
+		return nil
+	})
+	if err != nil {
+		if cbErr, ok := errors.Cause(err).(callbackError); ok {
+			return chunks, cbErr.err
+		}
+		// peers serve only the chunks they already have
+		if !errors.Is(err, ErrIncompleteBatch) {
+			ps.remove(peer, err)
+		}
+	}
+
+	var remaining []structs.ChunkStream
+	for _, chunkStream := range chunks {
+		if !received[chunkStream.ChunkId] {
+			remaining = append(remaining, chunkStream)
+		}
+	}
+	if len(received) > 0 {
+		Logger().Debug("received chunks from peer", "peer", peer.baseUrl.String(), "chunks", len(received))
+	}
+	return remaining, nil
+}
+
+// startPeers starts the peer server for the targetfile, if enabled, and
+// returns the reader requesting the chunks from the peers first. The returned
+// function stops the peer server after the seed time.
+func startPeers(source *HttpFile, read chunkReader, targetfile string, opts HttpOptions) (chunkReader, func(), error) {
+	fileinfo, err := source.GetFileInfo()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get file info for source file")
+	}
+	swarm := newPeerSwarm(source, fileinfo, opts)
+	if opts.Peer.ListenAddress == "" {
+		return swarm.wrap(read), func() {}, nil
+	}
+
+	if err := validPeerAddress(opts.Peer.Address); err != nil {
+		return nil, nil, err
+	}
+	// peers serve the chunks without authentication
+	if opts.BearerToken != "" || opts.Username != "" || opts.ClientCertFile != "" {
+		return nil, nil, fmt.Errorf("chunks of sources requiring credentials are not served to peers")
+	}
+	_, chunkStreamChan, errChan := source.GetAllChunks()
+	var hashes []string
+	for chunkStream := range chunkStreamChan {
+		for uint64(len(hashes)) <= chunkStream.ChunkId {
+			hashes = append(hashes, "")
+		}
+		hashes[chunkStream.ChunkId] = chunkStream.Chunk.Hash
+	}
+	if err := <-errChan; err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get chunks from source")
+	}
+
+	server := NewPeerServer(targetfile, fileinfo, hashes)
+	err = server.Start(opts.Peer.ListenAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := func() {
+		// the peer is announced again, otherwise it expires in the tracker
+		if opts.Peer.SeedTime > 0 {
+			Logger().Info("serving chunks to peers after the copy", "duration", opts.Peer.SeedTime)
+		}
+		deadline := time.Now().Add(opts.Peer.SeedTime)
+		for remaining := time.Until(deadline); remaining > 0; remaining = time.Until(deadline) {
+			swarm.announce()
+			if remaining > PeerAnnounceInterval {
+				remaining = PeerAnnounceInterval
+			}
+			time.Sleep(remaining)
+		}
+		server.Close()
+	}
+	return swarm.wrap(read), stop, nil
+}
@@ -0,0 +1,269 @@
+package transmitlib
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/hasher"
+	"github.com/tsauter/transmit/structs"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTrackerAnnounce(t *testing.T) {
+	now := time.Now()
+	tr := NewTracker(time.Minute)
+	tr.now = func() time.Time { return now }
+
+	if peers, _ := tr.Announce("c1", "http://a", "client1"); len(peers) != 0 {
+		t.Errorf("Expected no peers, got %v", peers)
+	}
+	if peers, _ := tr.Announce("c1", "http://b", "client2"); len(peers) != 1 || peers[0] != "http://a" {
+		t.Errorf("Expected peer a, got %v", peers)
+	}
+	peers, _ := tr.Announce("c1", "", "client3")
+	sort.Strings(peers)
+	if len(peers) != 2 || peers[0] != "http://a" || peers[1] != "http://b" {
+		t.Errorf("Expected peers a and b, got %v", peers)
+	}
+	if peers, _ := tr.Announce("c2", "", "client3"); len(peers) != 0 {
+		t.Errorf("Expected no peers for another version, got %v", peers)
+	}
+
+	// a expires, b is announced again
+	now = now.Add(40 * time.Second)
+	tr.Announce("c1", "http://b", "client2")
+	now = now.Add(40 * time.Second)
+	if peers, _ := tr.Announce("c1", "", "client3"); len(peers) != 1 || peers[0] != "http://b" {
+		t.Errorf("Expected only peer b, got %v", peers)
+	}
+
+	// a single client can not register an unlimited number of peers
+	for i := 0; i < MaxPeersPerClient; i++ {
+		if _, err := tr.Announce("c3", "http://c"+strconv.Itoa(i), "client4"); err != nil {
+			t.Fatalf("Failed to announce peer %d: %s", i, err.Error())
+		}
+	}
+	if _, err := tr.Announce("c3", "http://d", "client4"); err != ErrTooManyPeers {
+		t.Errorf("Expected too many peers, got %v", err)
+	}
+	if _, err := tr.Announce("c3", "http://c0", "client4"); err != nil {
+		t.Errorf("Failed to renew peer: %s", err.Error())
+	}
+	for i := 0; len(tr.peers["c3"]) < MaxTrackedPeers; i++ {
+		tr.Announce("c3", "http://e"+strconv.Itoa(i), "client"+strconv.Itoa(i+10))
+	}
+	if _, err := tr.Announce("c3", "http://f", "client5"); err != ErrTooManyPeers {
+		t.Errorf("Expected too many peers, got %v", err)
+	}
+}
+
+// startPeer serves the data as target file of a peer, the hashes are taken
+// from the source.
+func startPeer(t *testing.T, tmpdir string, name string, source *LocalFile, data []byte) *httptest.Server {
+	targetfile := filepath.Join(tmpdir, name)
+	err := ioutil.WriteFile(targetfile, data, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write peer file: %s", err.Error())
+	}
+
+	fileinfo, err := source.GetFileInfo()
+	if err != nil {
+		t.Fatalf("Failed to get file info: %s", err.Error())
+	}
+	_, chunkStreamChan, errChan := source.GetAllChunks()
+	hashes := map[uint64]string{}
+	for chunkStream := range chunkStreamChan {
+		hashes[chunkStream.ChunkId] = chunkStream.Chunk.Hash
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("Failed to get chunks: %s", err.Error())
+	}
+
+	list := make([]string, len(hashes))
+	for id, hash := range hashes {
+		list[id] = hash
+	}
+	return httptest.NewServer(NewPeerServer(targetfile, fileinfo, list))
+}
+
+func TestPeerServer(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	defer source.Close()
+	original, _ := ioutil.ReadFile(filepath.Join(tmpdir, "test2.txt"))
+	fileinfo, _ := source.GetFileInfo()
+
+	// the second chunk of the peer is not copied yet
+	data := append([]byte{}, original...)
+	copy(data[64:128], bytes.Repeat([]byte{0}, 64))
+	server := startPeer(t, tmpdir, "peer.txt", source, data)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	peer, err := OpenHttpSource(u, HttpOptions{Retries: -1})
+	if err != nil {
+		t.Fatalf("Failed to open peer: %s", err.Error())
+	}
+	peer.version = strconv.Quote(fileinfo.Checksum)
+	peer.chunksize = fileinfo.Chunksize
+
+	var received []uint64
+	err = peer.ReadChunkDataBatch([]uint64{0, 1, 2}, func(frame ChunkFrame) error {
+		received = append(received, frame.ChunkId)
+		return nil
+	})
+	if !errors.Is(err, ErrIncompleteBatch) {
+		t.Errorf("Expected incomplete batch, got %v", err)
+	}
+	if len(received) != 2 || received[0] != 0 || received[1] != 2 {
+		t.Errorf("Expected chunks 0 and 2, got %v", received)
+	}
+
+	// other versions of the file are not served
+	peer.version = strconv.Quote("other")
+	err = peer.ReadChunkDataBatch([]uint64{0}, func(frame ChunkFrame) error {
+		return nil
+	})
+	if !errors.Is(err, ErrSourceChanged) {
+		t.Errorf("Expected changed source, got %v", err)
+	}
+}
+
+func TestCopyHttpToLocalPeers(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	original, _ := ioutil.ReadFile(filepath.Join(tmpdir, "test2.txt"))
+	fileinfo, _ := source.GetFileInfo()
+	tracker := NewTracker(DefaultPeerTTL)
+	handler, err := NewSourceHandler(source, ServerOptions{Tracker: tracker})
+	if err != nil {
+		source.Close()
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	defer handler.Close()
+
+	var requests int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/ReadChunksData") {
+			atomic.AddInt32(&requests, 1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer origin.Close()
+
+	seed := startPeer(t, tmpdir, "seed.txt", source, original)
+	defer seed.Close()
+	corrupt := startPeer(t, tmpdir, "corrupt.txt", source, bytes.Repeat([]byte{'x'}, len(original)))
+	defer corrupt.Close()
+	// the peer announces huge chunks, the frame header 4 GiB of data
+	oversized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/GetFileInfo" {
+			json.NewEncoder(w).Encode(structs.FileData{Filesize: 1 << 40, Chunksize: 1 << 31})
+			return
+		}
+		w.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff})
+	}))
+	defer oversized.Close()
+
+	testcases := []struct {
+		Name     string
+		Peers    []string
+		Requests bool
+	}{
+		{Name: "seed", Peers: []string{seed.URL}, Requests: false},
+		{Name: "corrupt", Peers: []string{corrupt.URL}, Requests: true},
+		{Name: "oversized", Peers: []string{oversized.URL}, Requests: true},
+		{Name: "unreachable", Peers: []string{"http://127.0.0.1:1"}, Requests: true},
+	}
+
+	for _, tc := range testcases {
+		tracker.peers = map[string]map[string]trackedPeer{}
+		for _, peer := range tc.Peers {
+			tracker.Announce(fileinfo.Checksum, peer, "client")
+		}
+		atomic.StoreInt32(&requests, 0)
+
+		targetfile := filepath.Join(tmpdir, "target.txt")
+		var h hasher.Hasher = hasher.NewSHA1Hasher()
+		err := CopyHttpToLocal(origin.URL, targetfile, &h, 64, HttpOptions{Retries: -1, Peer: PeerOptions{Enabled: true}})
+		if err != nil {
+			t.Errorf("[%s] Failed to copy file: %s", tc.Name, err.Error())
+			continue
+		}
+		data, _ := ioutil.ReadFile(targetfile)
+		if !bytes.Equal(data, original) {
+			t.Errorf("[%s] Target file is different", tc.Name)
+		}
+		os.Remove(targetfile)
+
+		if got := atomic.LoadInt32(&requests) > 0; got != tc.Requests {
+			t.Errorf("[%s] Chunks requested from the source: %t, expected %t", tc.Name, got, tc.Requests)
+		}
+	}
+
+	// a client serving its chunks is announced to other clients
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find free port: %s", err.Error())
+	}
+	listenaddress := listener.Addr().String()
+	listener.Close()
+	tracker.peers = map[string]map[string]trackedPeer{}
+	targetfile := filepath.Join(tmpdir, "target.txt")
+	var h hasher.Hasher = hasher.NewSHA1Hasher()
+	peeropts := PeerOptions{Enabled: true, ListenAddress: listenaddress, Address: "http://" + listenaddress}
+	err = CopyHttpToLocal(origin.URL, targetfile, &h, 64, HttpOptions{Retries: -1, Peer: peeropts})
+	if err != nil {
+		t.Errorf("Failed to copy file with peer server: %s", err.Error())
+	}
+	if peers, _ := tracker.Announce(fileinfo.Checksum, "", "client"); len(peers) != 1 || peers[0] != peeropts.Address {
+		t.Errorf("Expected announced peer %s, got %v", peeropts.Address, peers)
+	}
+	os.Remove(targetfile)
+
+	// chunks of sources requiring credentials are never served to peers
+	err = CopyHttpToLocal(origin.URL, targetfile, &h, 64, HttpOptions{Retries: -1, BearerToken: "secret-token", Peer: peeropts})
+	if err == nil {
+		t.Errorf("Peer server started for a source with credentials")
+	}
+	os.Remove(targetfile)
+
+	// sources without tracker do not stop the copy
+	plaindir := filepath.Join(tmpdir, "plain")
+	os.Mkdir(plaindir, 0755)
+	plainsource := openTestSource(t, plaindir, "test2.txt")
+	plain, err := NewSourceHandler(plainsource, ServerOptions{})
+	if err != nil {
+		plainsource.Close()
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	defer plain.Close()
+	server := httptest.NewServer(plain)
+	defer server.Close()
+	err = CopyHttpToLocal(server.URL, targetfile, &h, 64, HttpOptions{Retries: -1, Peer: PeerOptions{Enabled: true}})
+	if err != nil {
+		t.Errorf("Failed to copy file without tracker: %s", err.Error())
+	}
+}
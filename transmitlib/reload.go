@@ -0,0 +1,396 @@
+package transmitlib
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/cache"
+	"github.com/tsauter/transmit/manifest"
+	"github.com/tsauter/transmit/structs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSourceChanged is returned by http sources if the file was changed on the
+// server during the transfer. The transfer must be started again.
+var ErrSourceChanged = errors.New("source file changed on the server")
+
+// versionKey is the context key of the source version of a request.
+type versionKey struct{}
+
+// sourceVersion is a loaded version of the served file and its cache.
+type sourceVersion struct {
+	source    *LocalFile
+	fileinfo  structs.FileData
+	signature manifest.Signature
+	signed    bool
+	// the version id, sent as ETag with every response
+	id string
+	// the active requests of this version
+	active sync.WaitGroup
+	// set to 1 if the file was modified in place, the data does not
+	// match the cache anymore
+	stale int32
+}
+
+// newSourceVersion returns the version of the source, the cache of the
+// source must be loaded. A signature must match the cache.
+func newSourceVersion(source *LocalFile) (*sourceVersion, error) {
+	fileinfo, err := source.GetFileInfo()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get file info for source file")
+	}
+	v := &sourceVersion{source: source, fileinfo: fileinfo, id: fileinfo.Checksum}
+
+	// never serve a signature that does not match the cache
+	signature, err := source.GetSignature()
+	switch err {
+	case nil:
+		err = source.VerifySignature(signature.PublicKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "signature does not match the source cache, run gencache again")
+		}
+		Logger().Info("source cache is signed")
+		v.signature = signature
+		v.signed = true
+	case ErrNotSigned:
+	default:
+		return nil, errors.Wrap(err, "failed to load signature for source file")
+	}
+
+	return v, nil
+}
+
+// close waits for all active requests and closes the source.
+func (v *sourceVersion) close() error {
+	v.active.Wait()
+	if v.source.ephemeral {
+		return v.source.CloseAndRemove()
+	}
+	return v.source.Close()
+}
+
+// requestVersion returns the source version of the request.
+func requestVersion(r *http.Request) *sourceVersion {
+	return r.Context().Value(versionKey{}).(*sourceVersion)
+}
+
+// acquire returns the current version, the caller must call active.Done
+// when it is finished.
+func (sh *SourceHandler) acquire() *sourceVersion {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	v := sh.current
+	v.active.Add(1)
+	return v
+}
+
+// swap serves the new version from now on, the previous version is closed
+// after all its active requests are finished. False is returned if the
+// handler is already closed.
+func (sh *SourceHandler) swap(v *sourceVersion) bool {
+	sh.mu.Lock()
+	if sh.closed {
+		sh.mu.Unlock()
+		return false
+	}
+	old := sh.current
+	sh.current = v
+	sh.mu.Unlock()
+
+	go func() {
+		err := old.close()
+		if err != nil {
+			Logger().Warn("failed to close previous version", "version", old.id, "error", err.Error())
+		}
+	}()
+	return true
+}
+
+// acquireVersion returns the current version, or the stored version with the
+// checksum. The caller must call active.Done when it is finished.
+func (sh *SourceHandler) acquireVersion(checksum string) (*sourceVersion, bool) {
+	v := sh.acquire()
+	if checksum == "" || checksum == v.id {
+		return v, true
+	}
+	v.active.Done()
+
+	if sh.snapshots == nil {
+		return nil, false
+	}
+	return sh.snapshots.acquire(checksum)
+}
+
+// storeSnapshot stores a snapshot of the version, if snapshots are enabled.
+// The caller must make sure the version is not closed.
+func (sh *SourceHandler) storeSnapshot(v *sourceVersion) {
+	if sh.snapshots == nil {
+		return
+	}
+	err := sh.snapshots.Add(v)
+	if err != nil {
+		Logger().Error("failed to store snapshot", "checksum", v.id, "error", err.Error())
+	}
+}
+
+// Close closes the source of the current version, after all active requests
+// are finished.
+func (sh *SourceHandler) Close() error {
+	sh.mu.Lock()
+	sh.closed = true
+	v := sh.current
+	sh.mu.Unlock()
+
+	return v.close()
+}
+
+// versionMiddleware passes the current version of the source, or the stored
+// version selected by the checksum in the path, to the handlers and sends its
+// id as ETag. Requests for a different version (If-Match header) are rejected
+// with 412 Precondition Failed, the client must start the transfer again.
+func (sh *SourceHandler) versionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := sh.acquireVersion(mux.Vars(r)["checksum"])
+		if !ok {
+			http.Error(w, "version not found", http.StatusNotFound)
+			return
+		}
+		defer v.active.Done()
+
+		w.Header().Set("ETag", strconv.Quote(v.id))
+		if match := r.Header.Get("If-Match"); match != "" && !matchesVersion(match, v.id) {
+			http.Error(w, ErrSourceChanged.Error(), http.StatusPreconditionFailed)
+			requestLogger(r).Info("rejected request for previous version", "version", match, "current", v.id)
+			return
+		}
+
+		// the data of the file does not match the cache until the
+		// new cache is complete, clients retry the request
+		if atomic.LoadInt32(&v.stale) == 1 {
+			w.Header().Set("Retry-After", "10")
+			http.Error(w, "source file is being reloaded", http.StatusServiceUnavailable)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), versionKey{}, v)))
+	})
+}
+
+// matchesVersion returns true if the If-Match header contains the version id.
+func matchesVersion(header string, id string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == strconv.Quote(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameFileState returns true if both details describe the same and
+// unmodified file.
+func sameFileState(a os.FileInfo, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// Watch checks the source file every interval and reloads it after it was
+// modified or replaced. The file is reloaded when it was not modified for one
+// interval. The cache is rebuilt in the background, with the hash algorithm
+// and chunk size of the current version, and the current version is served
+// until the new cache is complete. Watch returns when the context is done.
+func (sh *SourceHandler) Watch(ctx context.Context, interval time.Duration) {
+	atomic.StoreInt32(&sh.watching, 1)
+
+	last, err := os.Stat(sh.filename)
+	if err != nil {
+		Logger().Warn("failed to check source file", "file", sh.filename, "error", err.Error())
+	}
+
+	// a cache created before the last modification is rebuilt immediately
+	v := sh.acquire()
+	changed := v.source.CheckCache() != nil
+	if changed {
+		Logger().Warn("source cache does not match the file, rebuilding cache", "file", sh.filename)
+		atomic.StoreInt32(&v.stale, 1)
+	}
+	v.active.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fstat, err := os.Stat(sh.filename)
+		if err != nil {
+			Logger().Warn("failed to check source file", "file", sh.filename, "error", err.Error())
+			continue
+		}
+		if last == nil || !sameFileState(fstat, last) {
+			// wait until the file is completely written
+			Logger().Info("source file modified", "file", sh.filename, "size", fstat.Size())
+			last = fstat
+			changed = true
+			sh.checkModifiedInPlace(fstat)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		err = sh.reload(ctx)
+		if err != nil {
+			Logger().Error("failed to reload source file", "file", sh.filename, "error", err.Error())
+			continue
+		}
+		changed = false
+	}
+}
+
+// checkModifiedInPlace marks the current version as stale, if the open file
+// of the version was modified. A replaced file is not relevant, the version
+// still reads the previous file.
+func (sh *SourceHandler) checkModifiedInPlace(fstat os.FileInfo) {
+	v := sh.acquire()
+	defer v.active.Done()
+
+	current, err := v.source.f.Stat()
+	if err != nil || os.SameFile(current, fstat) {
+		Logger().Warn("source file modified in place, rejecting requests until the cache is rebuilt", "file", sh.filename)
+		atomic.StoreInt32(&v.stale, 1)
+	}
+}
+
+// reload rebuilds the cache of the source file and serves the new version.
+// The rebuilt cache replaces the stored cache of the file.
+func (sh *SourceHandler) reload(ctx context.Context) error {
+	v := sh.acquire()
+	previous := v.fileinfo
+	signed := v.signed
+	v.active.Done()
+
+	// clients with a trusted key would reject the rebuilt cache, the
+	// signed version is served until the server is restarted
+	if signed {
+		atomic.StoreInt32(&sh.unsignedReload, 1)
+		return fmt.Errorf("signed source file can not be reloaded, run gencache with the signing key and restart the server")
+	}
+
+	h, err := newHasher(previous.ChunkHashAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	// the new cache is kept in memory, the stored cache is still
+	// used by the current version
+	source, err := OpenLocalSource(sh.filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to open source file")
+	}
+	source.cache = cache.NewDefaultMemoryCache()
+	source.ephemeral = true
+	source.quiet = true
+
+	before, err := source.f.Stat()
+	if err != nil {
+		source.CloseAndRemove()
+		return errors.Wrap(err, "failed to get file details")
+	}
+
+	Logger().Info("rebuilding source cache", "file", sh.filename, "size", before.Size())
+	started := time.Now()
+	err = source.BuildCache(&h, previous.Chunksize)
+	if err != nil {
+		source.CloseAndRemove()
+		return errors.Wrap(err, "failed to build cache")
+	}
+
+	// the file was modified during the rebuild, try again later
+	after, err := os.Stat(sh.filename)
+	if err != nil || !sameFileState(before, after) {
+		source.CloseAndRemove()
+		return fmt.Errorf("file modified during cache rebuild")
+	}
+	if ctx.Err() != nil {
+		source.CloseAndRemove()
+		return ctx.Err()
+	}
+
+	next, err := newSourceVersion(source)
+	if err != nil {
+		source.CloseAndRemove()
+		return err
+	}
+	// the new version must not be closed before its snapshot is stored
+	next.active.Add(1)
+	if !sh.swap(next) {
+		next.active.Done()
+		next.close()
+		return fmt.Errorf("server is closed")
+	}
+	Logger().Info("source file reloaded", "file", sh.filename, "version", next.id, "previous", previous.Checksum, "duration", time.Since(started))
+
+	err = persistCache(source)
+	if err != nil {
+		Logger().Warn("failed to store rebuilt cache, run gencache before the next start", "file", sh.filename, "error", err.Error())
+	}
+	sh.storeSnapshot(next)
+	next.active.Done()
+
+	return nil
+}
+
+// persistCache replaces the stored cache of the file with the cache of the
+// source. The stored database is replaced with a new file, an open database
+// of a previous version is not modified.
+func persistCache(source *LocalFile) error {
+	cachename, err := cache.CacheName(source.filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to get cache name")
+	}
+	dbfilename, err := cache.DatabaseFilename(cache.DefaultBackend, cachename)
+	if err != nil {
+		return err
+	}
+
+	tmp := cache.NewDefaultCacheDB()
+	err = tmp.InitDatabase(dbfilename + ".reload")
+	if err != nil {
+		return errors.Wrap(err, "failed to create cache database")
+	}
+	err = cache.CopyCache(tmp, source.cache)
+	if err != nil {
+		tmp.Cleanup()
+		return err
+	}
+	err = tmp.CloseDatabase()
+	if err != nil {
+		os.Remove(tmp.GetDatabaseFilename())
+		return errors.Wrap(err, "failed to close cache database")
+	}
+
+	// the signature of the previous cache is invalid
+	err = os.Remove(cachename + ".sig")
+	if err != nil && !os.IsNotExist(err) {
+		os.Remove(tmp.GetDatabaseFilename())
+		return errors.Wrap(err, "failed to remove signature")
+	}
+
+	err = os.Rename(tmp.GetDatabaseFilename(), dbfilename)
+	if err != nil {
+		os.Remove(tmp.GetDatabaseFilename())
+		return errors.Wrap(err, "failed to replace cache database")
+	}
+
+	return nil
+}
@@ -0,0 +1,247 @@
+package transmitlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/tsauter/transmit/hasher"
+	"github.com/tsauter/transmit/structs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// replaceFile replaces the file with a new file, like a deployment of a new release.
+func replaceFile(t *testing.T, filename string, data []byte) {
+	err := ioutil.WriteFile(filename+".new", data, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write test file: %s", err.Error())
+	}
+	err = os.Rename(filename+".new", filename)
+	if err != nil {
+		t.Fatalf("Failed to replace test file: %s", err.Error())
+	}
+}
+
+// getFileInfo requests the file info and returns the file info and the version.
+func getFileInfo(t *testing.T, handler http.Handler, version string) (structs.FileData, string, int) {
+	var fd structs.FileData
+	req := httptest.NewRequest("GET", "/GetFileInfo", nil)
+	if version != "" {
+		req.Header.Set("If-Match", version)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code == http.StatusOK {
+		err := json.Unmarshal(w.Body.Bytes(), &fd)
+		if err != nil {
+			t.Fatalf("Invalid file info: %s", err.Error())
+		}
+	}
+	return fd, w.Header().Get("ETag"), w.Code
+}
+
+func TestMatchesVersion(t *testing.T) {
+	testcases := []struct {
+		Header string
+		Match  bool
+	}{
+		{Header: `"abc"`, Match: true},
+		{Header: `"xyz", "abc"`, Match: true},
+		{Header: `*`, Match: true},
+		{Header: `"xyz"`, Match: false},
+		{Header: `abc`, Match: false},
+	}
+
+	for _, tc := range testcases {
+		if matchesVersion(tc.Header, "abc") != tc.Match {
+			t.Errorf("Invalid result for %s: %t", tc.Header, !tc.Match)
+		}
+	}
+}
+
+func TestSourceReload(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	sourcefile := filepath.Join(tmpdir, "test2.txt")
+	handler, err := NewSourceHandler(source, ServerOptions{})
+	if err != nil {
+		source.Close()
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	defer handler.Close()
+
+	fd, version, _ := getFileInfo(t, handler, "")
+	if version != strconv.Quote(fd.Checksum) {
+		t.Fatalf("Invalid version: %s", version)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go handler.Watch(ctx, 10*time.Millisecond)
+
+	// the new file is served after the cache was rebuilt
+	replaceFile(t, sourcefile, []byte("the new release of the file"))
+	var reloaded structs.FileData
+	var newVersion string
+	for i := 0; i < 200; i++ {
+		reloaded, newVersion, _ = getFileInfo(t, handler, "")
+		if newVersion != version {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if newVersion == version {
+		t.Fatalf("File not reloaded")
+	}
+	if reloaded.Filesize != 27 || reloaded.Chunksize != fd.Chunksize || reloaded.ChunkHashAlgorithm != fd.ChunkHashAlgorithm {
+		t.Errorf("Invalid file info of reloaded file: %v", reloaded)
+	}
+
+	// requests for the previous version are rejected
+	if _, _, code := getFileInfo(t, handler, version); code != http.StatusPreconditionFailed {
+		t.Errorf("Request for previous version accepted: %d", code)
+	}
+	if _, _, code := getFileInfo(t, handler, newVersion); code != http.StatusOK {
+		t.Errorf("Request for current version rejected: %d", code)
+	}
+	if err := handler.Ready(); err != nil {
+		t.Errorf("Reloaded server not ready: %s", err.Error())
+	}
+
+	// a file modified in place is not served until the cache is rebuilt
+	cancel()
+	f, err := os.OpenFile(sourcefile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open test file: %s", err.Error())
+	}
+	f.Write([]byte(" with more data"))
+	f.Close()
+	fstat, _ := os.Stat(sourcefile)
+	handler.checkModifiedInPlace(fstat)
+	if _, _, code := getFileInfo(t, handler, ""); code != http.StatusServiceUnavailable {
+		t.Errorf("Modified file served: %d", code)
+	}
+	if err := handler.Ready(); err == nil {
+		t.Errorf("Modified file reported as ready")
+	}
+
+	err = handler.reload(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to reload file: %s", err.Error())
+	}
+	if fd, _, code := getFileInfo(t, handler, ""); code != http.StatusOK || fd.Filesize != 42 {
+		t.Errorf("Modified file not reloaded: %d: %v", code, fd)
+	}
+
+	// the rebuilt cache is stored for the next start
+	handler.Close()
+	stored, err := OpenLocalSource(sourcefile)
+	if err != nil {
+		t.Fatalf("Failed to open test file: %s", err.Error())
+	}
+	defer stored.Close()
+	err = stored.LoadCache()
+	if err != nil {
+		t.Fatalf("Failed to load stored cache: %s", err.Error())
+	}
+	if err := stored.CheckCache(); err != nil {
+		t.Errorf("Stored cache is not valid: %s", err.Error())
+	}
+}
+
+func TestSourceReloadSigned(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	sourcefile := filepath.Join(tmpdir, "test2.txt")
+	handler, err := NewSourceHandler(source, ServerOptions{})
+	if err != nil {
+		source.Close()
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	defer handler.Close()
+
+	v := handler.acquire()
+	v.signed = true
+	v.active.Done()
+	_, version, _ := getFileInfo(t, handler, "")
+
+	// the signed version is not replaced by an unsigned cache
+	replaceFile(t, sourcefile, []byte("the new release of the file"))
+	err = handler.reload(context.Background())
+	if err == nil {
+		t.Errorf("Signed file reloaded without signature")
+	}
+	if _, current, code := getFileInfo(t, handler, ""); code != http.StatusOK || current != version {
+		t.Errorf("Signed version not served: %d: %s", code, current)
+	}
+	if err := handler.Ready(); err == nil {
+		t.Errorf("Server with unsigned file reported as ready")
+	}
+}
+
+func TestCopyHttpSourceChanged(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	sourcefile := filepath.Join(tmpdir, "test2.txt")
+	handler, err := NewSourceHandler(source, ServerOptions{})
+	if err != nil {
+		source.Close()
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	defer handler.Close()
+
+	// the file is replaced before the first chunk data is sent
+	newdata := bytes.Repeat([]byte("new release "), 20)
+	var once sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/ReadChunksData") {
+			once.Do(func() {
+				replaceFile(t, sourcefile, newdata)
+				err := handler.reload(context.Background())
+				if err != nil {
+					t.Errorf("Failed to reload file: %s", err.Error())
+				}
+			})
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	targetfile := filepath.Join(tmpdir, "target.txt")
+	var h hasher.Hasher = hasher.NewSHA1Hasher()
+	err = CopyHttpToLocal(server.URL, targetfile, &h, 64, HttpOptions{RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to copy file: %s", err.Error())
+	}
+
+	data, err := ioutil.ReadFile(targetfile)
+	if err != nil {
+		t.Fatalf("Failed to read target file: %s", err.Error())
+	}
+	if !bytes.Equal(data, newdata) {
+		t.Errorf("Target file does not contain the new version")
+	}
+}
@@ -0,0 +1,194 @@
+package transmitlib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultRequestTimeout is the time to wait for the response of a
+	// single request.
+	DefaultRequestTimeout = 30 * time.Second
+	// DefaultRetries is the number of retries of a single failed request.
+	DefaultRetries = 5
+	// DefaultRetryBackoff is the delay before the first retry, the delay
+	// is doubled for every further retry.
+	DefaultRetryBackoff = 500 * time.Millisecond
+	// MaxRetryBackoff is the maximum delay between two retries.
+	MaxRetryBackoff = 30 * time.Second
+	// DefaultErrorBudget is the number of retries of all requests during
+	// a transfer, the transfer is aborted if the budget is exhausted.
+	DefaultErrorBudget = 50
+)
+
+// StatusError is returned if the remote server responds with an unexpected
+// http status code.
+type StatusError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *StatusError) Error() string {
+	if e.StatusCode == http.StatusUnauthorized {
+		return fmt.Sprintf("remote server rejected the credentials: %s", e.URL)
+	}
+	return fmt.Sprintf("unexpected response from remote server: %d: %s", e.StatusCode, e.URL)
+}
+
+// errIdleTimeout is returned by the body of a response, if no data was
+// received within the timeout.
+var errIdleTimeout net.Error = idleTimeoutError{}
+
+type idleTimeoutError struct{}
+
+func (idleTimeoutError) Error() string {
+	return "no data received from remote server within the timeout"
+}
+func (idleTimeoutError) Timeout() bool   { return true }
+func (idleTimeoutError) Temporary() bool { return true }
+
+// idleTimeoutBody cancels the request of a response body, if a single read
+// does not return within the timeout. A stalled response is aborted, while
+// slow consumers of the body are not affected.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  func()
+	expired int32
+}
+
+// newIdleTimeoutBody returns the body, cancel must cancel the request.
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel func()) io.ReadCloser {
+	b := &idleTimeoutBody{ReadCloser: body, timeout: timeout, cancel: cancel}
+	b.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&b.expired, 1)
+		cancel()
+	})
+	b.timer.Stop()
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if err != nil && atomic.LoadInt32(&b.expired) == 1 {
+		err = errIdleTimeout
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// IsRetryable returns true if the error is temporary and the failed request
+// can be repeated: server errors (5xx), rate limits, timeouts and connections
+// reset, refused or closed by the server.
+// Client errors (4xx), certificate errors and invalid data are fatal.
+func IsRetryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	// repeating the request does not fix certificate problems
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var certInvalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var alertErr tls.AlertError
+	if errors.As(err, &unknownAuthorityErr) || errors.As(err, &certInvalidErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &alertErr) {
+		return false
+	}
+
+	// other network errors, like unknown hosts or unsupported schemes,
+	// are permanent
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// retries returns the configured number of retries of a single request.
+func (hf *HttpFile) retries() int {
+	switch {
+	case hf.opts.Retries < 0:
+		return 0
+	case hf.opts.Retries == 0:
+		return DefaultRetries
+	}
+	return hf.opts.Retries
+}
+
+// backoff returns the jittered delay before the retry with the passed number.
+func (hf *HttpFile) backoff(attempt int) time.Duration {
+	delay := hf.opts.RetryBackoff
+	if delay <= 0 {
+		delay = DefaultRetryBackoff
+	}
+	for i := 0; i < attempt && delay < MaxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > MaxRetryBackoff {
+		delay = MaxRetryBackoff
+	}
+
+	// wait between half and the full delay, this avoids that multiple
+	// clients retry at the same time
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// useErrorBudget takes one retry from the error budget of the transfer,
+// false is returned if the budget is exhausted.
+func (hf *HttpFile) useErrorBudget() bool {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+
+	budget := hf.opts.ErrorBudget
+	if budget == 0 {
+		budget = DefaultErrorBudget
+	}
+	if budget > 0 && hf.failures >= budget {
+		return false
+	}
+	hf.failures++
+	return true
+}
+
+// retry calls fn until it succeeds, returns a fatal error or the retries
+// are exhausted. fn must be idempotent.
+func (hf *HttpFile) retry(method string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !IsRetryable(err) {
+			return err
+		}
+		if attempt >= hf.retries() {
+			return errors.Wrapf(err, "giving up after %d retries", attempt)
+		}
+		if !hf.useErrorBudget() {
+			return errors.Wrap(err, "error budget of the transfer exhausted")
+		}
+
+		delay := hf.backoff(attempt)
+		Logger().Warn("request failed, retrying", "method", method, "attempt", attempt+1, "delay", delay.Round(time.Millisecond), "error", err.Error())
+		time.Sleep(delay)
+	}
+}
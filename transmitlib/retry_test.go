@@ -0,0 +1,170 @@
+package transmitlib
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/tsauter/transmit/structs"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	testcases := []struct {
+		Err       error
+		Retryable bool
+	}{
+		{Err: &StatusError{StatusCode: 500}, Retryable: true},
+		{Err: &StatusError{StatusCode: 503}, Retryable: true},
+		{Err: &StatusError{StatusCode: 429}, Retryable: true},
+		{Err: &StatusError{StatusCode: 401}, Retryable: false},
+		{Err: &StatusError{StatusCode: 404}, Retryable: false},
+		{Err: errors.Wrap(&StatusError{StatusCode: 502}, "wrapped"), Retryable: true},
+		{Err: errors.Wrap(syscall.ECONNRESET, "read"), Retryable: true},
+		{Err: io.ErrUnexpectedEOF, Retryable: true},
+		{Err: fmt.Errorf("invalid data"), Retryable: false},
+		{Err: &url.Error{Op: "Get", URL: "http://unknown.invalid", Err: &net.DNSError{Err: "no such host", Name: "unknown.invalid", IsNotFound: true}}, Retryable: false},
+		{Err: &url.Error{Op: "Get", URL: "ftp://localhost", Err: fmt.Errorf("unsupported protocol scheme")}, Retryable: false},
+		{Err: &url.Error{Op: "Get", URL: "http://localhost", Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, Retryable: true},
+		{Err: &url.Error{Op: "Get", URL: "http://localhost", Err: errIdleTimeout}, Retryable: true},
+	}
+
+	for _, tc := range testcases {
+		if IsRetryable(tc.Err) != tc.Retryable {
+			t.Errorf("Invalid result for %v: %t", tc.Err, !tc.Retryable)
+		}
+	}
+}
+
+func TestHttpRetry(t *testing.T) {
+	fileinfo := structs.FileData{Filename: "test.txt", Filesize: 5, Checksum: "cfb789a8e782467d5e9af43f9bb19769", ChunkHashAlgorithm: "MD5", Chunksize: 2}
+
+	testcases := []struct {
+		Name     string
+		Opts     HttpOptions
+		Failures int
+		Status   int
+		Requests int
+		Valid    bool
+	}{
+		{Name: "no failures", Opts: HttpOptions{}, Failures: 0, Status: 503, Requests: 1, Valid: true},
+		{Name: "temporary failures", Opts: HttpOptions{}, Failures: 2, Status: 503, Requests: 3, Valid: true},
+		{Name: "retries exhausted", Opts: HttpOptions{Retries: 2}, Failures: 5, Status: 500, Requests: 3, Valid: false},
+		{Name: "retries disabled", Opts: HttpOptions{Retries: -1}, Failures: 1, Status: 503, Requests: 1, Valid: false},
+		{Name: "error budget", Opts: HttpOptions{ErrorBudget: 1}, Failures: 2, Status: 503, Requests: 2, Valid: false},
+		{Name: "fatal", Opts: HttpOptions{}, Failures: 1, Status: 404, Requests: 1, Valid: false},
+	}
+
+	for _, tc := range testcases {
+		requests := 0
+		tc.Opts.RetryBackoff = time.Millisecond
+		source, server := openTestHttpSource(t, tc.Opts, func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests <= tc.Failures {
+				http.Error(w, "failed", tc.Status)
+				return
+			}
+			fmt.Fprintf(w, `{"filename":"test.txt","filesize":5,"checksum":"cfb789a8e782467d5e9af43f9bb19769","hashalgo":"MD5","chunksize":2}`)
+		})
+
+		fd, err := source.GetFileInfo()
+		if tc.Valid && (err != nil || !reflect.DeepEqual(fd, fileinfo)) {
+			t.Errorf("[%s] Failed to get file info: %v", tc.Name, err)
+		}
+		if !tc.Valid && err == nil {
+			t.Errorf("[%s] Expected error, got none", tc.Name)
+		}
+		if requests != tc.Requests {
+			t.Errorf("[%s] Invalid number of requests: %d != %d", tc.Name, requests, tc.Requests)
+		}
+
+		server.Close()
+	}
+}
+
+func TestHttpReadChunkDataBatchResume(t *testing.T) {
+	var requested []string
+	source, server := openTestHttpSource(t, HttpOptions{RetryBackoff: time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Query().Get("chunks"))
+		chunkIds, err := ParseChunkRanges(r.URL.Query().Get("chunks"), MaxBatchChunks)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for pos, chunkno := range chunkIds {
+			// the first response is interrupted after two chunks
+			if len(requested) == 1 && pos == 2 {
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			WriteChunkFrame(w, ChunkFrame{ChunkId: chunkno, Hash: fmt.Sprintf("hash%d", chunkno), Data: []byte(fmt.Sprintf("data%d", chunkno))})
+		}
+	})
+	defer server.Close()
+	source.chunksize = 8
+
+	chunkIds := []uint64{0, 1, 2, 5, 7, 8}
+	var received []uint64
+	err := source.ReadChunkDataBatch(chunkIds, func(frame ChunkFrame) error {
+		received = append(received, frame.ChunkId)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read chunk batch: %s", err.Error())
+	}
+
+	if !reflect.DeepEqual(chunkIds, received) {
+		t.Errorf("Received chunks are different: %v != %v", received, chunkIds)
+	}
+	if !reflect.DeepEqual(requested, []string{"0-2,5,7-8", "2,5,7-8"}) {
+		t.Errorf("Invalid requests: %v", requested)
+	}
+}
+
+func TestHttpReadChunkDataBatchStalled(t *testing.T) {
+	var requested []string
+	stalled := make(chan struct{})
+	source, server := openTestHttpSource(t, HttpOptions{Timeout: 200 * time.Millisecond, RetryBackoff: time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Query().Get("chunks"))
+		chunkIds, err := ParseChunkRanges(r.URL.Query().Get("chunks"), MaxBatchChunks)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for pos, chunkno := range chunkIds {
+			// the first response stops sending after two chunks
+			if len(requested) == 1 && pos == 2 {
+				w.(http.Flusher).Flush()
+				<-stalled
+				return
+			}
+			WriteChunkFrame(w, ChunkFrame{ChunkId: chunkno, Hash: fmt.Sprintf("hash%d", chunkno), Data: []byte(fmt.Sprintf("data%d", chunkno))})
+		}
+	})
+	defer server.Close()
+	defer close(stalled)
+	source.chunksize = 8
+
+	chunkIds := []uint64{0, 1, 2, 5}
+	var received []uint64
+	err := source.ReadChunkDataBatch(chunkIds, func(frame ChunkFrame) error {
+		received = append(received, frame.ChunkId)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read chunk batch: %s", err.Error())
+	}
+
+	if !reflect.DeepEqual(chunkIds, received) {
+		t.Errorf("Received chunks are different: %v != %v", received, chunkIds)
+	}
+	if !reflect.DeepEqual(requested, []string{"0-2,5", "2,5"}) {
+		t.Errorf("Invalid requests: %v", requested)
+	}
+}
@@ -0,0 +1,352 @@
+package transmitlib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultKeepVersions is the default number of retained snapshots.
+	DefaultKeepVersions = 5
+
+	// the details of a snapshot, a snapshot without this file is incomplete
+	snapshotInfoFilename = "snapshot.json"
+)
+
+// Snapshot describes a stored version of the served file.
+type Snapshot struct {
+	// the sequential number of the version
+	Version  int       `json:"version"`
+	Checksum string    `json:"checksum"`
+	Filename string    `json:"filename"`
+	Filesize int64     `json:"filesize"`
+	Created  time.Time `json:"created"`
+	// set for the version served by default
+	Current bool `json:"current,omitempty"`
+}
+
+// RetentionPolicy defines which snapshots are removed. The snapshot that was
+// added last is never removed.
+type RetentionPolicy struct {
+	// the number of retained snapshots, unlimited if zero
+	KeepVersions int
+	// snapshots created before this time are removed, unlimited if zero
+	KeepFor time.Duration
+}
+
+// storedSnapshot is a snapshot with its loaded source.
+type storedSnapshot struct {
+	Snapshot
+	dir     string
+	version *sourceVersion
+}
+
+// remove deletes the snapshot after all active requests are finished.
+func (s *storedSnapshot) remove() error {
+	s.version.active.Wait()
+	err := s.version.source.CloseAndRemove()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(s.dir)
+}
+
+// SnapshotStore keeps versions of the served file in a directory. Each
+// snapshot is a copy of the file with its own cache.
+type SnapshotStore struct {
+	dir       string
+	retention RetentionPolicy
+	now       func() time.Time
+	// serializes the creation of snapshots
+	addMu sync.Mutex
+	// protects snapshots, ordered by version
+	mu        sync.Mutex
+	snapshots []*storedSnapshot
+}
+
+// OpenSnapshotStore loads all snapshots of the directory, the directory is
+// created if it does not exist. Incomplete snapshots are removed and the
+// retention policy is applied.
+func OpenSnapshotStore(dir string, retention RetentionPolicy) (*SnapshotStore, error) {
+	ss := &SnapshotStore{dir: dir, retention: retention, now: time.Now}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create snapshot directory")
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read snapshot directory")
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		snapshotdir := filepath.Join(dir, entry.Name())
+
+		s, err := loadSnapshot(snapshotdir)
+		if os.IsNotExist(errors.Cause(err)) {
+			Logger().Warn("removing incomplete snapshot", "dir", snapshotdir)
+			os.RemoveAll(snapshotdir)
+			continue
+		}
+		if err != nil {
+			Logger().Warn("failed to load snapshot", "dir", snapshotdir, "error", err.Error())
+			continue
+		}
+		ss.snapshots = append(ss.snapshots, s)
+	}
+	sort.Slice(ss.snapshots, func(i, j int) bool {
+		return ss.snapshots[i].Version < ss.snapshots[j].Version
+	})
+
+	if len(ss.snapshots) > 0 {
+		ss.applyRetention(ss.snapshots[len(ss.snapshots)-1].Checksum)
+	}
+
+	return ss, nil
+}
+
+// loadSnapshot loads the details and the cache of the snapshot in the directory.
+func loadSnapshot(dir string) (*storedSnapshot, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, snapshotInfoFilename))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read snapshot details")
+	}
+	s := &storedSnapshot{dir: dir}
+	err = json.Unmarshal(data, &s.Snapshot)
+	if err != nil {
+		return nil, errors.Wrap(err, "snapshot details are corrupt")
+	}
+
+	source, err := OpenLocalSource(filepath.Join(dir, s.Filename))
+	if err != nil {
+		return nil, err
+	}
+	err = source.LoadCache()
+	if err != nil {
+		source.Close()
+		return nil, errors.Wrap(err, "failed to load cache of snapshot")
+	}
+	s.version, err = newSourceVersion(source)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	if s.version.id != s.Checksum {
+		source.Close()
+		return nil, fmt.Errorf("cache of snapshot does not match: %s != %s", s.version.id, s.Checksum)
+	}
+
+	return s, nil
+}
+
+// Close closes all snapshots, after all active requests are finished.
+func (ss *SnapshotStore) Close() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for _, s := range ss.snapshots {
+		err := s.version.close()
+		if err != nil {
+			return err
+		}
+	}
+	ss.snapshots = nil
+	return nil
+}
+
+// List returns the details of all snapshots, ordered by version.
+func (ss *SnapshotStore) List() []Snapshot {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	list := make([]Snapshot, 0, len(ss.snapshots))
+	for _, s := range ss.snapshots {
+		list = append(list, s.Snapshot)
+	}
+	return list
+}
+
+// find returns the snapshot with the checksum, nil if not found. The
+// caller must hold the lock.
+func (ss *SnapshotStore) find(checksum string) *storedSnapshot {
+	for _, s := range ss.snapshots {
+		if s.Checksum == checksum {
+			return s
+		}
+	}
+	return nil
+}
+
+// acquire returns the version of the snapshot with the checksum, the caller
+// must call active.Done when it is finished.
+func (ss *SnapshotStore) acquire(checksum string) (*sourceVersion, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	s := ss.find(checksum)
+	if s == nil {
+		return nil, false
+	}
+	s.version.active.Add(1)
+	return s.version, true
+}
+
+// Add stores a snapshot of the version, if the version is not already stored.
+// The file is copied from the open file of the version, the caller must make
+// sure the version is not closed during the copy. The cache of the copy is
+// built and must match the version. Afterwards the retention policy is applied.
+func (ss *SnapshotStore) Add(v *sourceVersion) error {
+	ss.addMu.Lock()
+	defer ss.addMu.Unlock()
+
+	ss.mu.Lock()
+	exists := ss.find(v.id) != nil
+	number := 1
+	if len(ss.snapshots) > 0 {
+		number = ss.snapshots[len(ss.snapshots)-1].Version + 1
+	}
+	ss.mu.Unlock()
+	if exists {
+		return nil
+	}
+
+	// the checksum is a hex string, it is safe to use as directory name
+	dir := filepath.Join(ss.dir, v.id)
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove incomplete snapshot")
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "failed to create snapshot directory")
+	}
+
+	Logger().Info("storing snapshot", "version", number, "checksum", v.id, "dir", dir)
+	s, err := createSnapshot(dir, v)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	s.Version = number
+	s.Created = ss.now()
+
+	// the details are written last, they mark the snapshot as complete
+	data, err := json.Marshal(s.Snapshot)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, snapshotInfoFilename), data, 0644)
+	}
+	if err != nil {
+		s.version.source.CloseAndRemove()
+		os.RemoveAll(dir)
+		return errors.Wrap(err, "failed to write snapshot details")
+	}
+
+	ss.mu.Lock()
+	ss.snapshots = append(ss.snapshots, s)
+	ss.applyRetention(v.id)
+	ss.mu.Unlock()
+
+	return nil
+}
+
+// createSnapshot copies the file of the version to the directory and builds
+// the cache of the copy. A signature of the version is also valid for the copy.
+func createSnapshot(dir string, v *sourceVersion) (*storedSnapshot, error) {
+	filename := filepath.Join(dir, v.fileinfo.Filename)
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create snapshot file")
+	}
+	_, err = io.Copy(f, io.NewSectionReader(v.source.f, 0, v.fileinfo.Filesize))
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to copy file to snapshot")
+	}
+
+	h, err := newHasher(v.fileinfo.ChunkHashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	source, err := OpenLocalSource(filename)
+	if err != nil {
+		return nil, err
+	}
+	source.quiet = true
+	err = source.BuildCache(&h, v.fileinfo.Chunksize)
+	if err != nil {
+		source.CloseAndRemove()
+		return nil, errors.Wrap(err, "failed to build cache of snapshot")
+	}
+
+	if v.signed {
+		data, err := json.Marshal(v.signature)
+		if err == nil {
+			err = ioutil.WriteFile(source.signatureFilename(), data, 0644)
+		}
+		if err != nil {
+			source.CloseAndRemove()
+			return nil, errors.Wrap(err, "failed to copy signature to snapshot")
+		}
+	}
+
+	// the copy must contain the same data as the version
+	version, err := newSourceVersion(source)
+	if err != nil {
+		source.CloseAndRemove()
+		return nil, err
+	}
+	if version.id != v.id {
+		source.CloseAndRemove()
+		return nil, fmt.Errorf("snapshot does not match the file: checksum %s != %s", version.id, v.id)
+	}
+
+	s := &storedSnapshot{dir: dir, version: version}
+	s.Checksum = v.id
+	s.Filename = v.fileinfo.Filename
+	s.Filesize = v.fileinfo.Filesize
+	return s, nil
+}
+
+// applyRetention removes all snapshots not retained by the policy, except
+// the snapshot with the checksum. The files are removed in the background,
+// after all active requests are finished. The caller must hold the lock.
+func (ss *SnapshotStore) applyRetention(keep string) {
+	cutoff := ss.now().Add(-ss.retention.KeepFor)
+
+	var kept []*storedSnapshot
+	retained := 0
+	for i := len(ss.snapshots) - 1; i >= 0; i-- {
+		s := ss.snapshots[i]
+		retained++
+		expired := (ss.retention.KeepVersions > 0 && retained > ss.retention.KeepVersions) ||
+			(ss.retention.KeepFor > 0 && s.Created.Before(cutoff))
+		if !expired || s.Checksum == keep {
+			kept = append([]*storedSnapshot{s}, kept...)
+			continue
+		}
+
+		Logger().Info("removing snapshot", "version", s.Version, "checksum", s.Checksum, "created", s.Created)
+		go func(s *storedSnapshot) {
+			err := s.remove()
+			if err != nil {
+				Logger().Warn("failed to remove snapshot", "dir", s.dir, "error", err.Error())
+			}
+		}(s)
+	}
+	ss.snapshots = kept
+}
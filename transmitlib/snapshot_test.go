@@ -0,0 +1,228 @@
+package transmitlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/tsauter/transmit/hasher"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// getVersions requests the list of versions from the handler.
+func getVersions(t *testing.T, handler http.Handler) []Snapshot {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/GetVersions", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to get versions: %d", w.Code)
+	}
+	var versions []Snapshot
+	err := json.Unmarshal(w.Body.Bytes(), &versions)
+	if err != nil {
+		t.Fatalf("Invalid versions: %s", err.Error())
+	}
+	return versions
+}
+
+// waitForRemoval waits until the directory contains count snapshots, the
+// removal of snapshots is done in the background.
+func waitForRemoval(t *testing.T, dir string, count int) {
+	for i := 0; i < 100; i++ {
+		entries, _ := ioutil.ReadDir(dir)
+		if len(entries) == count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Snapshots not removed from %s", dir)
+}
+
+func TestSnapshotStore(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	snapshotdir := filepath.Join(tmpdir, "snapshots")
+	store, err := OpenSnapshotStore(snapshotdir, RetentionPolicy{KeepVersions: 2})
+	if err != nil {
+		t.Fatalf("Failed to open snapshot store: %s", err.Error())
+	}
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	sourcefile := filepath.Join(tmpdir, "test2.txt")
+	original, _ := ioutil.ReadFile(sourcefile)
+	handler, err := NewSourceHandler(source, ServerOptions{Snapshots: store})
+	if err != nil {
+		source.Close()
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	defer handler.Close()
+
+	v := handler.acquire()
+	handler.storeSnapshot(v)
+	v.active.Done()
+
+	// every reloaded version is stored
+	replaceFile(t, sourcefile, []byte("the second release"))
+	err = handler.reload(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to reload file: %s", err.Error())
+	}
+
+	versions := getVersions(t, handler)
+	if len(versions) != 2 || versions[0].Version != 1 || versions[1].Version != 2 {
+		t.Fatalf("Invalid versions: %v", versions)
+	}
+	if versions[0].Current || !versions[1].Current || versions[1].Filesize != 18 {
+		t.Errorf("Invalid details of versions: %v", versions)
+	}
+
+	// the previous version is served by its checksum
+	first := versions[0].Checksum
+	fd, etag, code := getFileInfo(t, handler, "")
+	if code != http.StatusOK || fd.Filesize != 18 {
+		t.Errorf("Invalid current version: %d: %v", code, fd)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/versions/"+first+"/ReadChunksData?chunks=0-2", nil))
+	var data []byte
+	for {
+		frame, err := ReadChunkFrame(w.Body, fd.Chunksize)
+		if err != nil {
+			break
+		}
+		data = append(data, frame.Data...)
+	}
+	if !bytes.Equal(data, original) {
+		t.Errorf("Previous version returns different data")
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Errorf("Previous version served with current ETag")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/versions/0123456789abcdef/GetFileInfo", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Unknown version served: %d", w.Code)
+	}
+
+	// the oldest version is removed by the retention policy
+	replaceFile(t, sourcefile, []byte("the third release"))
+	err = handler.reload(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to reload file: %s", err.Error())
+	}
+	versions = getVersions(t, handler)
+	if len(versions) != 2 || versions[0].Version != 2 || versions[1].Version != 3 {
+		t.Errorf("Invalid versions after retention: %v", versions)
+	}
+	waitForRemoval(t, snapshotdir, 2)
+
+	// the snapshots are loaded again
+	handler.Close()
+	store.Close()
+	store, err = OpenSnapshotStore(snapshotdir, RetentionPolicy{})
+	if err != nil {
+		t.Fatalf("Failed to open snapshot store: %s", err.Error())
+	}
+	reopened := store.List()
+	if len(reopened) != 2 || reopened[0].Checksum != versions[0].Checksum || reopened[1].Checksum != versions[1].Checksum {
+		t.Errorf("Invalid versions after reopen: %v", reopened)
+	}
+	store.Close()
+
+	// old versions expire
+	store, err = OpenSnapshotStore(snapshotdir, RetentionPolicy{KeepFor: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to open snapshot store: %s", err.Error())
+	}
+	store.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	store.mu.Lock()
+	store.applyRetention(versions[1].Checksum)
+	store.mu.Unlock()
+	if remaining := store.List(); len(remaining) != 1 || remaining[0].Version != 3 {
+		t.Errorf("Invalid versions after expiry: %v", remaining)
+	}
+	waitForRemoval(t, snapshotdir, 1)
+	store.Close()
+}
+
+func TestCopyHttpVersion(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	store, err := OpenSnapshotStore(filepath.Join(tmpdir, "snapshots"), RetentionPolicy{})
+	if err != nil {
+		t.Fatalf("Failed to open snapshot store: %s", err.Error())
+	}
+	defer store.Close()
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	sourcefile := filepath.Join(tmpdir, "test2.txt")
+	original, _ := ioutil.ReadFile(sourcefile)
+	handler, err := NewSourceHandler(source, ServerOptions{Snapshots: store})
+	if err != nil {
+		source.Close()
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	defer handler.Close()
+
+	v := handler.acquire()
+	handler.storeSnapshot(v)
+	v.active.Done()
+	replaceFile(t, sourcefile, bytes.Repeat([]byte("second release "), 20))
+	err = handler.reload(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to reload file: %s", err.Error())
+	}
+	checksum := store.List()[0].Checksum
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	testcases := []struct {
+		Name  string
+		Opts  HttpOptions
+		Data  []byte
+		Valid bool
+	}{
+		{Name: "latest", Opts: HttpOptions{Version: "latest"}, Data: bytes.Repeat([]byte("second release "), 20), Valid: true},
+		{Name: "version", Opts: HttpOptions{Version: "1"}, Data: original, Valid: true},
+		{Name: "checksum", Opts: HttpOptions{Checksum: checksum[:8]}, Data: original, Valid: true},
+		{Name: "checksum with default version", Opts: HttpOptions{Version: "latest", Checksum: checksum[:8]}, Data: original, Valid: true},
+		{Name: "both", Opts: HttpOptions{Version: "1", Checksum: checksum}, Data: original, Valid: true},
+		{Name: "unknown version", Opts: HttpOptions{Version: "9"}, Valid: false},
+		{Name: "mismatch", Opts: HttpOptions{Version: "2", Checksum: checksum}, Valid: false},
+	}
+
+	for _, tc := range testcases {
+		targetfile := filepath.Join(tmpdir, "target.txt")
+		var h hasher.Hasher = hasher.NewSHA1Hasher()
+		err := CopyHttpToLocal(server.URL, targetfile, &h, 64, tc.Opts)
+		if !tc.Valid {
+			if err == nil {
+				t.Errorf("[%s] Expected error, got none", tc.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%s] Failed to copy file: %s", tc.Name, err.Error())
+			continue
+		}
+		data, _ := ioutil.ReadFile(targetfile)
+		if !bytes.Equal(data, tc.Data) {
+			t.Errorf("[%s] Target file contains a different version", tc.Name)
+		}
+		os.Remove(targetfile)
+	}
+}
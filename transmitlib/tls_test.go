@@ -0,0 +1,93 @@
+package transmitlib
+
+import (
+	"encoding/pem"
+	"github.com/tsauter/transmit/hasher"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestSource copies the fixture to a temp directory and builds the cache.
+// The LocalFile with loaded cache is returned.
+func openTestSource(t *testing.T, tmpdir string, fixture string) *LocalFile {
+	data, err := ioutil.ReadFile(filepath.Join("fixtures", fixture))
+	if err != nil {
+		t.Fatalf("Failed to read test file: %s", err.Error())
+	}
+	sourcefile := filepath.Join(tmpdir, fixture)
+	err = ioutil.WriteFile(sourcefile, data, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write test file: %s", err.Error())
+	}
+
+	var h hasher.Hasher = hasher.NewSHA1Hasher()
+	source, err := OpenLocalSource(sourcefile)
+	if err != nil {
+		t.Fatalf("Failed to open test file: %s", err.Error())
+	}
+	err = source.BuildCache(&h, 64)
+	if err != nil {
+		source.Close()
+		t.Fatalf("Failed to build cache: %s", err.Error())
+	}
+
+	return source
+}
+
+func TestCopyHttpsToLocal(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transmit-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	source := openTestSource(t, tmpdir, "test2.txt")
+	defer source.Close()
+
+	handler, err := NewSourceHandler(source, ServerOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %s", err.Error())
+	}
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	// the certificate of the test server is the only trusted ca
+	cafile := filepath.Join(tmpdir, "ca.pem")
+	capem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	err = ioutil.WriteFile(cafile, capem, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write ca file: %s", err.Error())
+	}
+
+	testcases := []struct {
+		Name  string
+		Opts  HttpOptions
+		Valid bool
+	}{
+		{Name: "system ca", Opts: HttpOptions{}, Valid: false},
+		{Name: "ca file", Opts: HttpOptions{CAFile: cafile}, Valid: true},
+		{Name: "insecure", Opts: HttpOptions{InsecureSkipVerify: true}, Valid: true},
+	}
+
+	for _, tc := range testcases {
+		targetfile := filepath.Join(tmpdir, "target.txt")
+		var h hasher.Hasher = hasher.NewSHA1Hasher()
+		err := CopyHttpToLocal(server.URL, targetfile, &h, 64, tc.Opts)
+		if tc.Valid && err != nil {
+			t.Errorf("[%s] Failed to copy file: %s", tc.Name, err.Error())
+		}
+		if !tc.Valid && err == nil {
+			t.Errorf("[%s] Untrusted certificate accepted", tc.Name)
+		}
+		os.Remove(targetfile)
+	}
+
+	// an invalid ca file is rejected
+	_, err = OpenHttpSource(nil, HttpOptions{CAFile: filepath.Join(tmpdir, "test2.txt")})
+	if err == nil {
+		t.Errorf("Invalid ca file accepted")
+	}
+}
@@ -0,0 +1,154 @@
+package transmitlib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPeerTTL is the time a peer is tracked after its last announcement.
+	DefaultPeerTTL = 2 * time.Minute
+	// MaxAnnouncedPeers is the maximum number of peers returned to a client.
+	MaxAnnouncedPeers = 20
+	// MaxTrackedPeers is the maximum number of peers of a single version.
+	MaxTrackedPeers = 1000
+	// MaxPeersPerClient is the maximum number of peers announced by a single
+	// client address for a version.
+	MaxPeersPerClient = 8
+)
+
+// ErrTooManyPeers is returned by Announce, if the limits of the tracker are
+// exceeded.
+var ErrTooManyPeers = errors.New("too many peers")
+
+// trackedPeer is a peer announced to the tracker.
+type trackedPeer struct {
+	expires time.Time
+	// the address of the client that announced the peer
+	client string
+}
+
+// Tracker keeps the addresses of the clients serving chunks to other
+// clients (peers), separately for each version of the file. Peers must
+// announce themselves regularly, otherwise they expire.
+type Tracker struct {
+	ttl time.Duration
+	now func() time.Time
+	// protects peers, the tracked peers by checksum and address
+	mu    sync.Mutex
+	peers map[string]map[string]trackedPeer
+}
+
+// NewTracker returns a tracker, peers expire after ttl.
+func NewTracker(ttl time.Duration) *Tracker {
+	if ttl <= 0 {
+		ttl = DefaultPeerTTL
+	}
+	return &Tracker{ttl: ttl, now: time.Now, peers: map[string]map[string]trackedPeer{}}
+}
+
+// Announce registers the address as peer of the version, an empty address
+// is not registered. client is the address of the announcing client, the
+// number of peers per version and per client is limited. Up to
+// MaxAnnouncedPeers other peers of the same version are returned, in random
+// order.
+func (tr *Tracker) Announce(checksum string, address string, client string) ([]string, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	now := tr.now()
+	peers := tr.peers[checksum]
+	if peers == nil {
+		peers = map[string]trackedPeer{}
+		tr.peers[checksum] = peers
+	}
+
+	list := []string{}
+	byClient := 0
+	for peer, tracked := range peers {
+		if tracked.expires.Before(now) {
+			delete(peers, peer)
+			continue
+		}
+		if peer == address {
+			continue
+		}
+		list = append(list, peer)
+		if tracked.client == client {
+			byClient++
+		}
+	}
+
+	if address != "" {
+		// known peers are always renewed
+		if _, ok := peers[address]; !ok && (len(peers) >= MaxTrackedPeers || byClient >= MaxPeersPerClient) {
+			return nil, ErrTooManyPeers
+		}
+		peers[address] = trackedPeer{expires: now.Add(tr.ttl), client: client}
+	}
+	if len(peers) == 0 {
+		delete(tr.peers, checksum)
+	}
+
+	rand.Shuffle(len(list), func(i, j int) {
+		list[i], list[j] = list[j], list[i]
+	})
+	if len(list) > MaxAnnouncedPeers {
+		list = list[:MaxAnnouncedPeers]
+	}
+	return list, nil
+}
+
+// validPeerAddress checks that the address is a http or https url.
+func validPeerAddress(address string) error {
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid peer address: %s", address)
+	}
+	return nil
+}
+
+// announcePeer registers the peer of the request for the version of the
+// request and sends the other peers.
+func (sh *SourceHandler) announcePeer(w http.ResponseWriter, r *http.Request) {
+	if sh.tracker == nil {
+		http.Error(w, "peers are not enabled", http.StatusNotFound)
+		return
+	}
+
+	address := r.URL.Query().Get("address")
+	if address != "" {
+		if err := validPeerAddress(address); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			requestLogger(r).Warn("invalid peer address", "address", address)
+			return
+		}
+	}
+
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	peers, err := sh.tracker.Announce(requestVersion(r).id, address, client)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		requestLogger(r).Warn("peer not registered", "address", address, "error", err.Error())
+		return
+	}
+	jsondata, err := json.Marshal(peers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		requestLogger(r).Error("failed to encode peers", "error", err.Error())
+		return
+	}
+
+	requestLogger(r).Debug("sending peers", "address", address, "peers", len(peers))
+	w.Write(jsondata)
+}
@@ -1,16 +1,25 @@
 package transmitlib
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/tsauter/transmit/hasher"
+	"github.com/tsauter/transmit/manifest"
 	"github.com/tsauter/transmit/structs"
+	"google.golang.org/grpc"
 	"gopkg.in/cheggaaa/pb.v1"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,7 +34,7 @@ func CopyLocalToLocal(sourcefile string, targetfile string, h *hasher.Hasher, ch
 	}
 	defer source.Close()
 
-	fmt.Printf("Loading source cache...\n")
+	Logger().Info("loading source cache", "file", sourcefile)
 	err = source.LoadCache()
 	if err != nil {
 		return errors.Wrap(err, "failed to local cache for local source file")
@@ -49,7 +58,7 @@ func CopyLocalToLocal(sourcefile string, targetfile string, h *hasher.Hasher, ch
 		return errors.Wrap(err, "unable to resize target file to new filesize")
 	}
 
-	fmt.Printf("Building local file cache...\n")
+	Logger().Info("building target cache", "file", targetfile)
 	err = target.BuildCache(&targethasher, chunksize)
 	if err != nil {
 		return errors.Wrap(err, "failed to build cache for local target file")
@@ -58,15 +67,17 @@ func CopyLocalToLocal(sourcefile string, targetfile string, h *hasher.Hasher, ch
 	// walk over the list of stored source chunks,
 	// compaire the chunk checksum with the target checksum
 	// read/write chunk data if both hashes missmatch
-	fmt.Printf("Copy individual file chunks...\n")
-	maxchunkno, chunkStreamChan := source.GetAllChunks()
+	Logger().Info("copying chunks", "source", sourceinfo.Filename, "size", sourceinfo.Filesize)
+	maxchunkno, chunkStreamChan, errChan := source.GetAllChunks()
 	percentBar := pb.StartNew(int(maxchunkno) + 1)
+	var copyErr error
 	for chunkStream := range chunkStreamChan {
 		percentBar.Increment()
 
 		dstchunk, err := target.GetChunk(chunkStream.ChunkId)
 		if err != nil {
-			return errors.Wrapf(err, "failed to get chunk from target: %d: %s", chunkStream.ChunkId, err.Error())
+			copyErr = errors.Wrapf(err, "failed to get chunk from target: %d: %s", chunkStream.ChunkId, err.Error())
+			break
 		}
 
 		// comparing both chunks, do nothing if both are equal
@@ -82,17 +93,28 @@ func CopyLocalToLocal(sourcefile string, targetfile string, h *hasher.Hasher, ch
 
 		data, datalen, err := source.ReadChunkData(filepos)
 		if err != nil {
-			return errors.Wrapf(err, "failed to read from source: %s", err.Error())
+			copyErr = errors.Wrapf(err, "failed to read from source: %s", err.Error())
+			break
 		}
 
 		err = target.WriteChunkData(filepos, data, datalen)
 		if err != nil {
-			return errors.Wrapf(err, "failed to write to target: %s", err.Error())
+			copyErr = errors.Wrapf(err, "failed to write to target: %s", err.Error())
+			break
 		}
 	}
+	if copyErr != nil {
+		// drain the channel, otherwise the source stays blocked
+		for range chunkStreamChan {
+		}
+		return copyErr
+	}
+	if err := <-errChan; err != nil {
+		return errors.Wrap(err, "failed to get chunks from source")
+	}
 	percentBar.FinishPrint("Finish.")
 
-	fmt.Printf("Validating checksum...\n")
+	Logger().Info("validating checksum", "file", targetfile)
 	tchecksum, err := targethasher.HashFile(targetfile)
 	if err != nil {
 		return errors.Wrapf(err, "failed to calculate checksum: %s: %s", targetfile, err.Error())
@@ -104,14 +126,43 @@ func CopyLocalToLocal(sourcefile string, targetfile string, h *hasher.Hasher, ch
 	return nil
 }
 
-func CopyHttpToLocal(baseurl string, targetfile string, h *hasher.Hasher, chunksize int) error {
+// MaxSourceChanges is the number of times a copy from a http source is started
+// again, after the file was changed on the server during the copy.
+const MaxSourceChanges = 3
+
+// CopyHttpToLocal copy the file served by a remote http source to the local targetfile.
+// The hasher and chunksize parameter must must the options used in the source file cache.
+// If the file is changed on the server during the copy, the copy is started again
+// with the new version; the chunks already copied are reused if unchanged.
+func CopyHttpToLocal(baseurl string, targetfile string, h *hasher.Hasher, chunksize int, opts HttpOptions) error {
+	// the chunks received from peers are passed through the same reader
+	// as for multiple targets
+	if opts.Peer.Enabled {
+		results, err := CopyHttpToLocalTargets(baseurl, []string{targetfile}, h, chunksize, opts)
+		if err == nil {
+			err = results[0].Err
+		}
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := copyHttpToLocal(baseurl, targetfile, h, chunksize, opts)
+		if err == nil || !errors.Is(err, ErrSourceChanged) || attempt > MaxSourceChanges {
+			return err
+		}
+		Logger().Warn("source file changed on the server, starting again", "attempt", attempt)
+	}
+}
+
+// copyHttpToLocal copy a single version of the file served by a remote
+// http source to the local targetfile.
+func copyHttpToLocal(baseurl string, targetfile string, h *hasher.Hasher, chunksize int, opts HttpOptions) error {
 	url, err := url.Parse(baseurl)
 	if err != nil {
 		return errors.Wrap(err, "invalid url")
 	}
 
-	var source SourceFile
-	source, err = OpenHttpSource(url)
+	source, err := OpenHttpSource(url, opts)
 	if err != nil {
 		return errors.Wrap(err, "failed to open local source file")
 	}
@@ -135,7 +186,7 @@ func CopyHttpToLocal(baseurl string, targetfile string, h *hasher.Hasher, chunks
 		return errors.Wrap(err, "unable to resize target file to new filesize")
 	}
 
-	fmt.Printf("Building local file cache...\n")
+	Logger().Info("building target cache", "file", targetfile)
 	err = target.BuildCache(&targethasher, chunksize)
 	if err != nil {
 		return errors.Wrap(err, "failed to build cache for local target file")
@@ -143,16 +194,20 @@ func CopyHttpToLocal(baseurl string, targetfile string, h *hasher.Hasher, chunks
 
 	// walk over the list of stored source chunks,
 	// compaire the chunk checksum with the target checksum
-	// read/write chunk data if both hashes missmatch
-	fmt.Printf("Copy individual file chunks...\n")
-	maxchunkno, chunkStreamChan := source.GetAllChunks()
+	// collect all chunks with missmatching hashes and request their
+	// data in batches from the remote server
+	Logger().Info("copying chunks", "source", sourceinfo.Filename, "size", sourceinfo.Filesize)
+	var pending []structs.ChunkStream
+	maxchunkno, chunkStreamChan, errChan := source.GetAllChunks()
 	percentBar := pb.StartNew(int(maxchunkno) + 1)
+	var copyErr error
 	for chunkStream := range chunkStreamChan {
 		percentBar.Increment()
 
 		dstchunk, err := target.GetChunk(chunkStream.ChunkId)
 		if err != nil {
-			return errors.Wrapf(err, "failed to get chunk from target: %d: %s", chunkStream.ChunkId, err.Error())
+			copyErr = errors.Wrapf(err, "failed to get chunk from target: %d: %s", chunkStream.ChunkId, err.Error())
+			break
 		}
 
 		// comparing both chunks, do nothing if both are equal
@@ -162,24 +217,34 @@ func CopyHttpToLocal(baseurl string, targetfile string, h *hasher.Hasher, chunks
 		}
 		//fmt.Printf("Chunk %d different: %s != %s\n", chunkStream.ChunkId, chunkStream.Chunk.Hash, dstchunk.Hash)
 
-		// fetch the required data from files
-
-		filepos := int64(chunkStream.ChunkId * uint64(chunksize))
-
-		// for remote file we use the id of the chunk, not the real file position
-		data, datalen, err := source.ReadChunkData(int64(chunkStream.ChunkId))
-		if err != nil {
-			return errors.Wrapf(err, "failed to read from source: %s", err.Error())
+		pending = append(pending, chunkStream)
+		if len(pending) < DefaultBatchChunks {
+			continue
 		}
 
-		err = target.WriteChunkData(filepos, data, datalen)
+		err = copyChunkBatch(source, target, pending, chunksize, sourceinfo.ChunkHashAlgorithm)
 		if err != nil {
-			return errors.Wrapf(err, "failed to write to target: %s", err.Error())
+			copyErr = err
+			break
+		}
+		pending = pending[:0]
+	}
+	if copyErr != nil {
+		// drain the channel, otherwise the source stays blocked
+		for range chunkStreamChan {
 		}
+		return copyErr
+	}
+	if err := <-errChan; err != nil {
+		return errors.Wrap(err, "failed to get chunks from source")
+	}
+	err = copyChunkBatch(source, target, pending, chunksize, sourceinfo.ChunkHashAlgorithm)
+	if err != nil {
+		return err
 	}
 	percentBar.FinishPrint("Finish.")
 
-	fmt.Printf("Validating checksum...\n")
+	Logger().Info("validating checksum", "file", targetfile)
 	tchecksum, err := targethasher.HashFile(targetfile)
 	if err != nil {
 		return errors.Wrapf(err, "failed to calculate checksum: %s: %s", targetfile, err.Error())
@@ -191,120 +256,572 @@ func CopyHttpToLocal(baseurl string, targetfile string, h *hasher.Hasher, chunks
 	return nil
 }
 
-func ServeFileOverHttp(listenAddress string, sourcefile string) error {
-	var source SourceFile
+// copyChunkBatch fetches the data of all passed chunks with a single batch
+// request from the remote source and writes the data to the target file.
+// The data of each received chunk must match the expected source hash,
+// hashed with the algorithm of the source.
+func copyChunkBatch(source *HttpFile, target TargetFile, chunks []structs.ChunkStream, chunksize int, algorithm string) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	h, err := newHasher(algorithm)
+	if err != nil {
+		return err
+	}
+
+	expected := make(map[uint64]string, len(chunks))
+	chunkIds := make([]uint64, 0, len(chunks))
+	for _, chunkStream := range chunks {
+		expected[chunkStream.ChunkId] = chunkStream.Chunk.Hash
+		chunkIds = append(chunkIds, chunkStream.ChunkId)
+	}
+
+	err = source.ReadChunkDataBatch(chunkIds, func(frame ChunkFrame) error {
+		err := verifyChunkFrame(h, expected, frame)
+		if err != nil {
+			return err
+		}
+
+		filepos := int64(frame.ChunkId * uint64(chunksize))
+		err = target.WriteChunkData(filepos, frame.Data, len(frame.Data))
+		if err != nil {
+			return errors.Wrap(err, "failed to write to target")
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to read from source: %s", err.Error())
+	}
+
+	return nil
+}
+
+// ServerOptions contains the options of the http source server.
+type ServerOptions struct {
+	// The certificate and key files (PEM) for https, plain http is used
+	// if no certificate is set.
+	TLSCertFile string
+	TLSKeyFile  string
+	// A PEM file with the certificate authorities of the client certificates.
+	// If set, the certificates presented by clients are verified against
+	// these authorities, requires https.
+	ClientCAFile string
+	// The authenticators of the incoming requests, a request is accepted
+	// if any authenticator accepts it. All requests are accepted if empty.
+	Authenticators []Authenticator
+	// Limits the throughput of all responses, unlimited if nil.
+	BandwidthLimit *BandwidthLimiter
+	// Limits the throughput of each client (by ip address) in bytes per
+	// second, unlimited if zero.
+	ClientBandwidthLimit int64
+	// The prometheus metrics of the server, disabled if nil.
+	Metrics *Metrics
+	// The address of the admin server serving the metrics, the metrics
+	// are served by the file server if empty.
+	AdminAddress string
+	// The time to read a request, DefaultReadTimeout if zero.
+	ReadTimeout time.Duration
+	// The time to write a response, unlimited if zero. Must be long enough
+	// for the largest chunk batch on the slowest client connection.
+	WriteTimeout time.Duration
+	// The time to keep idle client connections open, DefaultIdleTimeout if zero.
+	IdleTimeout time.Duration
+	// The time to wait for active requests on shutdown, DefaultShutdownTimeout
+	// if zero. Remaining requests are aborted after this time.
+	ShutdownTimeout time.Duration
+	// The interval to check the source file for modifications, the file is
+	// reloaded after it was modified or replaced. Disabled if zero.
+	ReloadInterval time.Duration
+	// Stores every served version of the file, clients can select any
+	// stored version. Disabled if nil.
+	Snapshots *SnapshotStore
+	// Tracks the clients sharing chunks with other clients. Disabled if nil.
+	Tracker *Tracker
+	// The address of the gRPC server, serving the same file with the same
+	// tls certificate and authenticators. Disabled if empty.
+	GrpcAddress string
+}
+
+const (
+	// DefaultReadTimeout is the default time to read a request.
+	DefaultReadTimeout = 30 * time.Second
+	// DefaultIdleTimeout is the default time to keep idle connections open.
+	DefaultIdleTimeout = 2 * time.Minute
+	// DefaultShutdownTimeout is the default time to wait for active requests
+	// on shutdown.
+	DefaultShutdownTimeout = 30 * time.Second
+)
+
+// withDefaults returns the options with the defaults for all unset timeouts.
+func (opts ServerOptions) withDefaults() ServerOptions {
+	if opts.ReadTimeout <= 0 {
+		opts.ReadTimeout = DefaultReadTimeout
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = DefaultIdleTimeout
+	}
+	if opts.ShutdownTimeout <= 0 {
+		opts.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	return opts
+}
+
+// ServeFileOverHttp serves the local sourcefile on listenAddress. The cache
+// of the file must be created with gencache first.
+// When the context is done, the server stops accepting new requests and waits
+// for all active requests before it returns.
+func ServeFileOverHttp(ctx context.Context, listenAddress string, sourcefile string, opts ServerOptions) error {
+	opts = opts.withDefaults()
+
+	if (opts.TLSCertFile == "") != (opts.TLSKeyFile == "") {
+		return fmt.Errorf("tls certificate and key must be specified together")
+	}
+	if opts.ClientCAFile != "" && opts.TLSCertFile == "" {
+		return fmt.Errorf("client certificates require a tls certificate and key")
+	}
+
 	source, err := OpenLocalSource(sourcefile)
 	if err != nil {
 		return errors.Wrap(err, "failed to open local source file")
 	}
-	defer source.Close()
 
-	fmt.Printf("Loading source cache...\n")
+	Logger().Info("loading source cache", "file", sourcefile)
 	err = source.LoadCache()
 	if err != nil {
+		source.Close()
 		return errors.Wrap(err, "failed to load cache for local source file")
 	}
 
-	fileinfo, err := source.GetFileInfo()
+	// the handler closes the source, or the versions reloaded later
+	handler, err := NewSourceHandler(source, opts)
 	if err != nil {
-		return errors.Wrap(err, "failed to get file info for source file")
+		source.Close()
+		return err
+	}
+	defer handler.Close()
+
+	if opts.Snapshots != nil {
+		v := handler.acquire()
+		go func() {
+			defer v.active.Done()
+			handler.storeSnapshot(v)
+		}()
 	}
 
-	r := mux.NewRouter()
+	if opts.ReloadInterval > 0 {
+		watchCtx, stopWatching := context.WithCancel(ctx)
+		defer stopWatching()
+		go handler.Watch(watchCtx, opts.ReloadInterval)
+	}
+
+	tlsconfig, err := newServerTLSConfig(opts)
+	if err != nil {
+		return err
+	}
 
 	server := &http.Server{
-		Addr:         listenAddress,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		Handler:      r,
+		Addr:              listenAddress,
+		ReadHeaderTimeout: opts.ReadTimeout,
+		ReadTimeout:       opts.ReadTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+		Handler:           handler,
+		TLSConfig:         tlsconfig,
+	}
+	if opts.Metrics != nil {
+		server.ConnState = opts.Metrics.ConnState
+	}
+
+	if opts.Metrics != nil && opts.AdminAddress != "" {
+		// bind the admin address first, to fail early if it is in use
+		listener, err := net.Listen("tcp", opts.AdminAddress)
+		if err != nil {
+			return errors.Wrap(err, "failed to listen on admin address")
+		}
+		adminRouter := mux.NewRouter()
+		adminRouter.Handle("/metrics", opts.Metrics.Handler()).Methods("GET")
+		adminRouter.HandleFunc("/healthz", handler.healthz).Methods("GET")
+		adminRouter.HandleFunc("/readyz", handler.readyz).Methods("GET")
+		admin := &http.Server{Handler: adminRouter, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+		defer admin.Close()
+
+		go func() {
+			err := admin.Serve(listener)
+			if err != nil && err != http.ErrServerClosed {
+				Logger().Error("admin server failed", "error", err.Error())
+			}
+		}()
+		Logger().Info("serving metrics", "address", opts.AdminAddress)
+	}
+
+	var grpcServer *grpc.Server
+	if opts.GrpcAddress != "" {
+		listener, err := net.Listen("tcp", opts.GrpcAddress)
+		if err != nil {
+			return errors.Wrap(err, "failed to listen on grpc address")
+		}
+		grpcServer, err = NewGrpcServer(handler, opts)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		defer grpcServer.Stop()
+
+		go func() {
+			err := grpcServer.Serve(listener)
+			if err != nil {
+				Logger().Error("grpc server failed", "error", err.Error())
+			}
+		}()
+		Logger().Info("serving grpc requests", "address", opts.GrpcAddress, "tls", opts.TLSCertFile != "")
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		Logger().Info("waiting for incoming requests", "address", listenAddress, "tls", opts.TLSCertFile != "")
+		if opts.TLSCertFile != "" {
+			serveErr <- server.ListenAndServeTLS(opts.TLSCertFile, opts.TLSKeyFile)
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		return errors.Wrap(err, "failed to serve file")
+	case <-ctx.Done():
+	}
+
+	// stop accepting new requests and finish all active transfers
+	Logger().Info("shutting down, waiting for active requests", "timeout", opts.ShutdownTimeout)
+	handler.SetShuttingDown()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+	defer cancel()
+	grpcStopped := make(chan struct{})
+	if grpcServer != nil {
+		go func() {
+			grpcServer.GracefulStop()
+			close(grpcStopped)
+		}()
+	}
+	err = server.Shutdown(shutdownCtx)
+	if grpcServer != nil {
+		select {
+		case <-grpcStopped:
+		case <-shutdownCtx.Done():
+		}
+	}
+	if err != nil {
+		server.Close()
+		return errors.Wrap(err, "failed to finish active requests")
+	}
+	Logger().Info("server stopped")
+
+	return nil
+}
+
+// newServerTLSConfig returns the tls configuration of the server, nil if
+// client certificates are not used.
+func newServerTLSConfig(opts ServerOptions) (*tls.Config, error) {
+	if opts.ClientCAFile == "" {
+		return nil, nil
+	}
+
+	pem, err := ioutil.ReadFile(opts.ClientCAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read client ca bundle")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client ca bundle: %s", opts.ClientCAFile)
 	}
 
+	// the certificate is optional during the handshake, clients may
+	// authenticate with other methods; the CertAuthenticator rejects
+	// requests without a verified certificate
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
+
+// SourceHandler is the http handler serving the file info, the chunk list and
+// the chunk data of a source, and the health endpoints of the server.
+type SourceHandler struct {
+	router   *mux.Router
+	filename string
+	// the served version of the source, replaced when the file is reloaded
+	mu      sync.RWMutex
+	current *sourceVersion
+	closed  bool
+	// the stored versions of the file, nil if disabled
+	snapshots *SnapshotStore
+	// the peers of all versions, nil if disabled
+	tracker *Tracker
+	// the bandwidth limits of all responses, shared with the gRPC server
+	bandwidth *bandwidthLimits
+	// set to 1 when the file is watched for modifications
+	watching int32
+	// set to 1 when the server is shutting down
+	shuttingDown int32
+	// set to 1 when a signed file was modified, the rebuilt cache
+	// would not be signed
+	unsignedReload int32
+}
+
+// ServeHTTP passes the request to the router.
+func (sh *SourceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sh.router.ServeHTTP(w, r)
+}
+
+// NewSourceHandler returns the http handler serving the file info, the chunk
+// list and the chunk data of the source. The cache of the source must be loaded.
+// All requests, except the health endpoints, are checked by the authenticators
+// of the options. The source is closed by Close.
+func NewSourceHandler(source *LocalFile, opts ServerOptions) (*SourceHandler, error) {
+	version, err := newSourceVersion(source)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := opts.Metrics
+	sh := &SourceHandler{router: mux.NewRouter(), filename: source.filename, current: version, snapshots: opts.Snapshots, tracker: opts.Tracker,
+		bandwidth: newBandwidthLimits(opts.BandwidthLimit, opts.ClientBandwidthLimit)}
+	sh.router.Use(metrics.Middleware())
+
+	// the health endpoints are used by load balancers and orchestrators,
+	// they do not require authentication
+	sh.router.HandleFunc("/healthz", sh.healthz).Methods("GET").Name("healthz")
+	sh.router.HandleFunc("/readyz", sh.readyz).Methods("GET").Name("readyz")
+
+	r := sh.router.NewRoute().Subrouter()
+	r.Use(RequestIDMiddleware)
+	r.Use(AuthMiddleware(opts.Authenticators))
+	r.Use(sh.bandwidth.middleware())
+
+	if metrics != nil && opts.AdminAddress == "" {
+		r.Handle("/metrics", metrics.Handler()).Methods("GET").Name("metrics")
+	}
+
+	r.HandleFunc("/GetVersions", func(w http.ResponseWriter, r *http.Request) {
+		if sh.snapshots == nil {
+			http.Error(w, "versions are not enabled", http.StatusNotFound)
+			return
+		}
+
+		v := sh.acquire()
+		current := v.id
+		v.active.Done()
+
+		versions := sh.snapshots.List()
+		for i := range versions {
+			versions[i].Current = versions[i].Checksum == current
+		}
+		jsondata, err := json.Marshal(versions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			requestLogger(r).Error("failed to encode versions", "error", err.Error())
+			return
+		}
+
+		requestLogger(r).Debug("sending versions", "versions", len(versions))
+		w.Write(jsondata)
+	}).Methods("GET").Name("GetVersions")
+
+	// all file requests are served by the same version of the source,
+	// the current version or a selected snapshot
+	files := r.NewRoute().Subrouter()
+	files.Use(sh.versionMiddleware)
+	sh.handleFileRoutes(files, metrics)
+
+	snapshots := r.PathPrefix("/versions/{checksum:[0-9a-f]+}").Subrouter()
+	snapshots.Use(sh.versionMiddleware)
+	sh.handleFileRoutes(snapshots, metrics)
+
+	return sh, nil
+}
+
+// handleFileRoutes adds the routes serving the file info, the chunk list and
+// the chunk data to the router. The version of the source is passed by the
+// versionMiddleware.
+func (sh *SourceHandler) handleFileRoutes(r *mux.Router, metrics *Metrics) {
 	r.HandleFunc("/GetFileInfo", func(w http.ResponseWriter, r *http.Request) {
+		fileinfo := requestVersion(r).fileinfo
 		jsondata, err := json.Marshal(fileinfo)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			fmt.Printf("GetFileInfo: %s\n", err.Error())
+			requestLogger(r).Error("failed to encode file info", "error", err.Error())
 			return
 		}
 
-		fmt.Printf("Sending file info...\n")
-		fmt.Printf("   %#v\n", fileinfo)
+		requestLogger(r).Debug("sending file info", "fileinfo", fileinfo)
 		fmt.Fprintf(w, string(jsondata))
-	}).Methods("GET")
+	}).Methods("GET").Name("GetFileInfo")
+
+	r.HandleFunc("/GetSignature", func(w http.ResponseWriter, r *http.Request) {
+		v := requestVersion(r)
+		if !v.signed {
+			http.Error(w, ErrNotSigned.Error(), http.StatusNotFound)
+			return
+		}
+
+		jsondata, err := json.Marshal(v.signature)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			requestLogger(r).Error("failed to encode signature", "error", err.Error())
+			return
+		}
+
+		requestLogger(r).Debug("sending signature")
+		w.Write(jsondata)
+	}).Methods("GET").Name("GetSignature")
 
 	r.HandleFunc("/GetChunk/{chunkno:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
 		chunkno, err := strconv.ParseUint(mux.Vars(r)["chunkno"], 10, 64)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
-			fmt.Printf("GetChunk: %s: %s\n", mux.Vars(r)["chunkno"], err.Error())
+			requestLogger(r).Warn("invalid chunk number", "chunk", mux.Vars(r)["chunkno"], "error", err.Error())
 			return
 		}
 
-		chunk, err := source.GetChunk(chunkno)
+		chunk, err := requestVersion(r).source.GetChunk(chunkno)
+		metrics.CacheLookup(err == nil)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			fmt.Printf("GetChunk: %d: %s\n", chunkno, err.Error())
+			requestLogger(r).Error("failed to get chunk", "chunk", chunkno, "error", err.Error())
 			return
 		}
 
 		jsondata, err := json.Marshal(chunk)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			fmt.Printf("GetFileInfo: %s\n", err.Error())
+			requestLogger(r).Error("failed to encode chunk", "chunk", chunkno, "error", err.Error())
 			return
 		}
 
-		fmt.Printf("Sending chunk...\n")
+		requestLogger(r).Debug("sending chunk", "chunk", chunkno)
 		fmt.Fprintf(w, string(jsondata))
-	}).Methods("GET")
+	}).Methods("GET").Name("GetChunk")
 
 	r.HandleFunc("/GetAllChunks", func(w http.ResponseWriter, r *http.Request) {
-		var allChunks []structs.ChunkStream
-		_, chunkStreamChan := source.GetAllChunks()
-		for chunkStream := range chunkStreamChan {
-			allChunks = append(allChunks, chunkStream)
+		v := requestVersion(r)
+		numberOfChunks, chunkStreamChan, errChan := v.source.GetAllChunks()
+
+		// clients request the compact binary manifest format
+		if strings.Contains(r.Header.Get("Accept"), manifest.ContentType) {
+			requestLogger(r).Debug("sending all chunks", "format", manifest.FormatBinary, "chunks", numberOfChunks)
+			w.Header().Set("Content-Type", manifest.ContentType)
+			mw := manifest.NewWriter(w, v.fileinfo, uint64(numberOfChunks))
+			encodeErr := manifest.WriteChunks(mw, chunkStreamChan)
+			if encodeErr == nil {
+				encodeErr = mw.Close()
+			}
+			if err := <-errChan; err != nil {
+				metrics.Error("GetAllChunks")
+				requestLogger(r).Error("failed to read chunks", "error", err.Error())
+				return
+			}
+			if encodeErr != nil {
+				metrics.Error("GetAllChunks")
+				requestLogger(r).Error("failed to send chunks", "error", encodeErr.Error())
+				return
+			}
+			return
 		}
 
-		jsondata, err := json.Marshal(allChunks)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			fmt.Printf("GetAllChunks: %s\n", err.Error())
+		// stream the chunks as newline delimited json, this avoids
+		// holding the complete list in memory
+		requestLogger(r).Debug("sending all chunks", "format", manifest.FormatJSON, "chunks", numberOfChunks)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("X-ChunkCount", strconv.Itoa(numberOfChunks))
+		encoder := json.NewEncoder(w)
+		var encodeErr error
+		for chunkStream := range chunkStreamChan {
+			// continue reading the channel after an error, otherwise
+			// the cache would be blocked
+			if encodeErr != nil {
+				continue
+			}
+			encodeErr = encoder.Encode(chunkStream)
+		}
+		if err := <-errChan; err != nil {
+			// the header is already sent, the client will detect
+			// the incomplete list by the chunk count
+			metrics.Error("GetAllChunks")
+			requestLogger(r).Error("failed to read chunks", "error", err.Error())
 			return
 		}
-
-		fmt.Printf("Sending all chunks...\n")
-		fmt.Fprintf(w, string(jsondata))
-	}).Methods("GET")
+		if encodeErr != nil {
+			metrics.Error("GetAllChunks")
+			requestLogger(r).Error("failed to send chunks", "error", encodeErr.Error())
+			return
+		}
+	}).Methods("GET").Name("GetAllChunks")
 
 	r.HandleFunc("/ReadChunkData/{chunkno:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
 		chunkno, err := strconv.ParseUint(mux.Vars(r)["chunkno"], 10, 64)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
-			fmt.Printf("ReadChunkData: %s: %s\n", mux.Vars(r)["chunkno"], err.Error())
+			requestLogger(r).Warn("invalid chunk number", "chunk", mux.Vars(r)["chunkno"], "error", err.Error())
 			return
 		}
 
-		filepos := int64(chunkno * uint64(fileinfo.Chunksize))
+		v := requestVersion(r)
+		filepos := int64(chunkno * uint64(v.fileinfo.Chunksize))
 
-		data, datalen, err := source.ReadChunkData(filepos)
+		data, datalen, err := v.source.ReadChunkData(filepos)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			requestLogger(r).Error("failed to read chunk data", "chunk", chunkno, "error", err.Error())
 			return
 		}
 
-		fmt.Printf("Sending chunk data (%d bytes)...\n", datalen)
+		requestLogger(r).Debug("sending chunk data", "chunk", chunkno, "bytes", datalen)
 		w.Header().Set("Content-Type", "application/octet-stream")
 		//TODO
 		//w.Header().Set("Content-Length", strconv.Itoa(datalen))
 		w.Header().Set("X-ChunkLength", strconv.Itoa(datalen))
 		w.Write(data)
-	}).Methods("GET")
+	}).Methods("GET").Name("ReadChunkData")
 
-	fmt.Printf("Waiting for incoming requests...\n")
-	err = server.ListenAndServe()
-	if err != nil {
-		return errors.Wrap(err, "failed to serve file")
-	}
+	r.HandleFunc("/ReadChunksData", func(w http.ResponseWriter, r *http.Request) {
+		chunkIds, err := ParseChunkRanges(r.URL.Query().Get("chunks"), MaxBatchChunks)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			requestLogger(r).Warn("invalid chunk ranges", "chunks", r.URL.Query().Get("chunks"), "error", err.Error())
+			return
+		}
 
-	return nil
+		v := requestVersion(r)
+		requestLogger(r).Debug("sending chunk data", "chunks", len(chunkIds))
+		w.Header().Set("Content-Type", batchContentType)
+		for _, chunkno := range chunkIds {
+			chunk, err := v.source.GetChunk(chunkno)
+			metrics.CacheLookup(err == nil)
+			if err != nil {
+				// the header is already sent, the client will detect
+				// the missing frames
+				metrics.Error("ReadChunksData")
+				requestLogger(r).Error("failed to get chunk", "chunk", chunkno, "error", err.Error())
+				return
+			}
+
+			filepos := int64(chunkno * uint64(v.fileinfo.Chunksize))
+			data, datalen, err := v.source.ReadChunkData(filepos)
+			if err != nil {
+				metrics.Error("ReadChunksData")
+				requestLogger(r).Error("failed to read chunk data", "chunk", chunkno, "error", err.Error())
+				return
+			}
+
+			err = WriteChunkFrame(w, ChunkFrame{ChunkId: chunkno, Hash: chunk.Hash, Data: data[:datalen]})
+			if err != nil {
+				metrics.Error("ReadChunksData")
+				requestLogger(r).Error("failed to send chunk data", "chunk", chunkno, "error", err.Error())
+				return
+			}
+		}
+	}).Methods("GET").Name("ReadChunksData")
+
+	r.HandleFunc("/AnnouncePeer", sh.announcePeer).Methods("GET").Name("AnnouncePeer")
 }